@@ -0,0 +1,484 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
+	"github.com/serialx/hashring"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Client -- talks gRPC (KVService) straight to the nodes, instead of going through a single HTTP server.
+
+It learns the hash ring and which nodes are up from any node, and hashes keys onto the ring the same way the cluster
+does, so a request goes to one of the key's replicas, which coordinates it with the others. A node that can't be reached
+(or that couldn't reach enough replicas) gets the request's next replica instead, and the ring is fetched again. once
+every replica has been tried, the client backs off and tries them all again, a few times.
+*/
+
+const (
+	DefaultRetries = 3
+	DefaultBackoff = 50 * time.Millisecond
+
+	topologyTimeout = 2 * time.Second
+)
+
+type Client struct {
+	mu                sync.Mutex
+	seeds             []string
+	ring              *hashring.HashRing
+	members           []string
+	down              map[string]bool
+	replicationFactor int
+	siblings          bool // a write without a causal context adds a sibling, see retryWrite
+	conns             map[string]*grpc.ClientConn
+
+	consistency proto.Consistency
+	retries     int           // rounds over a key's replicas after the first one
+	backoff     time.Duration // before the first retry, doubles with every round
+}
+
+// Option configures a client when it's created
+type Option func(*Client)
+
+// WithConsistency sets how many of a key's replicas have to answer a request, ONE by default
+func WithConsistency(level utils.ConsistencyLevel) Option {
+	return func(c *Client) {
+		// numbered the same
+		c.consistency = proto.Consistency(level)
+	}
+}
+
+// WithRetries sets how many more times a request goes round a key's replicas once they all failed, waiting backoff
+// before the first retry and twice as long before each one after
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// New returns a client for the cluster the seeds (addresses of nodes' gRPC servers) are part of, it fetches the
+// ring from the first of them that answers
+func New(ctx context.Context, seeds []string, opts ...Option) (*Client, error) {
+	c := &Client{
+		seeds:   seeds,
+		ring:    hashring.New(nil),
+		down:    make(map[string]bool),
+		conns:   make(map[string]*grpc.ClientConn),
+		retries: DefaultRetries,
+		backoff: DefaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.Refresh(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connections to the nodes
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for addr, conn := range c.conns {
+		errs = append(errs, conn.Close())
+		delete(c.conns, addr)
+	}
+	return errors.Join(errs...)
+}
+
+// Refresh fetches the ring from the first node that answers, trying the members known to be up first and the seeds last
+func (c *Client) Refresh(ctx context.Context) error {
+	c.mu.Lock()
+	var candidates []string
+	for _, addr := range c.members {
+		if !c.down[addr] {
+			candidates = append(candidates, addr)
+		}
+	}
+	candidates = append(candidates, c.seeds...)
+	c.mu.Unlock()
+
+	var errs []error
+	for _, addr := range candidates {
+		node, err := c.node(addr)
+		var res *proto.TopologyResponse
+		if err == nil {
+			ctx, cancel := context.WithTimeout(ctx, topologyTimeout)
+			res, err = node.Topology(ctx, &proto.TopologyRequest{})
+			cancel()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("topology @ node addr = %s: %w", addr, err))
+			continue
+		}
+		c.setTopology(res)
+		return nil
+	}
+	return fmt.Errorf("no node answered: %w", errors.Join(errs...))
+}
+
+func (c *Client) setTopology(res *proto.TopologyResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	members := make([]string, 0, len(res.Members))
+	down := make(map[string]bool)
+	for _, m := range res.Members {
+		members = append(members, m.Addr)
+		if !m.Up {
+			down[m.Addr] = true
+		}
+	}
+	c.members = members
+	c.down = down
+	c.ring = hashring.New(members)
+	c.replicationFactor = max(int(res.ReplicationFactor), 1)
+	c.siblings = res.Siblings
+}
+
+// retryWrite reports whether a write with the causal context can be sent again after a node failed to answer. on a
+// cluster keeping siblings a write that doesn't replace the siblings it saw adds a new one every time it's applied
+func (c *Client) retryWrite(causalContext []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.siblings || len(causalContext) > 0
+}
+
+// node returns a client for the node at addr, connecting to it the first time. a node that can't be connected to
+// is unavailable
+func (c *Client) node(addr string) (proto.KVServiceClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, ok := c.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials())); err != nil {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		c.conns[addr] = conn
+	}
+	return proto.NewKVServiceClient(conn), nil
+}
+
+// replicas returns the key's replicas, the ones that are up first, in ring order
+func (c *Client) replicas(key []byte) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := min(c.replicationFactor, c.ring.Size())
+	addrs, ok := c.ring.GetNodes(string(key), n)
+	if !ok {
+		return nil
+	}
+	var up, down []string
+	for _, addr := range addrs {
+		if c.down[addr] {
+			down = append(down, addr)
+		} else {
+			up = append(up, addr)
+		}
+	}
+	return append(up, down...)
+}
+
+func (c *Client) markDown(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down[addr] = true
+}
+
+// call runs fn against the key's replicas in turn until one of them answers. a replica that can't be reached is
+// marked down and the ring is fetched again. once every replica failed it backs off and starts over, unless retry is
+// off: a write that isn't idempotent might have been applied by a node that failed to answer
+func (c *Client) call(ctx context.Context, key []byte, retry bool, fn func(proto.KVServiceClient) error) error {
+	backoff := c.backoff
+	for round := 0; ; round++ {
+		replicas := c.replicas(key)
+		if len(replicas) == 0 {
+			return fmt.Errorf("%w: no nodes on the ring", utils.ErrNodeUnavailable)
+		}
+		var err error
+		for _, addr := range replicas {
+			var node proto.KVServiceClient
+			if node, err = c.node(addr); err == nil {
+				err = fn(node)
+			}
+			if !retryable(err) {
+				return fromStatus(err)
+			}
+			// a node that answered it couldn't reach others is up, it might just see them differently than the next one
+			if !fromCoordinator(err) {
+				c.markDown(addr)
+			}
+			if !retry {
+				return fromStatus(err)
+			}
+		}
+		// the ring might have changed under the client, if no node answers the old one is kept
+		c.Refresh(ctx)
+		if round == c.retries {
+			return fromStatus(err)
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fromCoordinator reports whether the node failed the request itself, rather than the client failing to reach it
+func fromCoordinator(err error) bool {
+	return statusReason(status.Convert(err)) != nil
+}
+
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// statusReason returns the error the reason in a status names, nil if the status has none: the node didn't set it
+func statusReason(s *status.Status) error {
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == utils.ErrorDomain {
+			return utils.ReasonError(info.Reason)
+		}
+	}
+	return nil
+}
+
+// fromStatus turns the status of a failed call back into the error it stands for
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	if known := statusReason(s); known != nil {
+		return withMessage(known, s.Message())
+	}
+	switch s.Code() {
+	case codes.NotFound:
+		return utils.ErrKeyNotFound
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return withMessage(utils.ErrNodeUnavailable, s.Message())
+	}
+	return err
+}
+
+// withMessage wraps err in the message of a status, which often starts with err already
+func withMessage(err error, msg string) error {
+	if msg == err.Error() {
+		return err
+	}
+	if rest, ok := strings.CutPrefix(msg, err.Error()); ok {
+		return fmt.Errorf("%w%s", err, rest)
+	}
+	return fmt.Errorf("%w: %s", err, msg)
+}
+
+// Get returns the key's value, ErrKeyNotFound if it doesn't exist or ErrSiblings if it has several, see GetSiblings
+func (c *Client) Get(ctx context.Context, key []byte) ([]byte, error) {
+	values, _, err := c.GetSiblings(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) > 1 {
+		return nil, fmt.Errorf("%w: %d values", utils.ErrSiblings, len(values))
+	}
+	return values[0], nil
+}
+
+// GetSiblings returns every value of the key along with its causal context, to pass to the write replacing them.
+// only a cluster keeping siblings returns more than one value
+func (c *Client) GetSiblings(ctx context.Context, key []byte) ([][]byte, []byte, error) {
+	var res *proto.GetResponse
+	err := c.call(ctx, key, true, func(node proto.KVServiceClient) (err error) {
+		res, err = node.Get(ctx, &proto.GetRequest{Key: key, Consistency: c.consistency})
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return values(res.Kv), res.Kv.CausalContext, nil
+}
+
+func values(kv *proto.KeyValue) [][]byte {
+	if len(kv.Siblings) > 0 {
+		return kv.Siblings
+	}
+	return [][]byte{kv.Value}
+}
+
+// Put sets the key to value
+func (c *Client) Put(ctx context.Context, key, value []byte) error {
+	return c.PutWithContext(ctx, key, value, nil)
+}
+
+// PutWithContext sets the key to value, replacing every sibling the causal context (from GetSiblings) saw. on a
+// cluster keeping siblings it isn't retried without a causal context, as it might have added a sibling already
+func (c *Client) PutWithContext(ctx context.Context, key, value, causalContext []byte) error {
+	req := &proto.PutRequest{Kv: &proto.KeyValue{Key: key, Value: value, CausalContext: causalContext}, Consistency: c.consistency}
+	return c.call(ctx, key, c.retryWrite(causalContext), func(node proto.KVServiceClient) error {
+		_, err := node.Put(ctx, req)
+		return err
+	})
+}
+
+// Delete deletes the key
+func (c *Client) Delete(ctx context.Context, key []byte) error {
+	return c.DeleteWithContext(ctx, key, nil)
+}
+
+// DeleteWithContext deletes every sibling of the key the causal context saw. on a cluster keeping siblings it isn't
+// retried without a causal context, like PutWithContext
+func (c *Client) DeleteWithContext(ctx context.Context, key, causalContext []byte) error {
+	req := &proto.DeleteRequest{Key: key, CausalContext: causalContext, Consistency: c.consistency}
+	return c.call(ctx, key, c.retryWrite(causalContext), func(node proto.KVServiceClient) error {
+		_, err := node.Delete(ctx, req)
+		return err
+	})
+}
+
+// CompareAndSwap sets the key to value if its current value is expected, a nil expected meaning the key must not
+// exist. fails with ErrCompareFailed otherwise. it isn't retried on a node that fails to answer, as it might have
+// swapped already
+func (c *Client) CompareAndSwap(ctx context.Context, key, expected, value []byte) error {
+	req := &proto.CompareAndSwapRequest{Key: key, Expected: expected, Value: value, Consistency: c.consistency}
+	return c.call(ctx, key, false, func(node proto.KVServiceClient) error {
+		_, err := node.CompareAndSwap(ctx, req)
+		return err
+	})
+}
+
+// byCoordinator groups the keys by the replica their requests go to first
+func (c *Client) byCoordinator(keys [][]byte) map[string][][]byte {
+	groups := make(map[string][][]byte)
+	for _, key := range keys {
+		if replicas := c.replicas(key); len(replicas) > 0 {
+			groups[replicas[0]] = append(groups[replicas[0]], key)
+		}
+	}
+	return groups
+}
+
+// BatchGet returns the values of the keys that exist, each batch of keys sharing a replica is sent to it at once.
+// fails with ErrSiblings if a key has several values
+func (c *Client) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
+	var mu sync.Mutex
+	found := make(map[string][]byte)
+	err := c.batch(keys, func(group [][]byte) error {
+		var res *proto.BatchGetResponse
+		err := c.call(ctx, group[0], true, func(node proto.KVServiceClient) (err error) {
+			res, err = node.BatchGet(ctx, &proto.BatchGetRequest{Keys: group, Consistency: c.consistency})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, kv := range res.Kvs {
+			if len(kv.Siblings) > 0 {
+				return fmt.Errorf("%w: key = %s", utils.ErrSiblings, kv.Key)
+			}
+			found[string(kv.Key)] = kv.Value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// BatchPut sets every key to its value, each batch of keys sharing a replica is sent to it at once. not atomic, a
+// batch that fails may have been written in part. on a cluster keeping siblings it isn't retried, like PutWithContext
+func (c *Client) BatchPut(ctx context.Context, kvs map[string][]byte) error {
+	keys := make([][]byte, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, []byte(key))
+	}
+	return c.batch(keys, func(group [][]byte) error {
+		req := &proto.BatchPutRequest{Consistency: c.consistency}
+		for _, key := range group {
+			req.Kvs = append(req.Kvs, &proto.KeyValue{Key: key, Value: kvs[string(key)]})
+		}
+		return c.call(ctx, group[0], c.retryWrite(nil), func(node proto.KVServiceClient) error {
+			_, err := node.BatchPut(ctx, req)
+			return err
+		})
+	})
+}
+
+// batch runs fn for every group of keys sharing a replica, in parallel
+func (c *Client) batch(keys [][]byte, fn func(group [][]byte) error) error {
+	groups := c.byCoordinator(keys)
+	errs := make(chan error, len(groups))
+	for _, group := range groups {
+		go func() {
+			errs <- fn(group)
+		}()
+	}
+	var all []error
+	for range groups {
+		all = append(all, <-errs)
+	}
+	return errors.Join(all...)
+}
+
+// Scan calls fn for every live key in [start, end) in sorted order, at most limit of them (0 for no limit). a nil end
+// means no upper bound, stops early once fn returns false. fails with ErrSiblings at a key with several values
+func (c *Client) Scan(ctx context.Context, start, end []byte, limit int, fn func(key, value []byte) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req := &proto.ScanRequest{Start: start, End: end, Limit: uint32(limit)}
+	// every node scans the whole cluster, only a scan that hasn't returned anything yet can move to another one
+	started := false
+	return c.call(ctx, start, true, func(node proto.KVServiceClient) error {
+		stream, err := node.Scan(ctx, req)
+		if err != nil {
+			return err
+		}
+		for {
+			kv, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil && started {
+				return status.Errorf(codes.Aborted, "scan interrupted: %v", err)
+			}
+			if err != nil {
+				return err
+			}
+			started = true
+			if len(kv.Siblings) > 0 {
+				return fmt.Errorf("%w: key = %s", utils.ErrSiblings, kv.Key)
+			}
+			if !fn(kv.Key, kv.Value) {
+				return nil
+			}
+		}
+	})
+}
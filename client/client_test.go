@@ -0,0 +1,286 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jateen67/kv/internal"
+	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
+	"github.com/serialx/hashring"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func withReason(code codes.Code, msg, reason string) error {
+	s, err := status.New(code, msg).WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: utils.ErrorDomain})
+	if err != nil {
+		panic(err)
+	}
+	return s.Err()
+}
+
+// errors are told apart by the reason the node sets, never by their message
+func TestFromStatus(t *testing.T) {
+	plain := errors.New("not a status")
+	tests := []struct {
+		name            string
+		err             error
+		want            error
+		fromCoordinator bool
+	}{
+		{name: "reason", err: withReason(codes.FailedPrecondition, utils.ErrCompareFailed.Error(), "COMPARE_FAILED"), want: utils.ErrCompareFailed, fromCoordinator: true},
+		{name: "reason over message", err: withReason(codes.FailedPrecondition, "key = cart: "+utils.ErrCompareFailed.Error(), "SIBLINGS"), want: utils.ErrSiblings, fromCoordinator: true},
+		{name: "coordinator without enough replicas", err: withReason(codes.Unavailable, utils.ErrNotEnoughReplicas.Error(), "NOT_ENOUGH_REPLICAS"), want: utils.ErrNotEnoughReplicas, fromCoordinator: true},
+		{name: "unreachable node", err: status.Error(codes.Unavailable, utils.ErrNotEnoughReplicas.Error()), want: utils.ErrNodeUnavailable},
+		{name: "deadline", err: status.Error(codes.DeadlineExceeded, "context deadline exceeded"), want: utils.ErrNodeUnavailable},
+		{name: "not found without a reason", err: status.Error(codes.NotFound, "gone"), want: utils.ErrKeyNotFound},
+		{name: "unknown reason", err: withReason(codes.InvalidArgument, "bad", "SOMETHING_NEW"), want: nil},
+		{name: "not a status", err: plain, want: plain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fromStatus(tt.err)
+			if tt.want == nil {
+				if status.Code(got) != status.Code(tt.err) {
+					t.Fatalf("got %v, want the status as is", got)
+				}
+			} else if !errors.Is(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			if fromCoordinator(tt.err) != tt.fromCoordinator {
+				t.Fatalf("from coordinator = %t, want %t", !tt.fromCoordinator, tt.fromCoordinator)
+			}
+		})
+	}
+}
+
+// testNode is a node running on a local port, under a temporary directory
+type testNode struct {
+	*internal.Node
+	closeOnce sync.Once
+}
+
+func (n *testNode) close() {
+	n.closeOnce.Do(n.Node.Close)
+}
+
+func startNode(t *testing.T, id uint32, seeds []string, replicationFactor int) *testNode {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	dataDir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	node, err := internal.NewStandaloneNode(id, addr, dataDir, seeds,
+		internal.WithReplicationFactor(replicationFactor),
+		internal.WithGossipInterval(50*time.Millisecond),
+		internal.WithAntiEntropyInterval(0))
+	if err != nil {
+		t.Fatalf("start node %d: %v", id, err)
+	}
+	n := &testNode{Node: node}
+	t.Cleanup(n.close)
+	return n
+}
+
+// waitForMembers waits until the node at addr tells of n members
+func waitForMembers(t *testing.T, addr string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		probe, err := New(context.Background(), []string{addr})
+		if err == nil {
+			members := len(probe.members)
+			probe.Close()
+			if members == n {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s didn't learn of %d members in time", addr, n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// a request goes to the key's next replica when the first one can't be reached, and the node is tried last from then on
+func TestFailover(t *testing.T) {
+	seed := startNode(t, 1, nil, 3)
+	nodes := []*testNode{seed, startNode(t, 2, []string{seed.Addr}, 3), startNode(t, 3, []string{seed.Addr}, 3)}
+	for _, node := range nodes {
+		waitForMembers(t, node.Addr, 3)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := New(ctx, []string{seed.Addr}, WithConsistency(utils.ConsistencyAll), WithRetries(0, 0))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer c.Close()
+
+	key := []byte("cart")
+	if err := c.Put(ctx, key, []byte("apples")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := c.CompareAndSwap(ctx, key, []byte("pears"), []byte("plums")); !errors.Is(err, utils.ErrCompareFailed) {
+		t.Fatalf("compare-and-swap of another value: got %v, want %v", err, utils.ErrCompareFailed)
+	}
+
+	first := c.replicas(key)[0]
+	for _, node := range nodes {
+		if node.Addr == first {
+			node.close()
+		}
+	}
+	c.consistency = proto.Consistency_ONE // the other two replicas are up
+	value, err := c.Get(ctx, key)
+	if err != nil || string(value) != "apples" {
+		t.Fatalf("get with the first replica gone: got %q, %v, want apples", value, err)
+	}
+	if replicas := c.replicas(key); replicas[len(replicas)-1] != first {
+		t.Fatalf("replicas %v, want the unreachable %s last", replicas, first)
+	}
+}
+
+// a client whose ring is out of date finds out once the key's replica can't be reached, and fetches the ring again
+func TestTopologyRefresh(t *testing.T) {
+	seed := startNode(t, 1, nil, 1)
+	other := startNode(t, 2, []string{seed.Addr}, 1)
+	waitForMembers(t, seed.Addr, 2)
+	waitForMembers(t, other.Addr, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := New(ctx, []string{seed.Addr, other.Addr}, WithRetries(3, 20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer c.Close()
+
+	joined := startNode(t, 3, []string{seed.Addr}, 1)
+	for _, node := range []*testNode{seed, other, joined} {
+		waitForMembers(t, node.Addr, 3)
+	}
+	// a key the node that joined holds on the cluster's ring, and one of the others on the client's. that one crashes
+	before := hashring.New([]string{seed.Addr, other.Addr})
+	after := hashring.New([]string{seed.Addr, other.Addr, joined.Addr})
+	var key []byte
+	var owner string
+	for i := 0; key == nil && i < 10000; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		if is, _ := after.GetNode(k); is == joined.Addr {
+			key = []byte(k)
+			owner, _ = before.GetNode(k)
+		}
+	}
+	if key == nil {
+		t.Fatal("no key moved to the node that joined")
+	}
+	for _, node := range []*testNode{seed, other} {
+		if node.Addr == owner {
+			node.close()
+		}
+	}
+
+	if err := c.Put(ctx, key, []byte("apples")); err != nil {
+		t.Fatalf("put with the ring out of date: %v", err)
+	}
+	if got := c.replicas(key); len(got) != 1 || got[0] != joined.Addr {
+		t.Fatalf("replicas of %s after the refresh: %v, want %s", key, got, joined.Addr)
+	}
+	if value, err := joined.Store.Get(key); err != nil || string(value) != "apples" {
+		t.Fatalf("get @ node addr = %s: got %q, %v, want apples", joined.Addr, value, err)
+	}
+}
+
+// timeoutNode is a node every write times out on, it counts the writes it gets
+type timeoutNode struct {
+	proto.UnimplementedKVServiceServer
+	addr     string
+	siblings bool
+
+	mu     sync.Mutex
+	writes int
+}
+
+func (n *timeoutNode) Topology(ctx context.Context, req *proto.TopologyRequest) (*proto.TopologyResponse, error) {
+	return &proto.TopologyResponse{Members: []*proto.Member{{Addr: n.addr, Up: true}}, ReplicationFactor: 1, Siblings: n.siblings}, nil
+}
+
+func (n *timeoutNode) Put(ctx context.Context, req *proto.PutRequest) (*proto.PutResponse, error) {
+	return nil, n.write()
+}
+
+func (n *timeoutNode) Delete(ctx context.Context, req *proto.DeleteRequest) (*proto.DeleteResponse, error) {
+	return nil, n.write()
+}
+
+func (n *timeoutNode) write() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.writes++
+	// the write may have been applied, the client can't tell
+	return status.Error(codes.DeadlineExceeded, "timed out")
+}
+
+// on a cluster keeping siblings a write without a causal context adds a sibling every time it's applied, so it isn't
+// sent again after a node failed to answer it
+func TestNoRetryOfSiblingWrites(t *testing.T) {
+	tests := []struct {
+		name          string
+		siblings      bool
+		causalContext []byte
+		wantWrites    int
+	}{
+		{name: "without siblings", wantWrites: 3},
+		{name: "siblings without a causal context", siblings: true, wantWrites: 1},
+		{name: "siblings with a causal context", siblings: true, causalContext: []byte("context"), wantWrites: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			node := &timeoutNode{addr: l.Addr().String(), siblings: tt.siblings}
+			server := grpc.NewServer()
+			proto.RegisterKVServiceServer(server, node)
+			go server.Serve(l)
+			defer server.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, err := New(ctx, []string{node.addr}, WithRetries(2, time.Millisecond))
+			if err != nil {
+				t.Fatalf("new client: %v", err)
+			}
+			defer c.Close()
+
+			if err := c.PutWithContext(ctx, []byte("cart"), []byte("apples"), tt.causalContext); !errors.Is(err, utils.ErrNodeUnavailable) {
+				t.Fatalf("put: got %v, want %v", err, utils.ErrNodeUnavailable)
+			}
+			if err := c.DeleteWithContext(ctx, []byte("cart"), tt.causalContext); !errors.Is(err, utils.ErrNodeUnavailable) {
+				t.Fatalf("delete: got %v, want %v", err, utils.ErrNodeUnavailable)
+			}
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			if node.writes != 2*tt.wantWrites {
+				t.Fatalf("node got %d write(s), want %d", node.writes, 2*tt.wantWrites)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/jateen67/kv/internal"
+)
+
+// runs a single node in a process of its own, cmd/main.go -seeds runs a router in front of the nodes
+func main() {
+	id := flag.Uint("id", 1, "id of the node, unique in the cluster")
+	addr := flag.String("addr", ":11000", "address the node serves gRPC at")
+	dataDir := flag.String("data-dir", ".", "directory the node keeps its data in")
+	seeds := flag.String("seeds", "", "comma separated addresses of nodes to join the cluster through")
+	keyFile := flag.String("key-file", "", "encrypt data at rest with the keys in this file (one \"<id> <hex key>\" per line)")
+	gossipInterval := flag.Duration("gossip-interval", internal.DefaultGossipInterval, "how often the node gossips")
+	replicationFactor := flag.Int("replication-factor", 1, "number of nodes every key is copied to, the same on every node")
+	siblings := flag.Bool("siblings", false, "keep concurrent writes to a key as siblings instead of the newest one winning")
+	flag.Parse()
+
+	var opts []internal.StoreOption
+	if *keyFile != "" {
+		keys, err := internal.NewFileKeyProvider(*keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, internal.WithEncryption(keys))
+	}
+
+	clusterOpts := []internal.ClusterOption{
+		internal.WithStoreOptions(opts...),
+		internal.WithReplicationFactor(*replicationFactor),
+		internal.WithGossipInterval(*gossipInterval),
+	}
+	if *siblings {
+		clusterOpts = append(clusterOpts, internal.WithSiblings())
+	}
+	node, err := internal.NewStandaloneNode(uint32(*id), *addr, *dataDir, splitAddrs(*seeds), clusterOpts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	node.Run()
+}
+
+func splitAddrs(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -1,10 +1,46 @@
 package main
 
 import (
+	"flag"
+	"log"
+	"strings"
+
 	"github.com/jateen67/kv/internal"
 )
 
 func main() {
-	c := internal.NewCluster(5)
+	keyFile := flag.String("key-file", "", "encrypt data at rest with the keys in this file (one \"<id> <hex key>\" per line)")
+	replicationFactor := flag.Int("replication-factor", 1, "number of nodes every key is copied to")
+	siblings := flag.Bool("siblings", false, "keep concurrent writes to a key as siblings instead of the newest one winning")
+	seeds := flag.String("seeds", "", "comma separated addresses of nodes started with cmd/kvnode, routes requests to them instead of starting nodes in this process")
+	routerID := flag.Uint("router-id", 0, "id of the router's clock, unique among the routers and the nodes")
+	flag.Parse()
+
+	var opts []internal.StoreOption
+	if *keyFile != "" {
+		keys, err := internal.NewFileKeyProvider(*keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, internal.WithEncryption(keys))
+	}
+
+	clusterOpts := []internal.ClusterOption{internal.WithStoreOptions(opts...), internal.WithReplicationFactor(*replicationFactor)}
+	if *siblings {
+		clusterOpts = append(clusterOpts, internal.WithSiblings())
+	}
+	if *seeds != "" {
+		clusterOpts = append(clusterOpts, internal.WithRouterID(uint32(*routerID)))
+		router, err := internal.NewRouter(strings.Split(*seeds, ","), clusterOpts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		router.Open()
+		return
+	}
+	c, err := internal.NewCluster(5, clusterOpts...)
+	if err != nil {
+		log.Fatal(err)
+	}
 	c.Open()
 }
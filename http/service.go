@@ -1,32 +1,60 @@
 package http
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+
+	"github.com/jateen67/kv/utils"
 )
 
 type Store interface {
-	Get(key string) (string, error)
-	Set(key *string, value *string) error
-	Delete(key string) error
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
 	Close() bool
 }
 
 // not sure if this is the best way to go about this but it works
 type Cluster interface {
 	Open()
-	Get(key string) (string, error)
-	Set(key string, value string) error
-	Delete(key string) error
+	Get(key []byte, level utils.ConsistencyLevel) ([]byte, int, error)
+	Set(key, value []byte, level utils.ConsistencyLevel) (int, error)
+	Delete(key []byte, level utils.ConsistencyLevel) (int, error)
+	GetSiblings(key []byte, level utils.ConsistencyLevel) ([][]byte, []byte, int, error)
+	SetWithContext(key, value, causalContext []byte, level utils.ConsistencyLevel) (int, error)
+	DeleteWithContext(key, causalContext []byte, level utils.ConsistencyLevel) (int, error)
+	Merge(key []byte, operator string, operand []byte, level utils.ConsistencyLevel) (int, error)
+	DeletePrefix(prefix []byte, level utils.ConsistencyLevel) (int, error)
 	AddNode()
 	RemoveNode(addr string)
+	StopNode(addr string)
+	StartNode(addr string)
+	Repair() (int, error)
+	Members() []utils.Member
+	Migrations() []utils.Migration
 	Close()
 }
 
+// merge operator the store registers for int64 counters
+const incrMergeOperator = "int64add"
+
+const (
+	// consistency level of a request, ONE, QUORUM or ALL (ONE if missing). can also be given as ?consistency=<level>
+	consistencyLevelHeader = "X-Consistency-Level"
+	// how many replicas answered the request
+	replicasAnsweredHeader = "X-Replicas-Answered"
+	// base64 causal context of the siblings a GET returned, a write passing it back replaces them
+	causalContextHeader = "X-Causal-Context"
+)
+
 type Service struct {
 	addr    string
 	ln      net.Listener
@@ -73,6 +101,11 @@ func (s *Service) Close() error {
 }
 
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/keys") {
+		s.handleKeysRequest(w, r)
+		return
+	}
+
 	if strings.HasPrefix(r.URL.Path, "/key") {
 		s.handleKeyRequest(w, r)
 		return
@@ -84,15 +117,43 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if strings.HasPrefix(r.URL.Path, "/remove-node") {
-		s.handleNodeRemoval(w, r)
+		s.handleNodeRequest(w, r, s.cluster.RemoveNode)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/repair") && r.Method == "POST" {
+		s.handleRepair(w)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/members") && r.Method == "GET" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.cluster.Members())
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/migrations") && r.Method == "GET" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.cluster.Migrations())
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/stop-node") {
+		s.handleNodeRequest(w, r, s.cluster.StopNode)
 		return
 	}
 
-	fmt.Println("prefix must be one of the following: /key, /add-node, /remove-node")
+	if strings.HasPrefix(r.URL.Path, "/start-node") {
+		s.handleNodeRequest(w, r, s.cluster.StartNode)
+		return
+	}
+
+	fmt.Println("prefix must be one of the following: /key, /keys, /add-node, /remove-node, /stop-node, /start-node, /repair, /members, /migrations")
 	w.WriteHeader(http.StatusNotFound)
 }
 
-func (s *Service) handleNodeRemoval(w http.ResponseWriter, r *http.Request) {
+// handleNodeRequest handles POST /<action>/<node_port_number>
+func (s *Service) handleNodeRequest(w http.ResponseWriter, r *http.Request, action func(addr string)) {
 	if r.Method != "POST" {
 		io.WriteString(w, "err: must be POST method")
 		return
@@ -104,7 +165,46 @@ func (s *Service) handleNodeRemoval(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.cluster.RemoveNode(parts[2])
+	action(parts[2])
+}
+
+// handleRepair runs anti-entropy between every key's replicas and returns how many records were sent
+func (s *Service) handleRepair(w http.ResponseWriter) {
+	sent, err := s.cluster.Repair()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, strconv.Itoa(sent))
+}
+
+// handleKeysRequest handles operations over many keys, currently only DELETE /keys?prefix=<prefix>
+func (s *Service) handleKeysRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !r.URL.Query().Has("prefix") {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "err: missing prefix")
+		return
+	}
+
+	level, err := consistencyLevel(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "err: "+err.Error())
+		return
+	}
+	n, err := s.cluster.DeletePrefix([]byte(r.URL.Query().Get("prefix")), level)
+	if err != nil {
+		writeClusterError(w, err, n)
+		return
+	}
+	w.Header().Set(replicasAnsweredHeader, strconv.Itoa(n))
 }
 
 func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
@@ -116,51 +216,225 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 		return parts[2]
 	}
 
+	level, err := consistencyLevel(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "err: "+err.Error())
+		return
+	}
+
+	causalContext, err := base64.StdEncoding.DecodeString(r.Header.Get(causalContextHeader))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "err: invalid causal context")
+		return
+	}
+
+	if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/incr") {
+		s.handleIncr(w, r, level)
+		return
+	}
+
 	switch r.Method {
 	case "POST":
 		b, err := io.ReadAll(r.Body)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
 		m := map[string]string{}
 		if err := json.Unmarshal(b, &m); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// a causal context is what a read saw of one key's siblings, it means nothing to the other keys
+		if len(causalContext) > 0 && len(m) > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "err: a causal context applies to a single key, write it with PUT /key/{k}")
+			return
 		}
 
+		// the fewest replicas that answered any of the writes
+		answered := -1
 		for k, v := range m {
-			if err := s.cluster.Set(k, v); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+			n, err := s.cluster.SetWithContext([]byte(k), []byte(v), causalContext, level)
+			if err != nil {
+				writeClusterError(w, err, n)
 				return
 			}
+			if answered == -1 || n < answered {
+				answered = n
+			}
+		}
+		if answered != -1 {
+			w.Header().Set(replicasAnsweredHeader, strconv.Itoa(answered))
 		}
 
+	case "PUT":
+		// single key, the body is the value as-is (application/octet-stream) or a JSON string (application/json)
+		k := getKey()
+		if k == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		val, err := readValueBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n, err := s.cluster.SetWithContext([]byte(k), val, causalContext, level)
+		if err != nil {
+			writeClusterError(w, err, n)
+			return
+		}
+		w.Header().Set(replicasAnsweredHeader, strconv.Itoa(n))
+
 	case "GET":
 		k := getKey()
 		if k == "" {
 			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		vals, causalContext, n, err := s.cluster.GetSiblings([]byte(k), level)
+		if len(causalContext) > 0 {
+			w.Header().Set(causalContextHeader, base64.StdEncoding.EncodeToString(causalContext))
 		}
-		val, err := s.cluster.Get(k)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeClusterError(w, err, n)
+			return
+		}
+		w.Header().Set(replicasAnsweredHeader, strconv.Itoa(n))
+		if len(vals) > 1 {
+			// concurrent writes, the client resolves them by writing back with the causal context
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMultipleChoices)
+			json.NewEncoder(w).Encode(map[string][][]byte{"siblings": vals})
 			return
 		}
-		io.WriteString(w, val)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(vals[0])
 
 	case "DELETE":
 		k := getKey()
 		if k == "" {
 			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var n int
+		if r.Header.Get(causalContextHeader) != "" {
+			n, err = s.cluster.DeleteWithContext([]byte(k), causalContext, level)
+		} else {
+			n, err = s.cluster.Delete([]byte(k), level)
 		}
-		err := s.cluster.Delete(k)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeClusterError(w, err, n)
 			return
 		}
+		w.Header().Set(replicasAnsweredHeader, strconv.Itoa(n))
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// handleIncr handles POST /key/{k}/incr, the body is the amount to add (1 if empty) and the new value is returned.
+// the increment goes to every replica and returns once level's worth of them acknowledged it, the new value is read
+// back at level too
+func (s *Service) handleIncr(w http.ResponseWriter, r *http.Request, level utils.ConsistencyLevel) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[2] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	k := []byte(parts[2])
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	amount := strings.TrimSpace(string(b))
+	if amount == "" {
+		amount = "1"
+	}
+	if _, err := strconv.ParseInt(amount, 10, 64); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "err: amount must be an integer")
+		return
+	}
+
+	if n, err := s.cluster.Merge(k, incrMergeOperator, []byte(amount), level); errors.Is(err, utils.ErrMergeWithSiblings) {
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, err.Error())
+		return
+	} else if err != nil {
+		writeClusterError(w, err, n)
+		return
+	}
+	val, n, err := s.cluster.Get(k, level)
+	if err != nil {
+		w.Header().Set(replicasAnsweredHeader, strconv.Itoa(n))
+		if errors.Is(err, utils.ErrNotEnoughReplicas) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			// most likely the existing value isn't a number
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set(replicasAnsweredHeader, strconv.Itoa(n))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(val)
+}
+
+// consistencyLevel reads the request's consistency level from its header, or its query string
+func consistencyLevel(r *http.Request) (utils.ConsistencyLevel, error) {
+	s := r.Header.Get(consistencyLevelHeader)
+	if s == "" {
+		s = r.URL.Query().Get("consistency")
+	}
+	if s == "" {
+		return utils.ConsistencyOne, nil
+	}
+	return utils.ParseConsistencyLevel(s)
+}
+
+// writeClusterError reports a failed cluster request, answered being how many replicas answered before it failed
+func writeClusterError(w http.ResponseWriter, err error, answered int) {
+	w.Header().Set(replicasAnsweredHeader, strconv.Itoa(answered))
+	switch {
+	case errors.Is(err, utils.ErrKeyNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, utils.ErrInvalidCausalContext):
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+	case errors.Is(err, utils.ErrNotEnoughReplicas):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, err.Error())
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// readValueBody reads a single value from the request body based on its content type
+func readValueBody(r *http.Request) ([]byte, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return b, nil
+	}
+
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return []byte(v), nil
+}
+
 func (s *Service) Addr() net.Addr {
 	return s.ln.Addr()
 }
@@ -0,0 +1,131 @@
+package http
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jateen67/kv/utils"
+)
+
+// fakeCluster records the writes it gets, the methods it doesn't override aren't expected to be called
+type fakeCluster struct {
+	Cluster
+	writes map[string][]byte // causal context by key
+}
+
+func (f *fakeCluster) SetWithContext(key, value, causalContext []byte, level utils.ConsistencyLevel) (int, error) {
+	f.writes[string(key)] = causalContext
+	return 1, nil
+}
+
+func TestPostCausalContext(t *testing.T) {
+	causalContext := base64.StdEncoding.EncodeToString([]byte{1, 0, 1, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0})
+	tests := []struct {
+		name       string
+		body       string
+		context    string
+		wantStatus int
+		wantWrites int
+	}{
+		{name: "single key with context", body: `{"cart": "apples"}`, context: causalContext, wantStatus: http.StatusOK, wantWrites: 1},
+		{name: "several keys without context", body: `{"a": "1", "b": "2"}`, wantStatus: http.StatusOK, wantWrites: 2},
+		// the context would replace siblings of the other keys that no read of them ever saw
+		{name: "several keys with context", body: `{"a": "1", "b": "2"}`, context: causalContext, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &fakeCluster{writes: make(map[string][]byte)}
+			s := NewClusterService(":0", cluster)
+
+			r := httptest.NewRequest("POST", "/key", strings.NewReader(tt.body))
+			if tt.context != "" {
+				r.Header.Set(causalContextHeader, tt.context)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if len(cluster.writes) != tt.wantWrites {
+				t.Fatalf("%d key(s) written, want %d", len(cluster.writes), tt.wantWrites)
+			}
+			for key, got := range cluster.writes {
+				if want := tt.context; base64.StdEncoding.EncodeToString(got) != want {
+					t.Errorf("%s written with context %q, want %q", key, base64.StdEncoding.EncodeToString(got), want)
+				}
+			}
+		})
+	}
+}
+
+// memCluster keeps one value per key, the methods it doesn't override aren't expected to be called
+type memCluster struct {
+	Cluster
+	values map[string][]byte
+}
+
+func (m *memCluster) SetWithContext(key, value, causalContext []byte, level utils.ConsistencyLevel) (int, error) {
+	m.values[string(key)] = value
+	return 1, nil
+}
+
+func (m *memCluster) GetSiblings(key []byte, level utils.ConsistencyLevel) ([][]byte, []byte, int, error) {
+	value, ok := m.values[string(key)]
+	if !ok {
+		return nil, nil, 1, utils.ErrKeyNotFound
+	}
+	return [][]byte{value}, nil, 1, nil
+}
+
+// a PUT body is the value as-is, or a JSON string with application/json, and GET answers with the bytes stored
+func TestPutValueRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+		wantStatus  int
+	}{
+		{name: "binary", contentType: "application/octet-stream", body: "\x00\xff\xfe\x80", want: "\x00\xff\xfe\x80", wantStatus: http.StatusOK},
+		{name: "empty", contentType: "application/octet-stream", body: "", want: "", wantStatus: http.StatusOK},
+		{name: "no content type", body: `"quoted"`, want: `"quoted"`, wantStatus: http.StatusOK},
+		{name: "JSON string", contentType: "application/json; charset=utf-8", body: `"café\n"`, want: "café\n", wantStatus: http.StatusOK},
+		{name: "empty JSON string", contentType: "application/json", body: `""`, want: "", wantStatus: http.StatusOK},
+		{name: "JSON that isn't a string", contentType: "application/json", body: `{"a": 1}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &memCluster{values: make(map[string][]byte)}
+			s := NewClusterService(":0", cluster)
+
+			r := httptest.NewRequest("PUT", "/key/k", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("put: status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if len(cluster.values) != 0 {
+					t.Fatalf("rejected put stored %q", cluster.values["k"])
+				}
+				return
+			}
+
+			w = httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", "/key/k", nil))
+			if w.Code != http.StatusOK || w.Body.String() != tt.want {
+				t.Fatalf("get: status = %d, body = %q, want %d, %q", w.Code, w.Body, http.StatusOK, tt.want)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/octet-stream" {
+				t.Fatalf("get: content type = %q, want application/octet-stream", got)
+			}
+		})
+	}
+}
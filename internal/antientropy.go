@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"slices"
+	"time"
+
+	"github.com/jateen67/kv/proto"
+)
+
+/*
+Anti-entropy -- replicas that missed writes are brought back in sync in the background, without waiting for the keys to be read.
+
+The ring is cut into token ranges, one per node: the tokens from the previous node's position up to the node's own, every key
+in a range has the same replicas. For each range, every replica builds a Merkle tree over the newest version of the keys in it:
+the range is split evenly into 2^depth leaves, a leaf hashes the versions of the keys that fall in it and every other tree node
+hashes its two children. Two replicas compare their trees from the root down, only following the nodes that differ, and
+exchange the records of the leaves that differ.
+*/
+
+const (
+	merkleTreeDepth    = 10
+	maxMerkleTreeDepth = 20
+	// a tree a replica built is reused for the rest of the requests of the same repair
+	merkleTreeMaxAge           = 30 * time.Second
+	DefaultAntiEntropyInterval = 10 * time.Minute
+)
+
+// tokenRange is [start, end) on the hash ring, wrapping around past the largest token. start == end is the whole ring
+type tokenRange struct {
+	start, end uint64
+}
+
+// ringRange is a token range along with the replicas of every key in it
+type ringRange struct {
+	tokenRange
+	replicas []string
+}
+
+// keyToken is the key's position on the hash ring, hashed the same way the ring places keys
+func keyToken(key []byte) uint64 {
+	sum := md5.Sum(key)
+	// the ring orders positions by their first 8 bytes as a signed integer, flipping the sign bit keeps that order
+	return binary.LittleEndian.Uint64(sum[:8]) ^ (1 << 63)
+}
+
+// nodeToken is the node's position on the hash ring, every node has a single one named "<addr>-0"
+func nodeToken(addr string) uint64 {
+	return keyToken([]byte(addr + "-0"))
+}
+
+func (r tokenRange) contains(token uint64) bool {
+	if r.start < r.end {
+		return token >= r.start && token < r.end
+	}
+	return token >= r.start || token < r.end
+}
+
+// leaf returns which of the range's 2^depth leaves the token falls in
+func (r tokenRange) leaf(token uint64, depth int) int {
+	// both wrap around along with the range
+	offset := token - r.start
+	width := r.end - r.start
+	if width == 0 {
+		return int(offset >> (64 - depth))
+	}
+	hi, lo := bits.Mul64(offset, 1<<depth)
+	leaf, _ := bits.Div64(hi, lo, width)
+	return int(leaf)
+}
+
+// ringRanges cuts the ring into one token range per node, each with its replicas
+func (c *Cluster) ringRanges() []ringRange {
+	addrs := c.nodeAddrs()
+	slices.SortFunc(addrs, func(a, b string) int {
+		return cmp.Compare(nodeToken(a), nodeToken(b))
+	})
+
+	n := min(c.replicationFactor, len(addrs))
+	ranges := make([]ringRange, len(addrs))
+	for i, addr := range addrs {
+		prev := addrs[(i+len(addrs)-1)%len(addrs)]
+		ranges[i].tokenRange = tokenRange{start: nodeToken(prev), end: nodeToken(addr)}
+		for j := range n {
+			ranges[i].replicas = append(ranges[i].replicas, addrs[(i+j)%len(addrs)])
+		}
+	}
+	return ranges
+}
+
+type merkleTree struct {
+	depth int
+	// 1 is the root and the children of i are 2i and 2i+1, the leaves are the last 2^depth
+	hashes [][sha256.Size]byte
+	built  time.Time
+}
+
+// buildMerkleTree builds the range's tree over the versions, versions of keys outside the range are ignored
+func buildMerkleTree(versions []Record, r tokenRange, depth int) *merkleTree {
+	leaves := 1 << depth
+	tree := &merkleTree{depth: depth, hashes: make([][sha256.Size]byte, 2*leaves), built: time.Now()}
+	for i := range versions {
+		token := keyToken(versions[i].Key)
+		if !r.contains(token) {
+			continue
+		}
+		// xor keeps a leaf's hash independent of the order its keys are seen in
+		digest := versionDigest(&versions[i])
+		leaf := &tree.hashes[leaves+r.leaf(token, depth)]
+		for j := range leaf {
+			leaf[j] ^= digest[j]
+		}
+	}
+	for i := leaves - 1; i >= 1; i-- {
+		tree.hashes[i] = sha256.Sum256(append(tree.hashes[2*i][:], tree.hashes[2*i+1][:]...))
+	}
+	return tree
+}
+
+// versionDigest identifies a version of a key, every replica of a write stores it with the coordinator's timestamp.
+// replicas timestamp the siblings they merge themselves, so those are identified by the siblings
+func versionDigest(record *Record) [sha256.Size]byte {
+	buf := bytes.NewBuffer(slices.Clone(record.Key))
+	if record.hasSiblings() {
+		buf.Write(record.Value)
+		return sha256.Sum256(buf.Bytes())
+	}
+	binary.Write(buf, binary.LittleEndian, record.Header.TimeStamp)
+	buf.WriteByte(record.Header.Tombstone)
+	return sha256.Sum256(buf.Bytes())
+}
+
+// merkleTree returns the node's tree for the range, the one built for an earlier request unless rebuild is set or it got
+// too old. keys are stored in key order rather than token order, so every range takes a scan of the whole store: the
+// trees of all the ranges the node replicates are built from the same one
+func (n *Node) merkleTree(r tokenRange, depth int, rebuild bool) (*merkleTree, error) {
+	n.treesMu.Lock()
+	defer n.treesMu.Unlock()
+	if tree, ok := n.trees[r]; ok && !rebuild && tree.depth == depth && time.Since(tree.built) < merkleTreeMaxAge {
+		return tree, nil
+	}
+
+	// the range asked for comes from the ring of whoever asked, it may not be one on the node's
+	ranges := []tokenRange{r}
+	for _, rr := range n.cluster.ringRanges() {
+		if rr.tokenRange != r && slices.Contains(rr.replicas, n.Addr) {
+			ranges = append(ranges, rr.tokenRange)
+		}
+	}
+	versions, err := n.Store.tokenRangeVersions(ranges)
+	if err != nil {
+		return nil, err
+	}
+	n.trees = make(map[tokenRange]*merkleTree, len(ranges))
+	for _, rng := range ranges {
+		n.trees[rng] = buildMerkleTree(versions[rng], rng, depth)
+	}
+	return n.trees[r], nil
+}
+
+// tokenRangeVersions returns the newest version of every key in each of the token ranges as stored, from a single scan.
+// range deleted keys are left out
+func (ds *DiskStore) tokenRangeVersions(ranges []tokenRange) (map[tokenRange][]Record, error) {
+	newest, err := ds.newestVersions(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[tokenRange][]Record, len(ranges))
+	for _, record := range newest {
+		token := keyToken(record.Key)
+		for _, r := range ranges {
+			if r.contains(token) && !ds.isRangeDeleted(&record) {
+				versions[r] = append(versions[r], record)
+			}
+		}
+	}
+	return versions, nil
+}
+
+// leafRecords returns the newest version of every key in the given leaves of the range's tree, ready to be stored by
+// another replica: merge operands folded and values inlined
+func (ds *DiskStore) leafRecords(r tokenRange, depth int, leaves []uint32) ([]Record, error) {
+	ranges, err := ds.tokenRangeVersions([]tokenRange{r})
+	if err != nil {
+		return nil, err
+	}
+	versions := ranges[r]
+
+	wanted := make(map[int]bool, len(leaves))
+	for _, leaf := range leaves {
+		wanted[int(leaf)] = true
+	}
+
+	ds.blobs.mu.RLock()
+	defer ds.blobs.mu.RUnlock()
+	var records []Record
+	for _, record := range versions {
+		if !wanted[r.leaf(keyToken(record.Key), depth)] {
+			continue
+		}
+		if record.Header.Tombstone == 0 {
+			if record, err = ds.resolveMerge(record); err != nil {
+				return nil, err
+			}
+			if record, err = ds.resolveValue(record); err != nil {
+				return nil, err
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Repair runs anti-entropy over every token range now, returns how many records were sent between replicas.
+// the first replica of a range syncs with every other one in turn, so what it got from a later replica only reaches the
+// earlier ones on the next run. a node rebuilds its trees the first time it's asked for one during the run, and the
+// local replica again after it pulled records
+func (c *Cluster) Repair() (int, error) {
+	c.repairMu.Lock()
+	defer c.repairMu.Unlock()
+
+	sent := 0
+	var errs []error
+	nodes := c.Nodes()
+	rebuilt := make(map[string]bool)
+	for _, r := range c.ringRanges() {
+		local, ok := nodes[r.replicas[0]]
+		if !ok || c.isDown(local) {
+			continue
+		}
+		for _, peer := range r.replicas[1:] {
+			node, ok := nodes[peer]
+			if !ok || c.isDown(node) {
+				continue
+			}
+			pulled, pushed, err := c.syncRange(local, node, r.tokenRange, !rebuilt[local.Addr], !rebuilt[peer])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("anti-entropy %s <-> %s: %w", local.Addr, peer, err))
+			}
+			rebuilt[local.Addr], rebuilt[peer] = pulled == 0, true
+			sent += pulled + pushed
+		}
+	}
+	fmt.Printf("anti-entropy: %d record(s) sent between replicas\n", sent)
+	return sent, errors.Join(errs...)
+}
+
+// syncRange compares the local node's tree for the range with the peer's, and exchanges the records of the leaves that
+// differ. both are asked over gRPC, so it works the same for nodes running in processes of their own
+func (c *Cluster) syncRange(local, peer *Node, r tokenRange, rebuildLocal, rebuildPeer bool) (pulled, pushed int, err error) {
+	clock := c.nodeClock(local)
+	localClient, localConn := StartAntiEntropyClient(local.Addr, clock)
+	defer localConn.Close()
+	peerClient, peerConn := StartAntiEntropyClient(peer.Addr, clock)
+	defer peerConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	protoRange := &proto.TokenRange{Start: r.start, End: r.end}
+
+	// walk down from the root, only into the nodes that differ
+	indexes := []uint32{1}
+	for level := 0; ; level++ {
+		req := &proto.MerkleNodesRequest{
+			Range:   protoRange,
+			Depth:   merkleTreeDepth,
+			Indexes: indexes,
+			Rebuild: level == 0 && rebuildLocal,
+		}
+		mine, err := localClient.GetMerkleNodes(ctx, req)
+		if err != nil {
+			return 0, 0, err
+		}
+		req.Rebuild = level == 0 && rebuildPeer
+		theirs, err := peerClient.GetMerkleNodes(ctx, req)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(mine.Hashes) != len(indexes) || len(theirs.Hashes) != len(indexes) {
+			return 0, 0, fmt.Errorf("asked for %d tree nodes, got %d and %d", len(indexes), len(mine.Hashes), len(theirs.Hashes))
+		}
+
+		var differing []uint32
+		for i, index := range indexes {
+			if !bytes.Equal(mine.Hashes[i], theirs.Hashes[i]) {
+				differing = append(differing, index)
+			}
+		}
+		if len(differing) == 0 {
+			return 0, 0, nil
+		}
+		if level == merkleTreeDepth {
+			indexes = differing
+			break
+		}
+		indexes = indexes[:0]
+		for _, index := range differing {
+			indexes = append(indexes, 2*index, 2*index+1)
+		}
+	}
+	leaves := make([]uint32, len(indexes))
+	for i, index := range indexes {
+		leaves[i] = index - 1<<merkleTreeDepth
+	}
+	req := &proto.RangeRecordsRequest{Range: protoRange, Depth: merkleTreeDepth, Leaves: leaves}
+
+	// taken before pulling, the records pulled from the peer don't need to go back to it
+	records, err := streamRange(ctx, localClient, req)
+	if err != nil {
+		return 0, 0, err
+	}
+	theirs, err := streamRange(ctx, peerClient, req)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i := range theirs {
+		if err := local.putRecord(&theirs[i]); err != nil {
+			return i, 0, err
+		}
+	}
+
+	if len(records) > 0 {
+		c.transferDataBetweenNodes(local.Addr, peer.Addr, &records)
+	}
+	fmt.Printf("anti-entropy %s <-> %s: %d leaves differ, pulled %d record(s), pushed %d\n", local.Addr, peer.Addr, len(leaves), len(theirs), len(records))
+	return len(theirs), len(records), nil
+}
+
+// streamRange returns the records of the requested leaves the node holds
+func streamRange(ctx context.Context, client proto.AntiEntropyServiceClient, req *proto.RangeRecordsRequest) ([]Record, error) {
+	stream, err := client.StreamRange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for {
+		record, err := stream.Recv()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, *convertProtoRecordToStoreRecord(record))
+	}
+}
+
+// repairPeriodically runs anti-entropy every interval until the cluster is closed
+func (c *Cluster) repairPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.Repair(); err != nil {
+				fmt.Println(err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
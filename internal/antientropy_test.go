@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/jateen67/kv/utils"
+)
+
+// replicas that missed writes get them from each other, only the leaves that differ are exchanged
+func TestAntiEntropy(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(3))
+	const keys = 50
+	for i := range keys {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if _, err := c.Set(key, key, utils.ConsistencyAll); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	if n, err := c.Repair(); err != nil || n != 0 {
+		t.Fatalf("repair of replicas in sync: sent %d record(s), %v, want 0", n, err)
+	}
+
+	// writes that only made it to one replica each
+	want := map[string]string{"key-03": "newer", "extra": "only on one replica", "key-07": ""}
+	for key, value := range want {
+		replicas := c.replicaNodes([]byte(key))
+		record := c.newRecord([]byte(key), []byte(value), 0, 0)
+		if value == "" {
+			record = c.newRecord([]byte(key), nil, 1, 0)
+		}
+		if err := replicas[len(replicas)-1].Store.PutRecord(record); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	// what the first replica of a range pulls from the last one reaches the others on the next run
+	n, err := c.Repair()
+	if err != nil || n == 0 || n > 2*len(want)*len(c.Nodes()) {
+		t.Fatalf("first repair: sent %d record(s), %v, want only the ones around the %d that differ", n, err, len(want))
+	}
+	if _, err := c.Repair(); err != nil {
+		t.Fatalf("second repair: %v", err)
+	}
+	for _, node := range c.Nodes() {
+		for key, value := range want {
+			got, err := node.Store.Get([]byte(key))
+			if value == "" {
+				if !errors.Is(err, utils.ErrKeyNotFound) {
+					t.Errorf("get %s @ node addr = %s: got %q, %v, want it deleted", key, node.Addr, got, err)
+				}
+			} else if err != nil || string(got) != value {
+				t.Errorf("get %s @ node addr = %s: got %q, %v, want %q", key, node.Addr, got, err, value)
+			}
+		}
+	}
+	if n, err := c.Repair(); err != nil || n != 0 {
+		t.Fatalf("repair once in sync again: sent %d record(s), %v, want 0", n, err)
+	}
+}
+
+// the trees of every range a node replicates come out of a single scan, each the same as one built for its range alone
+func TestMerkleTreesOfEveryRange(t *testing.T) {
+	c := startTestCluster(t, 4, WithReplicationFactor(2))
+	for i := range 100 {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if _, err := c.Set(key, key, utils.ConsistencyAll); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+
+	for _, node := range c.Nodes() {
+		var ranges []tokenRange
+		for _, r := range c.ringRanges() {
+			if slices.Contains(r.replicas, node.Addr) {
+				ranges = append(ranges, r.tokenRange)
+			}
+		}
+		if _, err := node.merkleTree(ranges[0], merkleTreeDepth, true); err != nil {
+			t.Fatalf("merkle tree @ node addr = %s: %v", node.Addr, err)
+		}
+		if len(node.trees) != len(ranges) {
+			t.Fatalf("@ node addr = %s: built %d tree(s), want one for each of its %d ranges", node.Addr, len(node.trees), len(ranges))
+		}
+		newest, err := node.Store.newestVersions(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var versions []Record
+		for _, record := range newest {
+			versions = append(versions, record)
+		}
+		for _, r := range ranges {
+			if want := buildMerkleTree(versions, r, merkleTreeDepth); !slices.Equal(node.trees[r].hashes, want.hashes) {
+				t.Errorf("@ node addr = %s: tree of range %v differs from the one built for it alone", node.Addr, r)
+			}
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Blob log -- key-value separation (WiscKey-style)
+
+Values at or above the store's blob threshold are appended to a blob file, and only a small
+pointer to it goes through the memtable, WAL, SSTables, compaction etc. This way compaction cost
+depends on the number of keys rather than the size of the values.
+
+Each blob file is the key id it's encrypted with (0 if it isn't), followed by a sequence of entries:
+---------------------------------------------------------------------
+| entry_size | checksum | key_size | value_size | key | value |
+---------------------------------------------------------------------
+Everything after entry_size is sealed on its own when the file is encrypted.
+The key is kept alongside the value so GC can check whether the entry is still the live version.
+*/
+
+const (
+	BLOB_FILE_EXTENSION       string  = ".blob"
+	DefaultBlobValueThreshold uint32  = 1024 * 4
+	BlobFileMaxSize           uint32  = 1024 * 1024 * 64
+	blobGCGarbageRatio        float64 = 0.5 // only rewrite blob files that are at least 50% garbage
+	blobEntryHeaderSize       uint32  = 12
+	blobEntrySizeSize         uint32  = 4
+	blobPointerSize           int     = 12
+)
+
+var blobFileCounter uint32
+
+// blobPointer is what gets stored as the record's value when the value lives in a blob file
+type blobPointer struct {
+	fileID uint32
+	offset uint32 // where the blob entry starts within the file
+	size   uint32 // size of the value
+}
+
+func (p blobPointer) encode() []byte {
+	buf := make([]byte, blobPointerSize)
+	binary.LittleEndian.PutUint32(buf[0:4], p.fileID)
+	binary.LittleEndian.PutUint32(buf[4:8], p.offset)
+	binary.LittleEndian.PutUint32(buf[8:12], p.size)
+	return buf
+}
+
+func decodeBlobPointer(buf []byte) (blobPointer, error) {
+	if len(buf) != blobPointerSize {
+		return blobPointer{}, utils.ErrDecodingBlobPointerFailed
+	}
+	return blobPointer{
+		fileID: binary.LittleEndian.Uint32(buf[0:4]),
+		offset: binary.LittleEndian.Uint32(buf[4:8]),
+		size:   binary.LittleEndian.Uint32(buf[8:12]),
+	}, nil
+}
+
+type blobFile struct {
+	id    uint32
+	file  File
+	size  uint32
+	keyID uint32
+}
+
+type blobLog struct {
+	// writes are serialized by the store's lock, they take mu to change which files there are. reads that don't hold
+	// the store's lock hold mu shared for as long as they read, so a file isn't closed under them
+	mu          sync.RWMutex
+	fs          FS
+	dir         string
+	encryption  *encryptor
+	maxFileSize uint32
+	active      *blobFile
+	sealed      map[uint32]*blobFile
+	unsynced    []*blobFile // sealed early by a failed write, still holding values that were never synced
+	// rewritten by GC, but older SSTables may still point into them, so they're only deleted once nothing references them
+	obsolete map[uint32]*blobFile
+	// what the tables pointed to in the files GC last found weren't worth rewriting, only used by GC
+	checked map[uint32]uint32
+}
+
+func newBlobLog(fs FS, dir string, enc *encryptor) *blobLog {
+	return &blobLog{
+		fs:          fs,
+		dir:         dir,
+		encryption:  enc,
+		maxFileSize: BlobFileMaxSize,
+		sealed:      make(map[uint32]*blobFile),
+		obsolete:    make(map[uint32]*blobFile),
+		checked:     make(map[uint32]uint32),
+	}
+}
+
+// openBlobLog picks up the blob files a previous run left in dir, they're all sealed: new values go to a fresh file
+func openBlobLog(fs FS, dir string, enc *encryptor) (*blobLog, error) {
+	bl := newBlobLog(fs, dir, enc)
+	names, err := fs.ReadDir(fmt.Sprintf("../%s", dir))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		var id uint32
+		if _, err := fmt.Sscanf(name, "blob_%d"+BLOB_FILE_EXTENSION, &id); err != nil {
+			continue
+		}
+		file, err := fs.OpenFile(getBlobFilename(dir, id), os.O_RDWR, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open blob file: %w", err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		header := make([]byte, fileKeyIDSize)
+		if _, err := file.ReadAt(header, 0); err != nil {
+			// crashed before the header made it, there can't be any values in it
+			file.Close()
+			fs.Remove(file.Name())
+			continue
+		}
+		bl.sealed[id] = &blobFile{id: id, file: file, size: uint32(info.Size()), keyID: binary.LittleEndian.Uint32(header)}
+		bumpCounter(&blobFileCounter, id)
+	}
+	return bl, nil
+}
+
+func getBlobFilename(directory string, id uint32) string {
+	return fmt.Sprintf("../%s/blob_%d%s", directory, id, BLOB_FILE_EXTENSION)
+}
+
+// append writes key + value to the active blob file, and returns a pointer to it.
+// returns true if the active file got sealed as a result (so the caller can decide to run GC)
+func (bl *blobLog) append(key, value []byte) (blobPointer, bool, error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if bl.active == nil {
+		if err := bl.openNewActiveFile(); err != nil {
+			return blobPointer{}, false, err
+		}
+	}
+
+	entry := new(bytes.Buffer)
+	binary.Write(entry, binary.LittleEndian, crc32.ChecksumIEEE(append(slices.Clone(key), value...)))
+	binary.Write(entry, binary.LittleEndian, uint32(len(key)))
+	binary.Write(entry, binary.LittleEndian, uint32(len(value)))
+	entry.Write(key)
+	entry.Write(value)
+	payload, err := bl.encryption.seal(bl.active.keyID, entry.Bytes(), associatedData(getBlobFilename(bl.dir, bl.active.id), uint64(bl.active.size)))
+	if err != nil {
+		return blobPointer{}, false, err
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+
+	ptr := blobPointer{fileID: bl.active.id, offset: bl.active.size, size: uint32(len(value))}
+	if _, err := bl.active.file.Write(buf.Bytes()); err != nil {
+		// part of the entry may have made it, nothing can be appended after it anymore
+		bl.sealed[bl.active.id] = bl.active
+		bl.unsynced = append(bl.unsynced, bl.active)
+		bl.active = nil
+		return blobPointer{}, false, err
+	}
+	bl.active.size += uint32(buf.Len())
+
+	if bl.active.size < bl.maxFileSize {
+		return ptr, false, nil
+	}
+
+	// active file is full, seal it. the next append will open a fresh one
+	if err := bl.active.file.Sync(); err != nil {
+		return blobPointer{}, false, err
+	}
+	bl.sealed[bl.active.id] = bl.active
+	bl.active = nil
+	return ptr, true, nil
+}
+
+func (bl *blobLog) openNewActiveFile() error {
+	if err := bl.fs.MkdirAll(fmt.Sprintf("../%s", bl.dir), 0755); err != nil {
+		return err
+	}
+	keyID, err := bl.encryption.currentKeyID()
+	if err != nil {
+		return err
+	}
+	id := atomic.AddUint32(&blobFileCounter, 1)
+	file, err := bl.fs.OpenFile(getBlobFilename(bl.dir, id), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	header := make([]byte, fileKeyIDSize)
+	binary.LittleEndian.PutUint32(header, keyID)
+	if err := writeToFile(header, file); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	if err := bl.fs.SyncDir(fmt.Sprintf("../%s", bl.dir)); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	bl.active = &blobFile{id: id, file: file, size: uint32(fileKeyIDSize), keyID: keyID}
+	return nil
+}
+
+// sync makes every value appended to the active file so far durable.
+// has to happen before anything that points at those values (WAL operations, tables) is made durable
+func (bl *blobLog) sync() error {
+	for len(bl.unsynced) > 0 {
+		if err := bl.unsynced[0].file.Sync(); err != nil {
+			return err
+		}
+		bl.unsynced = bl.unsynced[1:]
+	}
+	if bl.active == nil {
+		return nil
+	}
+	return bl.active.file.Sync()
+}
+
+func (bl *blobLog) getFile(id uint32) (*blobFile, error) {
+	if bl.active != nil && bl.active.id == id {
+		return bl.active, nil
+	}
+	if bf, ok := bl.sealed[id]; ok {
+		return bf, nil
+	}
+	if bf, ok := bl.obsolete[id]; ok {
+		return bf, nil
+	}
+	return nil, utils.ErrBlobFileNotFound
+}
+
+// read returns the value the pointer refers to
+func (bl *blobLog) read(ptr blobPointer) ([]byte, error) {
+	bf, err := bl.getFile(ptr.fileID)
+	if err != nil {
+		return nil, err
+	}
+	key, value, _, err := bl.readEntry(bf, ptr.offset)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(value)) != ptr.size {
+		return nil, fmt.Errorf("blob %d@%d: expected %d bytes, got %d for key %s", ptr.fileID, ptr.offset, ptr.size, len(value), key)
+	}
+	return value, nil
+}
+
+// readEntry reads the entry starting at offset, returning its key, value and total encoded size
+func (bl *blobLog) readEntry(bf *blobFile, offset uint32) ([]byte, []byte, uint32, error) {
+	sizeBuf := make([]byte, blobEntrySizeSize)
+	if _, err := bf.file.ReadAt(sizeBuf, int64(offset)); err != nil {
+		return nil, nil, 0, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(sizeBuf))
+	if _, err := bf.file.ReadAt(payload, int64(offset+blobEntrySizeSize)); err != nil {
+		return nil, nil, 0, err
+	}
+	entry, err := bl.encryption.open(bf.keyID, payload, associatedData(getBlobFilename(bl.dir, bf.id), uint64(offset)))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if uint32(len(entry)) < blobEntryHeaderSize {
+		return nil, nil, 0, utils.ErrBlobChecksumMismatch
+	}
+	checksum := binary.LittleEndian.Uint32(entry[0:4])
+	keySize := binary.LittleEndian.Uint32(entry[4:8])
+	valueSize := binary.LittleEndian.Uint32(entry[8:12])
+
+	data := entry[blobEntryHeaderSize:]
+	if uint32(len(data)) != keySize+valueSize || crc32.ChecksumIEEE(data) != checksum {
+		return nil, nil, 0, utils.ErrBlobChecksumMismatch
+	}
+	return data[:keySize], data[keySize:], blobEntrySizeSize + uint32(len(payload)), nil
+}
+
+// scan calls fn for every entry in the blob file, in the order they were written
+func (bl *blobLog) scan(bf *blobFile, fn func(key []byte, ptr blobPointer, entrySize uint32) error) error {
+	offset := uint32(fileKeyIDSize)
+	for offset < bf.size {
+		key, value, entrySize, err := bl.readEntry(bf, offset)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := fn(key, blobPointer{fileID: bf.id, offset: offset, size: uint32(len(value))}, entrySize); err != nil {
+			return err
+		}
+		offset += entrySize
+	}
+	return nil
+}
+
+// separateValue moves a large value out of the record and into the blob log, leaving a pointer in its place.
+// returns true if a blob file got sealed, GC should only run once the record is in the memtable otherwise its value looks like garbage
+func (ds *DiskStore) separateValue(record *Record) (bool, error) {
+	if ds.blobThreshold == 0 || uint32(len(record.Value)) < ds.blobThreshold || record.Header.Flags&flagBlobPointer != 0 ||
+		record.hasSiblings() {
+		return false, nil
+	}
+
+	ptr, sealed, err := ds.blobs.append(record.Key, record.Value)
+	if err != nil {
+		return false, err
+	}
+	record.Value = ptr.encode()
+	record.Header.Flags |= flagBlobPointer
+	record.Header.ValueSize = uint32(len(record.Value))
+	record.TotalSize = headerSize + record.Header.KeySize + record.Header.ValueSize
+	record.Header.CheckSum = record.CalculateChecksum()
+	return sealed, nil
+}
+
+// resolveValue returns a copy of the record with the actual value inlined, used when the value has to leave the store (reads, migration)
+func (ds *DiskStore) resolveValue(record Record) (Record, error) {
+	if record.Header.Flags&flagBlobPointer == 0 {
+		return record, nil
+	}
+
+	ptr, err := decodeBlobPointer(record.Value)
+	if err != nil {
+		return Record{}, err
+	}
+	value, err := ds.blobs.read(ptr)
+	if err != nil {
+		return Record{}, err
+	}
+
+	record.Value = value
+	record.Header.Flags &^= flagBlobPointer
+	record.Header.ValueSize = uint32(len(value))
+	record.TotalSize = headerSize + record.Header.KeySize + record.Header.ValueSize
+	record.Header.CheckSum = record.CalculateChecksum()
+	return record, nil
+}
+
+// AdjustBlobValueThreshold sets the value size at which values are moved into blob files, 0 disables key-value separation
+func (ds *DiskStore) AdjustBlobValueThreshold(threshold uint32) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.blobThreshold = threshold
+}
+
+// CollectBlobGarbage rewrites the live values of sealed blob files that are mostly garbage, one file at a time,
+// and deletes blob files that are no longer referenced
+func (ds *DiskStore) CollectBlobGarbage() error {
+	for {
+		rewritten, err := ds.collectBlobGarbage()
+		if err != nil || !rewritten {
+			return err
+		}
+	}
+}
+
+// runBlobGC collects blob garbage in the background every time a blob file gets sealed, until stopBlobGC
+func (ds *DiskStore) runBlobGC() {
+	defer close(ds.gcDone)
+	for {
+		select {
+		case <-ds.gcWake:
+			rewritten, err := ds.collectBlobGarbage()
+			if err != nil {
+				fmt.Println("blob gc err:", err)
+			} else if rewritten {
+				// the next file may be worth rewriting too
+				ds.wakeBlobGC()
+			}
+		case <-ds.gcStop:
+			return
+		}
+	}
+}
+
+// wakeBlobGC has the background GC run a round, a round that's already due covers it
+func (ds *DiskStore) wakeBlobGC() {
+	select {
+	case ds.gcWake <- struct{}{}:
+	default:
+	}
+}
+
+// stopBlobGC stops the background GC, waiting for the round under way
+func (ds *DiskStore) stopBlobGC() {
+	ds.gcStopOnce.Do(func() { close(ds.gcStop) })
+	<-ds.gcDone
+}
+
+// collectBlobGarbage runs a round of GC: the sealed file that looks like it holds the most garbage is checked,
+// and its live values are moved to the active file if enough of it is garbage. reports whether a file got rewritten.
+// the file is scanned without the store's lock, which is only taken to move the values that are still live by then
+func (ds *DiskStore) collectBlobGarbage() (bool, error) {
+	ds.gcMu.Lock()
+	defer ds.gcMu.Unlock()
+
+	bf, refs := ds.blobGCCandidate()
+	if bf == nil {
+		ds.mu.Lock()
+		defer ds.mu.Unlock()
+		return false, ds.purgeObsoleteBlobFiles()
+	}
+
+	// only this GC makes a sealed file obsolete, nothing closes it while it's scanned
+	var live []blobPointer
+	var liveBytes uint32
+	err := ds.blobs.scan(bf, func(key []byte, ptr blobPointer, entrySize uint32) error {
+		if _, ok, err := ds.liveBlobRecord(key, ptr); err != nil || !ok {
+			return err
+		}
+		live = append(live, ptr)
+		liveBytes += entrySize
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if bf.size > 0 && float64(bf.size-liveBytes)/float64(bf.size) < blobGCGarbageRatio {
+		ds.blobs.checked[bf.id] = refs
+		return false, nil
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	// move every live value to the active file. the new pointer keeps the original timestamp, it's the same version
+	moved := 0
+	for _, ptr := range live {
+		key, _, _, err := ds.blobs.readEntry(bf, ptr.offset)
+		if err != nil {
+			return false, err
+		}
+		record, ok, err := ds.liveBlobRecord(key, ptr)
+		if err != nil {
+			return false, err
+		}
+		// written since the scan, the new version doesn't point into the file
+		if !ok {
+			continue
+		}
+		inlined, err := ds.resolveValue(record)
+		if err != nil {
+			return false, err
+		}
+		newPtr, _, err := ds.blobs.append(inlined.Key, inlined.Value)
+		if err != nil {
+			return false, err
+		}
+		record.Value = newPtr.encode()
+		record.Header.CheckSum = record.CalculateChecksum()
+		ds.memtable.Set(record.Key, &record)
+		ds.wal.appendWALOperation(SET, &record)
+		moved++
+	}
+
+	ds.blobs.mu.Lock()
+	delete(ds.blobs.sealed, bf.id)
+	delete(ds.blobs.checked, bf.id)
+	ds.blobs.obsolete[bf.id] = bf
+	ds.blobs.mu.Unlock()
+	if moved == 0 {
+		return true, ds.purgeObsoleteBlobFiles()
+	}
+	// get the new pointers onto disk, the obsolete file is purged as part of the flush
+	ds.rotateMemtable()
+	return true, nil
+}
+
+// blobGCCandidate returns the sealed file the tables point into the least, relative to its size, along with how
+// many bytes of values they point to in it. nil if every file looks mostly live. values only a memtable points to
+// make a file look emptier than it is, a file that was checked is skipped until the tables point into it differently
+func (ds *DiskStore) blobGCCandidate() (*blobFile, uint32) {
+	refs := ds.bucketManager.BlobReferences()
+	ds.blobs.mu.RLock()
+	defer ds.blobs.mu.RUnlock()
+
+	var candidate *blobFile
+	var most float64
+	for id, bf := range ds.blobs.sealed {
+		if checked, ok := ds.blobs.checked[id]; ok && checked == refs[id] {
+			continue
+		}
+		if bf.size == 0 {
+			continue
+		}
+		garbage := 1 - float64(min(refs[id], bf.size))/float64(bf.size)
+		if garbage >= blobGCGarbageRatio && (candidate == nil || garbage > most) {
+			candidate, most = bf, garbage
+		}
+	}
+	if candidate == nil {
+		return nil, 0
+	}
+	return candidate, refs[candidate.id]
+}
+
+// cmpBlobCopies orders two records holding the same version of a key by where their value lives. GC moves a value
+// without giving it a new timestamp, and only ever to a newer blob file, so the copy in the newer file is the one to keep
+func cmpBlobCopies(a, b *Record) int {
+	if a.Header.Flags&flagBlobPointer == 0 || b.Header.Flags&flagBlobPointer == 0 {
+		return 0
+	}
+	pa, errA := decodeBlobPointer(a.Value)
+	pb, errB := decodeBlobPointer(b.Value)
+	if errA != nil || errB != nil {
+		return 0
+	}
+	if c := cmp.Compare(pa.fileID, pb.fileID); c != 0 {
+		return c
+	}
+	return cmp.Compare(pa.offset, pb.offset)
+}
+
+// liveBlobRecord returns the newest version of the key, if it still points at ptr
+func (ds *DiskStore) liveBlobRecord(key []byte, ptr blobPointer) (Record, bool, error) {
+	current, err := ds.getRecord(key)
+	if errors.Is(err, utils.ErrKeyNotFound) {
+		return Record{}, false, nil
+	} else if err != nil {
+		return Record{}, false, err
+	}
+	if current.Header.Tombstone == 1 || current.Header.Flags&flagBlobPointer == 0 || ds.isRangeDeleted(&current) {
+		return Record{}, false, nil
+	}
+	if currPtr, err := decodeBlobPointer(current.Value); err != nil || currPtr != ptr {
+		return Record{}, false, nil
+	}
+	return current, true, nil
+}
+
+// purgeObsoleteBlobFiles deletes every obsolete blob file that no SSTable points into anymore.
+// the memtable never does: GC overwrote those keys with pointers into the active file.
+// operations still in the WAL might though, they'd be replayed after a crash
+func (ds *DiskStore) purgeObsoleteBlobFiles() error {
+	if !ds.wal.empty() {
+		return nil
+	}
+	ds.blobs.mu.Lock()
+	defer ds.blobs.mu.Unlock()
+	for id, bf := range ds.blobs.obsolete {
+		if ds.bucketManager.ReferencesBlobFile(id) {
+			continue
+		}
+		bf.file.Close()
+		if err := ds.blobs.fs.Remove(bf.file.Name()); err != nil {
+			return err
+		}
+		delete(ds.blobs.obsolete, id)
+	}
+	return nil
+}
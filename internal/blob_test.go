@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// blobFileOf returns the blob file the key's newest version points into, 0 if its value is inline
+func blobFileOf(t *testing.T, ds *DiskStore, key string) uint32 {
+	t.Helper()
+	record, err := ds.getRecord([]byte(key))
+	if err != nil {
+		t.Fatalf("get record %s: %v", key, err)
+	}
+	if record.Header.Flags&flagBlobPointer == 0 {
+		return 0
+	}
+	ptr, err := decodeBlobPointer(record.Value)
+	if err != nil {
+		t.Fatalf("decode pointer of %s: %v", key, err)
+	}
+	return ptr.fileID
+}
+
+func expectValue(t *testing.T, ds *DiskStore, key, want string) {
+	t.Helper()
+	got, err := ds.Get([]byte(key))
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if string(got) != want {
+		t.Fatalf("get %s: got %.20q, want %.20q", key, got, want)
+	}
+}
+
+func blobValue(key string, n int) string {
+	return fmt.Sprintf("%s=%d%s", key, n, strings.Repeat("x", 300))
+}
+
+func TestValueSeparation(t *testing.T) {
+	fs := NewMemFS(1)
+	store := openTestStore(t, fs)
+	big, small := blobValue("big", 0), "small"
+	for key, value := range map[string]string{"big": big, "small": small} {
+		if err := store.Set([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+
+	if blobFileOf(t, store, "big") == 0 {
+		t.Fatal("a value above the threshold isn't in a blob file")
+	}
+	if blobFileOf(t, store, "small") != 0 {
+		t.Fatal("a value below the threshold isn't inline")
+	}
+	expectValue(t, store, "big", big)
+	expectValue(t, store, "small", small)
+
+	// the pointer goes into a table, then the store starts over from what's on disk
+	store.mu.Lock()
+	store.rotateMemtable()
+	store.mu.Unlock()
+	expectValue(t, store, "big", big)
+	if !store.Close() {
+		t.Fatal("close failed")
+	}
+	store = openTestStore(t, fs)
+	expectValue(t, store, "big", big)
+	expectValue(t, store, "small", small)
+}
+
+// the values still live in a file that's mostly garbage move to the active file, and the file gets deleted
+func TestBlobGCRewritesLiveValues(t *testing.T) {
+	fs := NewMemFS(1)
+	store := openTestStore(t, fs)
+	// everything stays in the memtable, no table points into a blob file so every sealed file is worth checking
+	store.flushThreshold = 1 << 30
+
+	live := []string{"live-0", "live-1", "live-2", "live-3"}
+	for _, key := range live {
+		if err := store.Set([]byte(key), []byte(blobValue(key, 0))); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	first := blobFileOf(t, store, live[0])
+	for n := range 200 {
+		key := fmt.Sprintf("churn-%d", n%4)
+		if err := store.Set([]byte(key), []byte(blobValue(key, n))); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	if err := store.CollectBlobGarbage(); err != nil {
+		t.Fatalf("blob gc: %v", err)
+	}
+
+	for _, key := range live {
+		if id := blobFileOf(t, store, key); id == first {
+			t.Errorf("%s still points into blob file %d", key, first)
+		}
+		expectValue(t, store, key, blobValue(key, 0))
+	}
+	names, err := fs.ReadDir("../" + store.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(names, fmt.Sprintf("blob_%d%s", first, BLOB_FILE_EXTENSION)) {
+		t.Errorf("blob file %d wasn't deleted once rewritten", first)
+	}
+
+	if !store.Close() {
+		t.Fatal("close failed")
+	}
+	store = openTestStore(t, fs)
+	for _, key := range live {
+		expectValue(t, store, key, blobValue(key, 0))
+	}
+}
+
+// GC moves values while they're read, a read sees the value either where it was or where it went
+func TestReadsWhileCollectingBlobGarbage(t *testing.T) {
+	store := openTestStore(t, NewMemFS(1))
+	store.flushThreshold = 1 << 30
+
+	live := []string{"live-0", "live-1", "live-2", "live-3"}
+	for _, key := range live {
+		if err := store.Set([]byte(key), []byte(blobValue(key, 0))); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	first := blobFileOf(t, store, live[0])
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := live[i]
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				got, err := store.Get([]byte(key))
+				if err == nil && string(got) != blobValue(key, 0) {
+					err = fmt.Errorf("got %.20q", got)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("get %s: %w", key, err)
+					return
+				}
+			}
+		}()
+	}
+
+	// the background GC runs as files get sealed, the explicit rounds race it too
+	for n := range 1000 {
+		key := fmt.Sprintf("churn-%d", n%4)
+		if err := store.Set([]byte(key), []byte(blobValue(key, n))); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+		if n%100 == 99 {
+			if err := store.CollectBlobGarbage(); err != nil {
+				t.Fatalf("blob gc: %v", err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if blobFileOf(t, store, live[0]) == first {
+		t.Errorf("%s was never moved out of blob file %d", live[0], first)
+	}
+	for _, key := range live {
+		expectValue(t, store, key, blobValue(key, 0))
+	}
+}
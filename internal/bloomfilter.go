@@ -3,13 +3,11 @@ package internal
 import (
 	"hash"
 	"math"
-	"os"
 
 	"github.com/spaolacci/murmur3"
 )
 
 type BloomFilter struct {
-	file       *os.File
 	bitSetSize uint64
 	bitSet     []bool
 	hashes     []hash.Hash64
@@ -17,8 +15,8 @@ type BloomFilter struct {
 
 const p = 0.01 // False positive probability
 
-func NewBloomFilter(bloomFile *os.File) *BloomFilter {
-	return &BloomFilter{file: bloomFile}
+func NewBloomFilter() *BloomFilter {
+	return &BloomFilter{}
 }
 
 func (bf *BloomFilter) InitBloomFilterAttrs(numElements uint32) {
@@ -37,22 +35,19 @@ func (bf *BloomFilter) initBitArray() {
 	bf.bitSet = make([]bool, bf.bitSetSize)
 }
 
-func (bf *BloomFilter) Add(key string) {
+func (bf *BloomFilter) Add(key []byte) {
 	// hash the key n times, and store it into the bits array
-	for _, hash := range bf.hashes {
-		hash.Reset()
-		hash.Write([]byte(key))
-		hashValue := hash.Sum64() % bf.bitSetSize
+	for seed := range bf.hashes {
+		hashValue := murmur3.Sum64WithSeed(key, uint32(seed)) % bf.bitSetSize
 		bf.bitSet[hashValue] = true
 	}
 }
 
-func (bf *BloomFilter) MightContain(key string) bool {
+func (bf *BloomFilter) MightContain(key []byte) bool {
 	// ! Bloom filter is probabilistic, so there's a chance to get false positives
-	for _, hasher := range bf.hashes {
-		hasher.Reset()
-		hasher.Write([]byte(key))
-		hashValue := hasher.Sum64() % bf.bitSetSize
+	// hashes are computed with the one-shot functions, the hashers themselves aren't safe to share between concurrent reads
+	for seed := range bf.hashes {
+		hashValue := murmur3.Sum64WithSeed(key, uint32(seed)) % bf.bitSetSize
 		if !bf.bitSet[hashValue] {
 			return false
 		}
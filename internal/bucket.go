@@ -1,13 +1,15 @@
 package internal
 
 import (
-	"cmp"
+	"bytes"
 	"container/heap"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"math"
 	"slices"
+
+	"github.com/jateen67/kv/utils"
 )
 
 type Bucket struct {
@@ -15,17 +17,31 @@ type Bucket struct {
 	avgBucketSize uint32
 	bucketLow     float32
 	bucketHigh    float32
-	tables        []SSTable
+	tables        []*SSTable
 }
 
 const DefaultTableSizeInBytes uint32 = 3_000
 
+// compactionOptions is everything compaction needs from the store that owns the tables
+type compactionOptions struct {
+	fs             FS
+	dir            string // where the merged table gets written
+	encryption     *encryptor
+	mergeOperators func() map[string]MergeOperator
+	resolveValue   func(Record) (Record, error)
+	separateValue  func(*Record) (bool, error)
+	filters        []CompactionFilter
+	filterStats    map[string]*CompactionFilterStats
+	// tombstones older than this can be dropped, the WAL can't replay anything older
+	tombstoneHorizon func() uint64
+}
+
 func InitBucket(table *SSTable) *Bucket {
 	bucket := &Bucket{
 		minTableSize: DefaultTableSizeInBytes,
 		bucketLow:    0.5,
 		bucketHigh:   1.5,
-		tables:       []SSTable{*table},
+		tables:       []*SSTable{table},
 	}
 	bucket.calculateAvgBucketSize()
 	return bucket
@@ -37,7 +53,7 @@ func InitEmptyBucket() *Bucket {
 		avgBucketSize: DefaultTableSizeInBytes,
 		bucketLow:     0.5,
 		bucketHigh:    1.5,
-		tables:        []SSTable{},
+		tables:        []*SSTable{},
 	}
 	return bucket
 }
@@ -48,26 +64,10 @@ func (b *Bucket) AdjustSizeThresholdParams(bucketLow, bucketHigh float32) {
 	b.bucketHigh = bucketHigh
 }
 
+// AppendTableToBucket always keeps the table, otherwise its data would be lost.
+// picking a bucket whose size range fits the table is up to the BucketManager (see calculateLevel)
 func (b *Bucket) AppendTableToBucket(table *SSTable) {
-	if table.totalSize < b.minTableSize {
-		return
-	}
-
-	if len(b.tables) == 0 {
-		b.tables = append(b.tables, *table)
-		b.calculateAvgBucketSize()
-		return
-	}
-
-	lowerSizeThreshold := uint32(b.bucketLow * float32(b.avgBucketSize))   // 50% lower than avg size
-	higherSizeThreshold := uint32(b.bucketHigh * float32(b.avgBucketSize)) // 50% higher than avg size
-
-	// calculate low and high thresholds-- this avoids a skewed distribution of SSTable sizes within a given bucket
-	if lowerSizeThreshold <= table.totalSize && table.totalSize <= higherSizeThreshold {
-		b.tables = append(b.tables, *table)
-	} else {
-		fmt.Println("Could not append table. Out of range")
-	}
+	b.tables = append(b.tables, table)
 
 	//update avg size on each append
 	b.calculateAvgBucketSize()
@@ -85,46 +85,25 @@ func (b *Bucket) NeedsCompaction(minNumTables, maxNumTables int) bool {
 	return len(b.tables) >= minNumTables && len(b.tables) <= maxNumTables
 }
 
-func (b *Bucket) TriggerCompaction() *SSTable {
+// TriggerCompaction merges every table in the bucket into one. storeRangeTombstones are the range tombstones of
+// the whole store, they decide which older versions merge operands can still be folded onto.
+// otherTables are the tables outside the bucket, a tombstone has to stay as long as one of them may hold the key
+func (b *Bucket) TriggerCompaction(opts compactionOptions, storeRangeTombstones []Record, otherTables []*SSTable) (*SSTable, error) {
 	var allSortedRuns [][]Record
+	var allRangeTombstones []Record
 
 	for i := range b.tables {
 		var currSortedRun []Record
-		var currOffset uint32
-
-		// Set seek to 0 for every table otherwise the seek position will be at the end of each file by default
-		// I assume because of previous reading done on said files?
-		b.tables[i].dataFile.Seek(int64(currOffset), 0)
-		for {
-			currEntry := make([]byte, headerSize)
-			_, err := io.ReadFull(b.tables[i].dataFile, currEntry)
-			if errors.Is(err, io.EOF) {
-				break
-			}
-
-			h := &Header{}
-			h.decodeHeader(currEntry)
-
-			// move the cursor so we can read the rest of the record
-			currOffset += headerSize
-			b.tables[i].dataFile.Seek(int64(currOffset), 0)
-			// set up []byte for the rest of the record
-			currRecord := make([]byte, h.KeySize+h.ValueSize)
-			if _, err := io.ReadFull(b.tables[i].dataFile, currRecord); err != nil {
-				fmt.Println("READFULL ERR:", err)
-				break
-			}
-			// append both []byte together in order to decode as a whole
-			currEntry = append(currEntry, currRecord...) // full size of the record
-			r := &Record{}
-			r.DecodeKV(currEntry)
-
-			currSortedRun = append(currSortedRun, *r)
 
-			currOffset += r.Header.KeySize + r.Header.ValueSize
-			b.tables[i].dataFile.Seek(int64(currOffset), 0)
+		err := b.tables[i].scanRange(nil, nil, func(r Record) bool {
+			currSortedRun = append(currSortedRun, r)
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("compaction read err: %w", err)
 		}
 		allSortedRuns = append(allSortedRuns, currSortedRun)
+		allRangeTombstones = append(allRangeTombstones, b.tables[i].rangeTombstones...)
 	}
 
 	// * now we have all our sorted runs
@@ -142,75 +121,126 @@ func (b *Bucket) TriggerCompaction() *SSTable {
 		finalSortedRun = append(finalSortedRun, ele.(Record))
 	}
 
-	filterAndDeleteTombstones(&finalSortedRun)
-	removeOutdatedEntires(&finalSortedRun)
-
-	// once the new merged table gets created, add it to a new bucket
-	mergedSSTable := InitSSTableOnDisk("storage", &finalSortedRun)
+	removeOutdatedEntires(&finalSortedRun, opts, storeRangeTombstones, otherTables)
+	var horizon uint64 = math.MaxUint64
+	if opts.tombstoneHorizon != nil {
+		horizon = opts.tombstoneHorizon()
+	}
+	dropRangeDeletedEntries(&finalSortedRun, allRangeTombstones)
+	// a record a filter drops becomes a tombstone, which goes away below like any other once it's safe to
+	applyCompactionFilters(&finalSortedRun, opts)
+	filterAndDeleteTombstones(&finalSortedRun, otherTables, horizon)
+
+	// once the new merged table gets created, add it to a new bucket.
+	// range tombstones are carried over since they may still cover older records in other tables
+	mergedSSTable, err := InitSSTableOnDisk(opts.fs, opts.dir, &finalSortedRun, &allRangeTombstones, opts.encryption)
+	if err != nil {
+		return nil, err
+	}
 
-	// ! now we need to delete the old sstables from disk to free up space
-	deleteOldSSTables(&b.tables)
-	return mergedSSTable
+	// the old tables can go once the reads still using them are done, see version.go
+	for _, table := range b.tables {
+		table.markObsolete()
+	}
+	b.tables = []*SSTable{}
+	return mergedSSTable, nil
 }
 
-func filterAndDeleteTombstones(sortedRun *[]Record) {
-	var collectedTombstones []string
+func filterAndDeleteTombstones(sortedRun *[]Record, otherTables []*SSTable, horizon uint64) {
+	collectedTombstones := make(map[string]bool)
 
-	// collect all tombstones to delete
+	// collect all tombstones to delete, unless dropping them would bring back an older version in another table,
+	// or in the WAL if a crash makes it replay writes the tables already hold
 	for i := range *sortedRun {
-		if (*sortedRun)[i].Header.Tombstone == 1 {
-			collectedTombstones = append(collectedTombstones, (*sortedRun)[i].Key)
+		r := (*sortedRun)[i]
+		if r.Header.Tombstone == 1 && r.Header.TimeStamp < horizon && !anyMayContain(otherTables, r.Key) {
+			collectedTombstones[string((*sortedRun)[i].Key)] = true
 		}
 	}
 
 	// now look at every key in collectedTombstones and delete it from the sorted run
-	for i := 0; i < len(*sortedRun); {
-		if slices.Contains(collectedTombstones, (*sortedRun)[i].Key) {
-			if i < len(*sortedRun)-1 {
-				*sortedRun = slices.Delete(*sortedRun, i, i+1)
-			} else {
-				*sortedRun = (*sortedRun)[:len(*sortedRun)-1]
-			}
-		} else {
-			i++
-		}
-	}
+	*sortedRun = slices.DeleteFunc(*sortedRun, func(r Record) bool {
+		return collectedTombstones[string(r.Key)]
+	})
 }
 
-func removeOutdatedEntires(sortedRun *[]Record) {
-	// take every entry -> append to a map, if value for a given map key is > 1,
-	// then sort the value (which will be a slice) & delete all values except the last 1 in the overall slice
-
-	var tempMap = make(map[string][]Record)
-
-	for i := range *sortedRun {
-		tempMap[(*sortedRun)[i].Key] = append(tempMap[(*sortedRun)[i].Key], (*sortedRun)[i])
+// dropRangeDeletedEntries removes every record that is covered by a newer range tombstone
+func dropRangeDeletedEntries(sortedRun *[]Record, rangeTombstones []Record) {
+	if len(rangeTombstones) == 0 {
+		return
 	}
+	*sortedRun = slices.DeleteFunc(*sortedRun, func(r Record) bool {
+		return newestCoveringTimestamp(rangeTombstones, r.Key) > r.Header.TimeStamp
+	})
+}
 
-	for _, v := range tempMap {
-		if len(v) > 1 {
-			slices.SortFunc(v, func(a, b Record) int {
-				return cmp.Compare(a.Header.TimeStamp, b.Header.TimeStamp)
-			})
+func removeOutdatedEntires(sortedRun *[]Record, opts compactionOptions, rangeTombstones []Record, otherTables []*SSTable) {
+	// the run is sorted by key, so every version of a key sits next to each other.
+	// only keep the version with the newest timestamp for each key, unless it's a merge operand:
+	// then the older versions get folded into it
+	deduped := make([]Record, 0, len(*sortedRun))
 
-			for i := 0; i < len(v)-1; i++ {
-				idx := slices.Index(*sortedRun, v[i])
-				*sortedRun = slices.Delete(*sortedRun, idx, idx+1)
+	for start := 0; start < len(*sortedRun); {
+		end := start + 1
+		for end < len(*sortedRun) && bytes.Equal((*sortedRun)[end].Key, (*sortedRun)[start].Key) {
+			end++
+		}
+		versions := slices.Clone((*sortedRun)[start:end])
+		sortNewestFirst(versions)
+
+		history := versions
+		var err error
+		if versions[0].isMergeOperand() {
+			// tables outside the bucket may hold versions from in between the ones here, so the operands are folded
+			// over the key's whole history. the result replaces every older version, even the ones in other tables
+			var older []Record
+			if older, err = olderVersions(otherTables, versions[0]); err == nil {
+				history = append(slices.Clone(versions), older...)
+				// nothing is older than that, a key without a base value has no value
+				history = append(history, Record{Key: versions[0].Key, Header: Header{Tombstone: 1}})
+				sortNewestFirst(history)
 			}
 		}
+		var collapsed Record
+		if err == nil {
+			collapsed, err = collapseVersions(history, rangeTombstones, opts.mergeOperators(), opts.resolveValue, false)
+		}
+		if err != nil {
+			// couldn't read a base value, keep the versions as they are rather than losing any of them
+			fmt.Println("compaction merge err:", err)
+			deduped = append(deduped, versions...)
+		} else {
+			deduped = append(deduped, collapsed)
+		}
+		start = end
 	}
+
+	*sortedRun = deduped
 }
 
-func deleteOldSSTables(tables *[]SSTable) error {
-	for i := range *tables {
-		files := []string{(*tables)[i].dataFile.Name(), (*tables)[i].indexFile.Name(), (*tables)[i].bloomFilter.file.Name()}
+func anyMayContain(tables []*SSTable, key []byte) bool {
+	for _, table := range tables {
+		if table.mayContain(key) {
+			return true
+		}
+	}
+	return false
+}
 
-		for _, file := range files {
-			if err := os.Remove(file); err != nil {
-				return err
-			}
+// olderVersions returns the versions of record's key in tables that aren't newer than record.
+// that includes copies of record itself, one of them may already have been folded by an earlier compaction
+func olderVersions(tables []*SSTable, record Record) ([]Record, error) {
+	var versions []Record
+	for _, table := range tables {
+		v, err := table.Get(record.Key)
+		if errors.Is(err, utils.ErrKeyNotFound) || errors.Is(err, utils.ErrKeyNotWithinTable) || errors.Is(err, io.EOF) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if v.Header.TimeStamp <= record.Header.TimeStamp {
+			versions = append(versions, v)
 		}
 	}
-	*tables = []SSTable{} // empty the slice
-	return nil
+	return versions, nil
 }
@@ -1,72 +1,236 @@
 package internal
 
-import "github.com/jateen67/kv/utils"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/jateen67/kv/utils"
+)
 
 type BucketManager struct {
 	buckets           map[int]*Bucket // maybe make map?
 	highestLvl        int
 	minTableThreshold int
 	maxTableThreshold int
+	dir               string // where the store's tables and manifest live
+	compaction        compactionOptions
+
+	versionMu sync.Mutex
+	current   *version              // the tables new reads see
+	versions  map[*version]struct{} // every version that hasn't been released yet
+	// versions whose manifest write failed, it may still have reached the disk
+	unconfirmed []*version
 }
 
 // InitBucketManager Initializes manager + first level of buckets
-func InitBucketManager() *BucketManager {
+func InitBucketManager(dir string) *BucketManager {
 	manager := &BucketManager{
 		buckets:           make(map[int]*Bucket),
 		highestLvl:        1,
 		minTableThreshold: 4,
 		maxTableThreshold: 12,
+		dir:               dir,
+		versions:          make(map[*version]struct{}),
 	}
 	manager.buckets[1] = InitEmptyBucket()
+	manager.setCurrentVersion(newVersion(nil))
 
 	return manager
 }
 
-func (bm *BucketManager) InsertTable(table *SSTable) {
+// InsertTable adds a freshly written table to the store, it's only durably part of it once this returns without error
+func (bm *BucketManager) InsertTable(table *SSTable) error {
 	var levelToAppend = 1
 
 	for currLvl := bm.highestLvl; currLvl > 0; currLvl-- {
 		bkt := bm.buckets[currLvl]
 
 		calculatedLevelReturn := calculateLevel(bkt, table)
-		levelToAppend = currLvl + calculatedLevelReturn
 
-		if calculatedLevelReturn == -1 {
+		// too small for this bucket, try the one below. the lowest bucket takes whatever is left
+		if calculatedLevelReturn == -1 && currLvl > 1 {
 			continue
 		}
 
-		if calculatedLevelReturn == 0 {
-			bm.buckets[currLvl].AppendTableToBucket(table)
-		} else { // calculatedLevelReturn == 1
+		levelToAppend = currLvl
+		if calculatedLevelReturn == 1 && currLvl == bm.highestLvl {
+			// bigger than anything we have so far, start a new level
+			levelToAppend = currLvl + 1
 			bm.buckets[levelToAppend] = InitEmptyBucket()
-			bm.buckets[levelToAppend].AppendTableToBucket(table)
 			bm.highestLvl++
 		}
+		bm.buckets[levelToAppend].AppendTableToBucket(table)
 		break
 	}
 
 	if bm.shouldCompact(levelToAppend) {
-		bm.compact(levelToAppend)
+		if err := bm.compact(levelToAppend); err != nil {
+			return err
+		}
 	}
+	return bm.installVersion()
 }
 
-func (bm *BucketManager) RetrieveKey(key *string) (string, error) {
-	// start at highest level first
-	for lvl := bm.highestLvl; lvl > 0; lvl-- {
-		for _, table := range bm.buckets[lvl].tables {
-			return table.Get(*key)
+// RetrieveKey returns the newest version of the key across every table (which may be a tombstone)
+func (bm *BucketManager) RetrieveKey(key []byte) (Record, error) {
+	versions, err := bm.RetrieveAllVersions(key)
+	if err != nil {
+		return Record{}, err
+	}
+	if len(versions) == 0 {
+		return Record{}, utils.ErrKeyNotFound
+	}
+	return versions[0], nil
+}
+
+// RetrieveAllVersions returns every version of the key across every table, newest first.
+// a table holds at most one version of a key, but the same key can live in several tables
+func (bm *BucketManager) RetrieveAllVersions(key []byte) ([]Record, error) {
+	var versions []Record
+
+	v := bm.pinVersion()
+	defer v.release(bm)
+	for _, table := range v.tables {
+		record, err := table.Get(key)
+		if errors.Is(err, utils.ErrKeyNotFound) || errors.Is(err, utils.ErrKeyNotWithinTable) || errors.Is(err, io.EOF) {
+			continue
+		} else if err != nil {
+			return nil, err
 		}
+		versions = append(versions, record)
 	}
-	return "<!not_found>", utils.ErrKeyNotFound
+
+	sortNewestFirst(versions)
+	return versions, nil
 }
 
-func (bm *BucketManager) compact(level int) {
+// NewestRangeTombstone returns the timestamp of the newest range tombstone covering key across every table, 0 if none
+func (bm *BucketManager) NewestRangeTombstone(key []byte) uint64 {
+	var newest uint64
+	v := bm.pinVersion()
+	defer v.release(bm)
+	for _, table := range v.tables {
+		newest = max(newest, newestCoveringTimestamp(table.rangeTombstones, key))
+	}
+	return newest
+}
+
+// AllRangeTombstones returns the range tombstones of every table
+func (bm *BucketManager) AllRangeTombstones() []Record {
+	var rangeTombstones []Record
+	v := bm.pinVersion()
+	defer v.release(bm)
+	for _, table := range v.tables {
+		rangeTombstones = append(rangeTombstones, table.rangeTombstones...)
+	}
+	return rangeTombstones
+}
+
+// ScanRange calls fn for every record in [start, end) in every table, different versions of a key may show up more than once.
+// the tables are pinned for the whole scan, so a compaction running in the meantime doesn't pull them out from under it
+func (bm *BucketManager) ScanRange(start, end []byte, fn func(Record) bool) error {
+	v := bm.pinVersion()
+	defer v.release(bm)
+	for _, table := range v.tables {
+		if err := table.scanRange(start, end, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReferencesBlobFile reports whether any table still holds a pointer into the given blob file,
+// obsolete tables that a read still has pinned count too
+func (bm *BucketManager) ReferencesBlobFile(id uint32) bool {
+	for _, table := range bm.liveTables() {
+		if _, ok := table.blobRefs[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// BlobReferences returns how many bytes of values the current tables point to in every blob file. the same value
+// counts once for every table holding a version pointing to it
+func (bm *BucketManager) BlobReferences() map[uint32]uint32 {
+	refs := make(map[uint32]uint32)
+	v := bm.pinVersion()
+	defer v.release(bm)
+	for _, table := range v.tables {
+		for id, size := range table.blobRefs {
+			refs[id] += size
+		}
+	}
+	return refs
+}
+
+func (bm *BucketManager) compact(level int) error {
 	bkt := bm.buckets[level]
-	mergedTable := bkt.TriggerCompaction() // ONLY triggers if threshold is reached in the bucket
+	// merge operands may only be folded onto a base value that no range tombstone (in any table) has deleted since.
+	// the buckets rather than the current version, the table that triggered this isn't in a version yet
+	var rangeTombstones []Record
+	var otherTables []*SSTable
+	for _, table := range bm.bucketTables() {
+		rangeTombstones = append(rangeTombstones, table.rangeTombstones...)
+		if !slices.Contains(bkt.tables, table) {
+			otherTables = append(otherTables, table)
+		}
+	}
+	mergedTable, err := bkt.TriggerCompaction(bm.compaction, rangeTombstones, otherTables) // ONLY triggers if threshold is reached in the bucket
+	if err != nil {
+		// the bucket keeps its tables, compaction is retried on the next insert
+		fmt.Println("compaction err:", err)
+		return nil
+	}
 
 	if mergedTable != nil {
-		bm.InsertTable(mergedTable)
+		return bm.InsertTable(mergedTable)
+	}
+	return nil
+}
+
+// dropRecords rewrites every table holding a record drop returns true for without it, a table left empty goes
+// entirely. the old tables can go once the reads still using them are done
+func (bm *BucketManager) dropRecords(drop func(Record) bool) error {
+	for lvl := bm.highestLvl; lvl > 0; lvl-- {
+		bkt := bm.buckets[lvl]
+		var kept []*SSTable
+		for _, table := range bkt.tables {
+			var records []Record
+			dropped := false
+			err := table.scanRange(nil, nil, func(r Record) bool {
+				if drop(r) {
+					dropped = true
+				} else {
+					records = append(records, r)
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+			if !dropped {
+				kept = append(kept, table)
+				continue
+			}
+			if len(records) > 0 || len(table.rangeTombstones) > 0 {
+				rewritten, err := InitSSTableOnDisk(bm.compaction.fs, bm.dir, &records, &table.rangeTombstones, bm.compaction.encryption)
+				if err != nil {
+					return err
+				}
+				kept = append(kept, rewritten)
+			}
+			table.markObsolete()
+		}
+		bkt.tables = kept
+		if len(kept) > 0 {
+			bkt.calculateAvgBucketSize()
+		}
 	}
+	return bm.installVersion()
 }
 
 func (bm *BucketManager) shouldCompact(level int) bool {
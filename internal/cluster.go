@@ -1,93 +1,283 @@
 package internal
 
 import (
-	"context"
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/jateen67/kv/http"
 	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
 	"github.com/serialx/hashring"
 	"google.golang.org/grpc"
 )
 
 type Node struct {
-	server *grpc.Server
-	ID     string
-	Addr   string
-	Store  *DiskStore
+	server  *grpc.Server
+	ID      string
+	Addr    string
+	Store   *DiskStore        // nil for a node running in a process of its own, see router.go
+	writes  chan replicaWrite // applied to the node one at a time, in the order they were sent, see send
+	done    chan struct{}     // closed once every write sent before stopWriter has been applied
+	down    atomic.Bool       // taken down by StopNode, writes for it become hints
+	gossip  *gossiper         // the node's view of the cluster, see gossip.go
+	cluster *Cluster          // coordinates the client requests the node gets, see kvservice.go
+
+	writesMu sync.RWMutex // held shared while a write is sent, stopWriter waits for those before closing writes
+	stopped  bool
+
+	conn    *grpc.ClientConn // to a node running in a process of its own
+	replica proto.ReplicaServiceClient
+
+	treesMu sync.Mutex
+	trees   map[tokenRange]*merkleTree // the last tree built for each range, see antientropy.go
 }
 
 type Cluster struct {
-	hashRing    *hashring.HashRing
-	Nodes       map[string]*Node
-	accumulator *dataMigrationAccumulator
+	topo              atomic.Pointer[topology] // see topology
+	topologyMu        sync.Mutex               // held while a topology is made out of the current one, see updateTopology
+	membershipMu      sync.Mutex               // held while a node joins or leaves, so rebalances run one at a time
+	accumulator       *dataMigrationAccumulator
+	storeOptions      []StoreOption
+	replicationFactor int     // copies kept of every key, each on a different node
+	readRepairChance  float64 // of a read waiting for the replicas that didn't answer in time, to repair them too
+	hints             *hintLog
+	hintTTL           time.Duration
+	repairInterval    time.Duration // of anti-entropy, 0 only repairs on request
+	repairMu          sync.Mutex
+	siblings          bool      // concurrent writes are kept as siblings instead of the newest one winning, see siblings.go
+	gossip            *gossiper // observes the nodes' gossip, requests avoid the nodes it considers down
+	gossipInterval    time.Duration
+	phiThreshold      float64
+	stop              chan struct{} // closed once the cluster is closed, stops the background work
+	remote            bool          // the nodes run in processes of their own, see router.go
+	ringMembers       []string      // the members gossip had on the ring when the nodes were last updated, see router.go
+	clock             *hybridClock  // timestamps the writes a router coordinates
+	casMu             sync.Mutex    // one compare-and-swap at a time, see CompareAndSwap
+	migrationsMu      sync.Mutex
+	migrations        map[migrationPair]*migration // the latest transfer between every pair of nodes, see migration.go
+	// how far the transfers left unfinished got through every range, see migration.go
+	checkpoints map[migrationPair]map[tokenRange]migrationCheckpoint
+}
+
+// topology is the cluster as requests see it: its nodes, the hash ring over them and the rebalance under way, if any.
+// a published topology is never modified, a node joining or leaving and a rebalance moving on to its next phase publish
+// a new one whole, so a request sees all of the cluster from before the change or all of it from after
+type topology struct {
+	nodes  map[string]*Node
+	ring   *hashring.HashRing
+	change *ringChange
+}
+
+// topology returns the cluster's current topology
+func (c *Cluster) topology() *topology {
+	return c.topo.Load()
+}
+
+// updateTopology publishes the topology update makes out of the current one, one update at a time. update gets a
+// copy of the current topology, the nodes map included, so it can change it as it likes
+func (c *Cluster) updateTopology(update func(t *topology)) {
+	c.topologyMu.Lock()
+	defer c.topologyMu.Unlock()
+	next := *c.topology()
+	next.nodes = maps.Clone(next.nodes)
+	update(&next)
+	c.topo.Store(&next)
+}
+
+// Nodes returns the cluster's nodes by address as of now. the map is shared with the requests under way, it must not be modified
+func (c *Cluster) Nodes() map[string]*Node {
+	return c.topology().nodes
+}
+
+// ClusterOption configures a cluster when it's started
+type ClusterOption func(*Cluster)
+
+// WithStoreOptions applies opts to every node's store, including the ones added later
+func WithStoreOptions(opts ...StoreOption) ClusterOption {
+	return func(c *Cluster) {
+		c.storeOptions = append(c.storeOptions, opts...)
+	}
+}
+
+// WithReplicationFactor keeps n copies of every key, on the n distinct nodes that follow the key on the hash ring.
+// a cluster with fewer than n nodes keeps a copy on every node
+func WithReplicationFactor(n int) ClusterOption {
+	return func(c *Cluster) {
+		c.replicationFactor = max(n, 1)
+	}
+}
+
+// WithHintTTL drops hints for a node that stays down longer than ttl
+func WithHintTTL(ttl time.Duration) ClusterOption {
+	return func(c *Cluster) {
+		c.hintTTL = ttl
+	}
+}
+
+// WithAntiEntropyInterval runs anti-entropy between replicas every interval, 0 only runs it through Repair
+func WithAntiEntropyInterval(interval time.Duration) ClusterOption {
+	return func(c *Cluster) {
+		c.repairInterval = interval
+	}
+}
+
+// WithReadRepairChance sets how often (0 to 1) a read waits in the background for the replicas it didn't need an
+// answer from, and repairs them if they're stale. the replicas a read did wait for are always repaired
+func WithReadRepairChance(chance float64) ClusterOption {
+	return func(c *Cluster) {
+		c.readRepairChance = chance
+	}
+}
+
+// WithSiblings keeps concurrent writes to a key as siblings for the client to resolve, instead of letting the
+// newest one win
+func WithSiblings() ClusterOption {
+	return func(c *Cluster) {
+		c.siblings = true
+	}
 }
 
 var nodeCounter uint32 = 1
 var currentNodePort uint32 = 11000
 
 func (c *Cluster) initNodes(numOfNodes uint32) {
-	c.Nodes = make(map[string]*Node)
+	nodes := make(map[string]*Node)
 	var nodeAddrs []string
 	c.accumulator = &dataMigrationAccumulator{}
 
 	for i := 0; i < int(numOfNodes); i++ {
-		store, _ := newStore(nodeCounter)
+		store, _ := newStore(nodeCounter, c.storeOptions...)
 		node := Node{
-			ID:    fmt.Sprintf("node-%d", nodeCounter),
-			Addr:  fmt.Sprintf(":%d", currentNodePort),
-			Store: store,
+			ID:      fmt.Sprintf("node-%d", nodeCounter),
+			Addr:    fmt.Sprintf(":%d", currentNodePort),
+			Store:   store,
+			cluster: c,
 		}
 
-		c.Nodes[node.Addr] = &node
-		node.server = StartGRPCServer(node.Addr, &node)
+		nodes[node.Addr] = &node
 		atomic.AddUint32(&currentNodePort, 1)
 		atomic.AddUint32(&nodeCounter, 1)
 		nodeAddrs = append(nodeAddrs, node.Addr)
 	}
+	for _, node := range nodes {
+		c.startGossip(node, nodeAddrs)
+		node.server = StartGRPCServer(node.Addr, node)
+		node.startWriter()
+	}
 
-	c.hashRing = hashring.New(nodeAddrs)
+	c.updateTopology(func(t *topology) {
+		t.nodes = nodes
+		t.ring = hashring.New(nodeAddrs)
+	})
 	c.accumulator = &dataMigrationAccumulator{}
 }
 
 func (c *Cluster) AddNode() {
+	if c.remote {
+		fmt.Println("nodes join by starting up with seeds, see cmd/kvnode")
+		return
+	}
+	c.membershipMu.Lock()
+	defer c.membershipMu.Unlock()
 	fmt.Println("adding new node @ address", currentNodePort)
-	store, _ := newStore(nodeCounter)
+	store, _ := newStore(nodeCounter, c.storeOptions...)
 	node := Node{
-		ID:    fmt.Sprintf("node-%d", nodeCounter),
-		Addr:  fmt.Sprintf(":%d", currentNodePort),
-		Store: store,
+		ID:      fmt.Sprintf("node-%d", nodeCounter),
+		Addr:    fmt.Sprintf(":%d", currentNodePort),
+		Store:   store,
+		cluster: c,
 	}
-	c.Nodes[node.Addr] = &node
+	c.startGossip(&node, c.nodeAddrs())
 	node.server = StartGRPCServer(node.Addr, &node)
+	node.startWriter()
 	atomic.AddUint32(&nodeCounter, 1)
 	atomic.AddUint32(&currentNodePort, 1)
+	// the node holds nothing yet, it only becomes a replica once the rebalance moves the ring
+	c.updateTopology(func(t *topology) {
+		t.nodes[node.Addr] = &node
+	})
 
 	// refresh the hash ring w/ new node
-	c.hashRing = c.hashRing.AddNode(node.Addr)
-	c.rebalance()
+	c.rebalance(c.topology().ring.AddNode(node.Addr), nil)
 }
 
 func (c *Cluster) RemoveNode(addr string) {
+	if c.remote {
+		c.decommission(addr)
+		return
+	}
+	c.membershipMu.Lock()
+	defer c.membershipMu.Unlock()
 	addr = fmt.Sprintf(":%s", addr)
-	_, ok := c.Nodes[addr]
+	node, ok := c.Nodes()[addr]
 	if ok {
-		c.hashRing = c.hashRing.RemoveNode(addr)
-		c.rebalance()
-		c.Nodes[addr].server.GracefulStop()
-		delete(c.Nodes, addr)
+		c.rebalance(c.topology().ring.RemoveNode(addr), nil)
+		if !node.down.Load() {
+			node.gossip.close()
+		}
+		// no more writes are doubled to it, see rebalance.go
+		node.down.Store(true)
+		c.gossip.leave(addr, node.gossip.state())
+		node.server.GracefulStop()
+		node.stopWriter()
+		c.updateTopology(func(t *topology) {
+			delete(t.nodes, addr)
+		})
 		fmt.Printf("node @ addr %s successfully deleted", addr)
 	} else {
 		fmt.Printf("node @ addr %s not found", addr)
 	}
 }
 
+// StopNode takes a node down without removing it from the cluster, e.g. to try out hinted handoff.
+// it keeps its place on the hash ring, writes for it are kept as hints until StartNode
+func (c *Cluster) StopNode(addr string) {
+	addr = fmt.Sprintf(":%s", addr)
+	if c.remote {
+		fmt.Println("a node running in a process of its own is stopped by stopping the process")
+		return
+	}
+	node, ok := c.Nodes()[addr]
+	if !ok || node.down.Load() {
+		fmt.Printf("node @ addr %s not found or already down\n", addr)
+		return
+	}
+	node.down.Store(true)
+	node.drainWrites()
+	node.gossip.close()
+	node.server.Stop()
+	fmt.Printf("node @ addr %s is down\n", addr)
+}
+
+// StartNode brings a node taken down by StopNode back up and hands it the hints stored for it in the meantime
+func (c *Cluster) StartNode(addr string) {
+	addr = fmt.Sprintf(":%s", addr)
+	if c.remote {
+		fmt.Println("a node running in a process of its own is started by starting the process")
+		return
+	}
+	node, ok := c.Nodes()[addr]
+	if !ok || !node.down.Load() {
+		fmt.Printf("node @ addr %s not found or not down\n", addr)
+		return
+	}
+	c.startGossip(node, c.nodeAddrs())
+	node.server = StartGRPCServer(node.Addr, node)
+	node.down.Store(false)
+	fmt.Printf("node @ addr %s is back up\n", addr)
+	c.deliverHints()
+}
+
 var defaultPort = ":8080"
 
 func (c *Cluster) Open() {
@@ -112,53 +302,143 @@ func (c *Cluster) Open() {
 
 func (c *Cluster) Close() {
 	fmt.Println("Closing entire cluster..")
-	for _, node := range c.Nodes {
+	close(c.stop)
+	// an onUp call under way may still be delivering hints
+	c.gossip.close()
+	if err := c.hints.close(); err != nil {
+		fmt.Println(err)
+	}
+	for _, node := range c.Nodes() {
+		node.stopWriter()
+		if node.Store == nil {
+			node.conn.Close()
+			continue
+		}
+		if !node.down.Load() {
+			node.gossip.close()
+		}
 		node.server.GracefulStop()
+		node.Store.Close()
 	}
 }
 
-func (c *Cluster) Get(key string) (string, error) {
+// Get reads the key from its replicas, returning once level's worth of them answered. the newest version among
+// the answers wins, a delete included. also returns how many replicas answered
+func (c *Cluster) Get(key []byte, level utils.ConsistencyLevel) ([]byte, int, error) {
+	if c.siblings {
+		values, _, answered, err := c.GetSiblings(key, level)
+		if err != nil {
+			return nil, answered, err
+		}
+		if len(values) > 1 {
+			return nil, answered, fmt.Errorf("%w: %d values", utils.ErrSiblings, len(values))
+		}
+		return values[0], answered, nil
+	}
 	fmt.Printf("key = %s\t", key)
-	nodeAddr, _ := c.hashRing.GetNode(key) // get which node this key should be on
-	node, ok := c.Nodes[nodeAddr]
-
-	if ok {
-		fmt.Printf("found @ node addr = %s\n", nodeAddr)
-		return node.Store.Get(key)
+	record, answered, err := c.readReplicas(key, level)
+	if err != nil {
+		return nil, answered, err
+	}
+	fmt.Printf("found @ %d node(s), consistency = %s\n", answered, level)
+	if record.Header.Tombstone == 1 {
+		return nil, answered, utils.ErrKeyNotFound
 	}
-	return "", nil
+	return record.Value, answered, nil
 }
 
-func (c *Cluster) Set(key, value string) error {
-	nodeAddr, _ := c.hashRing.GetNode(key) // get which node this key should be on
+// Set writes the key to all of its replicas, returning once level's worth of them acknowledged the write.
+// also returns how many replicas acknowledged. with WithSiblings it adds a sibling, see SetWithContext
+func (c *Cluster) Set(key, value []byte, level utils.ConsistencyLevel) (int, error) {
+	if c.siblings {
+		return c.SetWithContext(key, value, nil, level)
+	}
+	if len(key) == 0 {
+		return 0, utils.ErrEmptyKey
+	}
 	fmt.Printf("key = %s\t", key)
-	fmt.Printf("added @ node addr = %s\n", nodeAddr)
-	node, ok := c.Nodes[nodeAddr]
+	fmt.Printf("added @ node addrs = %v, consistency = %s\n", c.replicasFor(key), level)
+	return c.writeReplicas(c.newRecord(key, value, 0, 0), level)
+}
 
-	if ok {
-		return node.Store.Set(&key, &value)
+// Delete deletes the key on all of its replicas. with WithSiblings it only deletes the siblings a read at level sees
+func (c *Cluster) Delete(key []byte, level utils.ConsistencyLevel) (int, error) {
+	if len(key) == 0 {
+		return 0, utils.ErrEmptyKey
 	}
-	return nil
+	if c.siblings {
+		_, causalContext, answered, err := c.GetSiblings(key, level)
+		if err != nil && !errors.Is(err, utils.ErrKeyNotFound) {
+			return answered, err
+		}
+		return c.DeleteWithContext(key, causalContext, level)
+	}
+	fmt.Printf("deleted %s @ node addrs = %v, consistency = %s\n", key, c.replicasFor(key), level)
+	return c.writeReplicas(c.newRecord(key, nil, 1, 0), level)
 }
 
-func (c *Cluster) Delete(key string) error {
-	nodeAddr, _ := c.hashRing.GetNode(key) // get which node this key should be on
-	node, ok := c.Nodes[nodeAddr]
+// Merge applies operand to the key's value with the named merge operator (see MergeOperator) on every replica of the
+// key, returning once level's worth of them acknowledged it. also returns how many did. replicas that are down get the
+// operand once they're back like any other write, so a merge that fails for lack of replicas may still be applied
+func (c *Cluster) Merge(key []byte, operator string, operand []byte, level utils.ConsistencyLevel) (int, error) {
+	if len(key) == 0 {
+		return 0, utils.ErrEmptyKey
+	}
+	if c.siblings {
+		return 0, utils.ErrMergeWithSiblings
+	}
+	fmt.Printf("merged %s (%s) @ node addrs = %v, consistency = %s\n", key, operator, c.replicasFor(key), level)
+	value := encodeMergeOperands([]mergeOperand{{operator: operator, value: operand}})
+	return c.writeReplicas(c.newRecord(key, value, 0, flagMergeOperand), level)
+}
 
-	if ok {
-		fmt.Printf("deleted %s @ node addr = %s\n", key, nodeAddr)
-		return node.Store.Delete(key)
+// DeleteRange deletes [start, end) on every node, a key range is spread over the whole ring. returns once level's worth
+// of the nodes acknowledged it, along with how many did
+func (c *Cluster) DeleteRange(start, end []byte, level utils.ConsistencyLevel) (int, error) {
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return 0, utils.ErrInvalidRange
 	}
+	fmt.Printf("deleted range [%s, %s) @ %d node(s), consistency = %s\n", start, end, len(c.Nodes()), level)
+	return c.writeRangeTombstone(c.newRecord(start, end, 1, flagRangeTombstone), level)
+}
 
+// DeletePrefix deletes every key starting with prefix, an empty prefix deletes everything
+func (c *Cluster) DeletePrefix(prefix []byte, level utils.ConsistencyLevel) (int, error) {
+	return c.DeleteRange(prefix, prefixEnd(prefix), level)
+}
+
+// prefixEnd returns the smallest key that is greater than every key starting with prefix, nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := slices.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
 	return nil
 }
 
 func (c *Cluster) PrintDiagnostics() {
 	fmt.Println("DIAGNOSTICS:")
-	for _, v := range c.Nodes {
+	for _, v := range c.Nodes() {
+		if v.Store == nil {
+			continue
+		}
 		fmt.Printf("%s", v.ID+" @ address "+v.Addr+" , num keys: ")
 		v.Store.LengthOfMemtable()
 	}
+	stats := c.HintStats()
+	fmt.Printf("hints: %d stored, %d delivered, %d expired, pending by node addr = %v\n", stats.Stored, stats.Delivered, stats.Expired, stats.Pending)
+	for _, m := range c.Members() {
+		fmt.Printf("member %s @ address %s: %s, heartbeat = %d, phi = %.1f\n", m.ID, m.Addr, m.Status, m.Heartbeat, m.Phi)
+	}
+	if change := c.topology().change; change != nil {
+		fmt.Printf("rebalance: %s, %d key(s) left on their old replicas\n", change.phase, len(change.keys))
+	}
+	for _, m := range c.Migrations() {
+		fmt.Printf("migration %s -> %s: %d/%d record(s), %d/%d byte(s), %d attempt(s), done = %t\n", m.Source, m.Dest, m.Records, m.TotalRecords, m.Bytes, m.TotalBytes, m.Attempts, m.Done)
+	}
 }
 
 // meant to keep track of every single group of records that needs to be migrated
@@ -188,57 +468,16 @@ func (d *dataMigrationAccumulator) ClearAccumulator() {
 
 func (c *Cluster) getAllNodeAddrs() []string {
 	var addrs []string
-	for addr, _ := range c.Nodes {
+	for addr, _ := range c.Nodes() {
 		addrs = append(addrs, addr)
 	}
 	return addrs
 }
 
-func (c *Cluster) rebalance() {
-	// go through every key in the system and see if the key's GetNode pos doesn't match up
-	c.accumulator.Init(c.getAllNodeAddrs())
-
-	for _, node := range c.Nodes {
-		pairsMap := node.Store.memtable.GetAllKVPairs()
-
-		for key, record := range pairsMap {
-			newAddr, _ := c.hashRing.GetNode(key)
-
-			if newAddr != node.Addr {
-				c.accumulator.Append(node.Addr, newAddr, &record)
-				node.Store.memtable.data.Remove(key)
-			}
-		}
-	}
-
-	for srcNode, v := range c.accumulator.data {
-		for destNode, pairs := range v {
-			if len(pairs) > 0 {
-				c.transferDataBetweenNodes(srcNode, destNode, &pairs)
-			}
-		}
-	}
-	c.accumulator.ClearAccumulator()
-}
-
-func (c *Cluster) transferDataBetweenNodes(srcNodeAddr string, destNodeServerAddr string, data *[]Record) {
-	client, conn := StartGRPCClient(destNodeServerAddr)
-	defer conn.Close()
-
-	kvPairs := convertRecordsToProtoKVPairs(data)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	res, err := client.MigrateKeyValuePairs(ctx, &proto.KeyValueMigrationRequest{
-		SourceNodeAddr: srcNodeAddr,
-		DestNodeAddr:   destNodeServerAddr,
-		KvPairs:        kvPairs,
-	})
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	fmt.Println(res)
+// transferDataBetweenNodes streams the records to the destination, returns the keys it confirmed storing. the ones
+// it couldn't get through are hinted to the destination, see migration.go
+func (c *Cluster) transferDataBetweenNodes(srcNodeAddr string, destNodeServerAddr string, data *[]Record) map[string]bool {
+	return c.migrate(srcNodeAddr, destNodeServerAddr, *data)
 }
 
 func convertProtoRecordToStoreRecord(record *proto.Record) *Record {
@@ -246,6 +485,7 @@ func convertProtoRecordToStoreRecord(record *proto.Record) *Record {
 		Header: Header{
 			CheckSum:  record.Header.Checksum,
 			Tombstone: uint8(record.Header.Tombstone),
+			Flags:     uint8(record.Header.Flags),
 			TimeStamp: record.Header.Timestamp,
 			KeySize:   record.Header.KeySize,
 			ValueSize: record.Header.ValueSize,
@@ -256,24 +496,26 @@ func convertProtoRecordToStoreRecord(record *proto.Record) *Record {
 	}
 }
 
+func convertStoreRecordToProtoRecord(rec *Record) *proto.Record {
+	return &proto.Record{
+		Header: &proto.Header{
+			Checksum:  rec.Header.CheckSum,
+			Tombstone: uint32(rec.Header.Tombstone),
+			Flags:     uint32(rec.Header.Flags),
+			Timestamp: rec.Header.TimeStamp,
+			KeySize:   rec.Header.KeySize,
+			ValueSize: rec.Header.ValueSize,
+		},
+		Key:       rec.Key,
+		Value:     rec.Value,
+		TotalSize: rec.TotalSize,
+	}
+}
+
 func convertRecordsToProtoKVPairs(records *[]Record) []*proto.KVPair {
 	var KVPairs []*proto.KVPair
-	for _, rec := range *records {
-		convRec := &proto.KVPair{
-			Record: &proto.Record{
-				Header: &proto.Header{
-					Checksum:  rec.Header.CheckSum,
-					Tombstone: uint32(rec.Header.Tombstone),
-					Timestamp: rec.Header.TimeStamp,
-					KeySize:   rec.Header.KeySize,
-					ValueSize: rec.Header.ValueSize,
-				},
-				Key:       rec.Key,
-				Value:     rec.Value,
-				TotalSize: rec.TotalSize,
-			},
-		}
-		KVPairs = append(KVPairs, convRec)
+	for i := range *records {
+		KVPairs = append(KVPairs, &proto.KVPair{Record: convertStoreRecordToProtoRecord(&(*records)[i])})
 	}
 	return KVPairs
 }
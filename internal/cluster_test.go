@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jateen67/kv/utils"
+)
+
+// startTestCluster starts a cluster of n nodes serving gRPC on local ports, with every file it writes under a
+// temporary directory. it's closed once the test is over
+func startTestCluster(t *testing.T, n uint32, opts ...ClusterOption) *Cluster {
+	t.Helper()
+	// the stores and the hint log live in the parent of the working directory
+	work := filepath.Join(t.TempDir(), "work")
+	if err := os.Mkdir(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(work)
+	cluster, err := NewCluster(n, append([]ClusterOption{WithAntiEntropyInterval(0)}, opts...)...)
+	if err != nil {
+		t.Fatalf("new cluster: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+// a range delete goes to every node, the ones that are down get it once they're back
+func TestClusterDeleteRange(t *testing.T) {
+	c := startTestCluster(t, 3)
+	for i := range 20 {
+		key := []byte(fmt.Sprintf("song-%02d", i))
+		if _, err := c.Set(key, key, utils.ConsistencyOne); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	var down *Node
+	for _, node := range c.Nodes() {
+		down = node
+		break
+	}
+	c.StopNode(strings.TrimPrefix(down.Addr, ":"))
+
+	n, err := c.DeletePrefix([]byte("song-"), utils.ConsistencyAll)
+	if !errors.Is(err, utils.ErrNotEnoughReplicas) || n != 2 {
+		t.Fatalf("delete at ALL with a node down: got %d, %v, want 2, %v", n, err, utils.ErrNotEnoughReplicas)
+	}
+	if n, err := c.DeleteRange([]byte("song-"), []byte("song-10"), utils.ConsistencyQuorum); err != nil || n != 2 {
+		t.Fatalf("delete at QUORUM with a node down: got %d, %v, want 2, nil", n, err)
+	}
+	if _, err := c.DeleteRange([]byte("b"), []byte("a"), utils.ConsistencyOne); !errors.Is(err, utils.ErrInvalidRange) {
+		t.Fatalf("delete of an empty range: got %v, want %v", err, utils.ErrInvalidRange)
+	}
+	if pending := c.HintStats().Pending[down.Addr]; pending != 2 {
+		t.Fatalf("%d hint(s) for the node that's down, want 2", pending)
+	}
+
+	c.StartNode(strings.TrimPrefix(down.Addr, ":"))
+	for _, node := range c.Nodes() {
+		for i := range 20 {
+			key := []byte(fmt.Sprintf("song-%02d", i))
+			if value, err := node.Store.Get(key); !errors.Is(err, utils.ErrKeyNotFound) {
+				t.Fatalf("get %s @ node addr = %s: got %q, %v, want it deleted", key, node.Addr, value, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type prefixFilter string
+
+func (f prefixFilter) Name() string { return "drop-" + string(f) }
+
+func (f prefixFilter) Filter(key, value []byte) (CompactionFilterDecision, []byte) {
+	if strings.HasPrefix(string(key), string(f)) {
+		return FilterDrop, nil
+	}
+	return FilterKeep, nil
+}
+
+// a record a filter drops mustn't be left behind as a tombstone when nothing older is there for it to delete
+func TestCompactionFilterLeavesNoTombstones(t *testing.T) {
+	store := openTestStore(t, NewMemFS(1))
+	for i := range 1000 {
+		prefix := "live/"
+		if i%2 == 0 {
+			prefix = "expired/"
+		}
+		if err := store.Set([]byte(fmt.Sprintf("%s%04d", prefix, i)), []byte("value")); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	store.mu.Lock()
+	store.rotateMemtable()
+	store.mu.Unlock()
+	if !store.wal.empty() {
+		t.Fatal("the log still holds writes after the flush")
+	}
+
+	// compact every table at once, nothing is left outside the compaction
+	store.RegisterCompactionFilter(prefixFilter("expired/"))
+	bkt := InitEmptyBucket()
+	for _, table := range store.bucketManager.bucketTables() {
+		bkt.AppendTableToBucket(table)
+	}
+	merged, err := bkt.TriggerCompaction(store.bucketManager.compaction, nil, nil)
+	if err != nil {
+		t.Fatalf("compaction: %v", err)
+	}
+
+	if dropped := store.CompactionFilterStats()["drop-expired/"].Dropped; dropped != 500 {
+		t.Errorf("filter dropped %d record(s), want 500", dropped)
+	}
+	var tombstones, live int
+	err = merged.scanRange(nil, nil, func(r Record) bool {
+		if r.Header.Tombstone == 1 {
+			tombstones++
+		} else {
+			live++
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if tombstones > 0 {
+		t.Errorf("%d filtered record(s) left behind as tombstones", tombstones)
+	}
+	if live != 500 {
+		t.Errorf("got %d live record(s), want 500", live)
+	}
+}
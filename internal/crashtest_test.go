@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Crash test -- random writes against a store on MemFS, with power losses in between
+
+Every round runs random operations (with injected I/O errors), then crashes the file system and restarts the
+store. The store has to come back up, and what it recovered must be exactly the state after some prefix of the
+operations it acknowledged, no older than the last flush that succeeded. Values are big enough to end up in blob
+files, and thresholds are tiny so flushes, compactions and WAL batch writes happen all the time.
+*/
+
+type crashTestOptions struct {
+	seed      int64
+	rounds    int     // crash + recovery cycles
+	ops       int     // operations per round
+	keys      int     // size of the key space
+	errorRate float64 // probability of a write, sync or directory change failing while the operations run
+}
+
+func TestCrashRecovery(t *testing.T) {
+	rounds := 20
+	if testing.Short() {
+		rounds = 4
+	}
+	for _, seed := range []int64{1, 2, 3} {
+		for _, errorRate := range []float64{0.01, 0.05} {
+			t.Run(fmt.Sprintf("seed=%d,error-rate=%v", seed, errorRate), func(t *testing.T) {
+				opts := crashTestOptions{seed: seed, rounds: rounds, ops: 500, keys: 40, errorRate: errorRate}
+				if err := runCrashTest(t, opts); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+type crashTest struct {
+	opts  crashTestOptions
+	rng   *rand.Rand
+	fs    *MemFS
+	store *DiskStore
+	model map[string]string
+	// every state the store may recover to, oldest first. the first one is the last state known to be durable
+	history []map[string]string
+}
+
+// runCrashTest returns an error describing the first recovery invariant that got violated
+func runCrashTest(t *testing.T, opts crashTestOptions) error {
+	ct := &crashTest{
+		opts:  opts,
+		rng:   rand.New(rand.NewSource(opts.seed)),
+		fs:    NewMemFS(opts.seed),
+		model: make(map[string]string),
+	}
+	if err := ct.open(); err != nil {
+		return fmt.Errorf("initial open: %w", err)
+	}
+
+	for round := 1; round <= opts.rounds; round++ {
+		ct.history = []map[string]string{maps.Clone(ct.model)}
+
+		ct.fs.InjectErrors(opts.errorRate)
+		for i := 0; i < opts.ops; i++ {
+			if err := ct.step(); err != nil {
+				return fmt.Errorf("round %d, op %d: %w", round, i, err)
+			}
+		}
+		ct.fs.InjectErrors(0)
+
+		// the power loss takes the store's background work down with it
+		ct.store.stopBlobGC()
+		ct.fs.Crash()
+		if err := ct.open(); err != nil {
+			return fmt.Errorf("round %d: store didn't recover: %w", round, err)
+		}
+		if err := ct.checkRecovered(); err != nil {
+			return fmt.Errorf("round %d: %w", round, err)
+		}
+	}
+	t.Logf("%d rounds, %d injected faults, no invariant violated", opts.rounds, ct.fs.InjectedFaults())
+	return nil
+}
+
+// open starts the store on the file system, with thresholds small enough that everything happens often
+func (ct *crashTest) open() error {
+	store, err := newStore(1, WithFS(ct.fs))
+	if err != nil {
+		return err
+	}
+	useTinyThresholds(store)
+	ct.store = store
+	return nil
+}
+
+// useTinyThresholds makes flushes, compactions, blob files and WAL batch writes happen every few operations
+func useTinyThresholds(ds *DiskStore) {
+	ds.flushThreshold = 4 * 1024
+	ds.blobThreshold = 128
+	ds.blobs.maxFileSize = 8 * 1024
+	ds.wal.batchThreshold = 512
+	ds.bucketManager.minTableThreshold = 2
+	ds.bucketManager.maxTableThreshold = 4
+}
+
+func (ct *crashTest) key(i int) string {
+	return fmt.Sprintf("key-%04d", i)
+}
+
+func (ct *crashTest) randomKey() string {
+	return ct.key(ct.rng.Intn(ct.opts.keys))
+}
+
+// randomValue is unique per call, so a recovered value can only come from one write
+func (ct *crashTest) randomValue() string {
+	size := ct.rng.Intn(300)
+	value := fmt.Sprintf("%d-", ct.rng.Int63())
+	for len(value) < size {
+		value += string(rune('a' + ct.rng.Intn(26)))
+	}
+	return value
+}
+
+// step runs one random operation and checks reads against the model
+func (ct *crashTest) step() error {
+	key := ct.randomKey()
+	n := ct.rng.Intn(100)
+	switch {
+	case n < 45:
+		value := ct.randomValue()
+		err := ct.store.Set([]byte(key), []byte(value))
+		return ct.settle(key, value, true, err)
+	case n < 60:
+		err := ct.store.Delete([]byte(key))
+		return ct.settle(key, "", false, err)
+	case n < 70:
+		operand := fmt.Sprintf("+%d", ct.rng.Intn(1000))
+		err := ct.store.Merge([]byte(key), AppendOperatorName, []byte(operand))
+		return ct.settle(key, ct.model[key]+operand, true, err)
+	case n < 73:
+		start, end := ct.randomKey(), ct.randomKey()
+		if start >= end {
+			return nil
+		}
+		if err := ct.store.DeleteRange([]byte(start), []byte(end)); err != nil {
+			return err
+		}
+		for k := range ct.model {
+			if k >= start && k < end {
+				delete(ct.model, k)
+			}
+		}
+		ct.history = append(ct.history, maps.Clone(ct.model))
+		return nil
+	case n < 76:
+		ct.store.mu.Lock()
+		ct.store.immutableMemtables = append(ct.store.immutableMemtables, ct.store.memtable)
+		ct.store.memtable = NewMemtable()
+		ct.store.publishMemtables()
+		err := ct.store.FlushMemtable()
+		ct.store.mu.Unlock()
+		if err == nil {
+			// everything so far is in tables recorded in the manifest, a crash can't lose any of it anymore
+			ct.history = []map[string]string{maps.Clone(ct.model)}
+		}
+		return nil
+	default:
+		return ct.checkKey(key)
+	}
+}
+
+// settle records a write in the model. a write that failed may still have been applied,
+// in that case the store is asked (with faults off) which of the two states it's in
+func (ct *crashTest) settle(key, value string, exists bool, opErr error) error {
+	if opErr != nil && !errors.Is(opErr, errInjectedFault) {
+		return fmt.Errorf("write of %s failed: %w", key, opErr)
+	}
+	if opErr != nil {
+		ct.fs.InjectErrors(0)
+		got, err := ct.store.Get([]byte(key))
+		ct.fs.InjectErrors(ct.opts.errorRate)
+		if err != nil && !errors.Is(err, utils.ErrKeyNotFound) {
+			return fmt.Errorf("read of %s after a failed write: %w", key, err)
+		}
+		if applied := (err == nil) == exists && string(got) == value; !applied {
+			return nil
+		}
+	}
+
+	if exists {
+		ct.model[key] = value
+	} else {
+		delete(ct.model, key)
+	}
+	ct.history = append(ct.history, maps.Clone(ct.model))
+	return nil
+}
+
+func (ct *crashTest) checkKey(key string) error {
+	got, err := ct.store.Get([]byte(key))
+	want, exists := ct.model[key]
+	switch {
+	case err != nil && !errors.Is(err, utils.ErrKeyNotFound):
+		return fmt.Errorf("get %s: %w", key, err)
+	case exists != (err == nil):
+		return fmt.Errorf("get %s: exists = %v, model says %v", key, err == nil, exists)
+	case exists && string(got) != want:
+		return fmt.Errorf("get %s = %q, model says %q", key, got, want)
+	}
+	return nil
+}
+
+// checkRecovered verifies the recovered store is in one of the states it was allowed to recover to,
+// and that Get and Scan agree on it
+func (ct *crashTest) checkRecovered() error {
+	recovered := make(map[string]string)
+	err := ct.store.Scan(nil, nil, func(key, value []byte) bool {
+		recovered[string(key)] = string(value)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("scan after recovery: %w", err)
+	}
+
+	for i := 0; i < ct.opts.keys; i++ {
+		key := ct.key(i)
+		got, err := ct.store.Get([]byte(key))
+		if err != nil && !errors.Is(err, utils.ErrKeyNotFound) {
+			return fmt.Errorf("get %s after recovery: %w", key, err)
+		}
+		if value, ok := recovered[key]; ok != (err == nil) || !bytes.Equal([]byte(value), got) {
+			return fmt.Errorf("get and scan disagree on %s after recovery", key)
+		}
+	}
+
+	// the newest state that matches, earlier ones can only match if nothing changed in between
+	for i := len(ct.history) - 1; i >= 0; i-- {
+		if maps.Equal(ct.history[i], recovered) {
+			ct.model = ct.history[i]
+			return nil
+		}
+	}
+	return fmt.Errorf("recovered state matches none of the %d states since the last flush: %s",
+		len(ct.history), describeDiff(ct.history[len(ct.history)-1], recovered))
+}
+
+func describeDiff(want, got map[string]string) string {
+	var diffs []string
+	for k, v := range want {
+		if g, ok := got[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s missing", k))
+		} else if g != v {
+			diffs = append(diffs, fmt.Sprintf("%s = %.20q, expected %.20q", k, g, v))
+		}
+	}
+	for k := range got {
+		if _, ok := want[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s unexpected", k))
+		}
+	}
+	slices.Sort(diffs)
+	if len(diffs) > 5 {
+		diffs = append(diffs[:5], fmt.Sprintf("... %d more", len(diffs)-5))
+	}
+	return fmt.Sprint(diffs)
+}
@@ -1,22 +1,56 @@
 package internal
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"os"
+	"slices"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/jateen67/kv/proto"
 	"github.com/jateen67/kv/utils"
+	"github.com/serialx/hashring"
 )
 
 type DiskStore struct {
-	mu                 sync.Mutex
-	memtable           *Memtable
+	mu                 sync.Mutex // held by writes, reads go through view, pinned versions and blobs.mu instead
+	dir                string     // holds the store's tables, blob files and manifest
+	fs                 FS
+	encryption         *encryptor
+	memtable           Memtable
 	wal                *writeAheadLog
 	bucketManager      *BucketManager
 	immutableMemtables []Memtable
+	view               atomic.Pointer[memtables]
+	blobs              *blobLog
+	blobThreshold      uint32 // values >= this size are stored in blob files, 0 disables it
+	flushThreshold     uint32 // memtable size at which it gets flushed to a table
+	clock              *hybridClock
+	mergeOperators     atomic.Pointer[map[string]MergeOperator] // replaced whole when an operator is registered
+
+	gcMu       sync.Mutex    // one round of blob GC at a time, see collectBlobGarbage
+	gcWake     chan struct{} // a blob file got sealed
+	gcStop     chan struct{}
+	gcStopOnce sync.Once
+	gcDone     chan struct{}
+}
+
+// memtables is what reads see of the memtables, replaced whole (under mu) whenever one is rotated or flushed. the
+// memtables themselves can be read while they're written to, and one only leaves the view once its table is installed
+type memtables struct {
+	active    Memtable
+	immutable []Memtable // waiting to be flushed, oldest first
+}
+
+// publishMemtables makes the memtables as they are now the ones reads see
+func (ds *DiskStore) publishMemtables() {
+	ds.view.Store(&memtables{active: ds.memtable, immutable: slices.Clone(ds.immutableMemtables)})
+}
+
+// operators returns the merge operators registered with the store
+func (ds *DiskStore) operators() map[string]MergeOperator {
+	return *ds.mergeOperators.Load()
 }
 
 type Operation int
@@ -25,59 +59,334 @@ const (
 	SET Operation = iota
 	GET
 	DELETE
+	DELETE_RANGE
+	MERGE
 )
 
 const FlushSizeThreshold = 1024 * 1024 * 256
 
-// NewCluster starts up a cluster of N nodes (stores), internally calls the newStore method per node
-func NewCluster(numOfNodes uint32) *Cluster {
-	cluster := Cluster{}
+// NewCluster starts up a cluster of N nodes (stores), internally calls the newStore method per node.
+// every key is kept on a single node unless WithReplicationFactor says otherwise
+func NewCluster(numOfNodes uint32, opts ...ClusterOption) (*Cluster, error) {
+	cluster := newCluster(opts...)
+	// the nodes share the cluster's coordinator, and its hints
+	if err := cluster.openHints("storage/hints"); err != nil {
+		return nil, err
+	}
 	cluster.initNodes(numOfNodes)
-	return &cluster
+	cluster.gossip = newGossiper("", "", cluster.nodeAddrs(), cluster.clock, cluster.gossipInterval, cluster.phiThreshold)
+	cluster.gossip.onUp = func(string) { cluster.deliverHints() }
+	cluster.gossip.start()
+	cluster.startBackgroundWork()
+	return cluster, nil
 }
 
-// newStore starts up a single-node KV store
-func newStore(nodeNum uint32) (*DiskStore, error) {
-	ds := &DiskStore{memtable: NewMemtable(), bucketManager: InitBucketManager()}
-	err := os.MkdirAll("log", 0755)
+// newCluster sets up a cluster without any nodes yet
+func newCluster(opts ...ClusterOption) *Cluster {
+	cluster := &Cluster{
+		clock:             newHybridClock(0),
+		replicationFactor: 1,
+		readRepairChance:  DefaultReadRepairChance,
+		hintTTL:           DefaultHintTTL,
+		repairInterval:    DefaultAntiEntropyInterval,
+		gossipInterval:    DefaultGossipInterval,
+		phiThreshold:      DefaultPhiThreshold,
+		stop:              make(chan struct{}),
+		accumulator:       &dataMigrationAccumulator{},
+		migrations:        make(map[migrationPair]*migration),
+		checkpoints:       make(map[migrationPair]map[tokenRange]migrationCheckpoint),
+	}
+	cluster.topo.Store(&topology{nodes: make(map[string]*Node), ring: hashring.New(nil)})
+	for _, opt := range opts {
+		opt(cluster)
+	}
+	return cluster
+}
+
+// openHints opens the cluster's hint log in dir, named like a store's directory. it lives with the stores, on their FS
+// and encrypted with their keys
+func (c *Cluster) openHints(dir string) error {
+	settings := &DiskStore{fs: osFS{}}
+	for _, opt := range c.storeOptions {
+		opt(settings)
+	}
+	hints, err := openHintLog(settings.fs, fmt.Sprintf("../%s", dir), c.hintTTL, settings.encryption)
+	if err != nil {
+		return fmt.Errorf("open hint log: %w", err)
+	}
+	c.hints = hints
+	return nil
+}
+
+// startBackgroundWork starts delivering hints and running anti-entropy, until the cluster is closed
+func (c *Cluster) startBackgroundWork() {
+	go c.deliverHintsPeriodically()
+	if c.repairInterval > 0 {
+		go c.repairPeriodically(c.repairInterval)
+	}
+}
+
+// newStore starts up a single-node KV store, picking up whatever a previous run of the same node left on disk
+func newStore(nodeNum uint32, opts ...StoreOption) (*DiskStore, error) {
+	dir := fmt.Sprintf("storage/node-%d", nodeNum)
+	ds := &DiskStore{
+		dir:            dir,
+		fs:             osFS{},
+		memtable:       NewMemtable(),
+		bucketManager:  InitBucketManager(dir),
+		blobThreshold:  DefaultBlobValueThreshold,
+		flushThreshold: FlushSizeThreshold,
+		clock:          newHybridClock(nodeNum),
+		gcWake:         make(chan struct{}, 1),
+		gcStop:         make(chan struct{}),
+		gcDone:         make(chan struct{}),
+	}
+	operators := defaultMergeOperators()
+	ds.mergeOperators.Store(&operators)
+	ds.publishMemtables()
+	for _, opt := range opts {
+		opt(ds)
+	}
+	if err := ds.fs.MkdirAll(fmt.Sprintf("../%s", dir), 0755); err != nil {
+		return nil, err
+	}
+	// compaction folds merge operands and runs the compaction filters, so it needs access to the store's operators and values
+	ds.bucketManager.compaction = compactionOptions{
+		fs:             ds.fs,
+		dir:            dir,
+		encryption:     ds.encryption,
+		mergeOperators: ds.operators,
+		resolveValue:   ds.resolveValue,
+		separateValue:  ds.separateValue,
+		filterStats:    make(map[string]*CompactionFilterStats),
+	}
+
+	blobs, err := openBlobLog(ds.fs, dir, ds.encryption)
 	if err != nil {
 		return nil, err
 	}
-	logFile, err := os.OpenFile(fmt.Sprintf("../log/wal-%d.log", nodeNum), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	ds.blobs = blobs
+	if err := ds.bucketManager.load(); err != nil {
+		return nil, err
+	}
+
+	if err := ds.fs.MkdirAll("../log", 0755); err != nil {
+		return nil, err
+	}
+	ds.wal, err = openWAL(ds.fs, fmt.Sprintf("../log/wal-%d.log", nodeNum), ds.encryption)
 	if err != nil {
 		return nil, err
 	}
-	ds.wal = &writeAheadLog{file: logFile}
+	// logged operations may point into the active blob file
+	ds.wal.beforeFlush = ds.blobs.sync
+	ds.bucketManager.compaction.tombstoneHorizon = ds.wal.oldestTimestamp
+	// the log holds every write that hadn't been flushed to a table yet
+	err = ds.wal.replay(func(op Operation, record *Record) error {
+		ds.clock.Update(record.Header.TimeStamp)
+		// a crash before the log got reset replays writes that are already in tables, possibly older than
+		// what the tables hold for the key by now. the memtable always wins over the tables, so they must not go back in
+		if op != DELETE_RANGE {
+			if newest, err := ds.bucketManager.RetrieveKey(record.Key); err == nil && newest.Header.TimeStamp >= record.Header.TimeStamp {
+				return nil
+			}
+		}
+		switch op {
+		case DELETE_RANGE:
+			ds.memtable.AddRangeTombstone(record)
+		case MERGE:
+			stacked, err := ds.stackOperands(record)
+			if err != nil {
+				return err
+			}
+			ds.memtable.Set(stacked.Key, stacked)
+		default:
+			ds.memtable.Set(record.Key, record)
+		}
+		return nil
+	})
+	// GC reads the memtables, it can only start once the log is replayed
+	go ds.runBlobGC()
 	return ds, err
 }
 
-func (ds *DiskStore) PutRecordFromGRPC(record *proto.Record) {
+func (ds *DiskStore) PutRecordFromGRPC(record *proto.Record) error {
 	rec := convertProtoRecordToStoreRecord(record)
-	ds.memtable.Set(&record.Key, rec)
+	if err := ds.PutRecord(rec); err != nil {
+		return err
+	}
 	fmt.Printf("stored proto record with key = %s into memtable", rec.Key)
+	return nil
 }
 
-func (ds *DiskStore) Get(key string) (string, error) {
+// PutRecord stores a version of a key written somewhere else (another replica, the coordinator of a write),
+// keeping its timestamp. a version older than what the store already holds for the key is ignored,
+// so the same record can be put any number of times. siblings are merged with the ones held instead
+func (ds *DiskStore) PutRecord(record *Record) error {
 	if ds == nil {
-		return "<!>", fmt.Errorf("disk store is not initialized")
+		return fmt.Errorf("disk store is not initialized")
 	}
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
+
+	// deleting everything leaves a range tombstone with an empty start
+	if record.isRangeTombstone() {
+		if len(record.Value) > 0 && bytes.Compare(record.Key, record.Value) >= 0 {
+			return utils.ErrInvalidRange
+		}
+		ds.clock.Update(record.Header.TimeStamp)
+		rangeTombstone := *record
+		rangeTombstone.Key = slices.Clone(record.Key)
+		rangeTombstone.Value = slices.Clone(record.Value)
+		ds.addRangeTombstone(&rangeTombstone)
+		return nil
+	}
+	if len(record.Key) == 0 {
+		return utils.ErrEmptyKey
+	}
+	if record.isMergeOperand() {
+		operands, err := decodeMergeOperands(record.Value)
+		if err != nil {
+			return err
+		}
+		for _, operand := range operands {
+			if _, ok := ds.operators()[operand.operator]; !ok {
+				return fmt.Errorf("%w: %s", utils.ErrUnknownMergeOperator, operand.operator)
+			}
+		}
+	}
+	if record.hasSiblings() {
+		// siblings are merged with the ones the store holds whatever their timestamp, see siblings.go
+		ds.clock.Update(record.Header.TimeStamp)
+		merged, err := ds.mergeSiblingsRecord(record)
+		if err != nil || merged == nil {
+			return err
+		}
+		record = merged
+	} else if record.isMergeOperand() {
+		// operands aren't ordered by the newest version: one that arrives late still has to be folded in
+		if applied, err := ds.operandsApplied(record); err != nil || applied {
+			return err
+		}
+	} else if newest, err := ds.getRecord(record.Key); err == nil && newest.Header.TimeStamp >= record.Header.TimeStamp {
+		// operands newer than the record still have to be applied on top of it
+		if record, err = ds.underOperands(record); err != nil || record == nil {
+			return err
+		}
+	} else if err != nil && !errors.Is(err, utils.ErrKeyNotFound) {
+		return err
+	}
+	// writes made here afterwards have to be newer
+	ds.clock.Update(record.Header.TimeStamp)
+
+	rec := *record
+	rec.Key = slices.Clone(record.Key)
+	rec.Value = slices.Clone(record.Value)
+	sealed := false
+	switch {
+	case rec.Header.Tombstone == 1:
+		ds.memtable.Set(rec.Key, &rec)
+		ds.wal.appendWALOperation(DELETE, &rec)
+	case rec.isMergeOperand():
+		stacked, err := ds.stackOperands(&rec)
+		if err != nil {
+			return err
+		}
+		ds.memtable.Set(stacked.Key, stacked)
+		ds.wal.appendWALOperation(MERGE, &rec)
+	default:
+		// records from elsewhere always arrive with their value inlined, this node decides where to keep it
+		var err error
+		if sealed, err = ds.separateValue(&rec); err != nil {
+			return err
+		}
+		ds.memtable.Set(rec.Key, &rec)
+		ds.wal.appendWALOperation(SET, &rec)
+	}
+	if ds.memtable.Size() >= ds.flushThreshold {
+		ds.rotateMemtable()
+	}
+	if sealed {
+		ds.wakeBlobGC()
+	}
+	return nil
+}
+
+func (ds *DiskStore) Get(key []byte) ([]byte, error) {
+	if ds == nil {
+		return nil, fmt.Errorf("disk store is not initialized")
+	}
 	// log 'GET' operation first
-	ds.wal.appendWALOperation(GET, &Record{Key: key})
+	ds.mu.Lock()
+	ds.wal.appendGet(key)
+	ds.mu.Unlock()
 
-	record, err := ds.memtable.Get(&key)
-	// if not found in memtable search in sstable
-	if err == nil {
-		return record.Value, nil
-	} else if !errors.Is(err, utils.ErrKeyNotFound) {
-		return "<!>", err
+	record, err := ds.GetVersion(key)
+	if err != nil {
+		return nil, err
+	}
+	if record.Header.Tombstone == 1 {
+		return nil, utils.ErrKeyNotFound
+	}
+	return record.Value, nil
+}
+
+// GetVersion returns the key's newest version with its value resolved. a deleted key comes back as a tombstone
+// carrying the time it got deleted, so the answers of different replicas can be ordered by timestamp
+func (ds *DiskStore) GetVersion(key []byte) (Record, error) {
+	if ds == nil {
+		return Record{}, fmt.Errorf("disk store is not initialized")
+	}
+	ds.blobs.mu.RLock()
+	defer ds.blobs.mu.RUnlock()
+	return ds.getVersion(key)
+}
+
+func (ds *DiskStore) getVersion(key []byte) (Record, error) {
+	record, err := ds.getRecord(key)
+	if err != nil {
+		return Record{}, err
+	}
+	if ds.isRangeDeleted(&record) {
+		deleted := Record{
+			Header: Header{
+				Tombstone: 1,
+				TimeStamp: newestCoveringTimestamp(ds.allRangeTombstones(), key),
+				KeySize:   uint32(len(key)),
+			},
+			Key:       record.Key,
+			TotalSize: headerSize + uint32(len(key)),
+		}
+		deleted.Header.CheckSum = deleted.CalculateChecksum()
+		return deleted, nil
+	}
+	if record.Header.Tombstone == 1 {
+		return record, nil
 	}
 
-	return ds.bucketManager.RetrieveKey(&key)
+	record, err = ds.resolveMerge(record)
+	if err != nil {
+		return Record{}, err
+	}
+	return ds.resolveValue(record)
 }
 
-func (ds *DiskStore) Set(key *string, value *string) error {
+// getRecord returns the newest version of the key as stored, so it may be a tombstone or hold a blob pointer
+func (ds *DiskStore) getRecord(key []byte) (Record, error) {
+	view := ds.view.Load()
+	record, err := view.active.Get(key)
+	// if not found in memtable search the memtables waiting to be flushed (newest first), then the sstables
+	for i := len(view.immutable) - 1; i >= 0 && errors.Is(err, utils.ErrKeyNotFound); i-- {
+		record, err = view.immutable[i].Get(key)
+	}
+	if !errors.Is(err, utils.ErrKeyNotFound) {
+		return record, err
+	}
+
+	return ds.bucketManager.RetrieveKey(key)
+}
+
+// Set stores an arbitrary binary value under key, empty values are allowed
+func (ds *DiskStore) Set(key, value []byte) error {
 	if ds == nil {
 		return fmt.Errorf("disk store is not initialized")
 	}
@@ -88,70 +397,233 @@ func (ds *DiskStore) Set(key *string, value *string) error {
 		return fmt.Errorf("memtable is not initialized")
 	}
 
-	if len(*key) == 0 {
-		return errors.New("set() error: key empty")
-	}
-	if len(*value) == 0 {
-		return errors.New("set() error: value empty")
+	if len(key) == 0 {
+		return utils.ErrEmptyKey
 	}
 
 	header := Header{
 		CheckSum:  0,
 		Tombstone: 0,
-		TimeStamp: uint32(time.Now().Unix()),
-		KeySize:   uint32(len(*key)),
-		ValueSize: uint32(len(*value)),
+		TimeStamp: ds.clock.Now(),
+		KeySize:   uint32(len(key)),
+		ValueSize: uint32(len(value)),
 	}
+	// the caller owns key/value, copy them so later mutations don't leak into the memtable
 	record := &Record{
 		Header:    header,
-		Key:       *key,
-		Value:     *value,
+		Key:       slices.Clone(key),
+		Value:     slices.Clone(value),
 		TotalSize: headerSize + header.KeySize + header.ValueSize,
 	}
 	record.Header.CheckSum = record.CalculateChecksum()
 
-	ds.memtable.Set(key, record)
+	// large values go to the blob log, the record only keeps a pointer to it
+	sealed, err := ds.separateValue(record)
+	if err != nil {
+		return err
+	}
+
+	ds.memtable.Set(record.Key, record)
 	// Batch WAL appends to improve performance, constant disk writes are too expensive
 	ds.wal.appendWALOperation(SET, record)
 	// Automatically flush when memtable reaches certain threshold
-	if ds.memtable.totalSize >= FlushSizeThreshold {
-		ds.immutableMemtables = append(ds.immutableMemtables, *deepCopyMemtable(ds.memtable))
-		ds.memtable.clear()
-		ds.FlushMemtable()
+	if ds.memtable.Size() >= ds.flushThreshold {
+		ds.rotateMemtable()
+	}
+	if sealed {
+		ds.wakeBlobGC()
 	}
 	return nil
 }
 
-func (ds *DiskStore) Delete(key string) error {
+// rotateMemtable hands the full memtable off as-is and flushes it, no copy needed since writes go to the fresh one
+func (ds *DiskStore) rotateMemtable() {
+	ds.immutableMemtables = append(ds.immutableMemtables, ds.memtable)
+	ds.memtable = NewMemtable()
+	ds.publishMemtables()
+	if err := ds.FlushMemtable(); err != nil {
+		// the memtable stays queued (and readable), the next flush retries it
+		fmt.Println("flush err:", err)
+	}
+}
+
+func (ds *DiskStore) Delete(key []byte) error {
 	if ds == nil {
 		return fmt.Errorf("disk store is not initialized")
 	}
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 
-	// appending a new entry but with a tombstone value and empty key
-	value := ""
+	if len(key) == 0 {
+		return utils.ErrEmptyKey
+	}
+
+	// appending a new entry but with a tombstone value and empty value
+	var value []byte
 	header := Header{
 		Tombstone: 1,
-		TimeStamp: uint32(time.Now().Unix()),
+		TimeStamp: ds.clock.Now(),
 		KeySize:   uint32(len(key)),
 		ValueSize: uint32(len(value)),
 	}
 	deletionRecord := Record{
 		Header:    header,
-		Key:       key,
+		Key:       slices.Clone(key),
 		Value:     value,
 		TotalSize: headerSize + header.KeySize + header.ValueSize,
 	}
-	deletionRecord.CalculateChecksum()
+	deletionRecord.Header.CheckSum = deletionRecord.CalculateChecksum()
 
-	ds.memtable.Set(&key, &deletionRecord)
+	ds.memtable.Set(deletionRecord.Key, &deletionRecord)
 	ds.wal.appendWALOperation(DELETE, &deletionRecord)
+	if ds.memtable.Size() >= ds.flushThreshold {
+		ds.rotateMemtable()
+	}
+	return nil
+}
+
+// DeleteRange deletes every key in [start, end) with a single range tombstone, a nil/empty end means no upper bound
+func (ds *DiskStore) DeleteRange(start, end []byte) error {
+	if ds == nil {
+		return fmt.Errorf("disk store is not initialized")
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return utils.ErrInvalidRange
+	}
+
+	// the range is stored as key = start, value = end
+	header := Header{
+		Tombstone: 1,
+		Flags:     flagRangeTombstone,
+		TimeStamp: ds.clock.Now(),
+		KeySize:   uint32(len(start)),
+		ValueSize: uint32(len(end)),
+	}
+	rangeTombstone := Record{
+		Header:    header,
+		Key:       slices.Clone(start),
+		Value:     slices.Clone(end),
+		TotalSize: headerSize + header.KeySize + header.ValueSize,
+	}
+	rangeTombstone.Header.CheckSum = rangeTombstone.CalculateChecksum()
+
+	ds.addRangeTombstone(&rangeTombstone)
+	return nil
+}
+
+// addRangeTombstone stores the range tombstone, the caller holds ds.mu
+func (ds *DiskStore) addRangeTombstone(rangeTombstone *Record) {
+	ds.memtable.AddRangeTombstone(rangeTombstone)
+	ds.wal.appendWALOperation(DELETE_RANGE, rangeTombstone)
+	if ds.memtable.Size() >= ds.flushThreshold {
+		ds.rotateMemtable()
+	}
+}
+
+// Scan calls fn for every live key in [start, end) in sorted order, a nil end means no upper bound.
+// stops early once fn returns false
+func (ds *DiskStore) Scan(start, end []byte, fn func(key, value []byte) bool) error {
+	return ds.ScanVersions(start, end, func(record Record) bool {
+		if record.Header.Tombstone == 1 {
+			return true
+		}
+		return fn(record.Key, record.Value)
+	})
+}
+
+// ScanVersions calls fn with the newest version of every key in [start, end) in sorted order, deletes included but
+// not the keys a range tombstone covers. values are resolved, merge operands folded. stops early once fn returns false
+func (ds *DiskStore) ScanVersions(start, end []byte, fn func(record Record) bool) error {
+	if ds == nil {
+		return fmt.Errorf("disk store is not initialized")
+	}
+	ds.blobs.mu.RLock()
+	defer ds.blobs.mu.RUnlock()
 
+	newest, err := ds.newestVersions(start, end)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(newest))
+	for k := range newest {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		record := newest[k]
+		if ds.isRangeDeleted(&record) {
+			continue
+		}
+		if record.Header.Tombstone == 0 {
+			if record, err = ds.resolveMerge(record); err != nil {
+				return err
+			}
+			if record, err = ds.resolveValue(record); err != nil {
+				return err
+			}
+		}
+		if !fn(record) {
+			break
+		}
+	}
 	return nil
 }
 
-func (ds *DiskStore) writeToFile(data []byte, file *os.File) error {
+// newestVersions gathers the newest version of every key in [start, end) from every source, as stored
+func (ds *DiskStore) newestVersions(start, end []byte) (map[string]Record, error) {
+	newest := make(map[string]Record)
+	keepNewest := func(r Record) bool {
+		curr, ok := newest[string(r.Key)]
+		if !ok || r.Header.TimeStamp > curr.Header.TimeStamp || r.Header.TimeStamp == curr.Header.TimeStamp && cmpBlobCopies(&r, &curr) > 0 {
+			newest[string(r.Key)] = r
+		}
+		return true
+	}
+
+	if err := ds.bucketManager.ScanRange(start, end, keepNewest); err != nil {
+		return nil, err
+	}
+	view := ds.view.Load()
+	for _, m := range append(slices.Clone(view.immutable), view.active) {
+		it := m.NewIterator()
+		for it.Seek(start); it.Valid(); it.Next() {
+			if r := it.Record(); end == nil || bytes.Compare(r.Key, end) < 0 {
+				keepNewest(r)
+			} else {
+				break
+			}
+		}
+	}
+	return newest, nil
+}
+
+// isRangeDeleted reports whether a newer range tombstone anywhere in the store covers this record
+func (ds *DiskStore) isRangeDeleted(record *Record) bool {
+	view := ds.view.Load()
+	newest := newestCoveringTimestamp(view.active.RangeTombstones(), record.Key)
+	for i := range view.immutable {
+		newest = max(newest, newestCoveringTimestamp(view.immutable[i].RangeTombstones(), record.Key))
+	}
+	newest = max(newest, ds.bucketManager.NewestRangeTombstone(record.Key))
+	return newest > record.Header.TimeStamp
+}
+
+// allRangeTombstones returns the range tombstones of every memtable and table in the store
+func (ds *DiskStore) allRangeTombstones() []Record {
+	view := ds.view.Load()
+	rangeTombstones := slices.Clone(view.active.RangeTombstones())
+	for i := range view.immutable {
+		rangeTombstones = append(rangeTombstones, view.immutable[i].RangeTombstones()...)
+	}
+	return append(rangeTombstones, ds.bucketManager.AllRangeTombstones()...)
+}
+
+func (ds *DiskStore) writeToFile(data []byte, file File) error {
 	if _, err := file.Write(data); err != nil {
 		return err
 	}
@@ -163,31 +635,71 @@ func (ds *DiskStore) writeToFile(data []byte, file *os.File) error {
 }
 
 func (ds *DiskStore) LengthOfMemtable() {
-	fmt.Println(len(ds.memtable.data.Keys()))
+	fmt.Println(ds.memtable.Len())
 }
 
-func (ds *DiskStore) FlushMemtable() {
-	for i := range ds.immutableMemtables {
-		sstable := ds.immutableMemtables[i].Flush("storage")
-		ds.bucketManager.InsertTable(sstable)
-		ds.immutableMemtables = ds.immutableMemtables[:i] // basically removing a "queued" memtable since its flushed
+// Drop removes every version of the given keys up to the given timestamp (newer writes stay) from the memtables and
+// the tables, without leaving a tombstone behind: for data that moved to other nodes, the key isn't deleted
+func (ds *DiskStore) Drop(versions map[string]uint64) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// everything goes into tables first, so the WAL starts over and can't bring any of it back
+	ds.immutableMemtables = append(ds.immutableMemtables, ds.memtable)
+	ds.memtable = NewMemtable()
+	ds.publishMemtables()
+	if err := ds.FlushMemtable(); err != nil {
+		return err
 	}
+	return ds.bucketManager.dropRecords(func(r Record) bool {
+		ts, ok := versions[string(r.Key)]
+		return ok && r.Header.TimeStamp <= ts
+	})
 }
 
-func deepCopyMemtable(memtable *Memtable) *Memtable {
-	deepCopy := NewMemtable()
-	deepCopy.totalSize = memtable.totalSize
+// FlushMemtable writes every memtable waiting to be flushed into a table, oldest first
+func (ds *DiskStore) FlushMemtable() error {
+	// the tables may point into the active blob file
+	if err := ds.blobs.sync(); err != nil {
+		return err
+	}
+	for len(ds.immutableMemtables) > 0 {
+		m := ds.immutableMemtables[0]
+		if m.Len() > 0 || len(m.RangeTombstones()) > 0 {
+			sstable, err := FlushMemtableToDisk(m, ds.fs, ds.dir, ds.encryption)
+			if err != nil {
+				return err
+			}
+			if err := ds.bucketManager.InsertTable(sstable); err != nil {
+				return err
+			}
+		}
+		ds.immutableMemtables = ds.immutableMemtables[1:]
+		ds.publishMemtables()
+	}
 
-	keys := memtable.data.Keys()
-	values := memtable.data.Values()
-	for i := range keys {
-		deepCopy.data.Put(keys[i], values[i])
+	// once every write in the log is in a table the manifest knows about, the log can start over
+	if ds.memtable.Len() == 0 && len(ds.memtable.RangeTombstones()) == 0 {
+		if err := ds.wal.reset(); err != nil {
+			return err
+		}
 	}
 
-	return deepCopy
+	// compaction may have dropped the last pointers into blob files that GC already rewrote
+	if err := ds.purgeObsoleteBlobFiles(); err != nil {
+		fmt.Println("purge blob files err:", err)
+	}
+	return nil
 }
 
+// Close writes out the operations the WAL still has batched, everything else is already on disk
 func (ds *DiskStore) Close() bool {
-	//TODO implement
+	ds.stopBlobGC()
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if err := ds.wal.close(); err != nil {
+		fmt.Println("close wal err:", err)
+		return false
+	}
 	return true
 }
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jateen67/kv/utils"
+)
+
+func openTestStore(t *testing.T, fs FS) *DiskStore {
+	t.Helper()
+	store, err := newStore(1, WithFS(fs))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	useTinyThresholds(store)
+	t.Cleanup(store.stopBlobGC)
+	return store
+}
+
+// reads don't take the store's lock, they have to see whole values while memtables get flushed and blob files rewritten
+func TestReadsWhileWriting(t *testing.T) {
+	store := openTestStore(t, NewMemFS(1))
+	const keys = 64
+	writes := 4000
+	if testing.Short() {
+		writes = 1000
+	}
+
+	key := func(i int) string { return fmt.Sprintf("key-%02d", i) }
+	// every other value is large enough to go to a blob file
+	value := func(i, n int) string {
+		return fmt.Sprintf("%s=%d%s", key(i), n, strings.Repeat("x", (n%2)*200))
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := key(n % keys)
+				got, err := store.Get([]byte(k))
+				if err != nil && !errors.Is(err, utils.ErrKeyNotFound) {
+					errs <- fmt.Errorf("get %s: %w", k, err)
+					return
+				}
+				if err == nil && !strings.HasPrefix(string(got), k+"=") {
+					errs <- fmt.Errorf("get %s: got %.20q", k, got)
+					return
+				}
+				err = store.Scan(nil, nil, func(key, value []byte) bool {
+					if !strings.HasPrefix(string(value), string(key)+"=") {
+						err = fmt.Errorf("scan %s: got %.20q", key, value)
+						return false
+					}
+					return true
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for n := range writes {
+		if err := store.Set([]byte(key(n%keys)), []byte(value(n%keys, n))); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		if n%500 == 499 {
+			if err := store.CollectBlobGarbage(); err != nil {
+				t.Fatalf("blob gc: %v", err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for i := range keys {
+		got, err := store.Get([]byte(key(i)))
+		if err != nil {
+			t.Fatalf("get %s: %v", key(i), err)
+		}
+		last := (writes-1-i)/keys*keys + i
+		if string(got) != value(i, last) {
+			t.Errorf("get %s: got %.20q, want the value of write %d", key(i), got, last)
+		}
+	}
+}
+
+func tableCount(ds *DiskStore) int {
+	v := ds.bucketManager.pinVersion()
+	defer v.release(ds.bucketManager)
+	return len(v.tables)
+}
+
+func TestRangeTombstones(t *testing.T) {
+	fs := NewMemFS(1)
+	store := openTestStore(t, fs)
+	key := func(prefix string, i int) []byte { return []byte(fmt.Sprintf("%s/%02d", prefix, i)) }
+	for i := range 10 {
+		for _, prefix := range []string{"a", "b"} {
+			if err := store.Set(key(prefix, i), key(prefix, i)); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+		}
+	}
+	// the values are in a table, the range tombstone lands in the memtable above them
+	flush := func() {
+		store.mu.Lock()
+		store.rotateMemtable()
+		store.mu.Unlock()
+	}
+	flush()
+	if err := store.DeleteRange(key("a", 0), key("a", 5)); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+	// written after the range tombstone, it isn't covered by it
+	if err := store.Set(key("a", 2), []byte("again")); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	expect := func(when string) {
+		t.Helper()
+		for i := range 10 {
+			for _, prefix := range []string{"a", "b"} {
+				k := key(prefix, i)
+				got, err := store.Get(k)
+				switch {
+				case prefix == "a" && i == 2:
+					if string(got) != "again" {
+						t.Fatalf("%s: get %s: got %q, %v, want the write made after the delete", when, k, got, err)
+					}
+				case prefix == "a" && i < 5:
+					if !errors.Is(err, utils.ErrKeyNotFound) {
+						t.Fatalf("%s: get %s: got %q, %v, want it deleted", when, k, got, err)
+					}
+				case err != nil || string(got) != string(k):
+					t.Fatalf("%s: get %s: got %q, %v", when, k, got, err)
+				}
+			}
+		}
+		var scanned int
+		store.Scan(key("a", 0), key("b", 0), func(key, value []byte) bool {
+			scanned++
+			return true
+		})
+		if scanned != 6 {
+			t.Fatalf("%s: scanned %d keys of a/, want 6", when, scanned)
+		}
+	}
+	expect("in the memtable")
+	flush()
+	expect("flushed")
+	// enough tables for the ones holding the deleted keys and the range tombstone to get compacted together
+	for i := range 8 {
+		if err := store.Set(key("c", i), key("c", i)); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		flush()
+	}
+	expect("compacted")
+	if !store.Close() {
+		t.Fatal("close failed")
+	}
+	store = openTestStore(t, fs)
+	expect("reopened")
+}
+
+func TestDeletesFlushMemtable(t *testing.T) {
+	store := openTestStore(t, NewMemFS(1))
+	if err := store.Delete(nil); !errors.Is(err, utils.ErrEmptyKey) {
+		t.Fatalf("delete of an empty key: got %v, want %v", err, utils.ErrEmptyKey)
+	}
+
+	// deletes alone fill up the memtable too
+	for i := 0; tableCount(store) == 0; i++ {
+		if i == 1000 {
+			t.Fatal("deletes never flushed the memtable")
+		}
+		if err := store.Delete([]byte(fmt.Sprintf("key-%04d", i))); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+	}
+	tables := tableCount(store)
+	for i := 0; tableCount(store) == tables; i++ {
+		if i == 1000 {
+			t.Fatal("range deletes never flushed the memtable")
+		}
+		if err := store.DeleteRange([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("key-%04d", i+1))); err != nil {
+			t.Fatalf("delete range: %v", err)
+		}
+	}
+}
+
+// keys and values are bytes as-is: NUL and invalid UTF-8 included, an empty value is a value, not a delete
+func TestBinaryValues(t *testing.T) {
+	fs := NewMemFS(1)
+	store := openTestStore(t, fs)
+	want := map[string][]byte{
+		"empty":             {},
+		"binary":            {0x00, 0xff, 0xfe, 0x00, 0x80},
+		"\x00key\xff":       []byte("binary key"),
+		"separated-in-blob": bytes.Repeat([]byte{0x00, 0xc3, 0x28}, 100),
+	}
+	check := func(when string) {
+		t.Helper()
+		for key, value := range want {
+			got, err := store.Get([]byte(key))
+			if err != nil || !bytes.Equal(got, value) {
+				t.Errorf("%s: get %q: got %q, %v, want %q", when, key, got, err, value)
+			}
+		}
+	}
+	for key, value := range want {
+		if err := store.Set([]byte(key), value); err != nil {
+			t.Fatalf("set %q: %v", key, err)
+		}
+	}
+	check("in the memtable")
+	flush(store)
+	check("in a table")
+	if !store.Close() {
+		t.Fatal("close failed")
+	}
+	store = openTestStore(t, fs)
+	check("after reopening")
+}
@@ -8,10 +8,10 @@ import (
 
 func BenchmarkDiskStore_Put(b *testing.B) {
 	store, _ := newStore(1)
-	val := "val"
+	val := []byte("val")
 	for i := 0; i < b.N; i++ {
 		key := generateRandomKey()
-		store.Set(&key, &val)
+		store.Set(key, val)
 	}
 
 	opsPerSec := float64(b.N) / b.Elapsed().Seconds()
@@ -20,28 +20,28 @@ func BenchmarkDiskStore_Put(b *testing.B) {
 
 func BenchmarkDiskStore_Get(b *testing.B) {
 	store, _ := newStore(1)
-	testK := "Fuzzy"
-	val := "val"
+	testK := []byte("Fuzzy")
+	val := []byte("val")
 	for i := 0; i < 1_000_000; i++ {
 		if i == 4313 {
-			store.Set(&testK, &val)
+			store.Set(testK, val)
 		} else {
 			key := generateRandomKey()
-			store.Set(&key, &val)
+			store.Set(key, val)
 		}
 	}
 	store.FlushMemtable()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		store.Get("Fuzzy")
+		store.Get(testK)
 	}
 	opsPerSec := float64(b.N) / b.Elapsed().Seconds()
 	b.ReportMetric(opsPerSec, "ops/s")
 }
 
-func generateRandomKey() string {
-	return generateRandomString(10)
+func generateRandomKey() []byte {
+	return []byte(generateRandomString(10))
 }
 
 // generateRandomString generates a random string of a given length
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Encryption at rest -- AES-GCM over WAL records, SSTable blocks and blob entries
+
+Every encrypted file starts with the id of the key it was written with, so keys can be rotated: new files are
+written with the provider's current key, older files keep being readable as long as the provider still has
+their key. Compaction rewrites tables with the current key, so old keys eventually stop being used.
+Key id 0 means the file isn't encrypted.
+
+Sealed payload:
+---------------------------
+| nonce | ciphertext + tag |
+---------------------------
+The tag also covers the name of the file the payload is in and its offset there (neither is stored in the payload),
+so a payload copied over another one -- in the same file or a different one -- fails to open like a tampered one
+*/
+
+const fileKeyIDSize = 4
+
+type KeyProvider interface {
+	// CurrentKey returns the key new files are written with
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key with the given id, needed to read files written before a rotation
+	Key(id uint32) ([]byte, error)
+}
+
+// FileKeyProvider reads its keys from a file with one "<id> <hex key>" per line, the highest id is the current key.
+// keys have to be 16, 24 or 32 bytes (AES-128, AES-192, AES-256)
+type FileKeyProvider struct {
+	keys      map[uint32][]byte
+	currentID uint32
+}
+
+func NewFileKeyProvider(filename string) (*FileKeyProvider, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	kp := &FileKeyProvider{keys: make(map[uint32][]byte)}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("key file line %d: expected \"<id> <hex key>\"", lineNum)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("key file line %d: key id must be a positive integer", lineNum)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d: %w", lineNum, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("key file line %d: %w", lineNum, err)
+		}
+		kp.keys[uint32(id)] = key
+		kp.currentID = max(kp.currentID, uint32(id))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(kp.keys) == 0 {
+		return nil, fmt.Errorf("key file %s has no keys", filename)
+	}
+	return kp, nil
+}
+
+func (kp *FileKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return kp.currentID, kp.keys[kp.currentID], nil
+}
+
+func (kp *FileKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := kp.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", utils.ErrUnknownEncryptionKey, id)
+	}
+	return key, nil
+}
+
+// encryptor seals and opens payloads for the store, a nil encryptor only handles unencrypted (key id 0) data
+type encryptor struct {
+	provider KeyProvider
+	mu       sync.Mutex
+	aeads    map[uint32]cipher.AEAD
+}
+
+func newEncryptor(provider KeyProvider) *encryptor {
+	return &encryptor{provider: provider, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+// currentKeyID is the key id new files get written with, 0 if encryption is off
+func (e *encryptor) currentKeyID() (uint32, error) {
+	if e == nil {
+		return 0, nil
+	}
+	id, _, err := e.provider.CurrentKey()
+	return id, err
+}
+
+func (e *encryptor) aead(keyID uint32) (cipher.AEAD, error) {
+	if e == nil {
+		return nil, fmt.Errorf("%w: %d (encryption is off)", utils.ErrUnknownEncryptionKey, keyID)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if aead, ok := e.aeads[keyID]; ok {
+		return aead, nil
+	}
+
+	key, err := e.provider.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e.aeads[keyID] = aead
+	return aead, nil
+}
+
+// associatedData is what a payload at offset in the named file is bound to. only the base name is used,
+// a store's directory can be moved around without its files becoming unreadable
+func associatedData(filename string, offset uint64) []byte {
+	name := filepath.Base(filename)
+	ad := make([]byte, 8, 8+len(name))
+	binary.LittleEndian.PutUint64(ad, offset)
+	return append(ad, name...)
+}
+
+// seal encrypts plaintext with the given key and binds it to ad (see associatedData), key id 0 returns it as-is
+func (e *encryptor) seal(keyID uint32, plaintext, ad []byte) ([]byte, error) {
+	if keyID == 0 {
+		return plaintext, nil
+	}
+	aead, err := e.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// open decrypts a payload produced by seal with the same ad
+func (e *encryptor) open(keyID uint32, payload, ad []byte) ([]byte, error) {
+	if keyID == 0 {
+		return payload, nil
+	}
+	aead, err := e.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < aead.NonceSize() {
+		return nil, utils.ErrDecryptionFailed
+	}
+	plaintext, err := aead.Open(nil, payload[:aead.NonceSize()], payload[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, utils.ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+// sealFile encodes a whole file as a single sealed payload behind the key id header
+func (e *encryptor) sealFile(keyID uint32, filename string, data []byte) ([]byte, error) {
+	payload, err := e.seal(keyID, data, associatedData(filename, fileKeyIDSize))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, fileKeyIDSize, fileKeyIDSize+len(payload))
+	binary.LittleEndian.PutUint32(buf, keyID)
+	return append(buf, payload...), nil
+}
+
+// openFile decodes a file written by sealFile
+func (e *encryptor) openFile(filename string, buf []byte) ([]byte, error) {
+	if len(buf) < fileKeyIDSize {
+		return nil, utils.ErrDecryptionFailed
+	}
+	return e.open(binary.LittleEndian.Uint32(buf[:fileKeyIDSize]), buf[fileKeyIDSize:], associatedData(filename, fileKeyIDSize))
+}
+
+// StoreOption configures a store when it's started
+type StoreOption func(*DiskStore)
+
+// WithEncryption encrypts everything the store writes to disk with keys from provider
+func WithEncryption(provider KeyProvider) StoreOption {
+	return func(ds *DiskStore) {
+		ds.encryption = newEncryptor(provider)
+	}
+}
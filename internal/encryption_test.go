@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jateen67/kv/utils"
+)
+
+// testKeys is a KeyProvider over a fixed set of keys, the highest id is the current one
+type testKeys map[uint32][]byte
+
+func newTestKeys(ids ...uint32) testKeys {
+	keys := make(testKeys)
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte(id)}, 32)
+	}
+	return keys
+}
+
+func (k testKeys) CurrentKey() (uint32, []byte, error) {
+	var current uint32
+	for id := range k {
+		current = max(current, id)
+	}
+	return current, k[current], nil
+}
+
+func (k testKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", utils.ErrUnknownEncryptionKey, id)
+	}
+	return key, nil
+}
+
+func openEncryptedStore(t *testing.T, fs FS, keys testKeys) (*DiskStore, error) {
+	t.Helper()
+	store, err := newStore(1, WithFS(fs), WithEncryption(keys))
+	if err != nil {
+		return nil, err
+	}
+	store.blobThreshold = 128
+	t.Cleanup(store.stopBlobGC)
+	return store, nil
+}
+
+// flush moves the memtable into a table
+func flush(store *DiskStore) {
+	store.mu.Lock()
+	store.rotateMemtable()
+	store.mu.Unlock()
+}
+
+// fileKeyIDs returns the key id in the header of every file with the given suffix
+func fileKeyIDs(fs *MemFS, suffix string) map[string]uint32 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	ids := make(map[string]uint32)
+	for name, inode := range fs.files {
+		if strings.HasSuffix(name, suffix) && len(inode.data) >= fileKeyIDSize {
+			ids[name] = binary.LittleEndian.Uint32(inode.data)
+		}
+	}
+	return ids
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	fs := NewMemFS(1)
+	store, err := openEncryptedStore(t, fs, newTestKeys(1))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	values := map[string]string{"flushed": "in a table", "logged": "only in the log", "blob": blobValue("blob", 0)}
+	for _, key := range []string{"flushed", "blob"} {
+		if err := store.Set([]byte(key), []byte(values[key])); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	flush(store)
+	if err := store.Set([]byte("logged"), []byte(values["logged"])); err != nil {
+		t.Fatalf("set logged: %v", err)
+	}
+	if !store.Close() {
+		t.Fatal("close failed")
+	}
+
+	fs.mu.Lock()
+	for name, inode := range fs.files {
+		for _, value := range values {
+			if bytes.Contains(inode.data, []byte(value)) {
+				t.Errorf("%s holds %.20q in plaintext", name, value)
+			}
+		}
+	}
+	fs.mu.Unlock()
+
+	store, err = openEncryptedStore(t, fs, newTestKeys(1))
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	for key, value := range values {
+		expectValue(t, store, key, value)
+	}
+}
+
+// after a rotation, files written before it are read with the old key and new ones are written with the new key
+func TestEncryptionKeyRotation(t *testing.T) {
+	fs := NewMemFS(1)
+	store, err := openEncryptedStore(t, fs, newTestKeys(1))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	if err := store.Set([]byte("old"), []byte("written with key 1")); err != nil {
+		t.Fatalf("set old: %v", err)
+	}
+	flush(store)
+	if !store.Close() {
+		t.Fatal("close failed")
+	}
+	oldTables := fileKeyIDs(fs, DATA_FILE_EXTENSION)
+
+	store, err = openEncryptedStore(t, fs, newTestKeys(1, 2))
+	if err != nil {
+		t.Fatalf("reopen store after rotation: %v", err)
+	}
+	expectValue(t, store, "old", "written with key 1")
+	if err := store.Set([]byte("new"), []byte("written with key 2")); err != nil {
+		t.Fatalf("set new: %v", err)
+	}
+	flush(store)
+	expectValue(t, store, "new", "written with key 2")
+
+	for name, id := range fileKeyIDs(fs, DATA_FILE_EXTENSION) {
+		want := uint32(2)
+		if _, ok := oldTables[name]; ok {
+			want = 1
+		}
+		if id != want {
+			t.Errorf("%s written with key %d, want %d", name, id, want)
+		}
+	}
+	for name, id := range fileKeyIDs(fs, ".log") {
+		if id != 2 {
+			t.Errorf("%s written with key %d after the rotation, want 2", name, id)
+		}
+	}
+	if !store.Close() {
+		t.Fatal("close failed")
+	}
+
+	// a provider that lost the old key can't open the store, and says why
+	if _, err := openEncryptedStore(t, fs, newTestKeys(2)); !errors.Is(err, utils.ErrUnknownEncryptionKey) {
+		t.Fatalf("open without key 1: got %v, want %v", err, utils.ErrUnknownEncryptionKey)
+	}
+}
+
+// a modified payload doesn't open, and neither does a valid one moved somewhere else
+func TestEncryptionTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(data []byte, first, second blobPointer)
+	}{
+		{name: "flipped byte", tamper: func(data []byte, _, second blobPointer) {
+			data[second.offset+blobEntrySizeSize+20] ^= 0xff
+		}},
+		// both entries are the same size, without binding them to their offset the second key would read the first's value
+		{name: "entry copied over another", tamper: func(data []byte, first, second blobPointer) {
+			entry := bytes.Clone(data[first.offset:second.offset])
+			copy(data[second.offset:], entry)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := NewMemFS(1)
+			store, err := openEncryptedStore(t, fs, newTestKeys(1))
+			if err != nil {
+				t.Fatalf("open store: %v", err)
+			}
+			for _, key := range []string{"first", "secnd"} {
+				if err := store.Set([]byte(key), []byte(blobValue(key, 0))); err != nil {
+					t.Fatalf("set %s: %v", key, err)
+				}
+			}
+			pointer := func(key string) blobPointer {
+				record, err := store.getRecord([]byte(key))
+				if err != nil {
+					t.Fatalf("get record %s: %v", key, err)
+				}
+				ptr, err := decodeBlobPointer(record.Value)
+				if err != nil {
+					t.Fatalf("decode pointer of %s: %v", key, err)
+				}
+				return ptr
+			}
+			first, second := pointer("first"), pointer("secnd")
+
+			fs.mu.Lock()
+			tt.tamper(fs.files[getBlobFilename(store.dir, second.fileID)].data, first, second)
+			fs.mu.Unlock()
+
+			expectValue(t, store, "first", blobValue("first", 0))
+			if got, err := store.Get([]byte("secnd")); !errors.Is(err, utils.ErrDecryptionFailed) {
+				t.Fatalf("get secnd: got %.20q, %v, want %v", got, err, utils.ErrDecryptionFailed)
+			}
+		})
+	}
+}
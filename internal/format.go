@@ -10,10 +10,18 @@ import (
 
 /*
 -------------------------------------------------
-| checksum | tombstone | timestamp | key_size | value_size | key | value |
+| checksum | tombstone | flags | timestamp | key_size | value_size | key | value |
 -------------------------------------------------
 */
-const headerSize = 17
+const headerSize = 22
+
+// Header flags
+const (
+	flagBlobPointer    uint8 = 1 << iota // value holds a blobPointer into a blob file instead of the actual value
+	flagRangeTombstone                   // tombstone covering [key, value), an empty value means no upper bound
+	flagMergeOperand                     // value holds merge operands to be applied on top of the older versions of the key
+	flagSiblings                         // value holds the concurrent versions of the key, see siblings.go
+)
 
 // Metadata about the KV pair, which is what we insert into the keydir
 type KeyEntry struct {
@@ -25,15 +33,16 @@ type KeyEntry struct {
 type Header struct {
 	CheckSum  uint32
 	Tombstone uint8
-	TimeStamp uint32
+	Flags     uint8
+	TimeStamp uint64 // hybrid logical clock (see hlc.go), strictly increasing per store so every version of a key is ordered
 	KeySize   uint32
 	ValueSize uint32
 }
 
 type Record struct {
 	Header    Header
-	Key       string
-	Value     string
+	Key       []byte
+	Value     []byte
 	TotalSize uint32
 }
 
@@ -48,6 +57,7 @@ func NewKeyEntry(timestamp, position, totalSize uint32) KeyEntry {
 func (h *Header) encodeHeader(buf *bytes.Buffer) error {
 	err := binary.Write(buf, binary.LittleEndian, &h.CheckSum)
 	binary.Write(buf, binary.LittleEndian, &h.Tombstone)
+	binary.Write(buf, binary.LittleEndian, &h.Flags)
 	binary.Write(buf, binary.LittleEndian, &h.TimeStamp)
 	binary.Write(buf, binary.LittleEndian, &h.KeySize)
 	binary.Write(buf, binary.LittleEndian, &h.ValueSize)
@@ -63,9 +73,10 @@ func (h *Header) decodeHeader(buf []byte) error {
 	// must pass in reference b/c go is call by value and won't modify original otherwise
 	_, err := binary.Decode(buf[:4], binary.LittleEndian, &h.CheckSum)
 	binary.Decode(buf[4:5], binary.LittleEndian, &h.Tombstone)
-	binary.Decode(buf[5:9], binary.LittleEndian, &h.TimeStamp)
-	binary.Decode(buf[9:13], binary.LittleEndian, &h.KeySize)
-	binary.Decode(buf[13:17], binary.LittleEndian, &h.ValueSize)
+	binary.Decode(buf[5:6], binary.LittleEndian, &h.Flags)
+	binary.Decode(buf[6:14], binary.LittleEndian, &h.TimeStamp)
+	binary.Decode(buf[14:18], binary.LittleEndian, &h.KeySize)
+	binary.Decode(buf[18:22], binary.LittleEndian, &h.ValueSize)
 
 	if err != nil {
 		return utils.ErrDecodingHeaderFailed
@@ -76,32 +87,49 @@ func (h *Header) decodeHeader(buf []byte) error {
 
 func (r *Record) EncodeKV(buf *bytes.Buffer) error {
 	r.Header.encodeHeader(buf)
-	_, err := buf.WriteString(r.Key)
+	_, err := buf.Write(r.Key)
 	if err != nil {
 		return err
 	}
-	_, err = buf.WriteString(r.Value)
+	_, err = buf.Write(r.Value)
 	return err
 }
 
 func (r *Record) DecodeKV(buf []byte) error {
+	if len(buf) < headerSize {
+		return utils.ErrDecodingKVFailed
+	}
 	err := r.Header.decodeHeader(buf[:headerSize])
 	if err != nil {
 		return err
 	}
-	r.Key = string(buf[headerSize : headerSize+r.Header.KeySize])
-	r.Value = string(buf[headerSize+r.Header.KeySize : headerSize+r.Header.KeySize+r.Header.ValueSize])
+	if uint64(len(buf)) < uint64(headerSize)+uint64(r.Header.KeySize)+uint64(r.Header.ValueSize) {
+		return utils.ErrDecodingKVFailed
+	}
+	r.Key = buf[headerSize : headerSize+r.Header.KeySize]
+	r.Value = buf[headerSize+r.Header.KeySize : headerSize+r.Header.KeySize+r.Header.ValueSize]
 	r.TotalSize = headerSize + r.Header.KeySize + r.Header.ValueSize
 	return nil
 }
 
+func (r *Record) isRangeTombstone() bool {
+	return r.Header.Tombstone == 1 && r.Header.Flags&flagRangeTombstone != 0
+}
+
+// covers reports whether this range tombstone deletes the given version of a key
+func (r *Record) covers(key []byte, timestamp uint64) bool {
+	return r.Header.TimeStamp > timestamp && bytes.Compare(key, r.Key) >= 0 &&
+		(len(r.Value) == 0 || bytes.Compare(key, r.Value) < 0)
+}
+
 func (r *Record) CalculateChecksum() uint32 {
 	headerBuf := new(bytes.Buffer)
 	binary.Write(headerBuf, binary.LittleEndian, &r.Header.Tombstone)
+	binary.Write(headerBuf, binary.LittleEndian, &r.Header.Flags)
 	binary.Write(headerBuf, binary.LittleEndian, &r.Header.TimeStamp)
 	binary.Write(headerBuf, binary.LittleEndian, &r.Header.KeySize)
 	binary.Write(headerBuf, binary.LittleEndian, &r.Header.ValueSize)
-	data := append([]byte(r.Key), []byte(r.Value)...)
-	buf := append(headerBuf.Bytes(), data...)
-	return crc32.ChecksumIEEE(buf)
+	headerBuf.Write(r.Key)
+	headerBuf.Write(r.Value)
+	return crc32.ChecksumIEEE(headerBuf.Bytes())
 }
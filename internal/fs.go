@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+/*
+FS -- every file the storage engine touches goes through this, so tests can swap the disk out
+for MemFS and simulate crashes
+*/
+
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir returns the names of the entries in the directory, sorted
+	ReadDir(name string) ([]string, error)
+	// SyncDir makes file creations, renames and removals within the directory durable
+	SyncDir(name string) error
+}
+
+// File is the subset of *os.File the storage engine uses
+type File interface {
+	io.Writer
+	io.ReaderAt
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Name() string
+}
+
+// osFS is the real disk
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDir(name string) ([]string, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (osFS) SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// dirFS is the real disk, with the store's files under root instead of next to the working directory
+type dirFS struct {
+	root string
+}
+
+// the store names its files relative to the parent of the working directory
+func (d dirFS) path(name string) string {
+	return filepath.Join(d.root, strings.TrimPrefix(name, "../"))
+}
+
+func (d dirFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(d.path(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return dirFile{File: file, name: name}, nil
+}
+
+func (d dirFS) Remove(name string) error {
+	return os.Remove(d.path(name))
+}
+
+func (d dirFS) Rename(oldpath, newpath string) error {
+	return os.Rename(d.path(oldpath), d.path(newpath))
+}
+
+func (d dirFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(d.path(path), perm)
+}
+
+func (d dirFS) ReadDir(name string) ([]string, error) {
+	return osFS{}.ReadDir(d.path(name))
+}
+
+func (d dirFS) SyncDir(name string) error {
+	return osFS{}.SyncDir(d.path(name))
+}
+
+// dirFile keeps the name the file was opened with, the store passes it back to the FS
+type dirFile struct {
+	*os.File
+	name string
+}
+
+func (f dirFile) Name() string {
+	return f.name
+}
+
+// WithDataDir keeps the store's files under dir
+func WithDataDir(dir string) StoreOption {
+	return WithFS(dirFS{root: dir})
+}
+
+func openReadOnly(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// readFile reads the whole file
+func readFile(fs FS, name string) ([]byte, error) {
+	file, err := openReadOnly(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, info.Size())
+	if _, err := file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WithFS makes the store keep its files on fs instead of the real disk
+func WithFS(fs FS) StoreOption {
+	return func(ds *DiskStore) {
+		ds.fs = fs
+	}
+}
@@ -0,0 +1,539 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
+	"google.golang.org/grpc"
+)
+
+/*
+Gossip -- every node learns who is in the cluster, and who is alive, from the other nodes instead of a central list.
+
+Every member keeps a view of the cluster: for each member its address, status (joining, on the ring or left) and a heartbeat that
+the member itself bumps every round. Every round a node bumps its own heartbeat and swaps views with a random peer over
+gRPC (GossipService), both keep the newest state of each member: the newest generation (a restarted member starts a new
+one), then the highest heartbeat. A heartbeat spreads through the cluster in a few rounds. A ring change can't wait for
+that, whoever drives it announces it to every member right away, see router.go.
+
+Whoever sees a member's heartbeat go up feeds the time since the last one into a phi-accrual failure detector for it.
+Instead of a fixed timeout, phi is how unlikely it is that a heartbeat is still on its way given the intervals seen so
+far: phi = -log10(P(the next heartbeat comes later than now)). Past the threshold the member is considered down, until
+its heartbeat goes up again.
+*/
+
+const (
+	DefaultGossipInterval = time.Second
+	DefaultPhiThreshold   = 8.0
+	// the last intervals between heartbeats a failure detector estimates the next from
+	phiWindowSize = 100
+)
+
+// memberState is what the cluster knows about a member, as it spreads through gossip
+type memberState struct {
+	id         string
+	generation uint64
+	heartbeat  uint64
+	joining    bool // not on the ring until it took over its share of the keys
+	left       bool
+}
+
+// newer reports whether s is a newer state of the member than other. joining, then leaving, is final for a generation,
+// whatever heartbeats the member sent before
+func (s memberState) newer(other memberState) bool {
+	if s.generation != other.generation {
+		return s.generation > other.generation
+	}
+	if s.left != other.left {
+		return s.left
+	}
+	if s.joining != other.joining {
+		return !s.joining
+	}
+	return s.heartbeat > other.heartbeat
+}
+
+// phiDetector is the phi-accrual failure detector of a single member
+type phiDetector struct {
+	intervals []float64 // milliseconds, the last phiWindowSize
+	next      int
+	last      time.Time
+	// the interval heartbeats are expected at, and how long one can be late on top of the intervals seen so far
+	expected time.Duration
+}
+
+func newPhiDetector(expected time.Duration, now time.Time) *phiDetector {
+	// as if a heartbeat just came in at the expected interval, so a member isn't down before it had a chance
+	ms := float64(expected.Milliseconds())
+	return &phiDetector{intervals: []float64{ms - ms/4, ms + ms/4}, last: now, expected: expected}
+}
+
+// heartbeat records a heartbeat coming in at now
+func (d *phiDetector) heartbeat(now time.Time) {
+	interval := float64(now.Sub(d.last).Milliseconds())
+	d.last = now
+	if len(d.intervals) < phiWindowSize {
+		d.intervals = append(d.intervals, interval)
+		return
+	}
+	d.intervals[d.next] = interval
+	d.next = (d.next + 1) % phiWindowSize
+}
+
+// phi of no heartbeat having come in since the last one, by now. the intervals are taken to be normally distributed
+func (d *phiDetector) phi(now time.Time) float64 {
+	var mean, variance float64
+	for _, interval := range d.intervals {
+		mean += interval
+	}
+	mean /= float64(len(d.intervals))
+	for _, interval := range d.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	variance /= float64(len(d.intervals))
+
+	// a heartbeat passed along by gossip can take a round or two more, and perfectly regular ones make for a
+	// detector that convicts on the first late heartbeat
+	mean += float64(d.expected.Milliseconds())
+	stddev := max(math.Sqrt(variance), float64(d.expected.Milliseconds())/4)
+
+	elapsed := float64(now.Sub(d.last).Milliseconds())
+	later := 0.5 * math.Erfc((elapsed-mean)/(stddev*math.Sqrt2))
+	if later <= 0 {
+		// as sure as a float64 can tell
+		return -math.Log10(math.SmallestNonzeroFloat64)
+	}
+	return -math.Log10(later)
+}
+
+// gossiper is a member's view of the cluster. a gossiper without an address of its own only observes: it learns the
+// cluster's state from the nodes without being part of it
+type gossiper struct {
+	mu        sync.Mutex
+	self      string
+	members   map[string]memberState
+	detectors map[string]*phiDetector
+	down      map[string]bool // convicted by the failure detector
+	seeds     []string        // asked when no other member is known yet
+	clock     *hybridClock
+	conns     map[string]*grpc.ClientConn
+
+	interval     time.Duration
+	phiThreshold float64
+	onUp         func(addr string) // called when a member convicted earlier comes back
+	callbacks    sync.WaitGroup    // the onUp calls under way, close waits for them
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// newGossiper returns a gossiper that gossips every interval once started, as the member at self (with the given id)
+// or as an observer if self is empty
+func newGossiper(self, id string, seeds []string, clock *hybridClock, interval time.Duration, phiThreshold float64) *gossiper {
+	g := &gossiper{
+		self:         self,
+		members:      make(map[string]memberState),
+		detectors:    make(map[string]*phiDetector),
+		down:         make(map[string]bool),
+		seeds:        slices.DeleteFunc(slices.Clone(seeds), func(seed string) bool { return seed == self }),
+		clock:        clock,
+		conns:        make(map[string]*grpc.ClientConn),
+		interval:     interval,
+		phiThreshold: phiThreshold,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if self != "" {
+		g.members[self] = memberState{id: id, generation: uint64(time.Now().UnixNano())}
+	}
+	return g
+}
+
+func (g *gossiper) start() {
+	go g.run()
+}
+
+func (g *gossiper) run() {
+	defer close(g.done)
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.round()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// close stops gossiping, the member's heartbeat stops going up. returns once the onUp calls under way are done
+func (g *gossiper) close() {
+	close(g.stop)
+	<-g.done
+	// a merge that held mu before this started its onUp calls already, the ones after it see stop and start none
+	g.mu.Lock()
+	for _, conn := range g.conns {
+		conn.Close()
+	}
+	g.mu.Unlock()
+	g.callbacks.Wait()
+}
+
+// stopped reports whether close was called
+func (g *gossiper) stopped() bool {
+	select {
+	case <-g.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// round bumps the member's own heartbeat and swaps views with a random peer
+func (g *gossiper) round() {
+	g.mu.Lock()
+	if state, ok := g.members[g.self]; ok && !state.left {
+		state.heartbeat++
+		g.members[g.self] = state
+	}
+	peer := g.pickPeer()
+	conn := g.conn(peer)
+	msg := g.message()
+	g.mu.Unlock()
+	if peer == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.interval)
+	defer cancel()
+	res, err := proto.NewGossipServiceClient(conn).Gossip(ctx, msg)
+	if err == nil {
+		g.merge(res.Members)
+	}
+	g.checkDown()
+}
+
+// learn gets the view of the cluster of a random peer without telling it of the member. reports whether the cluster had
+// the member on the ring already, under an earlier generation: it restarted rather than joined
+func (g *gossiper) learn() bool {
+	g.mu.Lock()
+	peer := g.pickPeer()
+	conn := g.conn(peer)
+	msg := g.message()
+	msg.Members = slices.DeleteFunc(msg.Members, func(m *proto.MemberState) bool { return m.Addr == g.self })
+	g.mu.Unlock()
+	if peer == "" {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.interval)
+	defer cancel()
+	res, err := proto.NewGossipServiceClient(conn).Gossip(ctx, msg)
+	if err != nil {
+		fmt.Printf("gossip: could not learn the cluster from %s: %v\n", peer, err)
+		return false
+	}
+	g.merge(res.Members)
+	return slices.ContainsFunc(res.Members, func(m *proto.MemberState) bool {
+		return m.Addr == g.self && m.Status == proto.MemberStatus_NORMAL
+	})
+}
+
+// announce swaps views with every member that isn't down at once, instead of with one per round. returns once they all
+// answered or the round is over
+func (g *gossiper) announce() {
+	g.mu.Lock()
+	conns := make(map[string]*grpc.ClientConn)
+	for addr := range g.members {
+		if addr != g.self && !g.down[addr] {
+			conns[addr] = g.conn(addr)
+		}
+	}
+	msg := g.message()
+	g.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.interval)
+	defer cancel()
+	var wg sync.WaitGroup
+	for addr, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := proto.NewGossipServiceClient(conn).Gossip(ctx, msg)
+			if err != nil {
+				fmt.Printf("gossip: could not announce to %s: %v\n", addr, err)
+				return
+			}
+			g.merge(res.Members)
+		}()
+	}
+	wg.Wait()
+}
+
+// conn returns the gossiper's connection to the peer, nil for no peer. the caller holds g.mu
+func (g *gossiper) conn(peer string) *grpc.ClientConn {
+	if peer == "" {
+		return nil
+	}
+	conn := g.conns[peer]
+	if conn == nil {
+		conn = dialNode(peer, g.clock)
+		g.conns[peer] = conn
+	}
+	return conn
+}
+
+// pickPeer picks a random member that's up, or now and then one that's down to find out it's back.
+// a seed if no other member is known. the caller holds g.mu
+func (g *gossiper) pickPeer() string {
+	var up, down []string
+	for addr, state := range g.members {
+		if addr == g.self || state.left {
+			continue
+		}
+		if g.down[addr] {
+			down = append(down, addr)
+		} else {
+			up = append(up, addr)
+		}
+	}
+	switch {
+	case len(down) > 0 && rand.Intn(len(up)+1) == 0:
+		return down[rand.Intn(len(down))]
+	case len(up) > 0:
+		return up[rand.Intn(len(up))]
+	case len(g.seeds) > 0:
+		return g.seeds[rand.Intn(len(g.seeds))]
+	}
+	return ""
+}
+
+// message is the gossiper's view of the cluster. the caller holds g.mu
+func (g *gossiper) message() *proto.GossipMessage {
+	msg := &proto.GossipMessage{From: g.self}
+	for addr, state := range g.members {
+		status := proto.MemberStatus_NORMAL
+		switch {
+		case state.left:
+			status = proto.MemberStatus_LEFT
+		case state.joining:
+			status = proto.MemberStatus_JOINING
+		}
+		msg.Members = append(msg.Members, &proto.MemberState{
+			Addr:       addr,
+			Id:         state.id,
+			Generation: state.generation,
+			Heartbeat:  state.heartbeat,
+			Status:     status,
+		})
+	}
+	return msg
+}
+
+// merge keeps the newer state of every member, a member's heartbeat going up counts as a heartbeat from it
+func (g *gossiper) merge(members []*proto.MemberState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for _, m := range members {
+		// nobody knows better than the member itself, unless it has been removed from the cluster
+		if m.Addr == g.self {
+			self := g.members[g.self]
+			if m.Status == proto.MemberStatus_LEFT && !self.left && m.Generation == self.generation {
+				self.left = true
+				g.members[g.self] = self
+				fmt.Printf("gossip: node addr = %s was removed from the cluster\n", g.self)
+			}
+			continue
+		}
+		state := memberState{
+			id:         m.Id,
+			generation: m.Generation,
+			heartbeat:  m.Heartbeat,
+			joining:    m.Status == proto.MemberStatus_JOINING,
+			left:       m.Status == proto.MemberStatus_LEFT,
+		}
+		known, ok := g.members[m.Addr]
+		if ok && !state.newer(known) {
+			continue
+		}
+		g.members[m.Addr] = state
+
+		detector, ok := g.detectors[m.Addr]
+		switch {
+		case !ok || state.generation != known.generation:
+			// a new member, or a member that restarted, its downtime says nothing about its heartbeats
+			g.detectors[m.Addr] = newPhiDetector(g.interval, now)
+		case state.heartbeat != known.heartbeat:
+			detector.heartbeat(now)
+		}
+		if g.down[m.Addr] && !state.left {
+			delete(g.down, m.Addr)
+			fmt.Printf("gossip: node addr = %s is up\n", m.Addr)
+			if g.onUp != nil && !g.stopped() {
+				g.callbacks.Add(1)
+				go func(addr string) {
+					defer g.callbacks.Done()
+					g.onUp(addr)
+				}(m.Addr)
+			}
+		}
+	}
+}
+
+// checkDown convicts the members whose phi went past the threshold
+func (g *gossiper) checkDown() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for addr, detector := range g.detectors {
+		if g.down[addr] || g.members[addr].left {
+			continue
+		}
+		if phi := detector.phi(now); phi > g.phiThreshold {
+			g.down[addr] = true
+			fmt.Printf("gossip: node addr = %s is down, phi = %.1f\n", addr, phi)
+		}
+	}
+}
+
+// alive reports whether the member is up as far as the gossiper knows, a member it hasn't heard of yet included
+func (g *gossiper) alive(addr string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return !g.down[addr] && !g.members[addr].left
+}
+
+// leave marks a member as removed from the cluster, state being its newest state known
+func (g *gossiper) leave(addr string, state memberState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state.left = true
+	g.members[addr] = state
+	delete(g.down, addr)
+}
+
+// setJoining marks the member as joining the cluster, or as done joining it: it goes on the ring
+func (g *gossiper) setJoining(joining bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state := g.members[g.self]
+	state.joining = joining
+	g.members[g.self] = state
+}
+
+// state returns the member's own state
+func (g *gossiper) state() memberState {
+	return g.member(g.self)
+}
+
+// member returns the newest state of the member the gossiper knows of
+func (g *gossiper) member(addr string) memberState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.members[addr]
+}
+
+// ring returns the members on the hash ring, sorted
+func (g *gossiper) ring() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var addrs []string
+	for addr, state := range g.members {
+		if !state.left && !state.joining {
+			addrs = append(addrs, addr)
+		}
+	}
+	slices.Sort(addrs)
+	return addrs
+}
+
+// view returns every member the gossiper knows of, sorted by address
+func (g *gossiper) view() []utils.Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	var members []utils.Member
+	for addr, state := range g.members {
+		m := utils.Member{Addr: addr, ID: state.id, Generation: state.generation, Heartbeat: state.heartbeat, Status: utils.MemberUp}
+		if detector, ok := g.detectors[addr]; ok {
+			m.Phi = detector.phi(now)
+		}
+		switch {
+		case state.left:
+			m.Status = utils.MemberLeft
+		case g.down[addr]:
+			m.Status = utils.MemberDown
+		case state.joining:
+			m.Status = utils.MemberJoining
+		}
+		members = append(members, m)
+	}
+	slices.SortFunc(members, func(a, b utils.Member) int {
+		return cmp.Compare(a.Addr, b.Addr)
+	})
+	return members
+}
+
+type gossipServer struct {
+	proto.UnimplementedGossipServiceServer
+
+	underlyingNode *Node
+}
+
+func (s *gossipServer) Gossip(ctx context.Context, req *proto.GossipMessage) (*proto.GossipMessage, error) {
+	g := s.underlyingNode.gossip
+	g.merge(req.Members)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.message(), nil
+}
+
+// WithGossipInterval sets how often nodes gossip, and the interval the failure detector expects heartbeats at
+func WithGossipInterval(interval time.Duration) ClusterOption {
+	return func(c *Cluster) {
+		c.gossipInterval = interval
+	}
+}
+
+// WithPhiThreshold sets the phi past which the failure detector considers a node down, higher is slower to
+// notice a node went down but makes fewer mistakes
+func WithPhiThreshold(phi float64) ClusterOption {
+	return func(c *Cluster) {
+		c.phiThreshold = phi
+	}
+}
+
+// isDown reports whether the node was taken down or the failure detector considers it down, requests avoid it
+func (c *Cluster) isDown(node *Node) bool {
+	return node.down.Load() || !c.gossip.alive(node.Addr)
+}
+
+// startGossip starts the node's gossiper, seeded with the cluster's other nodes
+func (c *Cluster) startGossip(node *Node, seeds []string) {
+	node.gossip = newGossiper(node.Addr, node.ID, seeds, node.Store.clock, c.gossipInterval, c.phiThreshold)
+	node.gossip.start()
+}
+
+// nodeAddrs returns the addresses of the cluster's nodes
+func (c *Cluster) nodeAddrs() []string {
+	nodes := c.Nodes()
+	addrs := make([]string, 0, len(nodes))
+	for addr := range nodes {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Members returns the cluster's membership as gossip has it
+func (c *Cluster) Members() []utils.Member {
+	return c.gossip.view()
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
+)
+
+// a node that stops answering without being taken down is found out by the failure detector, requests avoid it
+// until its heartbeat goes up again
+func TestFailureDetection(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(3), WithGossipInterval(50*time.Millisecond))
+	key := []byte("cart")
+	crashed := c.replicaNodes(key)[0]
+	waitFor(t, "every node to be heard of", func() bool {
+		return len(c.gossip.ring()) == 3
+	})
+
+	// the process is gone as far as the others can tell, the cluster wasn't told
+	crashed.gossip.close()
+	crashed.server.Stop()
+	restarted := false
+	restart := func() {
+		c.startGossip(crashed, c.nodeAddrs())
+		crashed.server = StartGRPCServer(crashed.Addr, crashed)
+		restarted = true
+	}
+	t.Cleanup(func() {
+		if !restarted {
+			restart()
+		}
+	})
+
+	waitFor(t, crashed.Addr+" to be considered down", func() bool {
+		return c.isDown(crashed)
+	})
+	if crashed.down.Load() {
+		t.Fatal("the node was taken down, not found out")
+	}
+	if coordinator := c.coordinator(key); coordinator == crashed {
+		t.Fatalf("%s still coordinates %s once it's considered down", crashed.Addr, key)
+	}
+	if _, err := c.Set(key, []byte("apples"), utils.ConsistencyOne); err != nil {
+		t.Fatalf("set with a replica down: %v", err)
+	}
+	if pending := c.HintStats().Pending[crashed.Addr]; pending != 1 {
+		t.Fatalf("%d hint(s) for the node that's down, want 1", pending)
+	}
+
+	// a restarted node gossips a new generation, it's up as soon as that reaches the cluster
+	restart()
+	waitFor(t, crashed.Addr+" to be considered up", func() bool {
+		return !c.isDown(crashed)
+	})
+	waitFor(t, "the hint to be delivered", func() bool {
+		value, err := crashed.Store.Get(key)
+		return err == nil && string(value) == "apples"
+	})
+}
+
+// close waits for the onUp calls under way, and a member coming back after it doesn't start any
+func TestGossiperCloseWaitsForOnUp(t *testing.T) {
+	g := newGossiper("", "", nil, newHybridClock(0), time.Hour, DefaultPhiThreshold)
+	started, release := make(chan string, 2), make(chan struct{})
+	g.onUp = func(addr string) {
+		started <- addr
+		<-release
+	}
+	g.start()
+
+	comeBack := func(addr string) {
+		g.mu.Lock()
+		g.down[addr] = true
+		generation := g.members[addr].generation + 1
+		g.mu.Unlock()
+		g.merge([]*proto.MemberState{{Addr: addr, Generation: generation}})
+	}
+	comeBack(":1")
+	if addr := <-started; addr != ":1" {
+		t.Fatalf("onUp called for %s, want :1", addr)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		g.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("close returned with an onUp call under way")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-closed
+
+	comeBack(":2")
+	select {
+	case addr := <-started:
+		t.Fatalf("onUp called for %s after close", addr)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
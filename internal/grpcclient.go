@@ -10,12 +10,28 @@ import (
 	"github.com/jateen67/kv/proto"
 )
 
-func StartGRPCClient(destNodeAddr string) (proto.DataMigrationServiceClient, *grpc.ClientConn) {
-	conn, err := grpc.NewClient(destNodeAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+// dialNode connects to the node at addr, every call carries clock: the clock of the node making it.
+// addr is dialed as is, gRPC's default DNS resolver would also look up a service config for it first
+func dialNode(addr string, clock *hybridClock) *grpc.ClientConn {
+	conn, err := grpc.NewClient("passthrough:///"+addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(clock.unaryClientInterceptor),
+		grpc.WithStreamInterceptor(clock.streamClientInterceptor),
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return conn
+}
+
+func StartGRPCClient(destNodeAddr string, clock *hybridClock) (proto.DataMigrationServiceClient, *grpc.ClientConn) {
+	conn := dialNode(destNodeAddr, clock)
 	fmt.Println("grpc client started on port ", destNodeAddr)
 	client := proto.NewDataMigrationServiceClient(conn)
 	return client, conn
 }
+
+func StartAntiEntropyClient(destNodeAddr string, clock *hybridClock) (proto.AntiEntropyServiceClient, *grpc.ClientConn) {
+	conn := dialNode(destNodeAddr, clock)
+	return proto.NewAntiEntropyServiceClient(conn), conn
+}
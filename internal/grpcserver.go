@@ -2,12 +2,16 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 
 	"github.com/jateen67/kv/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type dataMigrationServer struct {
@@ -22,13 +26,15 @@ func (d *dataMigrationServer) MigrateKeyValuePairs(ctx context.Context, req *pro
 
 	for i := range req.KvPairs {
 		fmt.Println("storing data into node at address ", d.underlyingNode.Addr)
-		d.underlyingNode.Store.PutRecordFromGRPC(req.KvPairs[i].Record)
-
 		res := proto.MigrationResult{
 			Key:      req.KvPairs[i].Record.Key,
 			Success:  true,
 			ErrorMsg: "",
 		}
+		if err := d.underlyingNode.Store.PutRecordFromGRPC(req.KvPairs[i].Record); err != nil {
+			res.Success = false
+			res.ErrorMsg = err.Error()
+		}
 		migrationResults = append(migrationResults, &res)
 	}
 
@@ -39,20 +45,96 @@ func (d *dataMigrationServer) MigrateKeyValuePairs(ctx context.Context, req *pro
 	}, nil
 }
 
+// MigrateStream stores every chunk it gets and acknowledges it, chunks are taken one at a time so a sender that
+// gets ahead is held back by the stream's flow control
+func (d *dataMigrationServer) MigrateStream(stream grpc.BidiStreamingServer[proto.MigrationChunk, proto.MigrationAck]) error {
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ack := &proto.MigrationAck{Seq: chunk.Seq}
+		for _, pair := range chunk.KvPairs {
+			if pair.Record == nil || pair.Record.Header == nil {
+				ack.Failures = append(ack.Failures, &proto.MigrationResult{ErrorMsg: "record without a header"})
+				continue
+			}
+			if err := d.underlyingNode.Store.PutRecord(convertProtoRecordToStoreRecord(pair.Record)); err != nil {
+				ack.Failures = append(ack.Failures, &proto.MigrationResult{Key: pair.Record.Key, ErrorMsg: err.Error()})
+			}
+		}
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+type antiEntropyServer struct {
+	proto.UnimplementedAntiEntropyServiceServer
+
+	underlyingNode *Node
+}
+
+func (a *antiEntropyServer) GetMerkleNodes(ctx context.Context, req *proto.MerkleNodesRequest) (*proto.MerkleNodesResponse, error) {
+	if req.Range == nil || req.Depth > maxMerkleTreeDepth {
+		return nil, status.Errorf(codes.InvalidArgument, "need a range and a depth of at most %d", maxMerkleTreeDepth)
+	}
+	tree, err := a.underlyingNode.merkleTree(tokenRange{start: req.Range.Start, end: req.Range.End}, int(req.Depth), req.Rebuild)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	hashes := make([][]byte, len(req.Indexes))
+	for i, index := range req.Indexes {
+		if index == 0 || int(index) >= len(tree.hashes) {
+			return nil, status.Errorf(codes.InvalidArgument, "no tree node %d at depth %d", index, req.Depth)
+		}
+		hashes[i] = tree.hashes[index][:]
+	}
+	return &proto.MerkleNodesResponse{Hashes: hashes}, nil
+}
+
+func (a *antiEntropyServer) StreamRange(req *proto.RangeRecordsRequest, stream grpc.ServerStreamingServer[proto.Record]) error {
+	if req.Range == nil || req.Depth > maxMerkleTreeDepth {
+		return status.Errorf(codes.InvalidArgument, "need a range and a depth of at most %d", maxMerkleTreeDepth)
+	}
+	records, err := a.underlyingNode.Store.leafRecords(tokenRange{start: req.Range.Start, end: req.Range.End}, int(req.Depth), req.Leaves)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	for i := range records {
+		if err := stream.Send(convertStoreRecordToProtoRecord(&records[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func StartGRPCServer(addr string, node *Node) *grpc.Server {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	server := grpc.NewServer()
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(node.Store.clock.unaryServerInterceptor),
+		grpc.StreamInterceptor(node.Store.clock.streamServerInterceptor),
+	)
 	service := &dataMigrationServer{underlyingNode: node}
 	proto.RegisterDataMigrationServiceServer(server, service)
+	proto.RegisterAntiEntropyServiceServer(server, &antiEntropyServer{underlyingNode: node})
+	proto.RegisterGossipServiceServer(server, &gossipServer{underlyingNode: node})
+	proto.RegisterReplicaServiceServer(server, &replicaServer{underlyingNode: node})
+	proto.RegisterKVServiceServer(server, &kvServer{underlyingNode: node})
 
 	go func() {
 		fmt.Println("gRPC server started @ port ", addr)
 		err = server.Serve(ln)
-		if err != nil {
+		// a node that leaves right after joining may be stopped before it's served
+		if err != nil && !errors.Is(err, grpc.ErrServerStopped) {
 			log.Fatalf("failed to start gRPC server: %v", err)
 		}
 	}()
@@ -0,0 +1,372 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Hinted handoff -- a write for a replica that's down is kept by the coordinator as a hint, and handed to the
+replica over gRPC once it's back. Hints don't count towards a write's consistency level.
+
+The hint log holds every hint that wasn't delivered yet, it's rewritten (temp file + fsync + rename) once
+hints get delivered or expire. it lives with the stores and is encrypted like them: it starts with the key id its
+hints are sealed with (0 if they aren't), a rewrite picks up the current key
+-----------------------------------------------------------------------------------------------
+| key_id | hint_size | addr_size | target addr | stored_at | record | hint_size | ... |
+-----------------------------------------------------------------------------------------------
+addr_size + target addr + stored_at + record are sealed together when the log is encrypted
+*/
+
+const (
+	HINTS_FILENAME string = "hints.log"
+	// hints older than this are dropped, the replica is left to anti-entropy by then
+	DefaultHintTTL = 3 * time.Hour
+	// how often the coordinator tries to hand its hints to the replicas that are back
+	hintDeliveryInterval = 10 * time.Second
+)
+
+type hint struct {
+	seq      uint64 // tells hints apart while they're being delivered
+	target   string
+	storedAt time.Time
+	record   Record
+}
+
+// HintStats counts what happened to hints so far, and how many are still waiting per target node
+type HintStats struct {
+	Pending   map[string]int
+	Stored    uint64
+	Delivered uint64
+	Expired   uint64
+}
+
+type hintLog struct {
+	mu         sync.Mutex
+	fs         FS
+	filename   string
+	file       File
+	encryption *encryptor
+	keyID      uint32
+	size       int // where the next hint goes
+	ttl        time.Duration
+	seq        uint64
+	pending    []hint
+	stats      HintStats
+}
+
+// openHintLog loads the hints a previous run of the coordinator didn't deliver
+func openHintLog(fs FS, dir string, ttl time.Duration, enc *encryptor) (*hintLog, error) {
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h := &hintLog{fs: fs, filename: filepath.Join(dir, HINTS_FILENAME), encryption: enc, ttl: ttl}
+
+	data, err := readFile(fs, h.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// a new log, or one that crashed before its header made it
+	torn := len(data) < fileKeyIDSize
+	if !torn {
+		h.keyID = binary.LittleEndian.Uint32(data)
+		// hints sealed with a key that's gone would all look torn, and be dropped
+		if h.keyID != 0 {
+			if _, err := enc.aead(h.keyID); err != nil {
+				return nil, fmt.Errorf("hint log %s: %w", h.filename, err)
+			}
+		}
+	}
+	for offset := fileKeyIDSize; !torn && offset < len(data); {
+		entry, size := h.decodeHint(data[offset:], offset)
+		if size == 0 {
+			torn = true
+			break
+		}
+		h.seq++
+		entry.seq = h.seq
+		h.pending = append(h.pending, entry)
+		offset += size
+	}
+	h.size = len(data)
+	// a crash mid-append leaves a partial hint at the end, new hints have to follow the valid ones
+	if torn {
+		if err := h.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+
+	h.file, err = fs.OpenFile(h.filename, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// add durably stores a hint for the target node
+func (h *hintLog) add(target string, record Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	entry := hint{seq: h.seq, target: target, storedAt: time.Now(), record: record}
+	buf, err := h.encodeHint(entry, h.size)
+	if err != nil {
+		return err
+	}
+	if err := writeToFile(buf, h.file); err != nil {
+		return err
+	}
+	h.size += len(buf)
+	h.pending = append(h.pending, entry)
+	h.stats.Stored++
+	return nil
+}
+
+// due drops the expired hints and returns the rest, by target node
+func (h *hintLog) due() map[string][]hint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	byTarget := make(map[string][]hint)
+	live := h.pending[:0]
+	for _, entry := range h.pending {
+		if time.Since(entry.storedAt) > h.ttl {
+			h.stats.Expired++
+			continue
+		}
+		live = append(live, entry)
+		byTarget[entry.target] = append(byTarget[entry.target], entry)
+	}
+	if len(live) < len(h.pending) {
+		h.pending = live
+		if err := h.rewrite(); err != nil {
+			fmt.Println("hint log rewrite err:", err)
+		}
+	}
+	return byTarget
+}
+
+// delivered removes the hints that made it to their target
+func (h *hintLog) delivered(hints []hint) error {
+	if len(hints) == 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	done := make(map[uint64]bool, len(hints))
+	for _, entry := range hints {
+		done[entry.seq] = true
+	}
+	live := h.pending[:0]
+	for _, entry := range h.pending {
+		if done[entry.seq] {
+			h.stats.Delivered++
+			continue
+		}
+		live = append(live, entry)
+	}
+	h.pending = live
+	return h.rewrite()
+}
+
+func (h *hintLog) statistics() HintStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := h.stats
+	stats.Pending = make(map[string]int)
+	for _, entry := range h.pending {
+		stats.Pending[entry.target]++
+	}
+	return stats
+}
+
+// rewrite replaces the log with the pending hints, sealed with the current key. the caller holds h.mu
+func (h *hintLog) rewrite() error {
+	keyID, err := h.encryption.currentKeyID()
+	if err != nil {
+		return err
+	}
+	h.keyID = keyID
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, keyID)
+	for _, entry := range h.pending {
+		encoded, err := h.encodeHint(entry, buf.Len())
+		if err != nil {
+			return err
+		}
+		buf.Write(encoded)
+	}
+	if err := writeSyncedFile(h.fs, h.filename+TEMP_FILE_EXTENSION, buf.Bytes()); err != nil {
+		return err
+	}
+	if err := h.fs.Rename(h.filename+TEMP_FILE_EXTENSION, h.filename); err != nil {
+		return err
+	}
+	if err := h.fs.SyncDir(filepath.Dir(h.filename)); err != nil {
+		return err
+	}
+	h.size = buf.Len()
+	// the renamed file replaced the one the appends went to
+	if h.file == nil {
+		return nil
+	}
+	h.file.Close()
+	file, err := h.fs.OpenFile(h.filename, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	h.file = file
+	return nil
+}
+
+func (h *hintLog) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.file.Close()
+}
+
+// encodeHint encodes the hint that goes at offset in the log
+func (h *hintLog) encodeHint(entry hint, offset int) ([]byte, error) {
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.LittleEndian, uint16(len(entry.target)))
+	body.WriteString(entry.target)
+	binary.Write(body, binary.LittleEndian, uint64(entry.storedAt.UnixNano()))
+	entry.record.EncodeKV(body)
+	payload, err := h.encryption.seal(h.keyID, body.Bytes(), associatedData(h.filename, uint64(offset)))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// decodeHint decodes the hint at the start of data, found at offset in the log. a size of 0 means it's incomplete or corrupted
+func (h *hintLog) decodeHint(data []byte, offset int) (hint, int) {
+	if len(data) < 4 {
+		return hint{}, 0
+	}
+	size := 4 + int(binary.LittleEndian.Uint32(data))
+	if len(data) < size {
+		return hint{}, 0
+	}
+	body, err := h.encryption.open(h.keyID, data[4:size], associatedData(h.filename, uint64(offset)))
+	if err != nil || len(body) < 2 {
+		return hint{}, 0
+	}
+	addrSize := int(binary.LittleEndian.Uint16(body))
+	if len(body) < 2+addrSize+8+int(headerSize) {
+		return hint{}, 0
+	}
+	entry := hint{
+		target:   string(body[2 : 2+addrSize]),
+		storedAt: time.Unix(0, int64(binary.LittleEndian.Uint64(body[2+addrSize:]))),
+	}
+	if err := entry.record.DecodeKV(body[2+addrSize+8:]); err != nil || entry.record.CalculateChecksum() != entry.record.Header.CheckSum {
+		return hint{}, 0
+	}
+	return entry, size
+}
+
+// hint keeps a write for a replica that can't be reached
+func (c *Cluster) hint(target string, record *Record) {
+	if err := c.hints.add(target, *record); err != nil {
+		fmt.Printf("could not store hint for node addr = %s: %v\n", target, err)
+		return
+	}
+	fmt.Printf("stored hint for %s @ node addr = %s\n", record.Key, target)
+}
+
+// deliverHints hands every hint to its target node if it's up. hints for a node that left the cluster
+// go to the key's current replicas instead
+func (c *Cluster) deliverHints() {
+	for target, hints := range c.hints.due() {
+		node, ok := c.Nodes()[target]
+		if ok && c.isDown(node) {
+			continue
+		}
+
+		var delivered []hint
+		if !ok {
+			for _, entry := range hints {
+				write := c.writeReplicas
+				if entry.record.isRangeTombstone() {
+					write = c.writeRangeTombstone
+				}
+				if _, err := write(&entry.record, utils.ConsistencyOne); err == nil {
+					delivered = append(delivered, entry)
+				}
+			}
+		} else {
+			delivered = c.sendHints(target, hints)
+		}
+		if err := c.hints.delivered(delivered); err != nil {
+			fmt.Println("hint log rewrite err:", err)
+		}
+		fmt.Printf("delivered %d of %d hint(s) to node addr = %s\n", len(delivered), len(hints), target)
+	}
+}
+
+// sendHints sends the hints to the target node over gRPC, returns the ones it stored
+func (c *Cluster) sendHints(target string, hints []hint) []hint {
+	records := make([]Record, len(hints))
+	for i := range hints {
+		records[i] = hints[i].record
+	}
+
+	client, conn := StartGRPCClient(target, c.clockFor(hints[0].record.Key))
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.MigrateKeyValuePairs(ctx, &proto.KeyValueMigrationRequest{
+		DestNodeAddr: target,
+		KvPairs:      convertRecordsToProtoKVPairs(&records),
+	})
+	if err != nil {
+		fmt.Printf("could not deliver hints to node addr = %s: %v\n", target, err)
+		return nil
+	}
+
+	// the results come back in the order the records were sent
+	var delivered []hint
+	for i, result := range res.MigrationResults {
+		if i < len(hints) && result.Success {
+			delivered = append(delivered, hints[i])
+		}
+	}
+	return delivered
+}
+
+// HintStats returns how many hints were stored, delivered and expired so far, and how many are waiting per node
+func (c *Cluster) HintStats() HintStats {
+	return c.hints.statistics()
+}
+
+// deliverHintsPeriodically retries the outstanding hints until the cluster is closed
+func (c *Cluster) deliverHintsPeriodically() {
+	ticker := time.NewTicker(hintDeliveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.deliverHints()
+		case <-c.stop:
+			return
+		}
+	}
+}
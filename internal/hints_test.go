@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jateen67/kv/utils"
+)
+
+func hintRecord(key, value string) Record {
+	record := Record{
+		Header:    Header{TimeStamp: 1, KeySize: uint32(len(key)), ValueSize: uint32(len(value))},
+		Key:       []byte(key),
+		Value:     []byte(value),
+		TotalSize: headerSize + uint32(len(key)+len(value)),
+	}
+	record.Header.CheckSum = record.CalculateChecksum()
+	return record
+}
+
+func pendingHints(t *testing.T, h *hintLog) []hint {
+	t.Helper()
+	var hints []hint
+	for _, byTarget := range h.due() {
+		hints = append(hints, byTarget...)
+	}
+	return hints
+}
+
+// hints are sealed with the stores' key, and survive a rotation like the stores' files do
+func TestEncryptedHints(t *testing.T) {
+	fs := NewMemFS(1)
+	c := newCluster(WithStoreOptions(WithFS(fs), WithEncryption(newTestKeys(1))))
+	if err := c.openHints("storage/hints"); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"apples", "pears"} {
+		if err := c.hints.add(":11001", hintRecord("cart", value)); err != nil {
+			t.Fatalf("add hint: %v", err)
+		}
+	}
+	if err := c.hints.close(); err != nil {
+		t.Fatal(err)
+	}
+	filename := c.hints.filename
+	if ids := fileKeyIDs(fs, HINTS_FILENAME); ids[filename] != 1 {
+		t.Fatalf("hint log at %s written with key %d, want 1 (files: %v)", filename, ids[filename], ids)
+	}
+	fs.mu.Lock()
+	if data := fs.files[filename].data; bytes.Contains(data, []byte("apples")) || bytes.Contains(data, []byte(":11001")) {
+		t.Error("hint log holds hints in plaintext")
+	}
+	fs.mu.Unlock()
+
+	// after a rotation the old hints are still there, a rewrite seals them with the new key
+	h, err := openHintLog(fs, "../storage/hints", DefaultHintTTL, newEncryptor(newTestKeys(1, 2)))
+	if err != nil {
+		t.Fatalf("reopen hint log after rotation: %v", err)
+	}
+	hints := pendingHints(t, h)
+	if len(hints) != 2 || string(hints[1].record.Value) != "pears" {
+		t.Fatalf("got %d hint(s) after reopening, want the 2 added", len(hints))
+	}
+	if err := h.delivered(hints[:1]); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if err := h.add(":11002", hintRecord("cart", "plums")); err != nil {
+		t.Fatalf("add hint: %v", err)
+	}
+	h.close()
+	if id := fileKeyIDs(fs, HINTS_FILENAME)[filename]; id != 2 {
+		t.Fatalf("rewritten hint log has key %d, want 2", id)
+	}
+	h, err = openHintLog(fs, "../storage/hints", DefaultHintTTL, newEncryptor(newTestKeys(2)))
+	if err != nil {
+		t.Fatalf("reopen rewritten hint log: %v", err)
+	}
+	if hints := pendingHints(t, h); len(hints) != 2 {
+		t.Fatalf("got %d hint(s) after the rewrite, want 2", len(hints))
+	}
+	h.close()
+
+	// the hints aren't dropped as torn when their key is gone
+	if _, err := openHintLog(fs, "../storage/hints", DefaultHintTTL, newEncryptor(newTestKeys(3))); !errors.Is(err, utils.ErrUnknownEncryptionKey) {
+		t.Fatalf("open without the log's key: got %v, want %v", err, utils.ErrUnknownEncryptionKey)
+	}
+}
+
+// a hint cut short by a crash is dropped, the ones before it are kept and new ones follow them
+func TestTornHint(t *testing.T) {
+	fs := NewMemFS(1)
+	enc := newEncryptor(newTestKeys(1))
+	h, err := openHintLog(fs, "../storage/hints", time.Hour, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"apples", "pears"} {
+		if err := h.add(":11001", hintRecord("cart", value)); err != nil {
+			t.Fatalf("add hint: %v", err)
+		}
+	}
+	h.close()
+	fs.mu.Lock()
+	inode := fs.files[h.filename]
+	inode.data = inode.data[:len(inode.data)-3]
+	fs.mu.Unlock()
+
+	h, err = openHintLog(fs, "../storage/hints", time.Hour, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.add(":11001", hintRecord("cart", "plums")); err != nil {
+		t.Fatalf("add hint: %v", err)
+	}
+	h.close()
+	h, err = openHintLog(fs, "../storage/hints", time.Hour, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	var values []string
+	for _, entry := range pendingHints(t, h) {
+		values = append(values, string(entry.record.Value))
+	}
+	if len(values) != 2 || values[0] != "apples" || values[1] != "plums" {
+		t.Fatalf("got hints %v, want [apples plums]", values)
+	}
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+Hybrid logical clock -- timestamps that follow physical time, but never go backwards and always come after every
+timestamp the node has seen from another node (a record it stored, a gRPC message), so last-write-wins respects causality
+even when the machines' clocks are skewed. Every node has one, and the node's id is part of each timestamp it hands
+out, so two nodes never hand out the same one and ties between them are broken the same way everywhere.
+
+-------------------------------------------------
+| physical ms (44) | logical (10) | node id (10) |
+-------------------------------------------------
+a millisecond takes up more than a million, so timestamps from before the clock (unix nanoseconds) are older than any
+timestamp it hands out
+*/
+
+const (
+	hlcNodeBits    = 10
+	hlcLogicalBits = 10
+	hlcNodeMask    = 1<<hlcNodeBits - 1
+	hlcLogicalMask = 1<<hlcLogicalBits - 1
+
+	// gRPC metadata key every request and response carries the sender's clock in
+	hlcMetadataKey = "x-hlc"
+)
+
+type hybridClock struct {
+	mu      sync.Mutex
+	nodeID  uint64
+	wall    uint64 // milliseconds
+	logical uint64
+}
+
+func newHybridClock(nodeID uint32) *hybridClock {
+	return &hybridClock{nodeID: uint64(nodeID) & hlcNodeMask}
+}
+
+// Now hands out a timestamp newer than every timestamp handed out or seen so far
+func (c *hybridClock) Now() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if physical := uint64(time.Now().UnixMilli()); physical > c.wall {
+		c.wall, c.logical = physical, 0
+	} else {
+		c.logical++
+		if c.logical > hlcLogicalMask {
+			// too many timestamps within a millisecond, run ahead of the physical clock until it catches up
+			c.wall, c.logical = c.wall+1, 0
+		}
+	}
+	return c.wall<<(hlcLogicalBits+hlcNodeBits) | c.logical<<hlcNodeBits | c.nodeID
+}
+
+// Update makes sure every timestamp handed out from now on is newer than ts
+func (c *hybridClock) Update(ts uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall, logical := ts>>(hlcLogicalBits+hlcNodeBits), ts>>hlcNodeBits&hlcLogicalMask
+	if wall > c.wall || (wall == c.wall && logical > c.logical) {
+		c.wall, c.logical = wall, logical
+	}
+}
+
+// updateFromMetadata updates the clock with the timestamp in the metadata, if it has one
+func (c *hybridClock) updateFromMetadata(md metadata.MD) {
+	for _, v := range md.Get(hlcMetadataKey) {
+		if ts, err := strconv.ParseUint(v, 10, 64); err == nil {
+			c.Update(ts)
+		}
+	}
+}
+
+func (c *hybridClock) metadata() metadata.MD {
+	return metadata.Pairs(hlcMetadataKey, strconv.FormatUint(c.Now(), 10))
+}
+
+// the interceptors below carry the clock of the node on each end in every request and response
+
+func (c *hybridClock) unaryServerInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		c.updateFromMetadata(md)
+	}
+	res, err := handler(ctx, req)
+	grpc.SetTrailer(ctx, c.metadata())
+	return res, err
+}
+
+func (c *hybridClock) streamServerInterceptor(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if md, ok := metadata.FromIncomingContext(ss.Context()); ok {
+		c.updateFromMetadata(md)
+	}
+	err := handler(srv, ss)
+	ss.SetTrailer(c.metadata())
+	return err
+}
+
+func (c *hybridClock) unaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	var trailer metadata.MD
+	ctx = metadata.NewOutgoingContext(ctx, c.metadata())
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Trailer(&trailer))...)
+	c.updateFromMetadata(trailer)
+	return err
+}
+
+func (c *hybridClock) streamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx = metadata.NewOutgoingContext(ctx, c.metadata())
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &hlcClientStream{ClientStream: cs, clock: c}, nil
+}
+
+// hlcClientStream picks up the server's clock once the stream ends
+type hlcClientStream struct {
+	grpc.ClientStream
+	clock *hybridClock
+}
+
+func (s *hlcClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.clock.updateFromMetadata(s.Trailer())
+	}
+	return err
+}
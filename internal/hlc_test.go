@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
+)
+
+// hlcTimestamp is the first timestamp of the given time's millisecond
+func hlcTimestamp(at time.Time) uint64 {
+	return uint64(at.UnixMilli()) << (hlcLogicalBits + hlcNodeBits)
+}
+
+func TestHybridClock(t *testing.T) {
+	clock := newHybridClock(7)
+	// more timestamps than fit in a millisecond's logical counter
+	prev := clock.Now()
+	for range 5000 {
+		ts := clock.Now()
+		if ts <= prev {
+			t.Fatalf("timestamp %d handed out after %d", ts, prev)
+		}
+		if ts&hlcNodeMask != 7 {
+			t.Fatalf("timestamp %d doesn't carry the node id", ts)
+		}
+		prev = ts
+	}
+
+	// a timestamp from a node whose clock is ahead
+	ahead := hlcTimestamp(time.Now().Add(time.Hour)) | 3
+	clock.Update(ahead)
+	if ts := clock.Now(); ts <= ahead {
+		t.Fatalf("timestamp %d handed out after seeing %d", ts, ahead)
+	}
+	// and one from a node that's behind doesn't take it back
+	clock.Update(hlcTimestamp(time.Now().Add(-time.Hour)))
+	if ts := clock.Now(); ts <= ahead {
+		t.Fatalf("timestamp %d handed out after seeing %d, then an older one", ts, ahead)
+	}
+}
+
+// every gRPC request and response carries the sender's clock, so a write coordinated by a node whose clock is behind
+// still wins over a write it has seen from a node whose clock is ahead
+func TestClockPropagation(t *testing.T) {
+	c := startTestCluster(t, 2, WithReplicationFactor(2))
+	key := []byte("cart")
+	skewed := newHybridClock(9)
+	skewed.Update(hlcTimestamp(time.Now().Add(time.Hour)))
+	record := Record{Key: key, Value: []byte("from the future")}
+	record.Header = Header{TimeStamp: skewed.Now(), KeySize: uint32(len(key)), ValueSize: uint32(len(record.Value))}
+	record.TotalSize = headerSize + record.Header.KeySize + record.Header.ValueSize
+	record.Header.CheckSum = record.CalculateChecksum()
+
+	for _, node := range c.replicaNodes(key) {
+		client, conn := StartGRPCClient(node.Addr, skewed)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := client.MigrateKeyValuePairs(ctx, &proto.KeyValueMigrationRequest{
+			DestNodeAddr: node.Addr,
+			KvPairs:      convertRecordsToProtoKVPairs(&[]Record{record}),
+		})
+		cancel()
+		conn.Close()
+		if err != nil {
+			t.Fatalf("send to %s: %v", node.Addr, err)
+		}
+		if ts := node.Store.clock.Now(); ts <= record.Header.TimeStamp {
+			t.Fatalf("%s hands out %d after a request at %d", node.Addr, ts, record.Header.TimeStamp)
+		}
+	}
+
+	if _, err := c.Set(key, []byte("later"), utils.ConsistencyAll); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if value, _, err := c.Get(key, utils.ConsistencyAll); err != nil || string(value) != "later" {
+		t.Fatalf("get: got %q, %v, want the later write", value, err)
+	}
+
+	// the response carries the node's clock back
+	node := c.replicaNodes(key)[0]
+	node.Store.clock.Update(hlcTimestamp(time.Now().Add(2 * time.Hour)))
+	ahead := node.Store.clock.Now()
+	caller := newHybridClock(10)
+	client, conn := StartGRPCClient(node.Addr, caller)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.MigrateKeyValuePairs(ctx, &proto.KeyValueMigrationRequest{DestNodeAddr: node.Addr}); err != nil {
+		t.Fatalf("request to %s: %v", node.Addr, err)
+	}
+	if ts := caller.Now(); ts <= ahead {
+		t.Fatalf("caller hands out %d after a response at %d", ts, ahead)
+	}
+}
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+KV service -- clients can skip the HTTP server and talk gRPC (KVService) to any node, which coordinates the request with
+the key's replicas the same way the HTTP server's cluster does. A node in the cluster started by NewCluster coordinates
+with that cluster, a node started by NewStandaloneNode with the cluster it learned through gossip.
+*/
+
+// Scan calls fn for every live key in [start, end) in sorted order, with its value, or its siblings' values if it has
+// any. every node that's up is asked, as a key range is spread over the whole ring, and the newest version among
+// them wins. a nil end means no upper bound, stops early once fn returns false
+func (c *Cluster) Scan(start, end []byte, fn func(key []byte, values [][]byte) bool) error {
+	versions := make(map[string][]replicaAnswer)
+	for addr, node := range c.Nodes() {
+		if c.isDown(node) {
+			continue
+		}
+		err := node.scanVersions(start, end, func(record Record) bool {
+			versions[string(record.Key)] = append(versions[string(record.Key)], replicaAnswer{addr: addr, record: record})
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("scan @ node addr = %s: %w", addr, err)
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(versions)) {
+		newest := newestVersion(versions[key])
+		if newest.Header.Tombstone == 1 {
+			continue
+		}
+		values := [][]byte{newest.Value}
+		if newest.hasSiblings() {
+			siblings, err := recordSiblings(newest)
+			if err != nil {
+				return err
+			}
+			values = nil
+			for _, s := range siblings {
+				if !s.tombstone {
+					values = append(values, s.value)
+				}
+			}
+			if len(values) == 0 {
+				continue
+			}
+		}
+		if !fn(newest.Key, values) {
+			break
+		}
+	}
+	return nil
+}
+
+// CompareAndSwap writes value if the key's current value, as a read at level sees it, is expected. a nil expected
+// means the key must not exist. fails with ErrCompareFailed otherwise, or ErrSiblings if the key has several values.
+// compare-and-swaps coordinated by the same cluster never interleave, but a write coordinated elsewhere can land
+// between the read and the write: the newer write wins, or with WithSiblings both are kept as siblings
+func (c *Cluster) CompareAndSwap(key, expected, value []byte, level utils.ConsistencyLevel) (int, error) {
+	if len(key) == 0 {
+		return 0, utils.ErrEmptyKey
+	}
+	c.casMu.Lock()
+	defer c.casMu.Unlock()
+
+	values, causalContext, answered, err := c.GetSiblings(key, level)
+	switch {
+	case errors.Is(err, utils.ErrKeyNotFound):
+		if expected != nil {
+			return answered, fmt.Errorf("%w: key not found", utils.ErrCompareFailed)
+		}
+	case err != nil:
+		return answered, err
+	case len(values) > 1:
+		return answered, fmt.Errorf("%w: %d values", utils.ErrSiblings, len(values))
+	case expected == nil:
+		return answered, fmt.Errorf("%w: key exists", utils.ErrCompareFailed)
+	case !bytes.Equal(values[0], expected):
+		return answered, utils.ErrCompareFailed
+	}
+	return c.SetWithContext(key, value, causalContext, level)
+}
+
+type kvServer struct {
+	proto.UnimplementedKVServiceServer
+
+	underlyingNode *Node
+}
+
+func consistencyLevel(consistency proto.Consistency) (utils.ConsistencyLevel, error) {
+	switch consistency {
+	case proto.Consistency_ONE:
+		return utils.ConsistencyOne, nil
+	case proto.Consistency_QUORUM:
+		return utils.ConsistencyQuorum, nil
+	case proto.Consistency_ALL:
+		return utils.ConsistencyAll, nil
+	}
+	return 0, toStatus(fmt.Errorf("%w: %d", utils.ErrUnknownConsistencyLevel, consistency))
+}
+
+// get reads the key into the shape every read of the service answers with
+func (s *kvServer) get(key []byte, level utils.ConsistencyLevel) (*proto.KeyValue, int, error) {
+	values, causalContext, answered, err := s.underlyingNode.cluster.GetSiblings(key, level)
+	if err != nil {
+		return nil, answered, err
+	}
+	kv := &proto.KeyValue{Key: key, CausalContext: causalContext}
+	if len(values) == 1 {
+		kv.Value = values[0]
+	} else {
+		kv.Siblings = values
+	}
+	return kv, answered, nil
+}
+
+func (s *kvServer) Get(ctx context.Context, req *proto.GetRequest) (*proto.GetResponse, error) {
+	level, err := consistencyLevel(req.Consistency)
+	if err != nil {
+		return nil, err
+	}
+	kv, answered, err := s.get(req.Key, level)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &proto.GetResponse{Kv: kv, ReplicasAnswered: uint32(answered)}, nil
+}
+
+func (s *kvServer) Put(ctx context.Context, req *proto.PutRequest) (*proto.PutResponse, error) {
+	level, err := consistencyLevel(req.Consistency)
+	if err != nil {
+		return nil, err
+	}
+	if req.Kv == nil {
+		return nil, status.Error(codes.InvalidArgument, "put without a key")
+	}
+	answered, err := s.underlyingNode.cluster.SetWithContext(req.Kv.Key, req.Kv.Value, req.Kv.CausalContext, level)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &proto.PutResponse{ReplicasAnswered: uint32(answered)}, nil
+}
+
+func (s *kvServer) Delete(ctx context.Context, req *proto.DeleteRequest) (*proto.DeleteResponse, error) {
+	level, err := consistencyLevel(req.Consistency)
+	if err != nil {
+		return nil, err
+	}
+	var answered int
+	if len(req.CausalContext) > 0 {
+		answered, err = s.underlyingNode.cluster.DeleteWithContext(req.Key, req.CausalContext, level)
+	} else {
+		answered, err = s.underlyingNode.cluster.Delete(req.Key, level)
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &proto.DeleteResponse{ReplicasAnswered: uint32(answered)}, nil
+}
+
+func (s *kvServer) BatchGet(ctx context.Context, req *proto.BatchGetRequest) (*proto.BatchGetResponse, error) {
+	level, err := consistencyLevel(req.Consistency)
+	if err != nil {
+		return nil, err
+	}
+	kvs := make([]*proto.KeyValue, len(req.Keys))
+	errs := make([]error, len(req.Keys))
+	var wg sync.WaitGroup
+	for i, key := range req.Keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			kvs[i], _, errs[i] = s.get(key, level)
+		}()
+	}
+	wg.Wait()
+
+	res := &proto.BatchGetResponse{}
+	for i, err := range errs {
+		if errors.Is(err, utils.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, toStatus(fmt.Errorf("key = %s: %w", req.Keys[i], err))
+		}
+		res.Kvs = append(res.Kvs, kvs[i])
+	}
+	return res, nil
+}
+
+func (s *kvServer) BatchPut(ctx context.Context, req *proto.BatchPutRequest) (*proto.BatchPutResponse, error) {
+	level, err := consistencyLevel(req.Consistency)
+	if err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(req.Kvs))
+	var wg sync.WaitGroup
+	for i, kv := range req.Kvs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.underlyingNode.cluster.SetWithContext(kv.Key, kv.Value, kv.CausalContext, level); err != nil {
+				errs[i] = fmt.Errorf("key = %s: %w", kv.Key, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, toStatus(err)
+		}
+	}
+	return &proto.BatchPutResponse{}, nil
+}
+
+func (s *kvServer) Scan(req *proto.ScanRequest, stream grpc.ServerStreamingServer[proto.KeyValue]) error {
+	var end []byte
+	if len(req.End) > 0 {
+		end = req.End
+	}
+	sent := uint32(0)
+	var sendErr error
+	err := s.underlyingNode.cluster.Scan(req.Start, end, func(key []byte, values [][]byte) bool {
+		kv := &proto.KeyValue{Key: key}
+		if len(values) == 1 {
+			kv.Value = values[0]
+		} else {
+			kv.Siblings = values
+		}
+		if sendErr = stream.Send(kv); sendErr != nil {
+			return false
+		}
+		sent++
+		return req.Limit == 0 || sent < req.Limit
+	})
+	if sendErr != nil {
+		return sendErr
+	}
+	if err != nil {
+		return toStatus(err)
+	}
+	return nil
+}
+
+func (s *kvServer) CompareAndSwap(ctx context.Context, req *proto.CompareAndSwapRequest) (*proto.CompareAndSwapResponse, error) {
+	level, err := consistencyLevel(req.Consistency)
+	if err != nil {
+		return nil, err
+	}
+	answered, err := s.underlyingNode.cluster.CompareAndSwap(req.Key, req.Expected, req.Value, level)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &proto.CompareAndSwapResponse{ReplicasAnswered: uint32(answered)}, nil
+}
+
+func (s *kvServer) Topology(ctx context.Context, req *proto.TopologyRequest) (*proto.TopologyResponse, error) {
+	cluster := s.underlyingNode.cluster
+	nodes := cluster.Nodes()
+	res := &proto.TopologyResponse{ReplicationFactor: uint32(cluster.replicationFactor), Siblings: cluster.siblings}
+	for _, addr := range slices.Sorted(maps.Keys(nodes)) {
+		res.Members = append(res.Members, &proto.Member{Addr: addr, Id: nodes[addr].ID, Up: !cluster.isDown(nodes[addr])})
+	}
+	return res, nil
+}
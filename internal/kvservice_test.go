@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jateen67/kv/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// failures reach clients as the status codes they stand for
+func TestKVServiceStatusCodes(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(3), WithSiblings())
+	var served, down *Node
+	for _, node := range c.Nodes() {
+		if served == nil {
+			served = node
+		} else {
+			down = node
+		}
+	}
+	conn := dialNode(served.Addr, newHybridClock(50))
+	defer conn.Close()
+	client := proto.NewKVServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := client.Put(ctx, &proto.PutRequest{Kv: &proto.KeyValue{Key: []byte("cart"), Value: []byte("apples")}, Consistency: proto.Consistency_ALL}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	res, err := client.Get(ctx, &proto.GetRequest{Key: []byte("cart"), Consistency: proto.Consistency_ALL})
+	if err != nil || string(res.Kv.Value) != "apples" || res.ReplicasAnswered != 3 {
+		t.Fatalf("get: got %v, %v, want apples from 3 replicas", res, err)
+	}
+
+	expect := func(what string, err error, want codes.Code) {
+		t.Helper()
+		if got := status.Code(err); got != want {
+			t.Errorf("%s: got %v (%v), want %v", what, got, err, want)
+		}
+	}
+	_, err = client.Get(ctx, &proto.GetRequest{Key: []byte("missing")})
+	expect("get of a missing key", err, codes.NotFound)
+	_, err = client.Put(ctx, &proto.PutRequest{Kv: &proto.KeyValue{Value: []byte("apples")}})
+	expect("put without a key", err, codes.InvalidArgument)
+	_, err = client.Put(ctx, &proto.PutRequest{})
+	expect("put without a key value", err, codes.InvalidArgument)
+	_, err = client.Get(ctx, &proto.GetRequest{Key: []byte("cart"), Consistency: proto.Consistency(7)})
+	expect("get at an unknown consistency level", err, codes.InvalidArgument)
+	_, err = client.Put(ctx, &proto.PutRequest{Kv: &proto.KeyValue{Key: []byte("cart"), CausalContext: []byte{1, 2, 3}}})
+	expect("put with a malformed causal context", err, codes.InvalidArgument)
+	_, err = client.CompareAndSwap(ctx, &proto.CompareAndSwapRequest{Key: []byte("cart"), Expected: []byte("pears"), Value: []byte("plums")})
+	expect("compare-and-swap of another value", err, codes.FailedPrecondition)
+
+	// siblings can't be compared against one value
+	if _, err := client.Put(ctx, &proto.PutRequest{Kv: &proto.KeyValue{Key: []byte("cart"), Value: []byte("pears")}, Consistency: proto.Consistency_ALL}); err != nil {
+		t.Fatalf("put of a sibling: %v", err)
+	}
+	_, err = client.CompareAndSwap(ctx, &proto.CompareAndSwapRequest{Key: []byte("cart"), Expected: []byte("apples"), Value: []byte("plums")})
+	expect("compare-and-swap of siblings", err, codes.FailedPrecondition)
+
+	// missing keys are left out of a batch rather than failing it
+	batch, err := client.BatchGet(ctx, &proto.BatchGetRequest{Keys: [][]byte{[]byte("cart"), []byte("missing")}})
+	if err != nil || len(batch.Kvs) != 1 || len(batch.Kvs[0].Siblings) != 2 {
+		t.Fatalf("batch get: got %v, %v, want the siblings of cart only", batch, err)
+	}
+
+	c.StopNode(strings.TrimPrefix(down.Addr, ":"))
+	_, err = client.Put(ctx, &proto.PutRequest{Kv: &proto.KeyValue{Key: []byte("cart"), Value: []byte("figs")}, Consistency: proto.Consistency_ALL})
+	expect("put at ALL with a replica down", err, codes.Unavailable)
+	_, err = client.BatchPut(ctx, &proto.BatchPutRequest{Kvs: []*proto.KeyValue{{Key: []byte("cart"), Value: []byte("figs")}}, Consistency: proto.Consistency_ALL})
+	expect("batch put at ALL with a replica down", err, codes.Unavailable)
+	_, err = client.Get(ctx, &proto.GetRequest{Key: []byte("cart"), Consistency: proto.Consistency_QUORUM})
+	expect("get at QUORUM with a replica down", err, codes.OK)
+	c.StartNode(strings.TrimPrefix(down.Addr, ":"))
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Manifest -- which SSTables make up the store
+
+A table only becomes part of the store once it's recorded in the manifest, the manifest is rewritten
+(temp file + fsync + rename) every time the set of tables changes. On startup the tables in the manifest are
+loaded, and every other table file in the store's directory is a leftover from a crash and gets removed.
+
+-------------------------------------------------------------
+| checksum | count | level | table id | level | table id | ... |
+-------------------------------------------------------------
+*/
+
+const MANIFEST_FILENAME string = "MANIFEST"
+
+type manifestEntry struct {
+	level uint32
+	id    uint32
+}
+
+func getManifestFilename(directory string) string {
+	return fmt.Sprintf("../%s/%s", directory, MANIFEST_FILENAME)
+}
+
+func writeManifest(fs FS, directory string, entries []manifestEntry) error {
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.LittleEndian, uint32(len(entries)))
+	for _, e := range entries {
+		binary.Write(body, binary.LittleEndian, e.level)
+		binary.Write(body, binary.LittleEndian, e.id)
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(body.Bytes()))
+	buf.Write(body.Bytes())
+
+	filename := getManifestFilename(directory)
+	if err := writeSyncedFile(fs, filename+TEMP_FILE_EXTENSION, buf.Bytes()); err != nil {
+		return err
+	}
+	if err := fs.Rename(filename+TEMP_FILE_EXTENSION, filename); err != nil {
+		return err
+	}
+	return fs.SyncDir(fmt.Sprintf("../%s", directory))
+}
+
+// readManifest returns the tables recorded in the manifest, a store without a manifest has no tables
+func readManifest(fs FS, directory string) ([]manifestEntry, error) {
+	buf, err := readFile(fs, getManifestFilename(directory))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < 8 || crc32.ChecksumIEEE(buf[4:]) != binary.LittleEndian.Uint32(buf[:4]) {
+		return nil, utils.ErrCorruptManifest
+	}
+	count := binary.LittleEndian.Uint32(buf[4:8])
+	if uint32(len(buf)-8) != count*8 {
+		return nil, utils.ErrCorruptManifest
+	}
+
+	entries := make([]manifestEntry, count)
+	for i := range entries {
+		offset := 8 + i*8
+		entries[i].level = binary.LittleEndian.Uint32(buf[offset : offset+4])
+		entries[i].id = binary.LittleEndian.Uint32(buf[offset+4 : offset+8])
+	}
+	return entries, nil
+}
+
+// load opens every table recorded in the manifest, then removes whatever table files a crash left behind
+func (bm *BucketManager) load() error {
+	entries, err := readManifest(bm.compaction.fs, bm.dir)
+	if err != nil {
+		return err
+	}
+
+	live := make(map[uint32]struct{}, len(entries))
+	for _, e := range entries {
+		table, err := openSSTable(bm.compaction.fs, bm.dir, e.id, bm.compaction.encryption)
+		if err != nil {
+			return err
+		}
+		// every level up to the highest one has to exist, InsertTable walks all of them
+		for lvl := bm.highestLvl + 1; lvl <= int(e.level); lvl++ {
+			bm.buckets[lvl] = InitEmptyBucket()
+			bm.highestLvl = lvl
+		}
+		bm.buckets[int(e.level)].AppendTableToBucket(table)
+		live[e.id] = struct{}{}
+	}
+
+	if err := removeOrphanedFiles(bm.compaction.fs, bm.dir, live); err != nil {
+		return err
+	}
+	bm.setCurrentVersion(newVersion(bm.bucketTables()))
+	return nil
+}
+
+// removeOrphanedFiles removes temp files and the files of every table that isn't live.
+// new tables must get ids above every table file seen here, so the counter is moved past them
+func removeOrphanedFiles(fs FS, directory string, live map[uint32]struct{}) error {
+	names, err := fs.ReadDir(fmt.Sprintf("../%s", directory))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var id uint32
+		if strings.HasSuffix(name, TEMP_FILE_EXTENSION) {
+			// never renamed into place, so never complete
+		} else if _, err := fmt.Sscanf(name, "sst_%d", &id); err == nil {
+			bumpCounter(&ssTableCounter, id)
+			if _, ok := live[id]; ok {
+				continue
+			}
+		} else {
+			continue
+		}
+
+		fmt.Println("removing orphaned file:", name)
+		if err := fs.Remove(fmt.Sprintf("../%s/%s", directory, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bumpCounter moves a global file counter up to at least v
+func bumpCounter(counter *uint32, v uint32) {
+	for {
+		curr := atomic.LoadUint32(counter)
+		if curr >= v || atomic.CompareAndSwapUint32(counter, curr, v) {
+			return
+		}
+	}
+}
+
+// writeSyncedFile creates (or truncates) the file and writes data to it, only returning once it's on disk
+func writeSyncedFile(fs FS, filename string, data []byte) error {
+	file, err := fs.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if err := writeToFile(data, file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+MemFS -- an in-memory FS for crash testing
+
+Every file tracks what has been written to it and what of that has been fsynced, and the directory tracks which
+creations, renames and removals have been made durable by a SyncDir. Crash simulates a power loss: whatever
+wasn't synced is lost, except for a random prefix of the unsynced appends (a torn write). InjectErrors makes
+writes, syncs and directory changes fail at random.
+*/
+
+var errInjectedFault = errors.New("memfs: injected I/O error")
+
+type memInode struct {
+	data   []byte // what reads see
+	synced []byte // what survives a crash
+}
+
+type MemFS struct {
+	mu        sync.Mutex
+	rng       *rand.Rand
+	dirs      map[string]struct{}
+	files     map[string]*memInode // the directory as it is right now
+	durable   map[string]*memInode // the directory as of the last SyncDir
+	errorRate float64
+	faults    int
+	epoch     int // bumped by every crash, files opened before it stop working
+}
+
+func NewMemFS(seed int64) *MemFS {
+	return &MemFS{
+		rng:     rand.New(rand.NewSource(seed)),
+		dirs:    map[string]struct{}{".": {}, "..": {}},
+		files:   make(map[string]*memInode),
+		durable: make(map[string]*memInode),
+	}
+}
+
+// InjectErrors makes every write, sync and directory change fail with probability rate, 0 turns it off
+func (m *MemFS) InjectErrors(rate float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errorRate = rate
+}
+
+// InjectedFaults returns the number of errors injected so far
+func (m *MemFS) InjectedFaults() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.faults
+}
+
+// Crash simulates a power loss. every open file stops working, only what was synced is left on disk
+func (m *MemFS) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.epoch++
+	m.files = make(map[string]*memInode, len(m.durable))
+	recovered := make(map[*memInode]*memInode)
+	for name, inode := range m.durable {
+		if _, ok := recovered[inode]; !ok {
+			data := slices.Clone(inode.synced)
+			// appends past the synced part may have partially made it
+			if len(inode.data) > len(inode.synced) && strings.HasPrefix(string(inode.data), string(inode.synced)) {
+				torn := m.rng.Intn(len(inode.data) - len(inode.synced) + 1)
+				data = append(data, inode.data[len(inode.synced):len(inode.synced)+torn]...)
+			}
+			recovered[inode] = &memInode{data: data, synced: slices.Clone(data)}
+		}
+		m.files[name] = recovered[inode]
+	}
+	m.durable = make(map[string]*memInode, len(m.files))
+	for name, inode := range m.files {
+		m.durable[name] = inode
+	}
+}
+
+// fault decides whether the operation fails, m.mu must be held
+func (m *MemFS) fault(op, name string) error {
+	if m.errorRate > 0 && m.rng.Float64() < m.errorRate {
+		m.faults++
+		return &os.PathError{Op: op, Path: name, Err: errInjectedFault}
+	}
+	return nil
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable || flag&os.O_CREATE != 0 {
+		if err := m.fault("open", name); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := m.dirs[filepath.Dir(name)]; !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	inode, ok := m.files[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok:
+		inode = &memInode{}
+		m.files[name] = inode
+	case flag&os.O_TRUNC != 0 && writable:
+		inode.data = nil
+	}
+	return &memFile{fs: m, name: name, inode: inode, flag: flag, epoch: m.epoch}, nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if err := m.fault("remove", name); err != nil {
+		return err
+	}
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if err := m.fault("rename", oldpath); err != nil {
+		return err
+	}
+	inode, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if _, ok := m.dirs[filepath.Dir(newpath)]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	m.files[newpath] = inode
+	delete(m.files, oldpath)
+	return nil
+}
+
+// MkdirAll creates the directories right away and durably, the store only ever creates them on startup
+func (m *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+		}
+		m.dirs[dir] = struct{}{}
+		if dir == filepath.Dir(dir) || dir == ".." {
+			return nil
+		}
+	}
+}
+
+func (m *MemFS) ReadDir(name string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.dirs[name]; !ok {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var names []string
+	for file := range m.files {
+		if filepath.Dir(file) == name {
+			names = append(names, filepath.Base(file))
+		}
+	}
+	for dir := range m.dirs {
+		if dir != name && filepath.Dir(dir) == name {
+			names = append(names, filepath.Base(dir))
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (m *MemFS) SyncDir(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if err := m.fault("sync", name); err != nil {
+		return err
+	}
+	for file := range m.durable {
+		if filepath.Dir(file) == name {
+			delete(m.durable, file)
+		}
+	}
+	for file, inode := range m.files {
+		if filepath.Dir(file) == name {
+			m.durable[file] = inode
+		}
+	}
+	return nil
+}
+
+type memFile struct {
+	fs     *MemFS
+	name   string
+	inode  *memInode
+	flag   int
+	epoch  int
+	offset int64
+	closed bool
+}
+
+// usable reports whether the file can still be used, f.fs.mu must be held
+func (f *memFile) usable(op string) error {
+	if f.closed || f.epoch != f.fs.epoch {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.usable("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if err := f.fs.fault("write", f.name); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.inode.data))
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.inode.data)) {
+		f.inode.data = append(f.inode.data, make([]byte, end-int64(len(f.inode.data)))...)
+	}
+	copy(f.inode.data[f.offset:], p)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.usable("read"); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.inode.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.inode.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.usable("sync"); err != nil {
+		return err
+	}
+	if err := f.fs.fault("sync", f.name); err != nil {
+		return err
+	}
+	f.inode.synced = slices.Clone(f.inode.data)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.usable("truncate"); err != nil {
+		return err
+	}
+	if err := f.fs.fault("truncate", f.name); err != nil {
+		return err
+	}
+	if size <= int64(len(f.inode.data)) {
+		f.inode.data = f.inode.data[:size]
+	} else {
+		f.inode.data = append(f.inode.data, make([]byte, size-int64(len(f.inode.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.usable("stat"); err != nil {
+		return nil, err
+	}
+	return memFileInfo{name: filepath.Base(f.name), size: int64(len(f.inode.data))}, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0666 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() any           { return nil }
@@ -1,83 +1,71 @@
 package internal
 
-import (
-	"fmt"
-
-	rbt "github.com/emirpasic/gods/trees/redblacktree"
-	"github.com/jateen67/kv/utils"
-)
-
 /*
-Red-Black tree as memtable -- will replace original hash table
+Memtable -- in-memory, sorted write buffer that sits in front of the SSTables.
+The default implementation is a concurrent skiplist (see skiplist.go)
 */
 
-type Memtable struct {
-	data      *rbt.Tree
-	totalSize uint32
+type Memtable interface {
+	Get(key []byte) (Record, error)
+	Set(key []byte, value *Record)
+	// Remove drops a key from the memtable entirely (no tombstone is written)
+	Remove(key []byte)
+	// range tombstones are kept apart from the point records, their key would otherwise clash with a point key
+	AddRangeTombstone(record *Record)
+	RangeTombstones() []Record
+	// Size is the total encoded size of all live records, overwrites are not double counted
+	Size() uint32
+	Len() int
+	NewIterator() MemtableIterator
 }
 
-func NewMemtable() *Memtable {
-	return &Memtable{
-		rbt.NewWithStringComparator(),
-		0,
-	}
+// MemtableIterator walks the records of a memtable in sorted key order without copying them
+type MemtableIterator interface {
+	Valid() bool
+	Next()
+	SeekToFirst()
+	// Seek positions the iterator at the first key >= target
+	Seek(target []byte)
+	Record() Record
 }
 
-func (m *Memtable) Get(key *string) (Record, error) {
-	val, found := m.data.Get(*key)
-	if !found {
-		return Record{}, utils.ErrKeyNotFound
-	}
-	return val.(Record), nil
+func NewMemtable() Memtable {
+	return NewSkipList()
 }
 
-func (m *Memtable) Set(key *string, value *Record) {
-	m.data.Put(*key, *value)
-	m.totalSize += value.TotalSize
-}
-
-func (m *Memtable) GetAllKVPairs() map[string]Record {
-	kvPairs := make(map[string]Record)
+// GetAllKVPairs returns every live record in the memtable keyed by its key
+func GetAllKVPairs(m Memtable) map[string]Record {
+	kvPairs := make(map[string]Record, m.Len())
 
-	for _, k := range m.data.Keys() {
-		val, _ := m.data.Get(k)
-		kvPairs[k.(string)] = val.(Record)
+	it := m.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		record := it.Record()
+		kvPairs[string(record.Key)] = record
 	}
 
 	return kvPairs
 }
 
-func (m *Memtable) Flush(dir string) *SSTable {
-	sortedEntries := m.returnAllRecordsInSortedOrder()
-	return InitSSTableOnDisk(dir, castToRecordSlice(&sortedEntries))
-}
-
-func (m *Memtable) returnAllRecordsInSortedOrder() []any {
-	return inorderRBT(m.data.Root, make([]any, 0))
-}
+// FlushMemtableToDisk writes the memtable into a new SSTable, records are already sorted so no copying/sorting is needed
+func FlushMemtableToDisk(m Memtable, fs FS, dir string, enc *encryptor) (*SSTable, error) {
+	sortedEntries := make([]Record, 0, m.Len())
 
-func castToRecordSlice(interfaceSlice *[]any) *[]Record {
-	recordSlice := make([]Record, len(*interfaceSlice))
-	for i, iface := range *interfaceSlice {
-		record, ok := iface.(Record)
-		if !ok {
-			fmt.Errorf("element %d is not a Record", i)
-		}
-		recordSlice[i] = record
+	it := m.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		sortedEntries = append(sortedEntries, it.Record())
 	}
-	return &recordSlice
-}
 
-func inorderRBT(node *rbt.Node, data []interface{}) []interface{} {
-	if node != nil {
-		data = inorderRBT(node.Left, data)
-		data = append(data, node.Value)
-		data = inorderRBT(node.Right, data)
-	}
-	return data
+	rangeTombstones := m.RangeTombstones()
+	return InitSSTableOnDisk(fs, dir, &sortedEntries, &rangeTombstones, enc)
 }
 
-func (m *Memtable) clear() {
-	m.data.Clear()
-	m.totalSize = 0
+// newestCoveringTimestamp returns the timestamp of the newest range tombstone covering key, 0 if there is none
+func newestCoveringTimestamp(rangeTombstones []Record, key []byte) uint64 {
+	var newest uint64
+	for i := range rangeTombstones {
+		if rangeTombstones[i].covers(key, newest) {
+			newest = rangeTombstones[i].Header.TimeStamp
+		}
+	}
+	return newest
 }
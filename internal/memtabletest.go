@@ -12,10 +12,10 @@ func BenchmarkMemtable_Put(b *testing.B) {
 		record := &Record{
 			Header:    Header{},
 			Key:       key,
-			Value:     "testVal",
+			Value:     []byte("testVal"),
 			TotalSize: 0,
 		}
-		memtable.Set(&key, record)
+		memtable.Set(key, record)
 	}
 
 	opsPerSec := float64(b.N) / b.Elapsed().Seconds()
@@ -30,17 +30,17 @@ func BenchmarkMemtable_Get(b *testing.B) {
 		record := &Record{
 			Header:    Header{},
 			Key:       key,
-			Value:     "testVal",
+			Value:     []byte("testVal"),
 			TotalSize: 0,
 		}
-		memtable.Set(&key, record)
+		memtable.Set(key, record)
 	}
-	testKey := "Fuzzy"
-	memtable.Set(&testKey, &Record{})
+	testKey := []byte("Fuzzy")
+	memtable.Set(testKey, &Record{Key: testKey})
 	b.ResetTimer()
 
 	for i := 0; i < 1_000_000; i++ {
-		memtable.Get(&testKey)
+		memtable.Get(testKey)
 
 	}
 
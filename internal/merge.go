@@ -0,0 +1,542 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Merge operators -- read-modify-write (counters, appends, ...) without a Get + Set race
+
+A merge writes an operand record instead of a full value. Operands are only folded onto the base value
+lazily, on Get and during compaction. Every operand carries the name of the operator that has to apply it,
+so different keys can use different operators within the same store.
+
+Every operand also keeps the timestamp of the merge that wrote it. The HLC puts the writing node in the timestamp,
+so it identifies the operand: a copy that arrives twice (hint replay, anti-entropy) is only applied once, and one that
+arrives late is still folded in timestamp order. A zero timestamp stands for the timestamp of the record holding it.
+
+Operand record value:
+-------------------------------------------------------------
+| count | name_size | name | timestamp | operand_size | operand | ... |
+-------------------------------------------------------------
+*/
+
+type MergeOperator interface {
+	Name() string
+	// FullMerge applies operands (oldest first) on top of existing, existing is nil if the key has no value
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+const (
+	Int64AddOperatorName = "int64add"
+	AppendOperatorName   = "append"
+	MaxOperatorName      = "max"
+
+	// pseudo-operators, used by compaction to carry a base value along with operands it can't fold. names starting
+	// with a NUL byte are reserved for them
+	mergeBaseSet    = "\x00set"
+	mergeBaseDelete = "\x00delete"
+
+	maxOperatorNameSize = 255 // the name's size is encoded in a single byte
+)
+
+type mergeOperand struct {
+	operator  string
+	value     []byte
+	timestamp uint64
+}
+
+func encodeMergeOperands(operands []mergeOperand) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(operands)))
+	for i := range operands {
+		buf.WriteByte(byte(len(operands[i].operator)))
+		buf.WriteString(operands[i].operator)
+		binary.Write(buf, binary.LittleEndian, operands[i].timestamp)
+		binary.Write(buf, binary.LittleEndian, uint32(len(operands[i].value)))
+		buf.Write(operands[i].value)
+	}
+	return buf.Bytes()
+}
+
+func decodeMergeOperands(buf []byte) ([]mergeOperand, error) {
+	if len(buf) < 4 {
+		return nil, utils.ErrDecodingMergeOperandFailed
+	}
+	count := binary.LittleEndian.Uint32(buf[:4])
+	buf = buf[4:]
+
+	operands := make([]mergeOperand, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < 1 || len(buf) < 1+int(buf[0])+12 {
+			return nil, utils.ErrDecodingMergeOperandFailed
+		}
+		nameSize := int(buf[0])
+		name := string(buf[1 : 1+nameSize])
+		timestamp := binary.LittleEndian.Uint64(buf[1+nameSize : 9+nameSize])
+		valueSize := int(binary.LittleEndian.Uint32(buf[9+nameSize : 13+nameSize]))
+		buf = buf[13+nameSize:]
+		if len(buf) < valueSize {
+			return nil, utils.ErrDecodingMergeOperandFailed
+		}
+		operands = append(operands, mergeOperand{operator: name, value: buf[:valueSize], timestamp: timestamp})
+		buf = buf[valueSize:]
+	}
+	return operands, nil
+}
+
+func (r *Record) isMergeOperand() bool {
+	return r.Header.Flags&flagMergeOperand != 0
+}
+
+// operands decodes the record's merge operands, the ones written without a timestamp get the record's
+func (r *Record) operands() ([]mergeOperand, error) {
+	operands, err := decodeMergeOperands(r.Value)
+	if err != nil {
+		return nil, err
+	}
+	for i := range operands {
+		if operands[i].timestamp == 0 {
+			operands[i].timestamp = r.Header.TimeStamp
+		}
+	}
+	return operands, nil
+}
+
+// orderOperands sorts operands oldest first and drops the copies of an operand seen more than once
+func orderOperands(operands []mergeOperand) []mergeOperand {
+	slices.SortStableFunc(operands, func(a, b mergeOperand) int {
+		return cmpTimestamp(a.timestamp, b.timestamp)
+	})
+	return slices.CompactFunc(operands, func(a, b mergeOperand) bool {
+		return a.timestamp == b.timestamp && a.operator == b.operator
+	})
+}
+
+// sinceBase drops the operands (oldest first) a newer base value overwrote, ok reports whether there is a base at all
+func sinceBase(operands []mergeOperand) (_ []mergeOperand, ok bool) {
+	for i := len(operands) - 1; i >= 0; i-- {
+		if isMergeBase(operands[i].operator) {
+			return operands[i:], true
+		}
+	}
+	return operands, false
+}
+
+// Int64AddOperator adds decimal int64 operands to a decimal int64 value (missing value = 0)
+type Int64AddOperator struct{}
+
+func (Int64AddOperator) Name() string { return Int64AddOperatorName }
+
+func (Int64AddOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	sum, err := parseInt64OrZero(existing)
+	if err != nil {
+		return nil, fmt.Errorf("int64add on key %s: %w", key, err)
+	}
+	for _, op := range operands {
+		delta, err := strconv.ParseInt(string(op), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("int64add on key %s: %w", key, err)
+		}
+		sum += delta
+	}
+	return []byte(strconv.FormatInt(sum, 10)), nil
+}
+
+// AppendOperator appends every operand to the value as-is
+type AppendOperator struct{}
+
+func (AppendOperator) Name() string { return AppendOperatorName }
+
+func (AppendOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	return bytes.Join(append([][]byte{existing}, operands...), nil), nil
+}
+
+// MaxOperator keeps the largest decimal int64 seen, a missing value counts as no value rather than 0
+type MaxOperator struct{}
+
+func (MaxOperator) Name() string { return MaxOperatorName }
+
+func (MaxOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	result := existing
+	curr, err := parseInt64OrZero(existing)
+	if err != nil {
+		return nil, fmt.Errorf("max on key %s: %w", key, err)
+	}
+	for _, op := range operands {
+		val, err := strconv.ParseInt(string(op), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("max on key %s: %w", key, err)
+		}
+		if result == nil || val > curr {
+			result, curr = op, val
+		}
+	}
+	return slices.Clone(result), nil
+}
+
+func parseInt64OrZero(b []byte) (int64, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+func defaultMergeOperators() map[string]MergeOperator {
+	return map[string]MergeOperator{
+		Int64AddOperatorName: Int64AddOperator{},
+		AppendOperatorName:   AppendOperator{},
+		MaxOperatorName:      MaxOperator{},
+	}
+}
+
+// RegisterMergeOperator makes op available to Merge under op.Name(). an operator can't be replaced: operands already
+// written name it, and would be folded differently from then on
+func (ds *DiskStore) RegisterMergeOperator(op MergeOperator) error {
+	name := op.Name()
+	if len(name) == 0 || len(name) > maxOperatorNameSize || name[0] == 0 {
+		return fmt.Errorf("%w: %q", utils.ErrInvalidMergeOperatorName, name)
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.operators()[name]; ok {
+		return fmt.Errorf("%w: %s", utils.ErrMergeOperatorExists, name)
+	}
+	// reads use the operators without holding mu
+	operators := maps.Clone(ds.operators())
+	operators[name] = op
+	ds.mergeOperators.Store(&operators)
+	return nil
+}
+
+// Merge records operand to be applied to key's value by the named operator, no read happens here
+func (ds *DiskStore) Merge(key []byte, operator string, operand []byte) error {
+	if ds == nil {
+		return fmt.Errorf("disk store is not initialized")
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if len(key) == 0 {
+		return utils.ErrEmptyKey
+	}
+	if _, ok := ds.operators()[operator]; !ok {
+		return fmt.Errorf("%w: %s", utils.ErrUnknownMergeOperator, operator)
+	}
+
+	// the log only gets the new operand, what the memtable already holds for the key may end up in a table before the log is replayed
+	value := encodeMergeOperands([]mergeOperand{{operator: operator, value: slices.Clone(operand)}})
+	header := Header{
+		Flags:     flagMergeOperand,
+		TimeStamp: ds.clock.Now(),
+		KeySize:   uint32(len(key)),
+		ValueSize: uint32(len(value)),
+	}
+	record := &Record{
+		Header:    header,
+		Key:       slices.Clone(key),
+		Value:     value,
+		TotalSize: headerSize + header.KeySize + header.ValueSize,
+	}
+	record.Header.CheckSum = record.CalculateChecksum()
+
+	stacked, err := ds.stackOperands(record)
+	if err != nil {
+		return err
+	}
+	ds.memtable.Set(stacked.Key, stacked)
+	ds.wal.appendWALOperation(MERGE, record)
+	if ds.memtable.Size() >= ds.flushThreshold {
+		ds.rotateMemtable()
+	}
+	return nil
+}
+
+// stackOperands puts whatever the memtable holds for the key together with the record's operands, in timestamp
+// order. the memtable holds a single record per key so it has to be carried into the new one
+func (ds *DiskStore) stackOperands(record *Record) (*Record, error) {
+	existing, err := ds.memtable.Get(record.Key)
+	if err != nil {
+		return record, nil
+	}
+
+	var operands []mergeOperand
+	switch {
+	case existing.Header.Tombstone == 1 || ds.isRangeDeleted(&existing):
+		operands = append(operands, mergeOperand{operator: mergeBaseDelete, timestamp: existing.Header.TimeStamp})
+	case existing.isMergeOperand():
+		if operands, err = existing.operands(); err != nil {
+			return nil, err
+		}
+	default:
+		resolved, err := ds.resolveValue(existing)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, mergeOperand{operator: mergeBaseSet, value: resolved.Value, timestamp: existing.Header.TimeStamp})
+	}
+	added, err := record.operands()
+	if err != nil {
+		return nil, err
+	}
+	operands, _ = sinceBase(orderOperands(append(operands, added...)))
+
+	stacked := *record
+	stacked.Header.TimeStamp = max(existing.Header.TimeStamp, record.Header.TimeStamp)
+	stacked.Value = encodeMergeOperands(operands)
+	stacked.Header.ValueSize = uint32(len(stacked.Value))
+	stacked.TotalSize = headerSize + stacked.Header.KeySize + stacked.Header.ValueSize
+	stacked.Header.CheckSum = stacked.CalculateChecksum()
+	return &stacked, nil
+}
+
+// storedOperands returns the timestamp of the key's newest full value or delete and the operands stored on top of it
+func (ds *DiskStore) storedOperands(key []byte) (overwritten uint64, stored map[uint64]bool, err error) {
+	versions, err := ds.getAllVersions(key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	overwritten = newestCoveringTimestamp(ds.allRangeTombstones(), key)
+	stored = make(map[uint64]bool)
+	for i := range versions {
+		v := versions[i]
+		if !v.isMergeOperand() {
+			overwritten = max(overwritten, v.Header.TimeStamp)
+			break
+		}
+		ops, err := v.operands()
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, op := range ops {
+			if isMergeBase(op.operator) {
+				overwritten = max(overwritten, op.timestamp)
+			}
+			stored[op.timestamp] = true
+		}
+	}
+	return overwritten, stored, nil
+}
+
+// operandsApplied reports whether every operand of the record is already stored for its key, or was overwritten by a
+// newer full value or delete
+func (ds *DiskStore) operandsApplied(record *Record) (bool, error) {
+	operands, err := record.operands()
+	if err != nil {
+		return false, err
+	}
+	overwritten, stored, err := ds.storedOperands(record.Key)
+	if err != nil {
+		return false, err
+	}
+	return !slices.ContainsFunc(operands, func(op mergeOperand) bool {
+		return op.timestamp > overwritten && !stored[op.timestamp]
+	}), nil
+}
+
+// underOperands turns a full value or delete that is older than operands stored for its key into a base operand, so
+// it goes underneath them instead of replacing them. nil means a newer full value or delete overwrote it
+func (ds *DiskStore) underOperands(record *Record) (*Record, error) {
+	overwritten, _, err := ds.storedOperands(record.Key)
+	if err != nil || overwritten >= record.Header.TimeStamp {
+		return nil, err
+	}
+	base := mergeOperand{operator: mergeBaseDelete, timestamp: record.Header.TimeStamp}
+	if record.Header.Tombstone == 0 {
+		resolved, err := ds.resolveValue(*record)
+		if err != nil {
+			return nil, err
+		}
+		base = mergeOperand{operator: mergeBaseSet, value: resolved.Value, timestamp: record.Header.TimeStamp}
+	}
+
+	rec := *record
+	rec.Value = encodeMergeOperands([]mergeOperand{base})
+	rec.Header.Tombstone = 0
+	rec.Header.Flags = (rec.Header.Flags | flagMergeOperand) &^ flagBlobPointer
+	rec.Header.ValueSize = uint32(len(rec.Value))
+	rec.TotalSize = headerSize + rec.Header.KeySize + rec.Header.ValueSize
+	rec.Header.CheckSum = rec.CalculateChecksum()
+	return &rec, nil
+}
+
+// resolveMerge turns a merge operand record into a full value by folding it onto the key's older versions
+func (ds *DiskStore) resolveMerge(record Record) (Record, error) {
+	if !record.isMergeOperand() {
+		return record, nil
+	}
+
+	versions, err := ds.getAllVersions(record.Key)
+	if err != nil {
+		return Record{}, err
+	}
+	return collapseVersions(versions, ds.allRangeTombstones(), ds.operators(), ds.resolveValue, true)
+}
+
+// getAllVersions returns every version of the key in the store, newest first
+func (ds *DiskStore) getAllVersions(key []byte) ([]Record, error) {
+	var versions []Record
+	view := ds.view.Load()
+	for _, m := range append(slices.Clone(view.immutable), view.active) {
+		if record, err := m.Get(key); err == nil {
+			versions = append(versions, record)
+		}
+	}
+
+	tableVersions, err := ds.bucketManager.RetrieveAllVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	versions = append(versions, tableVersions...)
+
+	sortNewestFirst(versions)
+	return versions, nil
+}
+
+// sortNewestFirst orders versions by timestamp. the same version can show up more than once (a flush retried after
+// a failed manifest write, a WAL replayed after a crash) while compaction already folded one of the copies, the copy
+// that carries the most history comes first: a full value, then the operand record holding the most operands
+func sortNewestFirst(versions []Record) {
+	slices.SortFunc(versions, func(a, b Record) int {
+		if c := cmpTimestamp(a.Header.TimeStamp, b.Header.TimeStamp); c != 0 {
+			return -c
+		}
+		if a.isMergeOperand() != b.isMergeOperand() {
+			if a.isMergeOperand() {
+				return 1
+			}
+			return -1
+		}
+		if c := cmpBlobCopies(&a, &b); c != 0 {
+			return -c
+		}
+		return len(b.Value) - len(a.Value)
+	})
+}
+
+func cmpTimestamp(a, b uint64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// collapseVersions reduces the versions of a single key (newest first) to the one record that represents them.
+// complete means the versions are the key's entire history (Get), compaction only sees part of it so operands
+// without a base value in sight stay operands. if they can't be applied (unknown operator, bad value) compaction keeps
+// the operands along with the base, so the error surfaces on Get instead of losing data
+func collapseVersions(versions []Record, rangeTombstones []Record, operators map[string]MergeOperator,
+	resolveValue func(Record) (Record, error), complete bool) (Record, error) {
+	if len(versions) == 0 {
+		return Record{}, utils.ErrKeyNotFound
+	}
+	if !versions[0].isMergeOperand() {
+		return versions[0], nil
+	}
+	newest := versions[0]
+
+	// walk back in time collecting operands until we reach a full value. an operand record can hold operands older
+	// than a base compaction pinned in it or than a version further back (one that arrived late), so every operand is
+	// put in timestamp order and the newest base decides which of them still count. a version that shows up twice
+	// holds the same operands, they are only folded in once
+	var operands []mergeOperand
+	covering := newestCoveringTimestamp(rangeTombstones, newest.Key)
+	if covering > 0 {
+		operands = append(operands, mergeOperand{operator: mergeBaseDelete, timestamp: covering})
+	}
+	for i := range versions {
+		v := versions[i]
+		if covering > v.Header.TimeStamp {
+			break
+		}
+		if v.Header.Tombstone == 1 && !v.isMergeOperand() {
+			operands = append(operands, mergeOperand{operator: mergeBaseDelete, timestamp: v.Header.TimeStamp})
+			break
+		}
+		if !v.isMergeOperand() {
+			resolved, err := resolveValue(v)
+			if err != nil {
+				return Record{}, err
+			}
+			operands = append(operands, mergeOperand{operator: mergeBaseSet, value: resolved.Value, timestamp: v.Header.TimeStamp})
+			break
+		}
+
+		ops, err := v.operands()
+		if err != nil {
+			return Record{}, err
+		}
+		operands = append(operands, ops...)
+	}
+	operands, hasBase := sinceBase(orderOperands(operands))
+	if !hasBase && complete {
+		operands = append([]mergeOperand{{operator: mergeBaseDelete}}, operands...)
+		hasBase = true
+	}
+
+	collapsed := newest
+	value, err := applyMergeOperands(operators, newest.Key, operands)
+	switch {
+	case err != nil && complete:
+		return Record{}, err
+	case err != nil || !hasBase:
+		// can't fold (yet), keep everything as a single operand record
+		collapsed.Value = encodeMergeOperands(operands)
+	default:
+		collapsed.Value = value
+		collapsed.Header.Flags &^= flagMergeOperand
+	}
+	collapsed.Header.ValueSize = uint32(len(collapsed.Value))
+	collapsed.TotalSize = headerSize + collapsed.Header.KeySize + collapsed.Header.ValueSize
+	collapsed.Header.CheckSum = collapsed.CalculateChecksum()
+	return collapsed, nil
+}
+
+func isMergeBase(operator string) bool {
+	return operator == mergeBaseSet || operator == mergeBaseDelete
+}
+
+// applyMergeOperands folds operands (oldest first) starting from no value, runs of the same operator are applied in one call
+func applyMergeOperands(operators map[string]MergeOperator, key []byte, operands []mergeOperand) ([]byte, error) {
+	var value []byte
+	for i := 0; i < len(operands); {
+		switch operands[i].operator {
+		case mergeBaseSet:
+			value = operands[i].value
+			i++
+			continue
+		case mergeBaseDelete:
+			value = nil
+			i++
+			continue
+		}
+
+		op, ok := operators[operands[i].operator]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", utils.ErrUnknownMergeOperator, operands[i].operator)
+		}
+		var run [][]byte
+		j := i
+		for ; j < len(operands) && operands[j].operator == operands[i].operator; j++ {
+			run = append(run, operands[j].value)
+		}
+
+		merged, err := op.FullMerge(key, value, run)
+		if err != nil {
+			return nil, err
+		}
+		value = merged
+		i = j
+	}
+	return value, nil
+}
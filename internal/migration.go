@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Data migration -- records moving to another node (rebalancing, anti-entropy pushing a range) go over a MigrateStream in
+chunks of about migrationChunkSize bytes, with at most migrationWindow chunks waiting on their ack, so a large shard
+never has to fit in a single message or finish within a single timeout. records are sent one token range at a time, in
+key order within a range, and every ack adds the versions it covered to its range's checkpoint, up to the first key
+the destination couldn't store. a stream that breaks off is reopened, up to migrationAttempts times, past
+the checkpoints, so what the destination already stored isn't sent again. what's left after the last attempt is hinted
+to the destination. the checkpoints are kept by the cluster until a transfer between the same nodes gets through the
+whole range, so the next one starts past them too
+*/
+
+const (
+	migrationChunkSize  = 256 << 10
+	migrationWindow     = 4
+	migrationAttempts   = 3
+	migrationBackoff    = 200 * time.Millisecond // doubled every attempt
+	migrationAckTimeout = 10 * time.Second       // a stream that goes this long without an ack is broken off
+)
+
+type migrationPair struct {
+	src, dest string
+}
+
+// migration is a transfer between two nodes, the latest one between them is kept for Migrations
+type migration struct {
+	progress    utils.Migration
+	checkpoints map[tokenRange]migrationCheckpoint // the cluster's for the two nodes
+	held        map[tokenRange]bool                // the ranges the stream under way got a failure in
+}
+
+// migrationCheckpoint is what the destination stored of the records sent to it from a range
+type migrationCheckpoint struct {
+	stored map[string]uint64 // the timestamp of the version stored by key, a newer version of the key is sent again
+}
+
+// passed reports whether the destination stored the record already
+func (cp migrationCheckpoint) passed(record *Record) bool {
+	ts, ok := cp.stored[string(record.Key)]
+	return ok && record.Header.TimeStamp <= ts
+}
+
+type migrationChunk struct {
+	rng     tokenRange
+	records []Record
+	bytes   uint64
+}
+
+func recordSize(record *Record) uint64 {
+	return uint64(headerSize) + uint64(len(record.Key)) + uint64(len(record.Value))
+}
+
+// Migrations returns the progress of the latest transfer between every pair of nodes records moved between
+func (c *Cluster) Migrations() []utils.Migration {
+	c.migrationsMu.Lock()
+	defer c.migrationsMu.Unlock()
+	migrations := make([]utils.Migration, 0, len(c.migrations))
+	for _, m := range c.migrations {
+		migrations = append(migrations, m.progress)
+	}
+	slices.SortFunc(migrations, func(a, b utils.Migration) int {
+		return cmp.Or(cmp.Compare(a.Source, b.Source), cmp.Compare(a.Dest, b.Dest))
+	})
+	return migrations
+}
+
+// migrate streams the records to the destination, returns the keys it confirmed storing
+func (c *Cluster) migrate(src, dest string, records []Record) map[string]bool {
+	ranges := c.ringRanges()
+	rangeOf := func(key []byte) tokenRange {
+		token := keyToken(key)
+		for _, r := range ranges {
+			if r.contains(token) {
+				return r.tokenRange
+			}
+		}
+		// a ring of a single node is a single range, start == end
+		return tokenRange{}
+	}
+	records = slices.Clone(records)
+	slices.SortFunc(records, func(a, b Record) int {
+		ra, rb := rangeOf(a.Key), rangeOf(b.Key)
+		return cmp.Or(cmp.Compare(ra.start, rb.start), bytes.Compare(a.Key, b.Key))
+	})
+
+	pair := migrationPair{src, dest}
+	m := &migration{progress: utils.Migration{Source: src, Dest: dest, TotalRecords: uint64(len(records))}}
+	for i := range records {
+		m.progress.TotalBytes += recordSize(&records[i])
+	}
+	c.migrationsMu.Lock()
+	if c.checkpoints[pair] == nil {
+		c.checkpoints[pair] = make(map[tokenRange]migrationCheckpoint)
+	}
+	m.checkpoints = c.checkpoints[pair]
+	c.migrations[pair] = m
+	c.migrationsMu.Unlock()
+
+	confirmed := make(map[string]bool, len(records))
+	var pending []Record
+	for attempt := range migrationAttempts {
+		if attempt > 0 {
+			time.Sleep(migrationBackoff << (attempt - 1))
+		}
+		c.migrationsMu.Lock()
+		m.progress.Attempts++
+		m.held = make(map[tokenRange]bool)
+		pending = pending[:0]
+		for _, record := range records {
+			checkpoint, ok := m.checkpoints[rangeOf(record.Key)]
+			if !ok || !checkpoint.passed(&record) {
+				pending = append(pending, record)
+			} else {
+				confirmed[string(record.Key)] = true
+			}
+		}
+		c.migrationsMu.Unlock()
+
+		err := c.streamChunks(m, src, dest, chunkRecords(pending, rangeOf), confirmed)
+		c.migrationsMu.Lock()
+		if err == nil {
+			m.progress.Done, m.progress.Err = true, ""
+			// the ranges the destination got through don't need them anymore, the others resume from them
+			maps.DeleteFunc(m.checkpoints, func(rng tokenRange, _ migrationCheckpoint) bool { return !m.held[rng] })
+			if len(m.checkpoints) == 0 {
+				delete(c.checkpoints, pair)
+			}
+		} else {
+			m.progress.Err = err.Error()
+		}
+		progress := m.progress
+		c.migrationsMu.Unlock()
+
+		if err == nil {
+			fmt.Printf("migrated %d record(s), %d byte(s) %s -> %s\n", progress.Records, progress.Bytes, src, dest)
+			return confirmed
+		}
+		fmt.Printf("migration %s -> %s stopped at %d/%d record(s), attempt %d: %v\n", src, dest, progress.Records, progress.TotalRecords, attempt+1, err)
+	}
+
+	// most likely the destination is down, it gets the rest of the records once it's back
+	for i := range pending {
+		if !confirmed[string(pending[i].Key)] {
+			c.hint(dest, &pending[i])
+		}
+	}
+	return confirmed
+}
+
+// chunkRecords cuts the sorted records into chunks of about migrationChunkSize bytes, a chunk never spans two ranges
+func chunkRecords(records []Record, rangeOf func(key []byte) tokenRange) []migrationChunk {
+	var chunks []migrationChunk
+	for _, record := range records {
+		size := recordSize(&record)
+		rng := rangeOf(record.Key)
+		last := len(chunks) - 1
+		if last < 0 || chunks[last].rng != rng || chunks[last].bytes+size > migrationChunkSize {
+			chunks = append(chunks, migrationChunk{rng: rng})
+			last++
+		}
+		chunks[last].records = append(chunks[last].records, record)
+		chunks[last].bytes += size
+	}
+	return chunks
+}
+
+// streamChunks sends the chunks over a single stream, keeping at most migrationWindow of them unacknowledged, and
+// moves the migration's checkpoints and counters along with the acks
+func (c *Cluster) streamChunks(m *migration, src, dest string, chunks []migrationChunk, confirmed map[string]bool) error {
+	srcNode, ok := c.Nodes()[src]
+	if !ok && len(chunks) > 0 {
+		srcNode = c.coordinator(chunks[0].records[0].Key)
+	}
+	client, conn := StartGRPCClient(dest, c.nodeClock(srcNode))
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchdog := time.AfterFunc(migrationAckTimeout, cancel)
+	defer watchdog.Stop()
+
+	stream, err := client.MigrateStream(ctx)
+	if err != nil {
+		return err
+	}
+
+	window := make(chan struct{}, migrationWindow)
+	sent := make(chan error, 1)
+	go func() {
+		for i, chunk := range chunks {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				sent <- ctx.Err()
+				return
+			}
+			err := stream.Send(&proto.MigrationChunk{
+				SourceNodeAddr: src,
+				DestNodeAddr:   dest,
+				Seq:            uint64(i),
+				KvPairs:        convertRecordsToProtoKVPairs(&chunk.records),
+			})
+			if err != nil {
+				// the reason the stream broke comes out of Recv
+				sent <- err
+				return
+			}
+		}
+		sent <- stream.CloseSend()
+	}()
+
+	for i, chunk := range chunks {
+		ack, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("chunk %d/%d: %w", i+1, len(chunks), err)
+		}
+		watchdog.Reset(migrationAckTimeout)
+		<-window
+		if ack.Seq != uint64(i) {
+			return fmt.Errorf("chunk %d/%d: acknowledged out of order as %d", i+1, len(chunks), ack.Seq+1)
+		}
+
+		failed := make(map[string]bool, len(ack.Failures))
+		for _, failure := range ack.Failures {
+			failed[string(failure.Key)] = true
+			fmt.Printf("could not migrate key = %s to %s: %s\n", failure.Key, dest, failure.ErrorMsg)
+		}
+		c.migrationsMu.Lock()
+		// the checkpoint stays before the first record the destination couldn't store, every transfer sends it again
+		// until it's stored. a failure without a key holds the whole chunk back
+		// and none of its records count as stored
+		stored := len(chunk.records)
+		if failed[""] {
+			stored = 0
+		}
+		for i, record := range chunk.records {
+			if failed[string(record.Key)] {
+				stored = min(stored, i)
+			} else if !failed[""] {
+				confirmed[string(record.Key)] = true
+			}
+		}
+		if !m.held[chunk.rng] && stored > 0 {
+			checkpoint := m.checkpoints[chunk.rng]
+			if checkpoint.stored == nil {
+				checkpoint.stored = make(map[string]uint64)
+			}
+			for _, record := range chunk.records[:stored] {
+				checkpoint.stored[string(record.Key)] = record.Header.TimeStamp
+			}
+			m.checkpoints[chunk.rng] = checkpoint
+		}
+		if stored < len(chunk.records) {
+			m.held[chunk.rng] = true
+		}
+		m.progress.Records += uint64(len(chunk.records))
+		m.progress.Bytes += chunk.bytes
+		c.migrationsMu.Unlock()
+	}
+	return <-sent
+}
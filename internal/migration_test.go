@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/jateen67/kv/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// brokenDestination stores nothing, it acknowledges a number of chunks and breaks off every stream after that
+type brokenDestination struct {
+	proto.UnimplementedDataMigrationServiceServer
+
+	mu       sync.Mutex
+	acks     int    // chunks left to acknowledge, negative for no limit
+	fail     []byte // the key it fails to store
+	keyless  bool   // fails every chunk without naming a key
+	received []string
+}
+
+func (d *brokenDestination) MigrateStream(stream grpc.BidiStreamingServer[proto.MigrationChunk, proto.MigrationAck]) error {
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		if d.acks == 0 {
+			d.mu.Unlock()
+			return status.Error(codes.Unavailable, "broken off")
+		}
+		d.acks--
+		ack := &proto.MigrationAck{Seq: chunk.Seq}
+		if d.keyless {
+			ack.Failures = append(ack.Failures, &proto.MigrationResult{ErrorMsg: "shutting down"})
+		}
+		for _, pair := range chunk.KvPairs {
+			d.received = append(d.received, string(pair.Record.Key))
+			if bytes.Equal(pair.Record.Key, d.fail) {
+				ack.Failures = append(ack.Failures, &proto.MigrationResult{Key: pair.Record.Key, ErrorMsg: "disk full"})
+			}
+		}
+		d.mu.Unlock()
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// a transfer that breaks off partway resumes, in a later transfer between the same nodes, from the last chunk the
+// destination acknowledged, but not past a key the destination failed to store
+func TestMigrationResume(t *testing.T) {
+	c := startTestCluster(t, 1)
+	var src string
+	for addr := range c.Nodes() {
+		src = addr
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two records make a chunk
+	dest := &brokenDestination{acks: 3, fail: []byte("key-03")}
+	server := grpc.NewServer()
+	proto.RegisterDataMigrationServiceServer(server, dest)
+	go server.Serve(ln)
+	defer server.Stop()
+
+	var records []Record
+	for i := range 20 {
+		records = append(records, *c.newRecord([]byte(fmt.Sprintf("key-%02d", i)), bytes.Repeat([]byte{byte(i)}, 100<<10), 0, 0))
+	}
+	confirmed := c.migrate(src, ln.Addr().String(), records)
+	if want := []string{"key-00", "key-01", "key-02", "key-04", "key-05"}; !slices.Equal(slices.Sorted(maps.Keys(confirmed)), want) {
+		t.Fatalf("confirmed %v, want %v", slices.Sorted(maps.Keys(confirmed)), want)
+	}
+
+	dest.mu.Lock()
+	dest.acks, dest.fail, dest.received = -1, nil, nil
+	dest.mu.Unlock()
+	confirmed = c.migrate(src, ln.Addr().String(), records)
+	if len(confirmed) != len(records) {
+		t.Fatalf("confirmed %d record(s) once the destination is back, want %d", len(confirmed), len(records))
+	}
+	// sent again from the key it failed to store
+	var want []string
+	for i := 3; i < 20; i++ {
+		want = append(want, fmt.Sprintf("key-%02d", i))
+	}
+	dest.mu.Lock()
+	defer dest.mu.Unlock()
+	if !slices.Equal(dest.received, want) {
+		t.Fatalf("resumed transfer sent %v, want %v", dest.received, want)
+	}
+	if len(c.checkpoints) != 0 {
+		t.Fatalf("checkpoints kept after the transfer went through: %v", c.checkpoints)
+	}
+}
+
+func startBrokenDestination(t *testing.T, dest *brokenDestination) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	proto.RegisterDataMigrationServiceServer(server, dest)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+	return ln.Addr().String()
+}
+
+// a failure that names no key holds back the whole chunk, none of its keys are dropped at the source
+func TestMigrationKeylessFailure(t *testing.T) {
+	c := startTestCluster(t, 1)
+	var src *Node
+	for _, node := range c.Nodes() {
+		src = node
+	}
+	dest := startBrokenDestination(t, &brokenDestination{acks: -1, keyless: true})
+
+	var records []Record
+	for i := range 4 {
+		record := c.newRecord([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"), 0, 0)
+		if err := src.Store.PutRecord(record); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		records = append(records, *record)
+	}
+	confirmed := c.migrate(src.Addr, dest, records)
+	if len(confirmed) != 0 {
+		t.Fatalf("confirmed %v, want none", slices.Sorted(maps.Keys(confirmed)))
+	}
+
+	// the source drops what the destination confirmed, like a rebalance does
+	drop := make(map[string]uint64)
+	for _, record := range records {
+		if confirmed[string(record.Key)] {
+			drop[string(record.Key)] = record.Header.TimeStamp
+		}
+	}
+	if err := src.Store.Drop(drop); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	for _, record := range records {
+		if _, err := src.Store.Get(record.Key); err != nil {
+			t.Errorf("get %s from the source: %v", record.Key, err)
+		}
+	}
+}
+
+// a key rewritten after the destination stored it is sent again, even when the new version is older than another key
+// the destination stored from the same range
+func TestMigrationRewrittenKey(t *testing.T) {
+	c := startTestCluster(t, 1)
+	var src string
+	for addr := range c.Nodes() {
+		src = addr
+	}
+	// two records make a chunk, the second one never gets through
+	dest := &brokenDestination{acks: 1}
+	addr := startBrokenDestination(t, dest)
+
+	record := func(key string, ts uint64) Record {
+		r := *c.newRecord([]byte(key), bytes.Repeat([]byte{'x'}, 100<<10), 0, 0)
+		r.Header.TimeStamp = ts
+		r.Header.CheckSum = r.CalculateChecksum()
+		return r
+	}
+	c.migrate(src, addr, []Record{record("a", 100), record("b", 50), record("c", 10), record("d", 10)})
+
+	dest.mu.Lock()
+	dest.acks, dest.received = -1, nil
+	dest.mu.Unlock()
+	c.migrate(src, addr, []Record{record("a", 100), record("b", 80), record("c", 10), record("d", 10)})
+
+	dest.mu.Lock()
+	defer dest.mu.Unlock()
+	if want := []string{"b", "c", "d"}; !slices.Equal(dest.received, want) {
+		t.Fatalf("resumed transfer sent %v, want %v", dest.received, want)
+	}
+}
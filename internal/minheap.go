@@ -1,5 +1,7 @@
 package internal
 
+import "bytes"
+
 type MinRecordHeap []Record
 
 func (h MinRecordHeap) Len() int {
@@ -7,7 +9,7 @@ func (h MinRecordHeap) Len() int {
 }
 
 func (h MinRecordHeap) Less(i, j int) bool {
-	return h[i].Key < h[j].Key
+	return bytes.Compare(h[i].Key, h[j].Key) < 0
 }
 
 func (h MinRecordHeap) Swap(i, j int) {
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Model test -- random operations against a store, checked against a plain map
+
+Sets, deletes, merges, range deletes, gets and scans run against a store on MemFS with tiny thresholds, so flushes,
+compactions, blob files and lookups across several tables all get mixed together. Every read is compared with the
+map, and the store is closed and reopened every few operations, after which every key and a full scan are checked
+again.
+*/
+
+type modelTestOptions struct {
+	seed         int64
+	ops          int // operations in total
+	keys         int // size of the key space
+	restartEvery int // operations between restarts, 0 never restarts
+}
+
+func TestModel(t *testing.T) {
+	ops := 20000
+	if testing.Short() {
+		ops = 2000
+	}
+	for _, seed := range []int64{1, 2, 3} {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			opts := modelTestOptions{seed: seed, ops: ops, keys: 200, restartEvery: 1000}
+			if err := runModelTest(t, opts); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+type modelTest struct {
+	opts  modelTestOptions
+	rng   *rand.Rand
+	fs    *MemFS
+	store *DiskStore
+	model map[string]string
+}
+
+// runModelTest returns an error describing the first read that disagreed with the model
+func runModelTest(t *testing.T, opts modelTestOptions) error {
+	mt := &modelTest{
+		opts:  opts,
+		rng:   rand.New(rand.NewSource(opts.seed)),
+		fs:    NewMemFS(opts.seed),
+		model: make(map[string]string),
+	}
+	if err := mt.open(); err != nil {
+		return fmt.Errorf("initial open: %w", err)
+	}
+
+	restarts := 0
+	for i := 1; i <= opts.ops; i++ {
+		if err := mt.step(); err != nil {
+			return fmt.Errorf("op %d: %w", i, err)
+		}
+		if opts.restartEvery > 0 && i%opts.restartEvery == 0 {
+			if !mt.store.Close() {
+				return fmt.Errorf("op %d: close failed", i)
+			}
+			if err := mt.open(); err != nil {
+				return fmt.Errorf("op %d: reopen: %w", i, err)
+			}
+			if err := mt.checkAll(); err != nil {
+				return fmt.Errorf("op %d, after restart: %w", i, err)
+			}
+			restarts++
+		}
+	}
+	if err := mt.checkAll(); err != nil {
+		return fmt.Errorf("final check: %w", err)
+	}
+	t.Logf("%d ops, %d restarts, %d live keys, no mismatch", opts.ops, restarts, len(mt.model))
+	return nil
+}
+
+func (mt *modelTest) open() error {
+	store, err := newStore(1, WithFS(mt.fs))
+	if err != nil {
+		return err
+	}
+	useTinyThresholds(store)
+	mt.store = store
+	return nil
+}
+
+func (mt *modelTest) randomKey() string {
+	return fmt.Sprintf("key-%04d", mt.rng.Intn(mt.opts.keys))
+}
+
+// randomValue is mostly small, sometimes big enough to go to a blob file, sometimes empty
+func (mt *modelTest) randomValue() string {
+	size := mt.rng.Intn(64)
+	switch n := mt.rng.Intn(10); {
+	case n == 0:
+		size = 0
+	case n < 3:
+		size = 128 + mt.rng.Intn(512)
+	}
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = byte('a' + mt.rng.Intn(26))
+	}
+	return string(value)
+}
+
+func (mt *modelTest) step() error {
+	key := mt.randomKey()
+	switch n := mt.rng.Intn(100); {
+	case n < 40:
+		value := mt.randomValue()
+		if err := mt.store.Set([]byte(key), []byte(value)); err != nil {
+			return fmt.Errorf("set %s: %w", key, err)
+		}
+		mt.model[key] = value
+	case n < 50:
+		if err := mt.store.Delete([]byte(key)); err != nil {
+			return fmt.Errorf("delete %s: %w", key, err)
+		}
+		delete(mt.model, key)
+	case n < 60:
+		// a missing value is an empty one to the append operator
+		operand := fmt.Sprintf("+%d", mt.rng.Intn(1000))
+		if err := mt.store.Merge([]byte(key), AppendOperatorName, []byte(operand)); err != nil {
+			return fmt.Errorf("merge %s: %w", key, err)
+		}
+		mt.model[key] += operand
+	case n < 62:
+		start, end := key, mt.randomKey()
+		if start >= end {
+			return nil
+		}
+		if err := mt.store.DeleteRange([]byte(start), []byte(end)); err != nil {
+			return fmt.Errorf("delete range [%s, %s): %w", start, end, err)
+		}
+		for k := range mt.model {
+			if k >= start && k < end {
+				delete(mt.model, k)
+			}
+		}
+	case n < 90:
+		return mt.checkKey(key)
+	default:
+		start, end := []byte(mt.randomKey()), []byte(mt.randomKey())
+		if mt.rng.Intn(4) == 0 {
+			end = nil
+		} else if bytes.Compare(start, end) > 0 {
+			start, end = end, start
+		}
+		return mt.checkScan(start, end)
+	}
+	return nil
+}
+
+func (mt *modelTest) checkKey(key string) error {
+	got, err := mt.store.Get([]byte(key))
+	want, exists := mt.model[key]
+	switch {
+	case err != nil && !errors.Is(err, utils.ErrKeyNotFound):
+		return fmt.Errorf("get %s: %w", key, err)
+	case exists != (err == nil):
+		return fmt.Errorf("get %s: exists = %v, model says %v", key, err == nil, exists)
+	case exists && string(got) != want:
+		return fmt.Errorf("get %s = %.20q, model says %.20q", key, got, want)
+	}
+	return nil
+}
+
+// checkScan compares a scan of [start, end) with the model's keys in that range, in order
+func (mt *modelTest) checkScan(start, end []byte) error {
+	var want []string
+	for key := range mt.model {
+		if key >= string(start) && (end == nil || key < string(end)) {
+			want = append(want, key)
+		}
+	}
+	slices.Sort(want)
+
+	var got []string
+	var mismatch error
+	err := mt.store.Scan(start, end, func(key, value []byte) bool {
+		if want := mt.model[string(key)]; string(value) != want {
+			mismatch = fmt.Errorf("scan returned %s = %.20q, model says %.20q", key, value, want)
+			return false
+		}
+		got = append(got, string(key))
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("scan [%s, %s): %w", start, end, err)
+	}
+	if mismatch != nil {
+		return mismatch
+	}
+	if !slices.Equal(got, want) {
+		return fmt.Errorf("scan [%s, %s) = %v, model says %v", start, end, got, want)
+	}
+	return nil
+}
+
+// checkAll checks every key of the key space, and a full scan against the whole model
+func (mt *modelTest) checkAll() error {
+	for i := 0; i < mt.opts.keys; i++ {
+		if err := mt.checkKey(fmt.Sprintf("key-%04d", i)); err != nil {
+			return err
+		}
+	}
+	scanned := make(map[string]string)
+	err := mt.store.Scan(nil, nil, func(key, value []byte) bool {
+		scanned[string(key)] = string(value)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("full scan: %w", err)
+	}
+	if !maps.Equal(scanned, mt.model) {
+		return fmt.Errorf("full scan differs from the model: %s", describeDiff(mt.model, scanned))
+	}
+	return nil
+}
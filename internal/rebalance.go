@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/jateen67/kv/utils"
+	"github.com/serialx/hashring"
+)
+
+/*
+Rebalancing -- a node joining or leaving changes the replicas of the keys around it on the ring. the change goes
+through phases so that clients don't notice it:
+
+	pending     the new ring is known, requests still go by the old one while the writes already queued land
+	streaming   requests go by the new ring, but a key's writes are also sent to its old replicas and a read that finds
+	            the key missing asks them too. meanwhile every key is streamed to its new replicas, see migration.go
+	dual-write  the stream is done, requests still go to both rings. once the writes sent while streaming have landed,
+	            a second pass sends the new replicas whatever the first one missed
+	cutover     requests only go by the new ring, and the old replicas drop the keys they confirmed handing over
+
+a key whose transfer failed is still written to and read from its old replicas after the cutover, until the next
+rebalance moves it.
+
+nodes running in processes of their own go through the same phases, driven by the node joining or by whoever
+decommissions a node, see router.go. the keys are read over ReplicaService and streamed over MigrateStream. the other
+coordinators only learn of the change through gossip: it's announced to them once the stream is done, and the second
+pass waits for them to go by the new ring, so it also picks up the writes they sent to the old replicas in the meantime
+*/
+
+type rebalancePhase int
+
+const (
+	phasePending rebalancePhase = iota
+	phaseStreaming
+	phaseDualWrite
+	phaseCutover
+)
+
+func (p rebalancePhase) String() string {
+	switch p {
+	case phasePending:
+		return "pending"
+	case phaseStreaming:
+		return "streaming"
+	case phaseDualWrite:
+		return "dual-write"
+	case phaseCutover:
+		return "cutover"
+	}
+	return fmt.Sprintf("rebalancePhase(%d)", int(p))
+}
+
+// ringChange is a rebalance under way
+type ringChange struct {
+	phase rebalancePhase
+	from  *hashring.HashRing // the ring before the change
+	keys  map[string]bool    // after the cutover, the keys still on their old replicas. nil for every key
+}
+
+// previousReplicas returns the nodes that were the key's replicas before the rebalance under way and aren't anymore,
+// they keep getting the key's writes and answering for it until the rebalance is done with it
+func (c *Cluster) previousReplicas(key []byte) []*Node {
+	t := c.topology()
+	change := t.change
+	if change == nil || change.phase == phasePending || (change.keys != nil && !change.keys[string(key)]) {
+		return nil
+	}
+	current := t.replicasFor(key, c.replicationFactor)
+	addrs, _ := change.from.GetNodes(string(key), min(c.replicationFactor, change.from.Size()))
+	var nodes []*Node
+	for _, addr := range addrs {
+		node, ok := t.nodes[addr]
+		if ok && !slices.Contains(current, addr) && !c.isDown(node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// fallBackToPreviousReplicas adds the answers of the key's previous replicas to the ones read, if any replica
+// answered without the key: it may be one the key is still moving to
+func (c *Cluster) fallBackToPreviousReplicas(key []byte, received []replicaAnswer) []replicaAnswer {
+	missing := slices.ContainsFunc(received, func(answer replicaAnswer) bool {
+		return errors.Is(answer.err, utils.ErrKeyNotFound)
+	})
+	if !missing && newestVersion(received) != nil {
+		return received
+	}
+	for _, node := range c.previousReplicas(key) {
+		record, err := node.getVersion(key)
+		received = append(received, replicaAnswer{addr: node.Addr, record: record, err: err})
+	}
+	return received
+}
+
+// enterPhase publishes the rebalance's next phase, along with the ring requests go by from then on
+func (c *Cluster) enterPhase(change ringChange, ring *hashring.HashRing) {
+	c.updateTopology(func(t *topology) {
+		t.ring = ring
+		t.change = &change
+	})
+	fmt.Printf("rebalance: %s\n", change.phase)
+}
+
+// rebalance moves the cluster from its ring onto next, going through the phases above. announce, if set, tells the
+// coordinators in other processes to go by next once the keys are streamed, and returns once they do
+func (c *Cluster) rebalance(next *hashring.HashRing, announce func()) {
+	change := ringChange{phase: phasePending, from: c.topology().ring}
+	c.enterPhase(change, change.from)
+	// writes still queued on a replica would land after the stream went past their key
+	for _, node := range c.Nodes() {
+		node.drainWrites()
+	}
+
+	change.phase = phaseStreaming
+	c.enterPhase(change, next)
+	c.copyToReplicas()
+
+	change.phase = phaseDualWrite
+	c.enterPhase(change, next)
+	if announce != nil {
+		announce()
+	}
+	for _, node := range c.Nodes() {
+		node.drainWrites()
+	}
+	moved, unconfirmed := c.copyToReplicas()
+
+	change.phase = phaseCutover
+	change.keys = unconfirmed
+	c.enterPhase(change, next)
+	if len(unconfirmed) == 0 {
+		c.updateTopology(func(t *topology) {
+			t.change = nil
+		})
+	} else {
+		fmt.Printf("rebalance: %d key(s) stay on their old replicas until the next rebalance\n", len(unconfirmed))
+	}
+
+	for addr, keys := range moved {
+		maps.DeleteFunc(keys, func(key string, _ uint64) bool { return unconfirmed[key] })
+		if len(keys) == 0 {
+			continue
+		}
+		if err := c.Nodes()[addr].drop(keys); err != nil {
+			fmt.Printf("could not drop moved keys @ node addr = %s: %v\n", addr, err)
+			continue
+		}
+		fmt.Printf("dropped %d moved key(s) @ node addr = %s\n", len(keys), addr)
+	}
+}
+
+// migrationSource is the copy of a key that gets sent to the replicas missing it
+type migrationSource struct {
+	nodeAddr string
+	record   Record
+}
+
+// copyToReplicas sends every key, from the memtables and the tables, deletes included, to the replicas that don't
+// hold it yet. returns, by node, the keys it holds but is no longer a replica of, with the timestamp of the version
+// it holds, and the keys some replica didn't confirm getting. those are hinted to the replica
+func (c *Cluster) copyToReplicas() (map[string]map[string]uint64, map[string]bool) {
+	// go through every key in the system and see if the nodes holding it still match its replicas
+	c.accumulator.Init(c.getAllNodeAddrs())
+
+	holders := make(map[string][]string)
+	sources := make(map[string]migrationSource)
+	moved := make(map[string]map[string]uint64)
+	for _, node := range c.Nodes() {
+		moved[node.Addr] = make(map[string]uint64)
+		// merge operands only make sense next to the older versions they apply to, which stay here, so the merged
+		// value gets sent, and values kept in blob files have to be sent over the wire as-is. range deleted keys
+		// aren't there at all: range tombstones stay on the node they were written to
+		err := node.scanVersions(nil, nil, func(record Record) bool {
+			key := string(record.Key)
+			holders[key] = append(holders[key], node.Addr)
+			if !slices.Contains(c.replicasFor(record.Key), node.Addr) {
+				moved[node.Addr][key] = record.Header.TimeStamp
+			}
+			// the newest copy across the holders is the one that gets sent
+			if source, ok := sources[key]; !ok || record.Header.TimeStamp > source.record.Header.TimeStamp {
+				sources[key] = migrationSource{nodeAddr: node.Addr, record: record}
+			}
+			return true
+		})
+		if err != nil {
+			fmt.Printf("could not read node addr = %s for migration: %v\n", node.Addr, err)
+		}
+	}
+
+	// every replica of a key that doesn't hold it yet gets a copy
+	for key, source := range sources {
+		for _, replica := range c.replicasFor([]byte(key)) {
+			if !slices.Contains(holders[key], replica) {
+				c.accumulator.Append(source.nodeAddr, replica, &source.record)
+			}
+		}
+	}
+
+	unconfirmed := make(map[string]bool)
+	for srcNode, v := range c.accumulator.data {
+		for destNode, pairs := range v {
+			if len(pairs) == 0 {
+				continue
+			}
+			confirmed := c.transferDataBetweenNodes(srcNode, destNode, &pairs)
+			for _, record := range pairs {
+				if !confirmed[string(record.Key)] {
+					unconfirmed[string(record.Key)] = true
+				}
+			}
+		}
+	}
+	c.accumulator.ClearAccumulator()
+	return moved, unconfirmed
+}
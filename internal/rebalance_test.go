@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jateen67/kv/utils"
+)
+
+// checkPlacement checks that every key is on its replicas with its value and nowhere else
+func checkPlacement(t *testing.T, c *Cluster, want map[string]string) {
+	t.Helper()
+	if change := c.topology().change; change != nil {
+		t.Fatalf("rebalance still under way: %s", change.phase)
+	}
+	for key, value := range want {
+		replicas := c.replicasFor([]byte(key))
+		for addr, node := range c.Nodes() {
+			got, err := node.Store.Get([]byte(key))
+			switch {
+			case slices.Contains(replicas, addr) && (err != nil || string(got) != value):
+				t.Errorf("get %s @ replica addr = %s: got %q, %v, want %q", key, addr, got, err, value)
+			case !slices.Contains(replicas, addr) && !errors.Is(err, utils.ErrKeyNotFound):
+				t.Errorf("get %s @ node addr = %s: got %q, %v, want it moved off", key, addr, got, err)
+			}
+		}
+		if got, _, err := c.Get([]byte(key), utils.ConsistencyAll); err != nil || string(got) != value {
+			t.Errorf("get %s: got %q, %v, want %q", key, got, err, value)
+		}
+	}
+}
+
+// keys move to the replicas a node joining or leaving gives them, and off the nodes that aren't their replicas anymore
+func TestRebalance(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(2))
+	want := make(map[string]string)
+	for i := range 100 {
+		key := fmt.Sprintf("key-%03d", i)
+		want[key] = fmt.Sprintf("value-%d", i)
+		if _, err := c.Set([]byte(key), []byte(want[key]), utils.ConsistencyAll); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	// deletes move too, or the old replicas' values would come back
+	for i := range 10 {
+		key := fmt.Sprintf("key-%03d", i)
+		if _, err := c.Delete([]byte(key), utils.ConsistencyAll); err != nil {
+			t.Fatalf("delete %s: %v", key, err)
+		}
+		delete(want, key)
+	}
+
+	before := c.Nodes()
+	c.AddNode()
+	var joined *Node
+	for addr, node := range c.Nodes() {
+		if _, ok := before[addr]; !ok {
+			joined = node
+		}
+	}
+	if joined == nil || c.topology().ring.Size() != 4 {
+		t.Fatalf("no node joined the ring of %d node(s)", c.topology().ring.Size())
+	}
+	checkPlacement(t, c, want)
+	if keys := storedKeys(t, joined.Store); len(keys) == 0 {
+		t.Fatal("the node that joined got no keys")
+	}
+
+	left := c.replicasFor([]byte("key-050"))[0]
+	c.RemoveNode(strings.TrimPrefix(left, ":"))
+	if _, ok := c.Nodes()[left]; ok || c.topology().ring.Size() != 3 {
+		t.Fatalf("%s is still in the cluster", left)
+	}
+	checkPlacement(t, c, want)
+	for i := range 10 {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if _, _, err := c.Get(key, utils.ConsistencyAll); !errors.Is(err, utils.ErrKeyNotFound) {
+			t.Errorf("get %s: got %v, want it deleted", key, err)
+		}
+	}
+}
+
+// storedKeys returns the live keys the store holds
+func storedKeys(t *testing.T, ds *DiskStore) []string {
+	t.Helper()
+	var keys []string
+	err := ds.ScanVersions(nil, nil, func(record Record) bool {
+		if record.Header.Tombstone == 0 {
+			keys = append(keys, string(record.Key))
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	return keys
+}
+
+// while a key streams to its new replicas, its old ones keep answering for it and getting its writes, until the cutover
+func TestRebalancePreviousReplicas(t *testing.T) {
+	c := startTestCluster(t, 3)
+	key := []byte("cart")
+	if _, err := c.Set(key, []byte("apples"), utils.ConsistencyAll); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	from := c.topology().ring
+	old := c.replicaNodes(key)[0]
+	next := from.RemoveNode(old.Addr)
+
+	c.enterPhase(ringChange{phase: phaseStreaming, from: from}, next)
+	if got := c.replicasFor(key); slices.Contains(got, old.Addr) {
+		t.Fatalf("replicas %v on the new ring, want %s left out", got, old.Addr)
+	}
+	if got, _, err := c.Get(key, utils.ConsistencyOne); err != nil || string(got) != "apples" {
+		t.Fatalf("get while streaming: got %q, %v, want the old replica's apples", got, err)
+	}
+	// in-process nodes don't pass their clocks along like gRPC calls do, within a millisecond the new replica's may be
+	// behind the timestamp of the write it replaces
+	c.clockFor(key).Update(old.Store.clock.Now())
+	if _, err := c.Set(key, []byte("pears"), utils.ConsistencyOne); err != nil {
+		t.Fatalf("set while streaming: %v", err)
+	}
+	waitFor(t, "the write to reach the old replica", func() bool {
+		got, err := old.Store.Get(key)
+		return err == nil && string(got) == "pears"
+	})
+
+	// past the cutover only the keys whose transfer failed stay on their old replicas
+	c.enterPhase(ringChange{phase: phaseCutover, from: from, keys: map[string]bool{"other": true}}, next)
+	if got := c.previousReplicas(key); len(got) != 0 {
+		t.Fatalf("previous replicas after the cutover: %d, want none", len(got))
+	}
+	c.enterPhase(ringChange{phase: phaseCutover, from: from, keys: map[string]bool{string(key): true}}, next)
+	if got := c.previousReplicas(key); len(got) != 1 || got[0] != old {
+		t.Fatalf("previous replicas after a failed transfer: %v, want %s", got, old.Addr)
+	}
+}
+
+// requests keep going while nodes join and leave, two joining at once included. run with -race
+func TestRebalanceUnderLoad(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(2))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	last := make([]map[string]string, 4) // by worker, the value of every key it wrote last
+	errs := make(chan error, len(last))
+	for w := range last {
+		last[w] = make(map[string]string)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key-%d-%02d", w, i%20)
+				value := fmt.Sprintf("value-%d", i)
+				if _, err := c.Set([]byte(key), []byte(value), utils.ConsistencyQuorum); err != nil {
+					errs <- fmt.Errorf("set %s: %w", key, err)
+					return
+				}
+				last[w][key] = value
+				if _, _, err := c.Get([]byte(key), utils.ConsistencyOne); err != nil {
+					errs <- fmt.Errorf("get %s: %w", key, err)
+					return
+				}
+			}
+		}()
+	}
+
+	var joining sync.WaitGroup
+	for range 2 {
+		joining.Add(1)
+		go func() {
+			defer joining.Done()
+			c.AddNode()
+		}()
+	}
+	joining.Wait()
+	if size := c.topology().ring.Size(); size != 5 {
+		t.Errorf("ring of %d node(s) after two joined at once, want 5", size)
+	}
+	for addr := range c.Nodes() {
+		c.RemoveNode(strings.TrimPrefix(addr, ":"))
+		break
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	want := make(map[string]string)
+	for _, written := range last {
+		maps.Copy(want, written)
+	}
+	checkPlacement(t, c, want)
+}
@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Replication -- every key lives on the N distinct nodes that follow it on the hash ring (its preference list).
+
+The node coordinating a request sends it to every replica and waits until as many as the consistency level asks
+for have answered, the remaining replicas finish in the background. A write is timestamped once by the coordinator
+(see hlc.go), so every replica stores the same version of the key. Writes to a node go through a queue that applies them in
+order, so a write that returned early can't be overtaken on a slow replica by a later write.
+*/
+
+const DefaultReadRepairChance = 0.1
+
+// replicaWrite is a write waiting in a node's queue
+type replicaWrite struct {
+	record *Record // nil only waits for the writes ahead of it
+	acks   chan<- replicaAnswer
+}
+
+// replicaAnswer is one replica's answer to a read or a write
+type replicaAnswer struct {
+	addr   string
+	record Record // the version read, reads only
+	err    error
+}
+
+// startWriter starts applying the writes sent to the node
+func (n *Node) startWriter() {
+	n.writes = make(chan replicaWrite, 1024)
+	n.done = make(chan struct{})
+	n.stopped = false
+	go func() {
+		defer close(n.done)
+		for w := range n.writes {
+			var err error
+			if w.record != nil {
+				err = n.putRecord(w.record)
+			}
+			w.acks <- replicaAnswer{addr: n.Addr, err: err}
+		}
+	}()
+}
+
+// send queues the write on the node, false if its writer has been stopped. the node may be removed from the cluster
+// by the time a write for it is sent, stopWriter can't close the queue while a send is under way
+func (n *Node) send(w replicaWrite) bool {
+	n.writesMu.RLock()
+	defer n.writesMu.RUnlock()
+	if n.stopped {
+		return false
+	}
+	n.writes <- w
+	return true
+}
+
+// drainWrites waits for the writes already sent to be applied
+func (n *Node) drainWrites() {
+	acks := make(chan replicaAnswer, 1)
+	if n.send(replicaWrite{acks: acks}) {
+		<-acks
+	}
+}
+
+// stopWriter waits for the writes already sent to be applied, no more writes can be sent afterwards
+func (n *Node) stopWriter() {
+	n.writesMu.Lock()
+	if !n.stopped {
+		n.stopped = true
+		close(n.writes)
+	}
+	n.writesMu.Unlock()
+	<-n.done
+}
+
+// replicasFor returns the key's preference list: the nodes holding a copy of it, the first one being the key's
+// position on the hash ring followed by the next distinct nodes clockwise
+func (c *Cluster) replicasFor(key []byte) []string {
+	return c.topology().replicasFor(key, c.replicationFactor)
+}
+
+func (t *topology) replicasFor(key []byte, replicationFactor int) []string {
+	n := min(replicationFactor, t.ring.Size())
+	addrs, ok := t.ring.GetNodes(string(key), n)
+	if !ok {
+		return nil
+	}
+	return addrs
+}
+
+func (c *Cluster) replicaNodes(key []byte) []*Node {
+	t := c.topology()
+	var nodes []*Node
+	for _, addr := range t.replicasFor(key, c.replicationFactor) {
+		if node, ok := t.nodes[addr]; ok {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// coordinator returns the node that coordinates requests for the key: its first replica that's up
+func (c *Cluster) coordinator(key []byte) *Node {
+	replicas := c.replicaNodes(key)
+	for _, node := range replicas {
+		if !c.isDown(node) {
+			return node
+		}
+	}
+	if len(replicas) > 0 {
+		return replicas[0]
+	}
+	for _, node := range c.Nodes() {
+		return node
+	}
+	return nil
+}
+
+// nodeClock returns the clock of the node, a router's own clock for a node running in a process of its own
+func (c *Cluster) nodeClock(node *Node) *hybridClock {
+	if node == nil || node.Store == nil {
+		return c.clock
+	}
+	return node.Store.clock
+}
+
+// clockFor returns the clock that timestamps the key's writes, its coordinator's
+func (c *Cluster) clockFor(key []byte) *hybridClock {
+	return c.nodeClock(c.coordinator(key))
+}
+
+// newRecord builds the version of the key every replica stores, timestamped by the key's coordinator
+func (c *Cluster) newRecord(key, value []byte, tombstone, flags uint8) *Record {
+	header := Header{
+		Tombstone: tombstone,
+		Flags:     flags,
+		TimeStamp: c.clockFor(key).Now(),
+		KeySize:   uint32(len(key)),
+		ValueSize: uint32(len(value)),
+	}
+	record := &Record{
+		Header:    header,
+		Key:       slices.Clone(key),
+		Value:     slices.Clone(value),
+		TotalSize: headerSize + header.KeySize + header.ValueSize,
+	}
+	record.Header.CheckSum = record.CalculateChecksum()
+	return record
+}
+
+// writeReplicas sends the record to every replica of its key and waits for level's worth of acknowledgements,
+// returns how many replicas acknowledged the write by then. replicas that are down get a hint instead
+func (c *Cluster) writeReplicas(record *Record, level utils.ConsistencyLevel) (int, error) {
+	replicas := c.replicaNodes(record.Key)
+	acks, sent, errs := c.sendWrites(replicas, record)
+	// a key's old replicas keep getting its writes while it moves, nothing waits for them, see rebalance.go
+	previous := c.previousReplicas(record.Key)
+	doubled := make(chan replicaAnswer, len(previous))
+	for _, node := range previous {
+		node.send(replicaWrite{record: record, acks: doubled})
+	}
+	return awaitWrites(acks, sent, level.Required(len(replicas)), level, errs)
+}
+
+// writeRangeTombstone sends the range tombstone to every node, a key range is spread over the whole ring, and waits
+// for level's worth of acknowledgements among them. nodes that are down get a hint instead
+func (c *Cluster) writeRangeTombstone(record *Record, level utils.ConsistencyLevel) (int, error) {
+	nodes := slices.Collect(maps.Values(c.Nodes()))
+	acks, sent, errs := c.sendWrites(nodes, record)
+	return awaitWrites(acks, sent, level.Required(len(nodes)), level, errs)
+}
+
+// sendWrites queues the record on every node that's up and hints it for the others, returns where the acknowledgements
+// arrive and how many of them to expect
+func (c *Cluster) sendWrites(nodes []*Node, record *Record) (<-chan replicaAnswer, int, []error) {
+	acks := make(chan replicaAnswer, len(nodes))
+	sent := 0
+	var errs []error
+	for _, node := range nodes {
+		// a node removed since the nodes were looked up is as good as down
+		if c.isDown(node) || !node.send(replicaWrite{record: record, acks: acks}) {
+			c.hint(node.Addr, record)
+			errs = append(errs, fmt.Errorf("@ node addr = %s: %w", node.Addr, utils.ErrNodeUnavailable))
+			continue
+		}
+		sent++
+	}
+	return acks, sent, errs
+}
+
+// awaitWrites waits until required of the sent writes were acknowledged, returns how many were by then
+func awaitWrites(acks <-chan replicaAnswer, sent, required int, level utils.ConsistencyLevel, errs []error) (int, error) {
+	acked := 0
+	for i := 0; i < sent && acked < required; i++ {
+		ack := <-acks
+		if ack.err != nil {
+			errs = append(errs, fmt.Errorf("@ node addr = %s: %w", ack.addr, ack.err))
+			continue
+		}
+		acked++
+	}
+	if acked < required {
+		return acked, fmt.Errorf("%w: %d of %d required (%s): %w", utils.ErrNotEnoughReplicas, acked, required, level, errors.Join(errs...))
+	}
+	return acked, nil
+}
+
+// readReplicas asks every replica of the key for its newest version and waits for level's worth of answers,
+// a replica that doesn't have the key answers too. returns the newest version among the answers (ErrKeyNotFound
+// if none has one) and how many replicas answered. replicas that answered with an older version get repaired
+func (c *Cluster) readReplicas(key []byte, level utils.ConsistencyLevel) (Record, int, error) {
+	replicas := c.replicaNodes(key)
+	required := level.Required(len(replicas))
+	answers := make(chan replicaAnswer, len(replicas))
+	for _, node := range replicas {
+		if c.isDown(node) {
+			answers <- replicaAnswer{addr: node.Addr, err: utils.ErrNodeUnavailable}
+			continue
+		}
+		go func() {
+			record, err := node.getVersion(key)
+			answers <- replicaAnswer{addr: node.Addr, record: record, err: err}
+		}()
+	}
+
+	answered := 0
+	var received []replicaAnswer
+	var errs []error
+	for len(received) < len(replicas) && answered < required {
+		answer := <-answers
+		received = append(received, answer)
+		if answer.err != nil && !errors.Is(answer.err, utils.ErrKeyNotFound) {
+			errs = append(errs, fmt.Errorf("@ node addr = %s: %w", answer.addr, answer.err))
+			continue
+		}
+		answered++
+	}
+	late := len(replicas) - len(received)
+	// a replica the key is moving to may not have it yet, see rebalance.go
+	received = c.fallBackToPreviousReplicas(key, received)
+	newest := newestVersion(received)
+
+	// the replicas that didn't answer in time are only compared once in a while, waiting for them costs a
+	// goroutine per read. that's the only repair a read at ONE gets
+	if late > 0 && rand.Float64() < c.readRepairChance {
+		go func() {
+			all := slices.Clone(received)
+			for range late {
+				all = append(all, <-answers)
+			}
+			c.readRepair(all)
+		}()
+	} else {
+		c.readRepair(received)
+	}
+
+	if answered < required {
+		return Record{}, answered, fmt.Errorf("%w: %d of %d required (%s): %w", utils.ErrNotEnoughReplicas, answered, required, level, errors.Join(errs...))
+	}
+	if newest == nil {
+		return Record{}, answered, utils.ErrKeyNotFound
+	}
+	return *newest, answered, nil
+}
+
+// newestVersion returns the newest version among the answers, nil if no replica has the key. if any of them holds
+// siblings, it's all of their siblings merged
+func newestVersion(answers []replicaAnswer) *Record {
+	var newest *Record
+	var versions []*Record
+	siblings := false
+	for i := range answers {
+		if answers[i].err != nil {
+			continue
+		}
+		versions = append(versions, &answers[i].record)
+		siblings = siblings || answers[i].record.hasSiblings()
+		if newest == nil || answers[i].record.Header.TimeStamp > newest.Header.TimeStamp {
+			newest = &answers[i].record
+		}
+	}
+	if siblings {
+		merged, err := reconcileSiblings(versions)
+		if err != nil {
+			fmt.Printf("reconciling siblings of %s: %v\n", newest.Key, err)
+			return newest
+		}
+		return merged
+	}
+	return newest
+}
+
+// isStale reports whether the replica's version is older than the newest one
+func isStale(version, newest *Record) bool {
+	if newest.hasSiblings() {
+		return !sameSiblings(version, newest)
+	}
+	return version.Header.TimeStamp < newest.Header.TimeStamp
+}
+
+// readRepair sends the newest version among the answers to every replica that answered with an older one,
+// in the background. a replica missing a key that's deleted anyway is left alone
+func (c *Cluster) readRepair(answers []replicaAnswer) {
+	newest := newestVersion(answers)
+	if newest == nil {
+		return
+	}
+	for _, answer := range answers {
+		stale := answer.err == nil && isStale(&answer.record, newest)
+		missing := errors.Is(answer.err, utils.ErrKeyNotFound) && newest.Header.Tombstone == 0
+		if stale || missing {
+			go c.repairReplica(answer.addr, *newest)
+		}
+	}
+}
+
+// repairReplica sends the record to the replica over gRPC, it's kept as a hint if the replica can't be reached
+func (c *Cluster) repairReplica(addr string, record Record) {
+	fmt.Printf("read repair: sending %s @ ts = %d to node addr = %s\n", record.Key, record.Header.TimeStamp, addr)
+	client, conn := StartGRPCClient(addr, c.clockFor(record.Key))
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.MigrateKeyValuePairs(ctx, &proto.KeyValueMigrationRequest{
+		DestNodeAddr: addr,
+		KvPairs:      convertRecordsToProtoKVPairs(&[]Record{record}),
+	})
+	if err != nil {
+		fmt.Printf("read repair @ node addr = %s: %v\n", addr, err)
+		c.hint(addr, &record)
+		return
+	}
+	for _, result := range res.MigrationResults {
+		if !result.Success {
+			fmt.Printf("read repair @ node addr = %s: %s\n", addr, result.ErrorMsg)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jateen67/kv/utils"
+)
+
+// a node can be removed while writes for it are still being sent, they mustn't land on a closed queue
+func TestStopWriterWhileSending(t *testing.T) {
+	node := &Node{Addr: ":0", Store: openTestStore(t, NewMemFS(1))}
+	node.startWriter()
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acks := make(chan replicaAnswer, 1)
+			for {
+				record := &Record{
+					Header:    Header{TimeStamp: node.Store.clock.Now(), KeySize: 3, ValueSize: 5},
+					Key:       []byte("key"),
+					Value:     []byte("value"),
+					TotalSize: headerSize + 8,
+				}
+				record.Header.CheckSum = record.CalculateChecksum()
+				if !node.send(replicaWrite{record: record, acks: acks}) {
+					return
+				}
+				<-acks
+			}
+		}()
+	}
+	node.drainWrites()
+	node.stopWriter()
+	wg.Wait()
+
+	// stopping twice and draining a stopped node are no-ops
+	node.stopWriter()
+	node.drainWrites()
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// a request returns once level's worth of replicas answered, and fails if fewer than that are up
+func TestConsistencyLevels(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(3))
+	key := []byte("cart")
+	levels := []utils.ConsistencyLevel{utils.ConsistencyOne, utils.ConsistencyQuorum, utils.ConsistencyAll}
+
+	check := func(up int) {
+		t.Helper()
+		for _, level := range levels {
+			required := level.Required(3)
+			want := required
+			if up < required {
+				want = up
+			}
+			n, err := c.Set(key, []byte(level.String()), level)
+			if up < required {
+				if !errors.Is(err, utils.ErrNotEnoughReplicas) || n != want {
+					t.Errorf("set at %s with %d up: got %d, %v, want %d, %v", level, up, n, err, want, utils.ErrNotEnoughReplicas)
+				}
+			} else if err != nil || n != want {
+				t.Errorf("set at %s with %d up: got %d, %v, want %d, nil", level, up, n, err, want)
+			}
+
+			// the replicas that weren't waited for still apply the write, a read at ONE could see the previous one
+			for _, node := range c.replicaNodes(key) {
+				if !node.down.Load() {
+					waitFor(t, "the write to reach "+node.Addr, func() bool {
+						value, err := node.Store.Get(key)
+						return err == nil && string(value) == level.String()
+					})
+				}
+			}
+			_, n, err = c.Get(key, level)
+			if up < required {
+				if !errors.Is(err, utils.ErrNotEnoughReplicas) || n != want {
+					t.Errorf("get at %s with %d up: got %d, %v, want %d, %v", level, up, n, err, want, utils.ErrNotEnoughReplicas)
+				}
+			} else if err != nil || n != want {
+				t.Errorf("get at %s with %d up: got %d, %v, want %d, nil", level, up, n, err, want)
+			}
+		}
+	}
+
+	check(3)
+	replicas := c.replicaNodes(key)
+	c.StopNode(strings.TrimPrefix(replicas[0].Addr, ":"))
+	check(2)
+	c.StopNode(strings.TrimPrefix(replicas[1].Addr, ":"))
+	check(1)
+}
+
+// replicas that disagree are resolved by the newest version, whichever replica holds it
+func TestReadResolvesNewestVersion(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(3))
+	key := []byte("cart")
+	if _, err := c.Set(key, []byte("apples"), utils.ConsistencyAll); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	// a write that only made it to the last replica
+	replicas := c.replicaNodes(key)
+	newest := replicas[len(replicas)-1]
+	if err := newest.Store.PutRecord(c.newRecord(key, []byte("pears"), 0, 0)); err != nil {
+		t.Fatalf("put on %s: %v", newest.Addr, err)
+	}
+
+	value, n, err := c.Get(key, utils.ConsistencyAll)
+	if err != nil || n != 3 || string(value) != "pears" {
+		t.Fatalf("get at ALL: got %q from %d replica(s), %v, want \"pears\" from 3", value, n, err)
+	}
+	// the replicas that answered with the older version get it repaired
+	for _, node := range replicas {
+		waitFor(t, "read repair of "+node.Addr, func() bool {
+			value, err := node.Store.Get(key)
+			return err == nil && string(value) == "pears"
+		})
+	}
+}
+
+// a read compares the replicas' versions and sends the newest one to those that are behind, the ones that answered
+// after the read returned included
+func TestReadRepair(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(3), WithReadRepairChance(1))
+	stale, missing := []byte("stale"), []byte("missing")
+	if _, err := c.Set(stale, []byte("apples"), utils.ConsistencyAll); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	// writes that only made it to one replica each
+	for key, value := range map[string]string{"stale": "pears", "missing": "plums"} {
+		replicas := c.replicaNodes([]byte(key))
+		if err := replicas[1].Store.PutRecord(c.newRecord([]byte(key), []byte(value), 0, 0)); err != nil {
+			t.Fatalf("put %s on %s: %v", key, replicas[1].Addr, err)
+		}
+	}
+
+	for key, want := range map[string]string{"stale": "pears", "missing": "plums"} {
+		if _, _, err := c.Get([]byte(key), utils.ConsistencyOne); err != nil && !errors.Is(err, utils.ErrKeyNotFound) {
+			t.Fatalf("get %s: %v", key, err)
+		}
+		for _, node := range c.replicaNodes([]byte(key)) {
+			waitFor(t, "read repair of "+key+" on "+node.Addr, func() bool {
+				value, err := node.Store.Get([]byte(key))
+				return err == nil && string(value) == want
+			})
+		}
+	}
+	if value, n, err := c.Get(missing, utils.ConsistencyAll); err != nil || n != 3 || string(value) != "plums" {
+		t.Fatalf("get at ALL after repair: got %q from %d replica(s), %v", value, n, err)
+	}
+}
+
+// a merge returns once level's worth of replicas acknowledged it, the ones that are down get it once they're back
+func TestMergeConsistency(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(3))
+	key := []byte("visits")
+	replicas := c.replicaNodes(key)
+	c.StopNode(strings.TrimPrefix(replicas[0].Addr, ":"))
+
+	if n, err := c.Merge(key, Int64AddOperatorName, []byte("1"), utils.ConsistencyQuorum); err != nil || n != 2 {
+		t.Fatalf("merge at QUORUM with 2 up: got %d, %v, want 2, nil", n, err)
+	}
+	if n, err := c.Merge(key, Int64AddOperatorName, []byte("1"), utils.ConsistencyAll); !errors.Is(err, utils.ErrNotEnoughReplicas) || n != 2 {
+		t.Fatalf("merge at ALL with 2 up: got %d, %v, want 2, %v", n, err, utils.ErrNotEnoughReplicas)
+	}
+
+	c.StartNode(strings.TrimPrefix(replicas[0].Addr, ":"))
+	waitFor(t, "the hinted operands to reach "+replicas[0].Addr, func() bool {
+		value, err := replicas[0].Store.Get(key)
+		return err == nil && string(value) == "2"
+	})
+	for _, node := range replicas[1:] {
+		if value, err := node.Store.Get(key); err != nil || string(value) != "2" {
+			t.Errorf("get from %s: got %q, %v, want \"2\"", node.Addr, value, err)
+		}
+	}
+}
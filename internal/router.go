@@ -0,0 +1,435 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jateen67/kv/proto"
+	"github.com/jateen67/kv/utils"
+	"github.com/serialx/hashring"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Router -- nodes can run in processes of their own (cmd/kvnode), on separate hosts, with a router in front of them
+coordinating requests the same way an in-process cluster does, only over gRPC (ReplicaService).
+
+The router learns which nodes there are by observing their gossip, starting from a few seed nodes: a node joins the
+cluster by starting up with seeds of its own and leaves it by being removed through gossip, the router follows along.
+It timestamps writes with a clock of its own, so every router needs a distinct id (WithRouterID).
+
+The keys move along with the ring, see rebalance.go. a joining node drives its own join: it gossips as joining, which
+keeps it off every ring, streams over its share of the keys, then goes on the ring and catches up on the writes that
+went to the old replicas meanwhile. whoever decommissions a node drives its leaving the same way, the node keeps serving
+until its keys are streamed to their new replicas. a node that restarts goes back on the ring right away, hints and
+anti-entropy bring it up to date
+*/
+
+const (
+	replicaRequestTimeout = 5 * time.Second
+	// the gossip intervals an announced ring change is given to reach every coordinator: a router learns of it from a
+	// node on its next round and follows it on the one after
+	ringSettleRounds = 3
+)
+
+// remote nodes are reached through a connection of the router's
+
+func (c *Cluster) dialRemoteNode(addr, id string) *Node {
+	node := &Node{ID: id, Addr: addr}
+	node.conn = dialNode(addr, c.clock)
+	node.replica = proto.NewReplicaServiceClient(node.conn)
+	node.startWriter()
+	return node
+}
+
+// putRecord stores the record on the node, in this process or over gRPC
+func (n *Node) putRecord(record *Record) error {
+	if n.Store != nil {
+		return n.Store.PutRecord(record)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replicaRequestTimeout)
+	defer cancel()
+	_, err := n.replica.Write(ctx, convertStoreRecordToProtoRecord(record))
+	return fromStatus(err)
+}
+
+// getVersion returns the node's newest version of the key, in this process or over gRPC
+func (n *Node) getVersion(key []byte) (Record, error) {
+	if n.Store != nil {
+		return n.Store.GetVersion(key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replicaRequestTimeout)
+	defer cancel()
+	record, err := n.replica.Read(ctx, &proto.ReadRequest{Key: key})
+	if err != nil {
+		return Record{}, fromStatus(err)
+	}
+	return *convertProtoRecordToStoreRecord(record), nil
+}
+
+// scanVersions calls fn with the node's newest version of every key in [start, end), in this process or over gRPC
+func (n *Node) scanVersions(start, end []byte, fn func(record Record) bool) error {
+	if n.Store != nil {
+		return n.Store.ScanVersions(start, end, fn)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// a rebalance scans whole stores, only a stream that stalls is given up on
+	watchdog := time.AfterFunc(replicaRequestTimeout, cancel)
+	defer watchdog.Stop()
+	stream, err := n.replica.Scan(ctx, &proto.ScanRangeRequest{Start: start, End: end})
+	if err != nil {
+		return fromStatus(err)
+	}
+	for {
+		record, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fromStatus(err)
+		}
+		watchdog.Reset(replicaRequestTimeout)
+		if !fn(*convertProtoRecordToStoreRecord(record)) {
+			return nil
+		}
+	}
+}
+
+// drop drops the keys the node handed over to their new replicas, in this process or over gRPC
+func (n *Node) drop(versions map[string]uint64) error {
+	if n.Store != nil {
+		return n.Store.Drop(versions)
+	}
+	req := &proto.DropRequest{Keys: make([]*proto.DroppedKey, 0, len(versions))}
+	for key, ts := range versions {
+		req.Keys = append(req.Keys, &proto.DroppedKey{Key: []byte(key), Timestamp: ts})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replicaRequestTimeout)
+	defer cancel()
+	_, err := n.replica.Drop(ctx, req)
+	return fromStatus(err)
+}
+
+// fromStatus turns the status of a failed ReplicaService call back into the error it stands for
+func fromStatus(err error) error {
+	switch status.Code(err) {
+	case codes.OK:
+		return nil
+	case codes.NotFound:
+		return utils.ErrKeyNotFound
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return fmt.Errorf("%w: %s", utils.ErrNodeUnavailable, status.Convert(err).Message())
+	}
+	return err
+}
+
+// toStatus turns an error into the status a ReplicaService or KVService call fails with, the reason naming the error
+// goes along so that the caller can tell errors with the same code apart
+func toStatus(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, utils.ErrNotEnoughReplicas), errors.Is(err, utils.ErrNodeUnavailable):
+		code = codes.Unavailable
+	case errors.Is(err, utils.ErrKeyNotFound):
+		code = codes.NotFound
+	case errors.Is(err, utils.ErrCompareFailed), errors.Is(err, utils.ErrSiblings), errors.Is(err, utils.ErrMergeWithSiblings):
+		code = codes.FailedPrecondition
+	case errors.Is(err, utils.ErrEmptyKey), errors.Is(err, utils.ErrInvalidCausalContext), errors.Is(err, utils.ErrInvalidRange),
+		errors.Is(err, utils.ErrUnknownConsistencyLevel):
+		code = codes.InvalidArgument
+	}
+	s := status.New(code, err.Error())
+	if reason := utils.ErrorReason(err); reason != "" {
+		if detailed, detailErr := s.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: utils.ErrorDomain}); detailErr == nil {
+			s = detailed
+		}
+	}
+	return s.Err()
+}
+
+type replicaServer struct {
+	proto.UnimplementedReplicaServiceServer
+
+	underlyingNode *Node
+}
+
+func (s *replicaServer) Write(ctx context.Context, req *proto.Record) (*proto.WriteResponse, error) {
+	if req.Header == nil {
+		return nil, status.Error(codes.InvalidArgument, "record without a header")
+	}
+	if err := s.underlyingNode.Store.PutRecord(convertProtoRecordToStoreRecord(req)); err != nil {
+		return nil, toStatus(err)
+	}
+	return &proto.WriteResponse{}, nil
+}
+
+func (s *replicaServer) Read(ctx context.Context, req *proto.ReadRequest) (*proto.Record, error) {
+	record, err := s.underlyingNode.Store.GetVersion(req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return convertStoreRecordToProtoRecord(&record), nil
+}
+
+func (s *replicaServer) DeleteRange(ctx context.Context, req *proto.DeleteRangeRequest) (*proto.WriteResponse, error) {
+	if err := s.underlyingNode.Store.DeleteRange(req.Start, req.End); err != nil {
+		return nil, toStatus(err)
+	}
+	return &proto.WriteResponse{}, nil
+}
+
+func (s *replicaServer) Scan(req *proto.ScanRangeRequest, stream grpc.ServerStreamingServer[proto.Record]) error {
+	// sent once the store is let go of, a slow reader mustn't hold up its writes
+	var records []Record
+	err := s.underlyingNode.Store.ScanVersions(req.Start, req.End, func(record Record) bool {
+		records = append(records, record)
+		return true
+	})
+	if err != nil {
+		return toStatus(err)
+	}
+	for i := range records {
+		if err := stream.Send(convertStoreRecordToProtoRecord(&records[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *replicaServer) Drop(ctx context.Context, req *proto.DropRequest) (*proto.WriteResponse, error) {
+	versions := make(map[string]uint64, len(req.Keys))
+	for _, key := range req.Keys {
+		versions[string(key.Key)] = key.Timestamp
+	}
+	if err := s.underlyingNode.Store.Drop(versions); err != nil {
+		return nil, toStatus(err)
+	}
+	return &proto.WriteResponse{}, nil
+}
+
+// WithRouterID sets the id of a router's clock, it has to differ from every other router's and node's
+func WithRouterID(id uint32) ClusterOption {
+	return func(c *Cluster) {
+		c.clock = newHybridClock(id)
+	}
+}
+
+// NewRouter starts a router in front of nodes running in processes of their own, finding them through the seeds
+func NewRouter(seeds []string, opts ...ClusterOption) (*Cluster, error) {
+	cluster := newCluster(opts...)
+	cluster.remote = true
+	// routers on the same host keep their hints apart by their id
+	if err := cluster.openHints(fmt.Sprintf("storage/router-%d/hints", cluster.clock.nodeID)); err != nil {
+		return nil, err
+	}
+
+	cluster.gossip = newGossiper("", "", seeds, cluster.clock, cluster.gossipInterval, cluster.phiThreshold)
+	cluster.gossip.onUp = func(string) { cluster.deliverHints() }
+	// learn the cluster from a seed before taking requests
+	cluster.gossip.round()
+	cluster.followMembership()
+	cluster.gossip.start()
+	go cluster.followMembershipPeriodically()
+	cluster.startBackgroundWork()
+	return cluster, nil
+}
+
+// followMembership updates the nodes and the hash ring to the members gossip knows of, once the ring change this
+// process drives, if any, is done
+func (c *Cluster) followMembership() {
+	c.membershipMu.Lock()
+	defer c.membershipMu.Unlock()
+	c.applyMembership()
+}
+
+// applyMembership updates the nodes to the members gossip knows of, the joining ones included, and the hash ring to
+// the ones it has on the ring. the new ones replace the old ones whole, requests under way keep using the old ones.
+// the caller holds c.membershipMu
+func (c *Cluster) applyMembership() {
+	var old map[string]*Node
+	c.updateTopology(func(t *topology) {
+		ring := c.gossip.ring()
+		members := slices.DeleteFunc(c.gossip.view(), func(m utils.Member) bool { return m.Status == utils.MemberLeft })
+		addrs := make([]string, len(members))
+		for i, m := range members {
+			addrs[i] = m.Addr
+		}
+		if slices.Equal(ring, c.ringMembers) && slices.Equal(addrs, slices.Sorted(maps.Keys(t.nodes))) {
+			return
+		}
+		old = t.nodes
+		nodes := make(map[string]*Node, len(members))
+		for _, m := range members {
+			if node, ok := old[m.Addr]; ok {
+				nodes[m.Addr] = node
+				continue
+			}
+			nodes[m.Addr] = c.dialRemoteNode(m.Addr, m.ID)
+			fmt.Printf("router: node %s @ addr %s joined\n", m.ID, m.Addr)
+		}
+		t.nodes = nodes
+		t.ring = hashring.New(ring)
+		c.ringMembers = ring
+	})
+	// once the new nodes are published, no request picks the ones that left anymore
+	nodes := c.Nodes()
+	for addr, node := range old {
+		if _, ok := nodes[addr]; !ok {
+			fmt.Printf("router: node %s @ addr %s left\n", node.ID, addr)
+			node.stopWriter()
+			// a decommissioned node hears it left too, its own store isn't reached through a connection
+			if node.conn != nil {
+				node.conn.Close()
+			}
+		}
+	}
+}
+
+// decommission removes a node running in a process of its own from the cluster, its keys are streamed to their new
+// replicas first, see rebalance.go. the node stops heartbeating once it hears it left, and the process can be stopped
+// once this returns. the node is given by its address, or only its port
+func (c *Cluster) decommission(addr string) {
+	c.membershipMu.Lock()
+	defer c.membershipMu.Unlock()
+	nodes := c.Nodes()
+	if _, ok := nodes[addr]; !ok {
+		for nodeAddr := range nodes {
+			if strings.HasSuffix(nodeAddr, ":"+addr) {
+				addr = nodeAddr
+			}
+		}
+	}
+	if _, ok := nodes[addr]; !ok {
+		fmt.Printf("node @ addr %s not found\n", addr)
+		return
+	}
+	// it keeps serving the keys it still holds until the rebalance is done, the other coordinators stop sending it
+	// requests once they hear it left
+	c.rebalance(c.topology().ring.RemoveNode(addr), func() {
+		c.gossip.leave(addr, c.gossip.member(addr))
+		c.announceRingChange()
+	})
+	c.applyMembership()
+	fmt.Printf("node @ addr %s removed from the cluster\n", addr)
+}
+
+// join takes the node's share of the keys from the nodes in the cluster, then puts it on the ring, see rebalance.go.
+// the node gossips as joining until then
+func (c *Cluster) join(node *Node) {
+	c.membershipMu.Lock()
+	defer c.membershipMu.Unlock()
+	// the ring without the node, the one the other coordinators go by
+	c.applyMembership()
+	c.rebalance(c.topology().ring.AddNode(node.Addr), func() {
+		c.gossip.setJoining(false)
+		c.announceRingChange()
+	})
+	c.applyMembership()
+	fmt.Printf("node %s @ addr %s joined the cluster\n", node.ID, node.Addr)
+}
+
+// announceRingChange tells every node of the ring change gossip has, and gives the routers and the nodes' coordinators
+// time to follow it
+func (c *Cluster) announceRingChange() {
+	c.gossip.announce()
+	time.Sleep(ringSettleRounds * c.gossipInterval)
+}
+
+func (c *Cluster) followMembershipPeriodically() {
+	ticker := time.NewTicker(c.gossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.followMembership()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// NewStandaloneNode starts a node of its own: its store under dataDir, serving over gRPC at addr and gossiping with
+// the seeds. id has to be unique in the cluster. the node coordinates the client requests it gets (KVService) with
+// the cluster it learns through gossip, opts configure it the way they configure a router. a node joining the cluster
+// returns once it took over its share of the keys
+func NewStandaloneNode(id uint32, addr, dataDir string, seeds []string, opts ...ClusterOption) (*Node, error) {
+	cluster := newCluster(append([]ClusterOption{WithStoreOptions(WithDataDir(dataDir))}, opts...)...)
+	store, err := newStore(id, cluster.storeOptions...)
+	if err != nil {
+		return nil, err
+	}
+	// the hints the node coordinates go with its store
+	if err := cluster.openHints(fmt.Sprintf("%s/hints", store.dir)); err != nil {
+		store.Close()
+		return nil, err
+	}
+	node := &Node{
+		ID:      fmt.Sprintf("node-%d", id),
+		Addr:    addr,
+		Store:   store,
+		cluster: cluster,
+	}
+	node.startWriter()
+
+	// the node is the only one it knows of until gossip tells it of the others, it reaches them the way a router does
+	cluster.remote = true
+	cluster.clock = store.clock
+	cluster.updateTopology(func(t *topology) {
+		t.nodes[addr] = node
+		t.ring = hashring.New([]string{addr})
+	})
+	node.gossip = newGossiper(addr, node.ID, seeds, store.clock, cluster.gossipInterval, cluster.phiThreshold)
+	node.gossip.onUp = func(string) { cluster.deliverHints() }
+	cluster.gossip = node.gossip
+	// a node new to the cluster takes its share of the keys before going on the ring, over the server
+	joining := len(node.gossip.seeds) > 0 && !node.gossip.learn()
+	node.gossip.setJoining(joining)
+	node.gossip.start()
+	node.server = StartGRPCServer(addr, node)
+	if joining {
+		cluster.join(node)
+	}
+	go cluster.followMembershipPeriodically()
+	cluster.startBackgroundWork()
+	return node, nil
+}
+
+// Run serves until the process is told to stop, then closes the node
+func (n *Node) Run() {
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	<-signalCh
+	log.Println("signal received, shutting down...")
+	n.Close()
+}
+
+// Close stops a node started by NewStandaloneNode
+func (n *Node) Close() {
+	close(n.cluster.stop)
+	n.gossip.close()
+	n.server.GracefulStop()
+	for _, node := range n.cluster.Nodes() {
+		node.stopWriter()
+		if node.conn != nil {
+			node.conn.Close()
+		}
+	}
+	if err := n.cluster.hints.close(); err != nil {
+		fmt.Println(err)
+	}
+	n.Store.Close()
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jateen67/kv/utils"
+)
+
+// freeAddr returns a local address nothing listens at
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startStandaloneNode starts a node of its own under a temporary directory, it's closed once the test is over
+func startStandaloneNode(t *testing.T, id uint32, seeds []string, opts ...ClusterOption) *Node {
+	t.Helper()
+	dataDir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	node, err := NewStandaloneNode(id, freeAddr(t), dataDir, seeds, opts...)
+	if err != nil {
+		t.Fatalf("start node %d: %v", id, err)
+	}
+	t.Cleanup(node.Close)
+	return node
+}
+
+// a router keeps taking requests while nodes join and leave, the requests under way keep the nodes and ring they
+// started with. run with -race
+func TestRouterMembershipChange(t *testing.T) {
+	// the router's hint log lives in the parent of the working directory
+	work := filepath.Join(t.TempDir(), "work")
+	if err := os.Mkdir(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(work)
+	opts := []ClusterOption{WithReplicationFactor(2), WithGossipInterval(50 * time.Millisecond), WithAntiEntropyInterval(0)}
+	seed := startStandaloneNode(t, 1, nil, opts...)
+	startStandaloneNode(t, 2, []string{seed.Addr}, opts...)
+	router, err := NewRouter([]string{seed.Addr}, append(opts, WithRouterID(100))...)
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	t.Cleanup(router.Close)
+	waitFor(t, "the router to know of both nodes", func() bool {
+		return len(router.Nodes()) == 2
+	})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var requests atomic.Int64
+	errs := make(chan error, 4)
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := []byte(fmt.Sprintf("key-%d-%d", w, i%50))
+				if _, err := router.Set(key, key, utils.ConsistencyOne); err != nil {
+					errs <- fmt.Errorf("set %s: %w", key, err)
+					return
+				}
+				// a key may not have reached a replica the ring change gave it yet
+				if _, _, err := router.Get(key, utils.ConsistencyOne); err != nil && !errors.Is(err, utils.ErrKeyNotFound) {
+					errs <- fmt.Errorf("get %s: %w", key, err)
+					return
+				}
+				requests.Add(1)
+			}
+		}()
+	}
+
+	joined := startStandaloneNode(t, 3, []string{seed.Addr}, opts...)
+	waitFor(t, "the router to see the node join", func() bool {
+		_, ok := router.Nodes()[joined.Addr]
+		return ok
+	})
+	before := requests.Load()
+	router.decommission(joined.Addr)
+	if _, ok := router.Nodes()[joined.Addr]; ok {
+		t.Fatal("the decommissioned node is still among the router's nodes")
+	}
+	waitFor(t, "requests to go on after the node left", func() bool {
+		return requests.Load() > before+100
+	})
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if size := router.topology().ring.Size(); size != 2 {
+		t.Fatalf("ring of %d node(s) after the node left, want 2", size)
+	}
+}
+
+// the keys move along with the ring as nodes in processes of their own join and leave: with a single copy of every
+// key, none goes missing, and a node doesn't keep the keys it handed over
+func TestRouterRingChangeMovesKeys(t *testing.T) {
+	work := filepath.Join(t.TempDir(), "work")
+	if err := os.Mkdir(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(work)
+	opts := []ClusterOption{WithGossipInterval(50 * time.Millisecond), WithAntiEntropyInterval(0)}
+	seed := startStandaloneNode(t, 1, nil, opts...)
+	router, err := NewRouter([]string{seed.Addr}, append(opts, WithRouterID(100))...)
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	t.Cleanup(router.Close)
+	waitFor(t, "the router to know of the seed", func() bool {
+		return len(router.Nodes()) == 1
+	})
+
+	const keys = 100
+	for i := range keys {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if _, err := router.Set(key, key, utils.ConsistencyAll); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	readAll := func(when string) {
+		t.Helper()
+		for i := range keys {
+			key := []byte(fmt.Sprintf("key-%02d", i))
+			if value, _, err := router.Get(key, utils.ConsistencyOne); err != nil || string(value) != string(key) {
+				t.Fatalf("get %s %s: got %q, %v", key, when, value, err)
+			}
+		}
+	}
+
+	// the node is on the ring once it started, with its share of the keys
+	joined := startStandaloneNode(t, 2, []string{seed.Addr}, opts...)
+	if status := seed.gossip.member(joined.Addr); status.joining {
+		t.Fatal("the node is still joining once it started")
+	}
+	waitFor(t, "the router to go by the new ring", func() bool {
+		return router.topology().ring.Size() == 2
+	})
+	readAll("after the node joined")
+	var taken int
+	for i := range keys {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if router.replicasFor(key)[0] != joined.Addr {
+			continue
+		}
+		taken++
+		if _, err := joined.Store.Get(key); err != nil {
+			t.Fatalf("get %s from the node that joined: %v", key, err)
+		}
+		if _, err := seed.Store.Get(key); !errors.Is(err, utils.ErrKeyNotFound) {
+			t.Fatalf("get %s from the seed: %v, want it dropped once handed over", key, err)
+		}
+	}
+	if taken == 0 {
+		t.Fatal("the node that joined took none of the keys")
+	}
+
+	router.decommission(joined.Addr)
+	readAll("after the node left")
+	for i := range keys {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if _, err := seed.Store.Get(key); err != nil {
+			t.Fatalf("get %s from the seed: %v", key, err)
+		}
+	}
+}
+
+// a standalone node keeps its hints under its own storage directory, and fails to start rather than exit when it
+// can't open them
+func TestStandaloneNodeHints(t *testing.T) {
+	node := startStandaloneNode(t, 1, nil, WithAntiEntropyInterval(0))
+	if err := node.cluster.hints.add(":1", hintRecord("cart", "apples")); err != nil {
+		t.Fatalf("add hint: %v", err)
+	}
+	if want := filepath.Join("../storage/node-1/hints", HINTS_FILENAME); node.cluster.hints.filename != want {
+		t.Fatalf("hint log at %s, want %s", node.cluster.hints.filename, want)
+	}
+
+	dataDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dataDir, "storage/node-2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a file where the hints directory should be
+	if err := os.WriteFile(filepath.Join(dataDir, "storage/node-2/hints"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if node, err := NewStandaloneNode(2, freeAddr(t), dataDir, nil, WithAntiEntropyInterval(0)); err == nil {
+		node.Close()
+		t.Fatal("started a node whose hint log can't be opened")
+	}
+}
@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Siblings -- an opt-in alternative to last-write-wins (WithSiblings) for data where a concurrent update must not get lost.
+
+Every version of a key is tagged with a dot, the coordinating node's id and the timestamp its clock gave the write, and
+carries the causal context the write was made with: a vector clock holding, for each node, the timestamp of the newest
+write it coordinated that the writer had seen. A version whose context covers another's dot replaces it, versions that
+haven't seen each other are concurrent and all kept, as siblings (dotted version vectors, a write without a context
+never replaces an earlier one from the same node). A read returns every sibling along with a causal context (their
+contexts and dots merged), a write that passes the context back replaces every sibling it saw.
+
+The siblings of a key are stored as the value of a single record, so they go through the memtable, the WAL, SSTables
+and migration like any other value. A replica merges the siblings it receives with the ones it holds instead of
+keeping whichever record is newest:
+----------------------------------------------------------------------------------------------------
+| count | tombstone | dot node id | dot ts | clock_size | node id | ts | ... | value_size | value | ... |
+----------------------------------------------------------------------------------------------------
+*/
+
+// vectorClock maps the id of a node to the timestamp of the newest write it coordinated in a version's history
+type vectorClock map[uint32]uint64
+
+// dot identifies a single write, by the node that coordinated it and the timestamp it got
+type dot struct {
+	node uint32
+	ts   uint64
+}
+
+type sibling struct {
+	dot       dot
+	context   vectorClock // what the writer had seen
+	tombstone bool        // a delete, kept until a write that saw it replaces it
+	value     []byte
+}
+
+// covers reports whether the write d is known to c
+func (c vectorClock) covers(d dot) bool {
+	return c[d.node] >= d.ts
+}
+
+// clock is everything the sibling knows of, its own write included
+func (s *sibling) clock() vectorClock {
+	return s.context.merge(vectorClock{s.dot.node: s.dot.ts})
+}
+
+// merge returns a clock that descends from both
+func (c vectorClock) merge(vc vectorClock) vectorClock {
+	merged := maps.Clone(c)
+	if merged == nil {
+		merged = make(vectorClock)
+	}
+	for node, counter := range vc {
+		merged[node] = max(merged[node], counter)
+	}
+	return merged
+}
+
+// encode writes the clock with its entries ordered by node, so equal clocks encode the same
+func (c vectorClock) encode(buf *bytes.Buffer) {
+	nodes := slices.Sorted(maps.Keys(c))
+	binary.Write(buf, binary.LittleEndian, uint16(len(nodes)))
+	for _, node := range nodes {
+		binary.Write(buf, binary.LittleEndian, node)
+		binary.Write(buf, binary.LittleEndian, c[node])
+	}
+}
+
+func decodeVectorClock(buf []byte) (vectorClock, []byte, error) {
+	if len(buf) < 2 {
+		return nil, nil, utils.ErrDecodingSiblingsFailed
+	}
+	size := int(binary.LittleEndian.Uint16(buf))
+	buf = buf[2:]
+	if len(buf) < size*12 {
+		return nil, nil, utils.ErrDecodingSiblingsFailed
+	}
+	c := make(vectorClock, size)
+	for range size {
+		c[binary.LittleEndian.Uint32(buf)] = binary.LittleEndian.Uint64(buf[4:])
+		buf = buf[12:]
+	}
+	return c, buf, nil
+}
+
+// encodeCausalContext turns a vector clock into the opaque context handed to clients
+func encodeCausalContext(c vectorClock) []byte {
+	buf := new(bytes.Buffer)
+	c.encode(buf)
+	return buf.Bytes()
+}
+
+func decodeCausalContext(causalContext []byte) (vectorClock, error) {
+	if len(causalContext) == 0 {
+		return vectorClock{}, nil
+	}
+	c, rest, err := decodeVectorClock(causalContext)
+	if err != nil || len(rest) > 0 {
+		return nil, utils.ErrInvalidCausalContext
+	}
+	return c, nil
+}
+
+// encodeSiblings writes the siblings ordered by their encoding, so equal sets of siblings encode the same
+func encodeSiblings(siblings []sibling) []byte {
+	encoded := make([][]byte, len(siblings))
+	for i, s := range siblings {
+		buf := new(bytes.Buffer)
+		if s.tombstone {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		binary.Write(buf, binary.LittleEndian, s.dot.node)
+		binary.Write(buf, binary.LittleEndian, s.dot.ts)
+		s.context.encode(buf)
+		binary.Write(buf, binary.LittleEndian, uint32(len(s.value)))
+		buf.Write(s.value)
+		encoded[i] = buf.Bytes()
+	}
+	slices.SortFunc(encoded, bytes.Compare)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(siblings)))
+	for _, e := range encoded {
+		buf.Write(e)
+	}
+	return buf.Bytes()
+}
+
+func decodeSiblings(buf []byte) ([]sibling, error) {
+	if len(buf) < 4 {
+		return nil, utils.ErrDecodingSiblingsFailed
+	}
+	count := binary.LittleEndian.Uint32(buf)
+	buf = buf[4:]
+
+	var siblings []sibling
+	for range count {
+		if len(buf) < 13 {
+			return nil, utils.ErrDecodingSiblingsFailed
+		}
+		s := sibling{
+			tombstone: buf[0] == 1,
+			dot:       dot{node: binary.LittleEndian.Uint32(buf[1:]), ts: binary.LittleEndian.Uint64(buf[5:])},
+		}
+		var err error
+		if s.context, buf, err = decodeVectorClock(buf[13:]); err != nil {
+			return nil, err
+		}
+		if len(buf) < 4 || len(buf)-4 < int(binary.LittleEndian.Uint32(buf)) {
+			return nil, utils.ErrDecodingSiblingsFailed
+		}
+		size := int(binary.LittleEndian.Uint32(buf))
+		s.value = buf[4 : 4+size]
+		buf = buf[4+size:]
+		siblings = append(siblings, s)
+	}
+	return siblings, nil
+}
+
+// mergeSiblings keeps every sibling of either set that no other sibling has seen, a sibling showing up in both once
+func mergeSiblings(a, b []sibling) []sibling {
+	all := append(slices.Clone(a), b...)
+	var merged []sibling
+	seen := make(map[dot]bool)
+	for i, s := range all {
+		obsolete := seen[s.dot]
+		for j, other := range all {
+			if obsolete {
+				break
+			}
+			obsolete = i != j && other.context.covers(s.dot)
+		}
+		if !obsolete {
+			merged = append(merged, s)
+			seen[s.dot] = true
+		}
+	}
+	return merged
+}
+
+func (r *Record) hasSiblings() bool {
+	return r.Header.Flags&flagSiblings != 0
+}
+
+// recordSiblings returns the siblings a version of a key stands for. a version written without siblings is a single
+// sibling with an empty dot, every write with siblings replaces it
+func recordSiblings(record *Record) ([]sibling, error) {
+	if record.hasSiblings() {
+		return decodeSiblings(record.Value)
+	}
+	if record.Header.Tombstone == 1 {
+		return nil, nil
+	}
+	return []sibling{{context: vectorClock{}, value: record.Value}}, nil
+}
+
+// newSiblingsRecord builds the record holding the siblings of a key
+func newSiblingsRecord(key []byte, siblings []sibling, timestamp uint64) *Record {
+	value := encodeSiblings(siblings)
+	header := Header{
+		Flags:     flagSiblings,
+		TimeStamp: timestamp,
+		KeySize:   uint32(len(key)),
+		ValueSize: uint32(len(value)),
+	}
+	record := &Record{
+		Header:    header,
+		Key:       slices.Clone(key),
+		Value:     value,
+		TotalSize: headerSize + header.KeySize + header.ValueSize,
+	}
+	record.Header.CheckSum = record.CalculateChecksum()
+	return record
+}
+
+// mergeSiblingsRecord merges the siblings in record with the ones the store holds for the key, returns nil if the
+// store already holds all of them. the caller holds ds.mu
+func (ds *DiskStore) mergeSiblingsRecord(record *Record) (*Record, error) {
+	incoming, err := decodeSiblings(record.Value)
+	if err != nil {
+		return nil, err
+	}
+	var held []sibling
+	existing, err := ds.getVersion(record.Key)
+	if err == nil {
+		if held, err = recordSiblings(&existing); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, utils.ErrKeyNotFound) {
+		return nil, err
+	}
+
+	merged := mergeSiblings(held, incoming)
+	if existing.hasSiblings() && bytes.Equal(encodeSiblings(merged), existing.Value) {
+		return nil, nil
+	}
+	// a fresh timestamp, the merged siblings have to replace whatever the store held
+	return newSiblingsRecord(record.Key, merged, ds.clock.Now()), nil
+}
+
+// sameSiblings reports whether two versions of a key hold the same siblings
+func sameSiblings(a, b *Record) bool {
+	return a.hasSiblings() && b.hasSiblings() && bytes.Equal(a.Value, b.Value)
+}
+
+// reconcileSiblings merges the siblings of every version into a single record, as new as the newest of them
+func reconcileSiblings(versions []*Record) (*Record, error) {
+	var merged []sibling
+	var newest uint64
+	for _, version := range versions {
+		siblings, err := recordSiblings(version)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeSiblings(merged, siblings)
+		newest = max(newest, version.Header.TimeStamp)
+	}
+	return newSiblingsRecord(versions[0].Key, merged, newest), nil
+}
+
+// GetSiblings returns the values of every sibling of the key along with its causal context, to pass to the write
+// replacing them. without WithSiblings a key only ever has one value, and the context is empty
+func (c *Cluster) GetSiblings(key []byte, level utils.ConsistencyLevel) ([][]byte, []byte, int, error) {
+	if !c.siblings {
+		value, answered, err := c.Get(key, level)
+		if err != nil {
+			return nil, nil, answered, err
+		}
+		return [][]byte{value}, nil, answered, nil
+	}
+
+	fmt.Printf("key = %s\t", key)
+	record, answered, err := c.readReplicas(key, level)
+	if err != nil {
+		return nil, nil, answered, err
+	}
+	siblings, err := recordSiblings(&record)
+	if err != nil {
+		return nil, nil, answered, err
+	}
+	var values [][]byte
+	clock := vectorClock{}
+	for _, s := range siblings {
+		clock = clock.merge(s.clock())
+		if !s.tombstone {
+			values = append(values, s.value)
+		}
+	}
+	fmt.Printf("found %d sibling(s) @ %d node(s), consistency = %s\n", len(values), answered, level)
+	if len(values) == 0 {
+		return nil, encodeCausalContext(clock), answered, utils.ErrKeyNotFound
+	}
+	return values, encodeCausalContext(clock), answered, nil
+}
+
+// SetWithContext writes value, replacing every sibling the causal context (from GetSiblings) saw. an empty context
+// adds a sibling. without WithSiblings it's a plain Set
+func (c *Cluster) SetWithContext(key, value, causalContext []byte, level utils.ConsistencyLevel) (int, error) {
+	if !c.siblings {
+		return c.Set(key, value, level)
+	}
+	return c.writeSibling(key, sibling{value: slices.Clone(value)}, causalContext, level)
+}
+
+// DeleteWithContext deletes every sibling the causal context saw, siblings it didn't see stay.
+// without WithSiblings it's a plain Delete
+func (c *Cluster) DeleteWithContext(key, causalContext []byte, level utils.ConsistencyLevel) (int, error) {
+	if !c.siblings {
+		return c.Delete(key, level)
+	}
+	return c.writeSibling(key, sibling{tombstone: true}, causalContext, level)
+}
+
+func (c *Cluster) writeSibling(key []byte, s sibling, causalContext []byte, level utils.ConsistencyLevel) (int, error) {
+	if len(key) == 0 {
+		return 0, utils.ErrEmptyKey
+	}
+	var err error
+	if s.context, err = decodeCausalContext(causalContext); err != nil {
+		return 0, err
+	}
+	clock := c.clockFor(key)
+	ts := clock.Now()
+	s.dot = dot{node: uint32(clock.nodeID), ts: ts}
+
+	fmt.Printf("key = %s\tsibling added @ node addrs = %v, consistency = %s\n", key, c.replicasFor(key), level)
+	return c.writeReplicas(newSiblingsRecord(key, []sibling{s}, ts), level)
+}
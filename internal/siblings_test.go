@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jateen67/kv/utils"
+)
+
+func getSiblings(t *testing.T, c *Cluster, key string) ([]string, []byte) {
+	t.Helper()
+	values, causalContext, _, err := c.GetSiblings([]byte(key), utils.ConsistencyAll)
+	if err != nil && !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Fatalf("get siblings of %s: %v", key, err)
+	}
+	var got []string
+	for _, v := range values {
+		got = append(got, string(v))
+	}
+	slices.Sort(got)
+	return got, causalContext
+}
+
+func TestSiblings(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(3), WithSiblings())
+	set := func(value string, causalContext []byte) {
+		t.Helper()
+		if _, err := c.SetWithContext([]byte("cart"), []byte(value), causalContext, utils.ConsistencyAll); err != nil {
+			t.Fatalf("set %s: %v", value, err)
+		}
+	}
+	expect := func(want ...string) []byte {
+		t.Helper()
+		got, causalContext := getSiblings(t, c, "cart")
+		if !slices.Equal(got, want) {
+			t.Fatalf("siblings = %q, want %q", got, want)
+		}
+		return causalContext
+	}
+
+	// writes that didn't see each other are both kept
+	set("apples", nil)
+	set("pears", nil)
+	seen := expect("apples", "pears")
+
+	// a write passing the context back replaces what it saw
+	set("apples,pears", seen)
+	resolved := expect("apples,pears")
+
+	// a write made with an older context only replaces what that context saw
+	set("plums", seen)
+	expect("apples,pears", "plums")
+
+	// a delete passing the context back deletes everything it saw, a later write without one adds to nothing
+	if _, err := c.DeleteWithContext([]byte("cart"), expect("apples,pears", "plums"), utils.ConsistencyAll); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	expect()
+	set("figs", resolved)
+	expect("figs")
+
+	// Get refuses to pick one of several siblings
+	set("kiwis", nil)
+	if _, _, err := c.Get([]byte("cart"), utils.ConsistencyAll); !errors.Is(err, utils.ErrSiblings) {
+		t.Fatalf("get with siblings: got %v, want %v", err, utils.ErrSiblings)
+	}
+}
+
+func TestSiblingsInvalidCausalContext(t *testing.T) {
+	c := startTestCluster(t, 1, WithSiblings())
+	_, err := c.SetWithContext([]byte("cart"), []byte("apples"), []byte{1, 2, 3}, utils.ConsistencyOne)
+	if !errors.Is(err, utils.ErrInvalidCausalContext) {
+		t.Fatalf("set with a malformed context: got %v, want %v", err, utils.ErrInvalidCausalContext)
+	}
+}
+
+// replicas holding different siblings of a key merge them instead of keeping the newest version
+func TestMergeSiblings(t *testing.T) {
+	a := sibling{dot: dot{node: 1, ts: 10}, context: vectorClock{}, value: []byte("a")}
+	b := sibling{dot: dot{node: 2, ts: 11}, context: vectorClock{}, value: []byte("b")}
+	// c saw a but not b
+	c := sibling{dot: dot{node: 1, ts: 12}, context: vectorClock{1: 10}, value: []byte("c")}
+
+	merged := mergeSiblings([]sibling{a, b}, []sibling{b, c})
+	var got []string
+	for _, s := range merged {
+		got = append(got, string(s.value))
+	}
+	slices.Sort(got)
+	if want := []string{"b", "c"}; !slices.Equal(got, want) {
+		t.Fatalf("merged siblings = %q, want %q", got, want)
+	}
+
+	decoded, err := decodeSiblings(encodeSiblings(merged))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(decoded) != len(merged) {
+		t.Fatalf("decoded %d siblings, want %d", len(decoded), len(merged))
+	}
+}
+
+// storedSiblings returns the values of the siblings the store holds for the key
+func storedSiblings(t *testing.T, ds *DiskStore, key string) []string {
+	t.Helper()
+	record, err := ds.GetVersion([]byte(key))
+	if err != nil {
+		t.Fatalf("get version of %s: %v", key, err)
+	}
+	siblings, err := recordSiblings(&record)
+	if err != nil {
+		t.Fatalf("siblings of %s: %v", key, err)
+	}
+	var got []string
+	for _, s := range siblings {
+		got = append(got, string(s.value))
+	}
+	slices.Sort(got)
+	return got
+}
+
+// siblings written at different times end up in different tables, the store merges them as they come in and keeps them
+// through flushes, compaction and a restart
+func TestSiblingsInStore(t *testing.T) {
+	fs := NewMemFS(1)
+	store := openTestStore(t, fs)
+	var want []string
+	for i := range 8 {
+		value := fmt.Sprintf("from node %d", i)
+		s := sibling{dot: dot{node: uint32(i + 1), ts: uint64(i + 1)}, context: vectorClock{}, value: []byte(value)}
+		if err := store.PutRecord(newSiblingsRecord([]byte("cart"), []sibling{s}, store.clock.Now())); err != nil {
+			t.Fatalf("put sibling %d: %v", i, err)
+		}
+		want = append(want, value)
+		flush(store)
+		if got := storedSiblings(t, store, "cart"); !slices.Equal(got, want) {
+			t.Fatalf("after %d flush(es): siblings = %q, want %q", i+1, got, want)
+		}
+	}
+	if tables := tableCount(store); tables >= 8 {
+		t.Fatalf("%d tables, the flushes never got compacted", tables)
+	}
+	if !store.Close() {
+		t.Fatal("close failed")
+	}
+	store = openTestStore(t, fs)
+	if got := storedSiblings(t, store, "cart"); !slices.Equal(got, want) {
+		t.Fatalf("after reopening: siblings = %q, want %q", got, want)
+	}
+}
+
+// a replica that was down during concurrent writes gets both of them as hints, and keeps them as siblings
+func TestSiblingsHintedHandoff(t *testing.T) {
+	c := startTestCluster(t, 3, WithReplicationFactor(3), WithSiblings())
+	down := c.replicaNodes([]byte("cart"))[2]
+	c.StopNode(strings.TrimPrefix(down.Addr, ":"))
+	for _, value := range []string{"apples", "pears"} {
+		if _, err := c.SetWithContext([]byte("cart"), []byte(value), nil, utils.ConsistencyQuorum); err != nil {
+			t.Fatalf("set %s: %v", value, err)
+		}
+	}
+	c.StartNode(strings.TrimPrefix(down.Addr, ":"))
+
+	want := []string{"apples", "pears"}
+	for _, node := range c.replicaNodes([]byte("cart")) {
+		if got := storedSiblings(t, node.Store, "cart"); !slices.Equal(got, want) {
+			t.Errorf("siblings @ node addr = %s: %q, want %q", node.Addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jateen67/kv/utils"
+)
+
+/*
+Lock-free skiplist memtable
+
+- nodes are only ever linked in (never unlinked), so readers can walk the list without any locking
+- inserts link a node bottom-up with CAS, level 0 decides whether the insert "won"
+- overwrites/removals atomically swap the record pointer on an existing node, a nil record means removed
+- range tombstones are rare, so they just live in a slice behind their own lock
+*/
+
+const (
+	skipListMaxHeight = 16
+	skipListBranching = 4 // each level holds ~1/4 of the nodes of the level below it
+)
+
+type skipListNode struct {
+	key    []byte
+	record atomic.Pointer[Record]
+	next   []atomic.Pointer[skipListNode]
+}
+
+type SkipList struct {
+	head      *skipListNode
+	totalSize atomic.Int64
+	length    atomic.Int64
+
+	rangeMu         sync.RWMutex
+	rangeTombstones []Record
+}
+
+func NewSkipList() *SkipList {
+	return &SkipList{
+		head: &skipListNode{next: make([]atomic.Pointer[skipListNode], skipListMaxHeight)},
+	}
+}
+
+func (s *SkipList) Get(key []byte) (Record, error) {
+	node := s.findGreaterOrEqual(key)
+	if node == nil || !bytes.Equal(node.key, key) {
+		return Record{}, utils.ErrKeyNotFound
+	}
+	record := node.record.Load()
+	if record == nil {
+		return Record{}, utils.ErrKeyNotFound
+	}
+	return *record, nil
+}
+
+func (s *SkipList) Set(key []byte, value *Record) {
+	record := *value
+
+	var preds, succs [skipListMaxHeight]*skipListNode
+	for {
+		if existing := s.findSplice(key, &preds, &succs); existing != nil {
+			s.updateAccounting(existing.record.Swap(&record), &record)
+			return
+		}
+
+		height := randomHeight()
+		node := &skipListNode{key: key, next: make([]atomic.Pointer[skipListNode], height)}
+		node.record.Store(&record)
+
+		// level 0 is the source of truth, if someone else linked a node here first we start over
+		node.next[0].Store(succs[0])
+		if !preds[0].next[0].CompareAndSwap(succs[0], node) {
+			continue
+		}
+		s.updateAccounting(nil, &record)
+
+		for lvl := 1; lvl < height; lvl++ {
+			for {
+				node.next[lvl].Store(succs[lvl])
+				if preds[lvl].next[lvl].CompareAndSwap(succs[lvl], node) {
+					break
+				}
+				// lost a race on this level, nodes are never removed so we can resume from the old predecessor
+				preds[lvl], succs[lvl] = findSpliceForLevel(key, preds[lvl], lvl)
+			}
+		}
+		return
+	}
+}
+
+func (s *SkipList) Remove(key []byte) {
+	node := s.findGreaterOrEqual(key)
+	if node == nil || !bytes.Equal(node.key, key) {
+		return
+	}
+	s.updateAccounting(node.record.Swap(nil), nil)
+}
+
+func (s *SkipList) AddRangeTombstone(record *Record) {
+	s.rangeMu.Lock()
+	defer s.rangeMu.Unlock()
+	s.rangeTombstones = append(s.rangeTombstones, *record)
+	s.totalSize.Add(int64(record.TotalSize))
+}
+
+func (s *SkipList) RangeTombstones() []Record {
+	s.rangeMu.RLock()
+	defer s.rangeMu.RUnlock()
+	return slices.Clone(s.rangeTombstones)
+}
+
+func (s *SkipList) Size() uint32 {
+	return uint32(s.totalSize.Load())
+}
+
+func (s *SkipList) Len() int {
+	return int(s.length.Load())
+}
+
+func (s *SkipList) NewIterator() MemtableIterator {
+	return &skipListIterator{list: s}
+}
+
+// updateAccounting adjusts size/length given the record that was replaced and the one that replaced it (either may be nil)
+func (s *SkipList) updateAccounting(replaced, replacement *Record) {
+	var delta int64
+	if replaced != nil {
+		delta -= int64(replaced.TotalSize)
+		s.length.Add(-1)
+	}
+	if replacement != nil {
+		delta += int64(replacement.TotalSize)
+		s.length.Add(1)
+	}
+	s.totalSize.Add(delta)
+}
+
+// findSplice fills preds/succs for every level and returns the node with the exact key if it is already linked
+func (s *SkipList) findSplice(key []byte, preds, succs *[skipListMaxHeight]*skipListNode) *skipListNode {
+	pred := s.head
+	for lvl := skipListMaxHeight - 1; lvl >= 0; lvl-- {
+		preds[lvl], succs[lvl] = findSpliceForLevel(key, pred, lvl)
+		pred = preds[lvl]
+	}
+	if succs[0] != nil && bytes.Equal(succs[0].key, key) {
+		return succs[0]
+	}
+	return nil
+}
+
+// findSpliceForLevel walks a single level starting from 'start' (which must be < key) until it finds pred < key <= succ
+func findSpliceForLevel(key []byte, start *skipListNode, lvl int) (*skipListNode, *skipListNode) {
+	pred := start
+	for {
+		next := pred.next[lvl].Load()
+		if next == nil || bytes.Compare(next.key, key) >= 0 {
+			return pred, next
+		}
+		pred = next
+	}
+}
+
+func (s *SkipList) findGreaterOrEqual(key []byte) *skipListNode {
+	pred := s.head
+	var next *skipListNode
+	for lvl := skipListMaxHeight - 1; lvl >= 0; lvl-- {
+		pred, next = findSpliceForLevel(key, pred, lvl)
+	}
+	return next
+}
+
+func randomHeight() int {
+	height := 1
+	for height < skipListMaxHeight && rand.IntN(skipListBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+type skipListIterator struct {
+	list *SkipList
+	node *skipListNode
+	curr *Record
+}
+
+func (it *skipListIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *skipListIterator) Next() {
+	it.skipRemoved(it.node.next[0].Load())
+}
+
+func (it *skipListIterator) SeekToFirst() {
+	it.skipRemoved(it.list.head.next[0].Load())
+}
+
+func (it *skipListIterator) Seek(target []byte) {
+	it.skipRemoved(it.list.findGreaterOrEqual(target))
+}
+
+func (it *skipListIterator) Record() Record {
+	return *it.curr
+}
+
+// skipRemoved moves to the first node starting at 'node' that still holds a record
+func (it *skipListIterator) skipRemoved(node *skipListNode) {
+	for node != nil {
+		if record := node.record.Load(); record != nil {
+			it.node, it.curr = node, record
+			return
+		}
+		node = node.next[0].Load()
+	}
+	it.node, it.curr = nil, nil
+}
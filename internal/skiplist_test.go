@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/jateen67/kv/utils"
+)
+
+func skipListRecord(key, value string) *Record {
+	record := &Record{Key: []byte(key), Value: []byte(value)}
+	record.Header = Header{KeySize: uint32(len(key)), ValueSize: uint32(len(value))}
+	record.TotalSize = headerSize + record.Header.KeySize + record.Header.ValueSize
+	return record
+}
+
+// concurrent writers of the same and different keys, with readers and iterators walking the list meanwhile. run with -race
+func TestSkipListConcurrent(t *testing.T) {
+	s := NewSkipList()
+	const writers, keys = 8, 200
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range keys {
+				// every writer writes every key, the value says which writer
+				s.Set([]byte(fmt.Sprintf("key-%03d", i)), skipListRecord(fmt.Sprintf("key-%03d", i), fmt.Sprintf("w%d", w)))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := range keys {
+				if record, err := s.Get([]byte(fmt.Sprintf("key-%03d", i))); err == nil && string(record.Key) != fmt.Sprintf("key-%03d", i) {
+					t.Errorf("get key-%03d: got the record of %s", i, record.Key)
+				}
+			}
+			var prev []byte
+			it := s.NewIterator()
+			for it.SeekToFirst(); it.Valid(); it.Next() {
+				key := it.Record().Key
+				if prev != nil && string(key) <= string(prev) {
+					t.Errorf("iterator went from %s to %s", prev, key)
+				}
+				prev = key
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.Len() != keys {
+		t.Fatalf("len = %d, want %d", s.Len(), keys)
+	}
+	// every value is two bytes long, whichever writer was last
+	if want := uint32(keys * skipListRecord("key-000", "w0").TotalSize); s.Size() != want {
+		t.Fatalf("size = %d, want %d", s.Size(), want)
+	}
+	for i := range keys {
+		if _, err := s.Get([]byte(fmt.Sprintf("key-%03d", i))); err != nil {
+			t.Fatalf("get key-%03d: %v", i, err)
+		}
+	}
+}
+
+// an overwrite replaces the size of the record it replaces instead of adding to it, a remove takes it away
+func TestSkipListAccounting(t *testing.T) {
+	s := NewSkipList()
+	small, large := skipListRecord("a", "1"), skipListRecord("a", "a much longer value")
+	s.Set([]byte("a"), small)
+	s.Set([]byte("a"), large)
+	if s.Len() != 1 || s.Size() != large.TotalSize {
+		t.Fatalf("after an overwrite: len = %d, size = %d, want 1, %d", s.Len(), s.Size(), large.TotalSize)
+	}
+	s.Set([]byte("a"), small)
+	if s.Len() != 1 || s.Size() != small.TotalSize {
+		t.Fatalf("after overwriting with a smaller value: len = %d, size = %d, want 1, %d", s.Len(), s.Size(), small.TotalSize)
+	}
+
+	s.Set([]byte("b"), skipListRecord("b", "2"))
+	s.Remove([]byte("a"))
+	s.Remove([]byte("missing"))
+	if _, err := s.Get([]byte("a")); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Fatalf("get of a removed key: got %v, want %v", err, utils.ErrKeyNotFound)
+	}
+	if want := skipListRecord("b", "2").TotalSize; s.Len() != 1 || s.Size() != want {
+		t.Fatalf("after a remove: len = %d, size = %d, want 1, %d", s.Len(), s.Size(), want)
+	}
+	// removing twice doesn't take it away twice
+	s.Remove([]byte("a"))
+	if s.Len() != 1 {
+		t.Fatalf("after removing twice: len = %d, want 1", s.Len())
+	}
+
+	// set again after a remove, the node is reused
+	s.Set([]byte("a"), small)
+	if record, err := s.Get([]byte("a")); err != nil || string(record.Value) != "1" {
+		t.Fatalf("get after setting a removed key again: got %q, %v", record.Value, err)
+	}
+	if want := small.TotalSize + skipListRecord("b", "2").TotalSize; s.Len() != 2 || s.Size() != want {
+		t.Fatalf("after setting a removed key again: len = %d, size = %d, want 2, %d", s.Len(), s.Size(), want)
+	}
+}
+
+// the iterator never stops on a removed key, seeking to one included
+func TestSkipListIteratorSkipsRemoved(t *testing.T) {
+	s := NewSkipList()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		s.Set([]byte(key), skipListRecord(key, key))
+	}
+	s.Remove([]byte("b"))
+	s.Remove([]byte("c"))
+	s.Remove([]byte("e"))
+
+	var got []string
+	it := s.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		got = append(got, string(it.Record().Key))
+	}
+	if fmt.Sprint(got) != "[a d]" {
+		t.Fatalf("iterated over %v, want [a d]", got)
+	}
+
+	tests := []struct {
+		target string
+		want   string // "" for none
+	}{
+		{"a", "a"}, {"b", "d"}, {"bb", "d"}, {"c", "d"}, {"d", "d"}, {"e", ""}, {"z", ""}, {"", "a"},
+	}
+	for _, tt := range tests {
+		it.Seek([]byte(tt.target))
+		switch {
+		case tt.want == "" && it.Valid():
+			t.Errorf("seek %q: at %s, want past the end", tt.target, it.Record().Key)
+		case tt.want != "" && (!it.Valid() || string(it.Record().Key) != tt.want):
+			t.Errorf("seek %q: valid = %t, want %s", tt.target, it.Valid(), tt.want)
+		}
+	}
+}
@@ -6,8 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"strings"
+	"path/filepath"
+	"slices"
+	"sync"
 	"sync/atomic"
 
 	"github.com/jateen67/kv/utils"
@@ -17,118 +18,317 @@ const (
 	DATA_FILE_EXTENSION      string = ".data"
 	INDEX_FILE_EXTENSION     string = ".index"
 	BLOOM_FILE_EXTENSION     string = ".bloom"
-	SPARSE_INDEX_SAMPLE_SIZE int    = 1000
+	RANGE_DEL_FILE_EXTENSION string = ".rangedel"
+	TEMP_FILE_EXTENSION      string = ".tmp"
+	DATA_BLOCK_SIZE          int    = 1024 * 4 // records are grouped into blocks of about this size, the unit of reads and encryption
+	blockHeaderSize          uint32 = 4
 )
 
 var ssTableCounter uint32
 
 type SSTable struct {
-	dataFile    *os.File
-	indexFile   *os.File
-	bloomFilter *BloomFilter
-	sstCounter  uint32
-	minKey      string
-	maxKey      string
-	totalSize   uint32
-	sparseKeys  []sparseIndex
-}
-
-func InitSSTableOnDisk(directory string, entries *[]Record) *SSTable {
-	atomic.AddUint32(&ssTableCounter, 1)
+	dataFile        File   // the only file kept open, everything else is loaded into memory
+	path            string // every file of the table is path + its extension
+	fs              FS
+	encryption      *encryptor
+	keyID           uint32 // key the table's files are encrypted with, 0 if they aren't
+	bloomFilter     *BloomFilter
+	sstCounter      uint32
+	minKey          []byte
+	maxKey          []byte
+	totalSize       uint32
+	sparseKeys      []sparseIndex
+	blobRefs        map[uint32]uint32 // bytes of values records in this table point to, by blob file
+	rangeTombstones []Record          // kept in memory, there are only ever a handful per table
+	refs            atomic.Int32      // number of versions that contain this table
+	obsolete        atomic.Bool       // merged away by compaction, delete once refs drops to 0
+	deleteOnce      sync.Once
+}
+
+// tableFile is one file of an SSTable, identified by its extension
+type tableFile struct {
+	extension string
+	data      []byte
+}
+
+// InitSSTableOnDisk writes a new table and only returns once every one of its files is durably in place.
+// the table isn't part of the store until it's recorded in the manifest, a crash before that leaves an orphan
+// that gets removed on the next startup
+func InitSSTableOnDisk(fs FS, directory string, entries *[]Record, rangeTombstones *[]Record, enc *encryptor) (*SSTable, error) {
+	keyID, err := enc.currentKeyID()
+	if err != nil {
+		return nil, err
+	}
 	table := &SSTable{
-		sstCounter: ssTableCounter,
+		sstCounter: atomic.AddUint32(&ssTableCounter, 1),
+		blobRefs:   make(map[uint32]uint32),
+		fs:         fs,
+		encryption: enc,
+		keyID:      keyID,
+	}
+	table.path = getNextSstFilename(directory, table.sstCounter)
+
+	var files []tableFile
+	data, err := encodeEntries(entries, table)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, tableFile{DATA_FILE_EXTENSION, data})
+	// the other files are small enough to be sealed as a whole
+	for _, f := range []tableFile{
+		{INDEX_FILE_EXTENSION, encodeSparseIndex(&table.sparseKeys)},
+		{BLOOM_FILE_EXTENSION, encodeBloomFilter(entries, table.bloomFilter)},
+		{RANGE_DEL_FILE_EXTENSION, encodeRangeTombstones(rangeTombstones, table)},
+	} {
+		sealed, err := enc.sealFile(keyID, table.path+f.extension, f.data)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, tableFile{f.extension, sealed})
+	}
+	if err := writeTableFiles(fs, table.path, files); err != nil {
+		return nil, fmt.Errorf("failed to write sst %d: %w", table.sstCounter, err)
 	}
-	table.initTableFiles(directory)
-	writeEntriesToSST(entries, table)
-	return table
+
+	dataFile, err := openReadOnly(fs, table.path+DATA_FILE_EXTENSION)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data file: %w", err)
+	}
+	table.dataFile = dataFile
+	return table, nil
 }
 
-func (sst *SSTable) initTableFiles(directory string) error {
-	// Create "storage" folder with read-write-execute for owner & group, read-only for others
-	if err := os.MkdirAll("../storage", 0755); err != nil {
+// writeTableFiles writes every file under a temporary name and fsyncs it, and only then renames them into place.
+// a table whose files all have their final name is complete
+func writeTableFiles(fs FS, path string, files []tableFile) error {
+	// Create the store's folder with read-write-execute for owner & group, read-only for others
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
 
-	dataFile, err := os.Create(getNextSstFilename(directory, sst.sstCounter) + DATA_FILE_EXTENSION)
+	for _, f := range files {
+		if err := writeSyncedFile(fs, path+f.extension+TEMP_FILE_EXTENSION, f.data); err != nil {
+			for _, f := range files {
+				fs.Remove(path + f.extension + TEMP_FILE_EXTENSION)
+			}
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := fs.Rename(path+f.extension+TEMP_FILE_EXTENSION, path+f.extension); err != nil {
+			return err
+		}
+	}
+	// the renames are only durable once the directory itself is synced
+	return fs.SyncDir(filepath.Dir(path))
+}
+
+// openSSTable loads a table written by InitSSTableOnDisk, the in-memory parts (sparse index, bloom filter, ...)
+// are rebuilt from the data file
+func openSSTable(fs FS, directory string, id uint32, enc *encryptor) (*SSTable, error) {
+	table := &SSTable{
+		sstCounter: id,
+		blobRefs:   make(map[uint32]uint32),
+		path:       getNextSstFilename(directory, id),
+		fs:         fs,
+		encryption: enc,
+	}
+
+	dataFile, err := openReadOnly(fs, table.path+DATA_FILE_EXTENSION)
 	if err != nil {
-		return fmt.Errorf("failed to create data file: %w", err)
+		return nil, fmt.Errorf("failed to open data file: %w", err)
+	}
+	table.dataFile = dataFile
+	if err := table.loadIndex(); err != nil {
+		dataFile.Close()
+		return nil, fmt.Errorf("failed to read sst %d: %w", id, err)
+	}
+
+	buf, err := readFile(fs, table.path+RANGE_DEL_FILE_EXTENSION)
+	if err == nil {
+		buf, err = enc.openFile(table.path+RANGE_DEL_FILE_EXTENSION, buf)
 	}
-	indexFile, err := os.Create(getNextSstFilename(directory, sst.sstCounter) + INDEX_FILE_EXTENSION)
 	if err != nil {
 		dataFile.Close()
-		return fmt.Errorf("failed to create index file: %w", err)
+		return nil, fmt.Errorf("failed to read sst %d range tombstones: %w", id, err)
 	}
-	bloomFile, err := os.Create(getNextSstFilename(directory, sst.sstCounter) + BLOOM_FILE_EXTENSION)
+	rangeTombstones, err := decodeRecords(buf)
 	if err != nil {
 		dataFile.Close()
-		indexFile.Close()
-		return fmt.Errorf("failed to create bloom filter file: %w", err)
+		return nil, err
 	}
+	encodeRangeTombstones(&rangeTombstones, table)
+	return table, nil
+}
 
-	sst.dataFile, sst.indexFile = dataFile, indexFile
-	sst.bloomFilter = NewBloomFilter(bloomFile)
+// loadIndex reads every block of the data file to set up what the table keeps in memory
+func (sst *SSTable) loadIndex() error {
+	header := make([]byte, fileKeyIDSize)
+	if _, err := sst.dataFile.ReadAt(header, 0); err != nil {
+		return err
+	}
+	sst.keyID = binary.LittleEndian.Uint32(header)
 
+	var keys [][]byte
+	for offset := uint32(fileKeyIDSize); ; {
+		block, next, err := sst.readBlock(offset)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		records, err := decodeRecords(block)
+		if err != nil {
+			return err
+		}
+		for i := range records {
+			// copy the keys we hold on to, otherwise they'd keep the whole block in memory
+			key := slices.Clone(records[i].Key)
+			if i == 0 {
+				sst.sparseKeys = append(sst.sparseKeys, sparseIndex{keySize: records[i].Header.KeySize, key: key, byteOffset: offset})
+			}
+			sst.indexRecord(&records[i])
+			keys = append(keys, key)
+		}
+		offset = next
+	}
+
+	if len(keys) > 0 {
+		sst.minKey, sst.maxKey = keys[0], keys[len(keys)-1]
+	}
+	sst.bloomFilter = NewBloomFilter()
+	sst.bloomFilter.InitBloomFilterAttrs(uint32(max(len(keys), 1)))
+	for _, key := range keys {
+		sst.bloomFilter.Add(key)
+	}
 	return nil
 }
 
+// decodeRecords decodes a sequence of records encoded with EncodeKV
+func decodeRecords(data []byte) ([]Record, error) {
+	var records []Record
+	for offset := uint32(0); offset < uint32(len(data)); {
+		if uint32(len(data))-offset < headerSize {
+			return nil, utils.ErrDecodingKVFailed
+		}
+		h := &Header{}
+		if err := h.decodeHeader(data[offset : offset+headerSize]); err != nil {
+			return nil, err
+		}
+		size := headerSize + h.KeySize + h.ValueSize
+		if uint32(len(data))-offset < size {
+			return nil, utils.ErrDecodingKVFailed
+		}
+
+		r := Record{}
+		if err := r.DecodeKV(data[offset : offset+size]); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+		offset += size
+	}
+	return records, nil
+}
+
 func getNextSstFilename(directory string, c uint32) string {
 	return fmt.Sprintf("../%s/sst_%d", directory, c)
 }
 
 type sparseIndex struct {
 	keySize    uint32
-	key        string
+	key        []byte
 	byteOffset uint32
 }
 
-func writeEntriesToSST(entries *[]Record, table *SSTable) {
+// encodeEntries returns the content of the data file, and sets up everything the table keeps in memory about its entries.
+// the data file is the key id followed by blocks of records, each block is sealed on its own:
+// | key_id | block_size | block | block_size | block | ... |
+func encodeEntries(entries *[]Record, table *SSTable) ([]byte, error) {
 	buf := new(bytes.Buffer)
-	var byteOffsetCounter uint32
+	binary.Write(buf, binary.LittleEndian, table.keyID)
 
 	// Keep track of min, max for searching in the case our desired key is outside these bounds
-	table.minKey = (*entries)[0].Key
-	table.maxKey = (*entries)[len(*entries)-1].Key
+	// (a table can be empty if it only holds range tombstones)
+	if len(*entries) > 0 {
+		table.minKey = (*entries)[0].Key
+		table.maxKey = (*entries)[len(*entries)-1].Key
+	}
+
+	// * the first key of every block is put into the sparse index
+	block := new(bytes.Buffer)
+	var blockFirst *Record
+	flushBlock := func() error {
+		if block.Len() == 0 {
+			return nil
+		}
+		payload, err := table.encryption.seal(table.keyID, block.Bytes(), associatedData(table.path+DATA_FILE_EXTENSION, uint64(buf.Len())))
+		if err != nil {
+			return err
+		}
+		table.sparseKeys = append(table.sparseKeys, sparseIndex{
+			keySize:    blockFirst.Header.KeySize,
+			key:        blockFirst.Key,
+			byteOffset: uint32(buf.Len()),
+		})
+		binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+		buf.Write(payload)
+		block.Reset()
+		return nil
+	}
 
-	// * every 1000th key will be put into the sparse index
 	for i := range *entries {
-		table.totalSize += (*entries)[i].TotalSize
-		if i%SPARSE_INDEX_SAMPLE_SIZE == 0 {
-			table.sparseKeys = append(table.sparseKeys, sparseIndex{
-				keySize:    (*entries)[i].Header.KeySize,
-				key:        (*entries)[i].Key,
-				byteOffset: byteOffsetCounter,
-			})
+		if block.Len() == 0 {
+			blockFirst = &(*entries)[i]
+		}
+		table.indexRecord(&(*entries)[i])
+		(*entries)[i].EncodeKV(block)
+		if block.Len() >= DATA_BLOCK_SIZE {
+			if err := flushBlock(); err != nil {
+				return nil, err
+			}
 		}
-		byteOffsetCounter += (*entries)[i].TotalSize
-		(*entries)[i].EncodeKV(buf)
 	}
-	// after encoding each entry, dump into the SSTable
-	if err := writeToFile(buf.Bytes(), table.dataFile); err != nil {
-		fmt.Println("write to sst err:", err)
+	if err := flushBlock(); err != nil {
+		return nil, err
 	}
 
-	// Set up sparse index
-	populateSparseIndexFile(&table.sparseKeys, table.indexFile)
-	// Set up + populate bloom filter
-	table.bloomFilter.InitBloomFilterAttrs(uint32(len(*entries)))
-	populateBloomFilter(entries, table.bloomFilter)
+	// Set up bloom filter, it gets populated by encodeBloomFilter
+	table.bloomFilter = NewBloomFilter()
+	table.bloomFilter.InitBloomFilterAttrs(uint32(max(len(*entries), 1)))
+	return buf.Bytes(), nil
+}
+
+// indexRecord accounts for a record of the table in its in-memory metadata
+func (sst *SSTable) indexRecord(r *Record) {
+	sst.totalSize += r.TotalSize
+	if r.Header.Flags&flagBlobPointer != 0 {
+		if ptr, err := decodeBlobPointer(r.Value); err == nil {
+			sst.blobRefs[ptr.fileID] += ptr.size
+		}
+	}
 }
 
-func populateSparseIndexFile(indices *[]sparseIndex, indexFile *os.File) {
-	// encode and write to index file
+func encodeRangeTombstones(rangeTombstones *[]Record, table *SSTable) []byte {
+	buf := new(bytes.Buffer)
+	for i := range *rangeTombstones {
+		table.totalSize += (*rangeTombstones)[i].TotalSize
+		(*rangeTombstones)[i].EncodeKV(buf)
+	}
+	table.rangeTombstones = *rangeTombstones
+	return buf.Bytes()
+}
+
+func encodeSparseIndex(indices *[]sparseIndex) []byte {
 	buf := new(bytes.Buffer)
 	for i := range *indices {
 		binary.Write(buf, binary.LittleEndian, (*indices)[i].keySize)
-		buf.WriteString((*indices)[i].key)
+		buf.Write((*indices)[i].key)
 		binary.Write(buf, binary.LittleEndian, (*indices)[i].byteOffset)
 	}
-
-	if err := writeToFile(buf.Bytes(), indexFile); err != nil {
-		fmt.Println("write to indexfile err:", err)
-	}
+	return buf.Bytes()
 }
 
-func populateBloomFilter(entries *[]Record, bloomFilter *BloomFilter) {
+func encodeBloomFilter(entries *[]Record, bloomFilter *BloomFilter) []byte {
 	for i := range *entries {
 		bloomFilter.Add((*entries)[i].Key)
 	}
@@ -141,13 +341,10 @@ func populateBloomFilter(entries *[]Record, bloomFilter *BloomFilter) {
 			bfBytes[i] = 0
 		}
 	}
-
-	if err := writeToFile(bfBytes, bloomFilter.file); err != nil {
-		fmt.Println("write to bloomfile err:", err)
-	}
+	return bfBytes
 }
 
-func writeToFile(data []byte, file *os.File) error {
+func writeToFile(data []byte, file File) error {
 	if _, err := file.Write(data); err != nil {
 		return err
 	}
@@ -157,72 +354,102 @@ func writeToFile(data []byte, file *os.File) error {
 	return nil
 }
 
-func (sst *SSTable) Get(key string) (string, error) {
-	if key < sst.minKey || key > sst.maxKey {
-		return "<!>", utils.ErrKeyNotWithinTable
-	}
-	if !sst.bloomFilter.MightContain(key) {
-		return "", utils.ErrKeyNotWithinTable
+// mayContain checks the key range and the bloom filter, false means the key definitely isn't in the table
+func (sst *SSTable) mayContain(key []byte) bool {
+	if len(sst.sparseKeys) == 0 || bytes.Compare(key, sst.minKey) < 0 || bytes.Compare(key, sst.maxKey) > 0 {
+		return false
 	}
+	return sst.bloomFilter.MightContain(key)
+}
 
-	// Get sparse index and move to offset
-	currOffset := sst.sparseKeys[sst.getCandidateByteOffsetIndex(key)].byteOffset
-	if _, err := sst.dataFile.Seek(int64(currOffset), 0); err != nil {
-		return "", err
+// Get returns the full record (tombstones included) so the caller can tell deletes and blob pointers apart
+func (sst *SSTable) Get(key []byte) (Record, error) {
+	if !sst.mayContain(key) {
+		return Record{}, utils.ErrKeyNotWithinTable
 	}
 
-	var keyFound = false
-	for !keyFound {
-		// set up entry for the header
-		currEntry := make([]byte, 17)
-		_, err := io.ReadFull(sst.dataFile, currEntry)
-		if errors.Is(err, io.EOF) {
-			fmt.Println("LOG: END OF FILE")
-			return "", err
-		}
-
-		h := &Header{}
-		h.decodeHeader(currEntry)
-
-		// move the cursor so we can read the rest of the record
-		currOffset += headerSize
-		sst.dataFile.Seek(int64(currOffset), 0)
-		// set up []byte for the rest of the record
-		currRecord := make([]byte, h.KeySize+h.ValueSize)
-		if _, err := io.ReadFull(sst.dataFile, currRecord); err != nil {
-			fmt.Println("LOG: READFULL ERR:", err)
-			return "", err
-		}
-		// append both []byte together in order to decode as a whole
-		currEntry = append(currEntry, currRecord...) // full size of the record
-		r := &Record{}
-		r.DecodeKV(currEntry)
-
-		if r.Key == key {
-			fmt.Printf("LOG: FOUND KEY %s -> %s\n", key, r.Value)
-			keyFound = true
-			return r.Value, nil
-		} else if r.Key > key {
+	// the sparse index holds the first key of every block, so the key can only be in the candidate block
+	block, _, err := sst.readBlock(sst.sparseKeys[sst.getCandidateByteOffsetIndex(key)].byteOffset)
+	if err != nil {
+		return Record{}, err
+	}
+	records, err := decodeRecords(block)
+	if err != nil {
+		return Record{}, err
+	}
+	for i := range records {
+		if cmp := bytes.Compare(records[i].Key, key); cmp == 0 {
+			return records[i], nil
+		} else if cmp > 0 {
 			// return early
 			// this works b/c since our data is sorted, if the curr key is > target key,
 			// ..then the key is not in this table
-			return "", utils.ErrKeyNotFound
-		} else {
-			// else, keep iterating & looking
-			currOffset += r.Header.KeySize + r.Header.ValueSize
-			sst.dataFile.Seek(int64(currOffset), 0)
+			break
 		}
 	}
+	return Record{}, utils.ErrKeyNotFound
+}
+
+// readBlock returns the decrypted content of the block starting at offset, along with the offset of the next block.
+// ReadAt doesn't share a cursor so tables can be read concurrently
+func (sst *SSTable) readBlock(offset uint32) ([]byte, uint32, error) {
+	sizeBuf := make([]byte, blockHeaderSize)
+	if _, err := sst.dataFile.ReadAt(sizeBuf, int64(offset)); err != nil {
+		return nil, 0, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(sizeBuf))
+	if _, err := sst.dataFile.ReadAt(payload, int64(offset+blockHeaderSize)); err != nil {
+		return nil, 0, err
+	}
 
-	return "", utils.ErrKeyNotWithinTable
+	block, err := sst.encryption.open(sst.keyID, payload, associatedData(sst.path+DATA_FILE_EXTENSION, uint64(offset)))
+	if err != nil {
+		return nil, 0, err
+	}
+	return block, offset + blockHeaderSize + uint32(len(payload)), nil
+}
+
+// scanRange calls fn for every record with start <= key < end in sorted order (nil start/end means unbounded).
+// stops early once fn returns false
+func (sst *SSTable) scanRange(start, end []byte, fn func(Record) bool) error {
+	if len(sst.sparseKeys) == 0 {
+		return nil
+	}
+
+	offset := sst.sparseKeys[max(sst.getCandidateByteOffsetIndex(start), 0)].byteOffset
+	for {
+		block, next, err := sst.readBlock(offset)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		records, err := decodeRecords(block)
+		if err != nil {
+			return err
+		}
+		offset = next
+
+		for _, r := range records {
+			if bytes.Compare(r.Key, start) < 0 {
+				continue
+			}
+			if end != nil && bytes.Compare(r.Key, end) >= 0 {
+				return nil
+			}
+			if !fn(r) {
+				return nil
+			}
+		}
+	}
 }
 
-func (sst *SSTable) getCandidateByteOffsetIndex(targetKey string) int {
+func (sst *SSTable) getCandidateByteOffsetIndex(targetKey []byte) int {
 	low := 0
 	high := len(sst.sparseKeys) - 1
 	for low <= high {
 		mid := (low + high) / 2
-		cmp := strings.Compare(targetKey, sst.sparseKeys[mid].key)
+		cmp := bytes.Compare(targetKey, sst.sparseKeys[mid].key)
 		if cmp > 0 { // targetKey > sparseKeys[mid]
 			low = mid + 1
 		} else if cmp < 0 { // targetKey < sparseKeys[mid]
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+/*
+Versions -- the set of SSTables a read sees
+
+A version is an immutable snapshot of every table across every bucket. Reads pin the current version for as
+long as they use its tables, and compaction installs a new version once it's done. A table that compaction
+merged away is only marked obsolete, its files are deleted once no version references it anymore, so a read
+that started before the compaction can still finish on the old tables.
+*/
+
+type version struct {
+	tables []*SSTable
+	refs   atomic.Int32
+}
+
+func newVersion(tables []*SSTable) *version {
+	v := &version{tables: tables}
+	for _, table := range tables {
+		table.ref()
+	}
+	return v
+}
+
+// release drops a reference to the version, once nothing references it neither does it reference its tables
+func (v *version) release(bm *BucketManager) {
+	if v.refs.Add(-1) > 0 {
+		return
+	}
+
+	bm.versionMu.Lock()
+	delete(bm.versions, v)
+	bm.versionMu.Unlock()
+
+	for _, table := range v.tables {
+		table.unref()
+	}
+}
+
+// pinVersion returns the current version, the caller has to release it once it's done reading its tables
+func (bm *BucketManager) pinVersion() *version {
+	bm.versionMu.Lock()
+	defer bm.versionMu.Unlock()
+	bm.current.refs.Add(1)
+	return bm.current
+}
+
+// installVersion makes the tables currently in the buckets the version new reads see.
+// the manifest is written first, so the files of the tables this replaces are only deleted once it no longer lists them
+func (bm *BucketManager) installVersion() error {
+	var entries []manifestEntry
+	for lvl := bm.highestLvl; lvl > 0; lvl-- {
+		for _, table := range bm.buckets[lvl].tables {
+			entries = append(entries, manifestEntry{level: uint32(lvl), id: table.sstCounter})
+		}
+	}
+	if err := writeManifest(bm.compaction.fs, bm.dir, entries); err != nil {
+		// the manifest may have made it to disk anyway, so the tables it lists have to stay around until a manifest
+		// that is known to be durable replaces it
+		v := newVersion(bm.bucketTables())
+		v.refs.Add(1)
+		bm.versionMu.Lock()
+		bm.versions[v] = struct{}{}
+		bm.versionMu.Unlock()
+		bm.unconfirmed = append(bm.unconfirmed, v)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	bm.setCurrentVersion(newVersion(bm.bucketTables()))
+	for _, v := range bm.unconfirmed {
+		v.release(bm)
+	}
+	bm.unconfirmed = nil
+	return nil
+}
+
+func (bm *BucketManager) setCurrentVersion(v *version) {
+	v.refs.Add(1) // the reference held by bm.current
+
+	bm.versionMu.Lock()
+	old := bm.current
+	bm.current = v
+	bm.versions[v] = struct{}{}
+	bm.versionMu.Unlock()
+
+	if old != nil {
+		old.release(bm)
+	}
+}
+
+// bucketTables returns every table in the buckets, highest level first
+func (bm *BucketManager) bucketTables() []*SSTable {
+	var tables []*SSTable
+	for lvl := bm.highestLvl; lvl > 0; lvl-- {
+		tables = append(tables, bm.buckets[lvl].tables...)
+	}
+	return tables
+}
+
+// liveTables returns every table that some version still references, obsolete ones included
+func (bm *BucketManager) liveTables() []*SSTable {
+	bm.versionMu.Lock()
+	defer bm.versionMu.Unlock()
+
+	seen := make(map[*SSTable]struct{})
+	var tables []*SSTable
+	for v := range bm.versions {
+		for _, table := range v.tables {
+			if _, ok := seen[table]; !ok {
+				seen[table] = struct{}{}
+				tables = append(tables, table)
+			}
+		}
+	}
+	return tables
+}
+
+func (sst *SSTable) ref() {
+	sst.refs.Add(1)
+}
+
+func (sst *SSTable) unref() {
+	if sst.refs.Add(-1) == 0 && sst.obsolete.Load() {
+		sst.deleteFiles()
+	}
+}
+
+// markObsolete is called once compaction merged the table away, the files go as soon as no version references it
+func (sst *SSTable) markObsolete() {
+	sst.obsolete.Store(true)
+	if sst.refs.Load() == 0 {
+		sst.deleteFiles()
+	}
+}
+
+func (sst *SSTable) deleteFiles() {
+	sst.deleteOnce.Do(func() {
+		sst.dataFile.Close()
+		for _, extension := range []string{DATA_FILE_EXTENSION, INDEX_FILE_EXTENSION, BLOOM_FILE_EXTENSION, RANGE_DEL_FILE_EXTENSION} {
+			if err := sst.fs.Remove(sst.path + extension); err != nil {
+				fmt.Println("delete sst file err:", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+)
+
+// a read that pinned the tables before a compaction finishes on them, their files only go once it lets go
+func TestPinnedVersionSurvivesCompaction(t *testing.T) {
+	fs := NewMemFS(1)
+	store := openTestStore(t, fs)
+	bm := store.bucketManager
+	flush := func(i int) {
+		t.Helper()
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if err := store.Set(key, key); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		store.mu.Lock()
+		store.rotateMemtable()
+		store.mu.Unlock()
+	}
+
+	flush(0)
+	pinned := bm.pinVersion()
+	table := pinned.tables[0]
+	for i := 1; ; i++ {
+		if i == 20 {
+			t.Fatal("the table never got compacted")
+		}
+		flush(i)
+		current := bm.pinVersion()
+		compacted := !slices.Contains(current.tables, table)
+		current.release(bm)
+		if compacted {
+			break
+		}
+	}
+
+	if !table.obsolete.Load() {
+		t.Fatal("a table merged away by compaction isn't obsolete")
+	}
+	record, err := table.Get([]byte("key-00"))
+	if err != nil || string(record.Value) != "key-00" {
+		t.Fatalf("get from the pinned table: got %q, %v", record.Value, err)
+	}
+	if _, err := openReadOnly(fs, table.path+DATA_FILE_EXTENSION); err != nil {
+		t.Fatalf("the pinned table's data file is gone: %v", err)
+	}
+
+	pinned.release(bm)
+	if _, err := openReadOnly(fs, table.path+DATA_FILE_EXTENSION); !os.IsNotExist(err) {
+		t.Fatalf("the table's data file is still there once released: %v", err)
+	}
+	// the compacted table has the key
+	if got, err := store.Get([]byte("key-00")); err != nil || string(got) != "key-00" {
+		t.Fatalf("get after compaction: got %q, %v", got, err)
+	}
+}
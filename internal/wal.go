@@ -2,18 +2,68 @@ package internal
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 
 	"github.com/jateen67/kv/utils"
 )
 
 const WALBatchThreshold = 1024 * 1024 * 3
 
+/*
+The log starts with the key id its operations are encrypted with (0 if they aren't), followed by the operations:
+-------------------------------------------------------------
+| key_id | op_size | op | record | op_size | op | record | ... |
+-------------------------------------------------------------
+op + record are sealed together when the log is encrypted
+*/
+
+const walOpSizeSize uint32 = 4
+
 // writeAheadLog maintains the log and batches operations to minimize disk writes
 type writeAheadLog struct {
-	file     *os.File
-	opsBatch []byte
-	size     int
+	fs             FS
+	file           File
+	encryption     *encryptor
+	keyID          uint32
+	opsBatch       []byte
+	size           int
+	batchThreshold int
+	logged         bool   // whether any write was logged since the last reset
+	oldest         uint64 // timestamp of the first write logged since the last reset
+	truncated      bool   // a reset that didn't make it to disk yet, has to be redone before anything is appended
+	end            int64  // where the last batch that made it to disk ends
+	torn           bool   // a batch write failed, whatever it left past end has to go before the batch is written again
+	// called before a batch is written out, anything the batched operations point at has to be durable first
+	beforeFlush func() error
+}
+
+// openWAL opens (or creates) the log, an existing log keeps the key it was started with until it gets reset
+func openWAL(fs FS, filename string, enc *encryptor) (*writeAheadLog, error) {
+	file, err := fs.OpenFile(filename, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	w := &writeAheadLog{fs: fs, file: file, encryption: enc, batchThreshold: WALBatchThreshold}
+
+	header := make([]byte, fileKeyIDSize)
+	if n, _ := file.ReadAt(header, 0); n == fileKeyIDSize {
+		w.keyID = binary.LittleEndian.Uint32(header)
+		return w, nil
+	}
+	// new log (or one that crashed before its header made it)
+	if err := w.reset(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := fs.SyncDir(filepath.Dir(filename)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
 }
 
 func (w *writeAheadLog) clearBatch() {
@@ -22,32 +72,189 @@ func (w *writeAheadLog) clearBatch() {
 }
 
 func (w *writeAheadLog) appendWALOperation(op Operation, record *Record) error {
-	buf := new(bytes.Buffer)
+	entry := new(bytes.Buffer)
 	// Store operation as only 1 byte (only WAL entries will have this extra byte)
-	buf.WriteByte(byte(op))
+	entry.WriteByte(byte(op))
 
 	// encode the entire key, value entry
-	if encodeErr := record.EncodeKV(buf); encodeErr != nil {
+	if encodeErr := record.EncodeKV(entry); encodeErr != nil {
 		return utils.ErrEncodingKVFailed
 	}
+	// the entry goes after what's on disk and what's batched, a pending reset leaves only the header on disk
+	offset := w.end
+	if w.truncated {
+		offset = fileKeyIDSize
+	}
+	payload, err := w.encryption.seal(w.keyID, entry.Bytes(), associatedData(w.file.Name(), uint64(offset)+uint64(w.size)))
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+
+	if op != GET && !w.logged {
+		w.logged = true
+		w.oldest = record.Header.TimeStamp
+	}
 
 	// store in the batch
 	w.opsBatch = append(w.opsBatch, buf.Bytes()...)
 	w.size += len(buf.Bytes())
 
-	if w.size >= WALBatchThreshold {
+	if w.size >= w.batchThreshold {
 		return w.flushToDisk()
 	}
 
 	return nil
 }
 
-// Flushes the current batch of operations to disk, only called if size reaches WALBatchThreshold
+// appendGet logs a read of the key. nothing is replayed for it, but the record still has to be a well-formed one
+func (w *writeAheadLog) appendGet(key []byte) error {
+	return w.appendWALOperation(GET, &Record{
+		Header:    Header{KeySize: uint32(len(key))},
+		Key:       key,
+		TotalSize: headerSize + uint32(len(key)),
+	})
+}
+
+// Flushes the current batch of operations to disk, only called if size reaches the batch threshold
 func (w *writeAheadLog) flushToDisk() error {
+	if w.size == 0 {
+		return nil
+	}
+	if w.truncated {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+	if w.beforeFlush != nil {
+		if err := w.beforeFlush(); err != nil {
+			return err
+		}
+	}
+	// a retried batch appended after the failed attempt would replay the same operations twice,
+	// and a crash in the middle of the second copy rolls keys back to older values
+	if w.torn {
+		if err := w.file.Truncate(w.end); err != nil {
+			return err
+		}
+		w.torn = false
+	}
 	if logErr := writeToFile(w.opsBatch, w.file); logErr != nil {
+		w.torn = true
 		return logErr
 	}
 
+	w.end += int64(len(w.opsBatch))
+	w.clearBatch()
+	return nil
+}
+
+// replay calls fn for every operation in the log that changed the store, in the order they were logged, until fn fails.
+// a torn write at the end of the log (crash mid-append) ends the replay, and gets cut off so new appends follow valid ones
+func (w *writeAheadLog) replay(fn func(op Operation, record *Record) error) error {
+	data, err := readFile(w.fs, w.file.Name())
+	if err != nil {
+		return err
+	}
+
+	offset := uint32(fileKeyIDSize)
+	for uint32(len(data))-offset >= walOpSizeSize {
+		size := walOpSizeSize + binary.LittleEndian.Uint32(data[offset:offset+walOpSizeSize])
+		if uint32(len(data))-offset < size {
+			break
+		}
+		entry, err := w.encryption.open(w.keyID, data[offset+walOpSizeSize:offset+size], associatedData(w.file.Name(), uint64(offset)))
+		if err != nil || uint32(len(entry)) < 1+headerSize {
+			break
+		}
+
+		op := Operation(entry[0])
+		// reads are logged too, but there's nothing to replay for them. the entry's size is all it takes to skip one,
+		// logs written before reads were logged as well-formed records hold GETs whose record doesn't decode
+		if op == GET {
+			offset += size
+			continue
+		}
+		record := &Record{}
+		if err := record.DecodeKV(entry[1:]); err != nil || record.TotalSize != uint32(len(entry)-1) {
+			break
+		}
+		if record.CalculateChecksum() != record.Header.CheckSum {
+			break
+		}
+		if err := fn(op, record); err != nil {
+			return err
+		}
+		if !w.logged {
+			w.logged = true
+			w.oldest = record.Header.TimeStamp
+		}
+		offset += size
+	}
+	w.end = int64(offset)
+
+	if offset < uint32(len(data)) {
+		fmt.Printf("wal %s: dropping %d bytes of incomplete operations\n", w.file.Name(), uint32(len(data))-offset)
+		if err := w.file.Truncate(int64(offset)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset empties the log, once everything it holds made it into tables recorded in the manifest.
+// the fresh log is encrypted with the current key, this is where the log picks up key rotations
+func (w *writeAheadLog) reset() error {
 	w.clearBatch()
+	keyID, err := w.encryption.currentKeyID()
+	if err != nil {
+		return err
+	}
+	w.keyID = keyID
+	w.truncated = true
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.logged = false
 	return nil
 }
+
+// empty reports whether a crash would have nothing to replay
+func (w *writeAheadLog) empty() bool {
+	return !w.logged
+}
+
+// oldestTimestamp returns the timestamp of the oldest write a crash could replay, MaxUint64 if there's none
+func (w *writeAheadLog) oldestTimestamp() uint64 {
+	if !w.logged {
+		return math.MaxUint64
+	}
+	return w.oldest
+}
+
+// writeHeader truncates the log down to a fresh header
+func (w *writeAheadLog) writeHeader() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	header := make([]byte, fileKeyIDSize)
+	binary.LittleEndian.PutUint32(header, w.keyID)
+	if err := writeToFile(header, w.file); err != nil {
+		return err
+	}
+	w.end = int64(fileKeyIDSize)
+	w.torn = false
+	w.truncated = false
+	return nil
+}
+
+// close writes out the batched operations and closes the log
+func (w *writeAheadLog) close() error {
+	if err := w.flushToDisk(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,33 @@
+package internal
+
+import "testing"
+
+// a read logged between two writes mustn't end the replay, the second write would be lost on restart
+func TestReplayPastLoggedReads(t *testing.T) {
+	fs := NewMemFS(1)
+	store := openTestStore(t, fs)
+	if err := store.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if _, err := store.Get([]byte("a")); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	// the way reads used to be logged, with a header that doesn't describe the key
+	store.wal.appendWALOperation(GET, &Record{Key: []byte("a")})
+	if err := store.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if !store.Close() {
+		t.Fatal("close failed")
+	}
+
+	store, err := newStore(1, WithFS(fs))
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if got, err := store.Get([]byte(key)); err != nil || string(got) != want {
+			t.Errorf("get %s after reopen: got %q, %v, want %q", key, got, err, want)
+		}
+	}
+}
@@ -143,7 +143,7 @@ func (x *KeyValueMigrationResponse) GetMigrationResults() []*MigrationResult {
 
 type MigrationResult struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Key           string                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
 	Success       bool                   `protobuf:"varint,2,opt,name=success,proto3" json:"success,omitempty"`
 	ErrorMsg      string                 `protobuf:"bytes,3,opt,name=error_msg,json=errorMsg,proto3" json:"error_msg,omitempty"`
 	unknownFields protoimpl.UnknownFields
@@ -180,11 +180,11 @@ func (*MigrationResult) Descriptor() ([]byte, []int) {
 	return file_proto_datamigration_proto_rawDescGZIP(), []int{2}
 }
 
-func (x *MigrationResult) GetKey() string {
+func (x *MigrationResult) GetKey() []byte {
 	if x != nil {
 		return x.Key
 	}
-	return ""
+	return nil
 }
 
 func (x *MigrationResult) GetSuccess() bool {
@@ -249,9 +249,10 @@ type Header struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Checksum      uint32                 `protobuf:"varint,1,opt,name=checksum,proto3" json:"checksum,omitempty"`
 	Tombstone     uint32                 `protobuf:"varint,2,opt,name=tombstone,proto3" json:"tombstone,omitempty"`
-	Timestamp     uint32                 `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Timestamp     uint64                 `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
 	KeySize       uint32                 `protobuf:"varint,4,opt,name=key_size,json=keySize,proto3" json:"key_size,omitempty"`
 	ValueSize     uint32                 `protobuf:"varint,5,opt,name=value_size,json=valueSize,proto3" json:"value_size,omitempty"`
+	Flags         uint32                 `protobuf:"varint,6,opt,name=flags,proto3" json:"flags,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -300,7 +301,7 @@ func (x *Header) GetTombstone() uint32 {
 	return 0
 }
 
-func (x *Header) GetTimestamp() uint32 {
+func (x *Header) GetTimestamp() uint64 {
 	if x != nil {
 		return x.Timestamp
 	}
@@ -321,11 +322,18 @@ func (x *Header) GetValueSize() uint32 {
 	return 0
 }
 
+func (x *Header) GetFlags() uint32 {
+	if x != nil {
+		return x.Flags
+	}
+	return 0
+}
+
 type Record struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Header        *Header                `protobuf:"bytes,1,opt,name=header,proto3" json:"header,omitempty"`
-	Key           string                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
-	Value         string                 `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	Key           []byte                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Value         []byte                 `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
 	TotalSize     uint32                 `protobuf:"varint,4,opt,name=total_size,json=totalSize,proto3" json:"total_size,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -368,18 +376,18 @@ func (x *Record) GetHeader() *Header {
 	return nil
 }
 
-func (x *Record) GetKey() string {
+func (x *Record) GetKey() []byte {
 	if x != nil {
 		return x.Key
 	}
-	return ""
+	return nil
 }
 
-func (x *Record) GetValue() string {
+func (x *Record) GetValue() []byte {
 	if x != nil {
 		return x.Value
 	}
-	return ""
+	return nil
 }
 
 func (x *Record) GetTotalSize() uint32 {
@@ -389,6 +397,127 @@ func (x *Record) GetTotalSize() uint32 {
 	return 0
 }
 
+type MigrationChunk struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	SourceNodeAddr string                 `protobuf:"bytes,1,opt,name=source_node_addr,json=sourceNodeAddr,proto3" json:"source_node_addr,omitempty"`
+	DestNodeAddr   string                 `protobuf:"bytes,2,opt,name=dest_node_addr,json=destNodeAddr,proto3" json:"dest_node_addr,omitempty"`
+	Seq            uint64                 `protobuf:"varint,3,opt,name=seq,proto3" json:"seq,omitempty"`
+	KvPairs        []*KVPair              `protobuf:"bytes,4,rep,name=kv_pairs,json=kvPairs,proto3" json:"kv_pairs,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *MigrationChunk) Reset() {
+	*x = MigrationChunk{}
+	mi := &file_proto_datamigration_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MigrationChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MigrationChunk) ProtoMessage() {}
+
+func (x *MigrationChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_datamigration_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MigrationChunk.ProtoReflect.Descriptor instead.
+func (*MigrationChunk) Descriptor() ([]byte, []int) {
+	return file_proto_datamigration_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *MigrationChunk) GetSourceNodeAddr() string {
+	if x != nil {
+		return x.SourceNodeAddr
+	}
+	return ""
+}
+
+func (x *MigrationChunk) GetDestNodeAddr() string {
+	if x != nil {
+		return x.DestNodeAddr
+	}
+	return ""
+}
+
+func (x *MigrationChunk) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *MigrationChunk) GetKvPairs() []*KVPair {
+	if x != nil {
+		return x.KvPairs
+	}
+	return nil
+}
+
+type MigrationAck struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Seq   uint64                 `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	// the records of the chunk that couldn't be stored, every other one was
+	Failures      []*MigrationResult `protobuf:"bytes,2,rep,name=failures,proto3" json:"failures,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MigrationAck) Reset() {
+	*x = MigrationAck{}
+	mi := &file_proto_datamigration_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MigrationAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MigrationAck) ProtoMessage() {}
+
+func (x *MigrationAck) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_datamigration_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MigrationAck.ProtoReflect.Descriptor instead.
+func (*MigrationAck) Descriptor() ([]byte, []int) {
+	return file_proto_datamigration_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *MigrationAck) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *MigrationAck) GetFailures() []*MigrationResult {
+	if x != nil {
+		return x.Failures
+	}
+	return nil
+}
+
 var File_proto_datamigration_proto protoreflect.FileDescriptor
 
 const file_proto_datamigration_proto_rawDesc = "" +
@@ -403,26 +532,36 @@ const file_proto_datamigration_proto_rawDesc = "" +
 	"\terror_msg\x18\x02 \x01(\tR\berrorMsg\x12=\n" +
 	"\x11migration_results\x18\x03 \x03(\v2\x10.MigrationResultR\x10migrationResults\"Z\n" +
 	"\x0fMigrationResult\x12\x10\n" +
-	"\x03key\x18\x01 \x01(\tR\x03key\x12\x18\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x12\x18\n" +
 	"\asuccess\x18\x02 \x01(\bR\asuccess\x12\x1b\n" +
 	"\terror_msg\x18\x03 \x01(\tR\berrorMsg\")\n" +
 	"\x06KVPair\x12\x1f\n" +
-	"\x06record\x18\x01 \x01(\v2\a.RecordR\x06record\"\x9a\x01\n" +
+	"\x06record\x18\x01 \x01(\v2\a.RecordR\x06record\"\xb0\x01\n" +
 	"\x06Header\x12\x1a\n" +
 	"\bchecksum\x18\x01 \x01(\rR\bchecksum\x12\x1c\n" +
 	"\ttombstone\x18\x02 \x01(\rR\ttombstone\x12\x1c\n" +
-	"\ttimestamp\x18\x03 \x01(\rR\ttimestamp\x12\x19\n" +
+	"\ttimestamp\x18\x03 \x01(\x04R\ttimestamp\x12\x19\n" +
 	"\bkey_size\x18\x04 \x01(\rR\akeySize\x12\x1d\n" +
 	"\n" +
-	"value_size\x18\x05 \x01(\rR\tvalueSize\"p\n" +
+	"value_size\x18\x05 \x01(\rR\tvalueSize\x12\x14\n" +
+	"\x05flags\x18\x06 \x01(\rR\x05flags\"p\n" +
 	"\x06Record\x12\x1f\n" +
 	"\x06header\x18\x01 \x01(\v2\a.HeaderR\x06header\x12\x10\n" +
-	"\x03key\x18\x02 \x01(\tR\x03key\x12\x14\n" +
-	"\x05value\x18\x03 \x01(\tR\x05value\x12\x1d\n" +
+	"\x03key\x18\x02 \x01(\fR\x03key\x12\x14\n" +
+	"\x05value\x18\x03 \x01(\fR\x05value\x12\x1d\n" +
 	"\n" +
-	"total_size\x18\x04 \x01(\rR\ttotalSize2e\n" +
+	"total_size\x18\x04 \x01(\rR\ttotalSize\"\x96\x01\n" +
+	"\x0eMigrationChunk\x12(\n" +
+	"\x10source_node_addr\x18\x01 \x01(\tR\x0esourceNodeAddr\x12$\n" +
+	"\x0edest_node_addr\x18\x02 \x01(\tR\fdestNodeAddr\x12\x10\n" +
+	"\x03seq\x18\x03 \x01(\x04R\x03seq\x12\"\n" +
+	"\bkv_pairs\x18\x04 \x03(\v2\a.KVPairR\akvPairs\"N\n" +
+	"\fMigrationAck\x12\x10\n" +
+	"\x03seq\x18\x01 \x01(\x04R\x03seq\x12,\n" +
+	"\bfailures\x18\x02 \x03(\v2\x10.MigrationResultR\bfailures2\x9a\x01\n" +
 	"\x14DataMigrationService\x12M\n" +
-	"\x14MigrateKeyValuePairs\x12\x19.KeyValueMigrationRequest\x1a\x1a.KeyValueMigrationResponseB\x1eZ\x1cgithub.com/jateen67/kv/protob\x06proto3"
+	"\x14MigrateKeyValuePairs\x12\x19.KeyValueMigrationRequest\x1a\x1a.KeyValueMigrationResponse\x123\n" +
+	"\rMigrateStream\x12\x0f.MigrationChunk\x1a\r.MigrationAck(\x010\x01B\x1eZ\x1cgithub.com/jateen67/kv/protob\x06proto3"
 
 var (
 	file_proto_datamigration_proto_rawDescOnce sync.Once
@@ -436,7 +575,7 @@ func file_proto_datamigration_proto_rawDescGZIP() []byte {
 	return file_proto_datamigration_proto_rawDescData
 }
 
-var file_proto_datamigration_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_proto_datamigration_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
 var file_proto_datamigration_proto_goTypes = []any{
 	(*KeyValueMigrationRequest)(nil),  // 0: KeyValueMigrationRequest
 	(*KeyValueMigrationResponse)(nil), // 1: KeyValueMigrationResponse
@@ -444,19 +583,25 @@ var file_proto_datamigration_proto_goTypes = []any{
 	(*KVPair)(nil),                    // 3: KVPair
 	(*Header)(nil),                    // 4: Header
 	(*Record)(nil),                    // 5: Record
+	(*MigrationChunk)(nil),            // 6: MigrationChunk
+	(*MigrationAck)(nil),              // 7: MigrationAck
 }
 var file_proto_datamigration_proto_depIdxs = []int32{
 	3, // 0: KeyValueMigrationRequest.kv_pairs:type_name -> KVPair
 	2, // 1: KeyValueMigrationResponse.migration_results:type_name -> MigrationResult
 	5, // 2: KVPair.record:type_name -> Record
 	4, // 3: Record.header:type_name -> Header
-	0, // 4: DataMigrationService.MigrateKeyValuePairs:input_type -> KeyValueMigrationRequest
-	1, // 5: DataMigrationService.MigrateKeyValuePairs:output_type -> KeyValueMigrationResponse
-	5, // [5:6] is the sub-list for method output_type
-	4, // [4:5] is the sub-list for method input_type
-	4, // [4:4] is the sub-list for extension type_name
-	4, // [4:4] is the sub-list for extension extendee
-	0, // [0:4] is the sub-list for field type_name
+	3, // 4: MigrationChunk.kv_pairs:type_name -> KVPair
+	2, // 5: MigrationAck.failures:type_name -> MigrationResult
+	0, // 6: DataMigrationService.MigrateKeyValuePairs:input_type -> KeyValueMigrationRequest
+	6, // 7: DataMigrationService.MigrateStream:input_type -> MigrationChunk
+	1, // 8: DataMigrationService.MigrateKeyValuePairs:output_type -> KeyValueMigrationResponse
+	7, // 9: DataMigrationService.MigrateStream:output_type -> MigrationAck
+	8, // [8:10] is the sub-list for method output_type
+	6, // [6:8] is the sub-list for method input_type
+	6, // [6:6] is the sub-list for extension type_name
+	6, // [6:6] is the sub-list for extension extendee
+	0, // [0:6] is the sub-list for field type_name
 }
 
 func init() { file_proto_datamigration_proto_init() }
@@ -470,7 +615,7 @@ func file_proto_datamigration_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_datamigration_proto_rawDesc), len(file_proto_datamigration_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   6,
+			NumMessages:   8,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
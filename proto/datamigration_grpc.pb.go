@@ -20,6 +20,7 @@ const _ = grpc.SupportPackageIsVersion9
 
 const (
 	DataMigrationService_MigrateKeyValuePairs_FullMethodName = "/DataMigrationService/MigrateKeyValuePairs"
+	DataMigrationService_MigrateStream_FullMethodName        = "/DataMigrationService/MigrateStream"
 )
 
 // DataMigrationServiceClient is the client API for DataMigrationService service.
@@ -27,6 +28,8 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type DataMigrationServiceClient interface {
 	MigrateKeyValuePairs(ctx context.Context, in *KeyValueMigrationRequest, opts ...grpc.CallOption) (*KeyValueMigrationResponse, error)
+	// records sent in bounded chunks, every chunk acknowledged once stored, in the order they were sent
+	MigrateStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[MigrationChunk, MigrationAck], error)
 }
 
 type dataMigrationServiceClient struct {
@@ -47,11 +50,26 @@ func (c *dataMigrationServiceClient) MigrateKeyValuePairs(ctx context.Context, i
 	return out, nil
 }
 
+func (c *dataMigrationServiceClient) MigrateStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[MigrationChunk, MigrationAck], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &DataMigrationService_ServiceDesc.Streams[0], DataMigrationService_MigrateStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[MigrationChunk, MigrationAck]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type DataMigrationService_MigrateStreamClient = grpc.BidiStreamingClient[MigrationChunk, MigrationAck]
+
 // DataMigrationServiceServer is the server API for DataMigrationService service.
 // All implementations must embed UnimplementedDataMigrationServiceServer
 // for forward compatibility.
 type DataMigrationServiceServer interface {
 	MigrateKeyValuePairs(context.Context, *KeyValueMigrationRequest) (*KeyValueMigrationResponse, error)
+	// records sent in bounded chunks, every chunk acknowledged once stored, in the order they were sent
+	MigrateStream(grpc.BidiStreamingServer[MigrationChunk, MigrationAck]) error
 	mustEmbedUnimplementedDataMigrationServiceServer()
 }
 
@@ -65,6 +83,9 @@ type UnimplementedDataMigrationServiceServer struct{}
 func (UnimplementedDataMigrationServiceServer) MigrateKeyValuePairs(context.Context, *KeyValueMigrationRequest) (*KeyValueMigrationResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method MigrateKeyValuePairs not implemented")
 }
+func (UnimplementedDataMigrationServiceServer) MigrateStream(grpc.BidiStreamingServer[MigrationChunk, MigrationAck]) error {
+	return status.Errorf(codes.Unimplemented, "method MigrateStream not implemented")
+}
 func (UnimplementedDataMigrationServiceServer) mustEmbedUnimplementedDataMigrationServiceServer() {}
 func (UnimplementedDataMigrationServiceServer) testEmbeddedByValue()                              {}
 
@@ -104,6 +125,13 @@ func _DataMigrationService_MigrateKeyValuePairs_Handler(srv interface{}, ctx con
 	return interceptor(ctx, in, info, handler)
 }
 
+func _DataMigrationService_MigrateStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DataMigrationServiceServer).MigrateStream(&grpc.GenericServerStream[MigrationChunk, MigrationAck]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type DataMigrationService_MigrateStreamServer = grpc.BidiStreamingServer[MigrationChunk, MigrationAck]
+
 // DataMigrationService_ServiceDesc is the grpc.ServiceDesc for DataMigrationService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -116,6 +144,13 @@ var DataMigrationService_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _DataMigrationService_MigrateKeyValuePairs_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "MigrateStream",
+			Handler:       _DataMigrationService_MigrateStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "proto/datamigration.proto",
 }
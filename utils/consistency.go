@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConsistencyLevel is how many of a key's replicas have to answer a request before it's considered done
+type ConsistencyLevel int
+
+const (
+	ConsistencyOne ConsistencyLevel = iota
+	ConsistencyQuorum
+	ConsistencyAll
+)
+
+// ParseConsistencyLevel parses "one", "quorum" or "all" (any case)
+func ParseConsistencyLevel(s string) (ConsistencyLevel, error) {
+	switch strings.ToLower(s) {
+	case "one":
+		return ConsistencyOne, nil
+	case "quorum":
+		return ConsistencyQuorum, nil
+	case "all":
+		return ConsistencyAll, nil
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownConsistencyLevel, s)
+}
+
+func (l ConsistencyLevel) String() string {
+	switch l {
+	case ConsistencyOne:
+		return "ONE"
+	case ConsistencyQuorum:
+		return "QUORUM"
+	case ConsistencyAll:
+		return "ALL"
+	}
+	return fmt.Sprintf("ConsistencyLevel(%d)", int(l))
+}
+
+// Required returns how many of n replicas have to answer
+func (l ConsistencyLevel) Required(n int) int {
+	switch l {
+	case ConsistencyQuorum:
+		return n/2 + 1
+	case ConsistencyAll:
+		return n
+	}
+	return min(1, n)
+}
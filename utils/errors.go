@@ -3,15 +3,75 @@ package utils
 import "errors"
 
 var (
-	ErrEmptyKey             = errors.New("invalid key: key can not be empty")
-	ErrDuplicateKey         = errors.New("invalid key: already in store")
-	ErrKeyNotFound          = errors.New("invalid key: not found or deleted")
-	ErrEmptyValue           = errors.New("invalid value: value can not be empty")
-	ErrFileInit             = errors.New("error initializing file")
-	ErrEncodingHeaderFailed = errors.New("encoding fail: failed to encode header")
-	ErrDecodingHeaderFailed = errors.New("decoding fail: failed to decode header")
-	ErrEncodingKVFailed     = errors.New("encoding fail: failed to encode kv")
-	ErrDecodingKVFailed     = errors.New("decoding fail: failed to decode kv")
-	ErrMemtableLocked       = errors.New("memtable fail: currently locked for further operations")
-	ErrKeyNotWithinTable    = errors.New("sstable: key not within table's range")
+	ErrEmptyKey                   = errors.New("invalid key: key can not be empty")
+	ErrDuplicateKey               = errors.New("invalid key: already in store")
+	ErrKeyNotFound                = errors.New("invalid key: not found or deleted")
+	ErrEmptyValue                 = errors.New("invalid value: value can not be empty")
+	ErrFileInit                   = errors.New("error initializing file")
+	ErrEncodingHeaderFailed       = errors.New("encoding fail: failed to encode header")
+	ErrDecodingHeaderFailed       = errors.New("decoding fail: failed to decode header")
+	ErrEncodingKVFailed           = errors.New("encoding fail: failed to encode kv")
+	ErrDecodingKVFailed           = errors.New("decoding fail: failed to decode kv")
+	ErrMemtableLocked             = errors.New("memtable fail: currently locked for further operations")
+	ErrKeyNotWithinTable          = errors.New("sstable: key not within table's range")
+	ErrDecodingBlobPointerFailed  = errors.New("decoding fail: failed to decode blob pointer")
+	ErrBlobFileNotFound           = errors.New("blob: file not found")
+	ErrBlobChecksumMismatch       = errors.New("blob: checksum mismatch")
+	ErrInvalidRange               = errors.New("invalid range: start must be before end")
+	ErrUnknownMergeOperator       = errors.New("merge: unknown merge operator")
+	ErrInvalidMergeOperatorName   = errors.New("merge: operator name must be 1 to 255 bytes and not start with a NUL byte")
+	ErrMergeOperatorExists        = errors.New("merge: an operator with this name is already registered")
+	ErrCorruptManifest            = errors.New("manifest: checksum mismatch or truncated")
+	ErrUnknownEncryptionKey       = errors.New("encryption: unknown key id")
+	ErrDecryptionFailed           = errors.New("encryption: failed to decrypt, wrong key or corrupted data")
+	ErrDecodingMergeOperandFailed = errors.New("decoding fail: failed to decode merge operands")
+	ErrUnknownConsistencyLevel    = errors.New("consistency: unknown level, must be one of ONE, QUORUM, ALL")
+	ErrNotEnoughReplicas          = errors.New("consistency: not enough replicas answered")
+	ErrNodeUnavailable            = errors.New("cluster: node is down")
+	ErrDecodingSiblingsFailed     = errors.New("decoding fail: failed to decode siblings")
+	ErrInvalidCausalContext       = errors.New("siblings: invalid causal context")
+	ErrSiblings                   = errors.New("siblings: key has concurrent values, read all of them")
+	ErrMergeWithSiblings          = errors.New("siblings: merge operators can't be used while siblings are kept")
+	ErrCompareFailed              = errors.New("compare and swap: current value doesn't match the expected one")
 )
+
+// ErrorDomain is the domain of the reasons gRPC calls to a node fail with
+const ErrorDomain = "kv"
+
+// the errors a gRPC call to a node can fail with, by the reason that names them in the call's status. the first one an
+// error is wins
+var errorReasons = []struct {
+	reason string
+	err    error
+}{
+	{"NOT_ENOUGH_REPLICAS", ErrNotEnoughReplicas},
+	{"NODE_UNAVAILABLE", ErrNodeUnavailable},
+	{"KEY_NOT_FOUND", ErrKeyNotFound},
+	{"COMPARE_FAILED", ErrCompareFailed},
+	{"SIBLINGS", ErrSiblings},
+	{"MERGE_WITH_SIBLINGS", ErrMergeWithSiblings},
+	{"EMPTY_KEY", ErrEmptyKey},
+	{"INVALID_CAUSAL_CONTEXT", ErrInvalidCausalContext},
+	{"INVALID_RANGE", ErrInvalidRange},
+	{"UNKNOWN_CONSISTENCY_LEVEL", ErrUnknownConsistencyLevel},
+}
+
+// ErrorReason returns the reason naming err in a failed call's status, "" if it has none
+func ErrorReason(err error) string {
+	for _, r := range errorReasons {
+		if errors.Is(err, r.err) {
+			return r.reason
+		}
+	}
+	return ""
+}
+
+// ReasonError returns the error a reason names, nil if it names none
+func ReasonError(reason string) error {
+	for _, r := range errorReasons {
+		if r.reason == reason {
+			return r.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package utils
+
+// MemberStatus is whether a cluster member is up, as far as gossip and the failure detector know
+type MemberStatus string
+
+const (
+	MemberUp   MemberStatus = "up"
+	MemberDown MemberStatus = "down"
+	MemberLeft MemberStatus = "left"
+	// taking over its share of the keys, not on the hash ring yet
+	MemberJoining MemberStatus = "joining"
+)
+
+// Member is a cluster member as gossip has it
+type Member struct {
+	Addr       string       `json:"addr"`
+	ID         string       `json:"id"`
+	Status     MemberStatus `json:"status"`
+	Generation uint64       `json:"generation"`
+	Heartbeat  uint64       `json:"heartbeat"`
+	Phi        float64      `json:"phi"` // of the failure detector, how sure it is the member is down
+}
@@ -0,0 +1,14 @@
+package utils
+
+// Migration is the progress of moving records from one node to another
+type Migration struct {
+	Source       string `json:"source"`
+	Dest         string `json:"dest"`
+	Records      uint64 `json:"records"` // acknowledged by the destination so far
+	Bytes        uint64 `json:"bytes"`
+	TotalRecords uint64 `json:"total_records"`
+	TotalBytes   uint64 `json:"total_bytes"`
+	Attempts     int    `json:"attempts"` // streams opened, each one after the first resumes where the last one stopped
+	Done         bool   `json:"done"`
+	Err          string `json:"error,omitempty"` // why the last attempt stopped
+}